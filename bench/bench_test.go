@@ -0,0 +1,713 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-dqlite/driver"
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The operations of the harness as Go benchmarks, for quick local
+// comparisons with go test -bench and benchstat. Each runs against a fresh
+// database from each of the in-memory and file providers.
+
+func BenchmarkSeedModelAgents_SQL(b *testing.B)    { benchmarkOperation(b, SQLWrapper{}, "db-init") }
+func BenchmarkSeedModelAgents_SQLair(b *testing.B) { benchmarkOperation(b, SQLairWrapper{}, "db-init") }
+func BenchmarkSeedModelAgents_SQLX(b *testing.B)   { benchmarkOperation(b, SQLXWrapper{}, "db-init") }
+func BenchmarkSeedModelAgents_Gorm(b *testing.B)   { benchmarkOperation(b, GormWrapper{}, "db-init") }
+
+func BenchmarkSeedModelAgents_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "db-init")
+}
+
+func BenchmarkSeedModelAgents_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "db-init")
+}
+
+func BenchmarkUpdateModelAgentStatus_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "agent-status-active")
+}
+
+func BenchmarkUpdateModelAgentStatus_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "agent-status-active")
+}
+
+func BenchmarkUpdateModelAgentStatus_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "agent-status-active")
+}
+
+func BenchmarkUpdateModelAgentStatus_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "agent-status-active")
+}
+
+func BenchmarkUpdateModelAgentStatus_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "agent-status-active")
+}
+
+func BenchmarkUpdateModelAgentStatus_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "agent-status-active")
+}
+
+func BenchmarkGenerateAgentEvents_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "agent-events")
+}
+
+func BenchmarkGenerateAgentEvents_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "agent-events")
+}
+
+func BenchmarkGenerateAgentEvents_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "agent-events")
+}
+
+func BenchmarkGenerateAgentEvents_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "agent-events")
+}
+
+func BenchmarkGenerateAgentEvents_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "agent-events")
+}
+
+func BenchmarkGenerateAgentEvents_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "agent-events")
+}
+
+func BenchmarkCullAgentEvents_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkCullAgentEvents_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkCullAgentEvents_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkCullAgentEvents_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkCullAgentEvents_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkCullAgentEvents_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "cull-agent-events")
+}
+
+func BenchmarkAgentModelCount_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentModelCount_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentModelCount_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentModelCount_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentModelCount_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentModelCount_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "agents-count")
+}
+
+func BenchmarkAgentEventModelCount_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "agent-events-count")
+}
+
+func BenchmarkAgentEventModelCount_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "agent-events-count")
+}
+
+func BenchmarkAgentEventModelCount_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "agent-events-count")
+}
+
+func BenchmarkAgentEventModelCount_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "agent-events-count")
+}
+
+func BenchmarkAgentEventModelCount_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "agent-events-count")
+}
+
+func BenchmarkAgentEventModelCount_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "agent-events-count")
+}
+
+func BenchmarkOrphanedAgentEventCount_SQL(b *testing.B) {
+	benchmarkOperation(b, SQLWrapper{}, "orphaned-agent-events")
+}
+
+func BenchmarkOrphanedAgentEventCount_SQLair(b *testing.B) {
+	benchmarkOperation(b, SQLairWrapper{}, "orphaned-agent-events")
+}
+
+func BenchmarkOrphanedAgentEventCount_SQLairPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLairWrapper{}, "orphaned-agent-events")
+}
+
+func BenchmarkOrphanedAgentEventCount_SQLPrepared(b *testing.B) {
+	benchmarkOperation(b, PreparedSQLWrapper{}, "orphaned-agent-events")
+}
+
+func BenchmarkOrphanedAgentEventCount_SQLX(b *testing.B) {
+	benchmarkOperation(b, SQLXWrapper{}, "orphaned-agent-events")
+}
+
+func BenchmarkOrphanedAgentEventCount_Gorm(b *testing.B) {
+	benchmarkOperation(b, GormWrapper{}, "orphaned-agent-events")
+}
+
+// benchmarkOperation runs the named default operation under wrapper, in a
+// sub-benchmark per provider. Periodic operations run against a database
+// that has been initialised once, while initialisation gets a fresh
+// database every iteration since it can only run once.
+func benchmarkOperation(b *testing.B, wrapper DBWrapper, opName string) {
+	var def DBOperationDef
+	ops := DefaultOperations(unregisteredMetrics())
+	for _, op := range ops {
+		if op.OpName == opName {
+			def = op
+		}
+	}
+	if def.Op == nil {
+		b.Fatalf("no operation %q", opName)
+	}
+	initOps := initOperations(ops)
+
+	providers := []struct {
+		name     string
+		provider func(*testing.B) DBProvider
+	}{
+		{"memory", func(*testing.B) DBProvider { return NewSQLiteDBProvider() }},
+		{"file", func(b *testing.B) DBProvider {
+			dbp, err := NewSQLiteFileDBProvider(b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			return dbp
+		}},
+	}
+	for _, p := range providers {
+		p := p
+		b.Run(p.name, func(b *testing.B) {
+			provider := p.provider(b)
+			newDB := func(init bool) DB {
+				name := uuid.New().String()
+				sqldb, err := provider.NewDB(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				db := wrapper.Wrap(sqldb, name, true)
+				if init {
+					for _, op := range initOps {
+						if _, err := op(context.Background(), db); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				return db
+			}
+			// The operations log as they run, which would drown out
+			// the results.
+			defer quietStdout(b)()
+
+			b.ReportAllocs()
+			if def.Freq == 0 {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					db := newDB(false)
+					b.StartTimer()
+					if _, err := def.Op(context.Background(), db); err != nil {
+						b.Fatal(err)
+					}
+					b.StopTimer()
+					_ = db.Close()
+					b.StartTimer()
+				}
+				return
+			}
+			db := newDB(true)
+			defer db.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := def.Op(context.Background(), db); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// quietStdout discards what is written to stdout until the returned
+// function is called.
+func quietStdout(b *testing.B) func() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	return func() {
+		DefaultWorkerLog().Flush()
+		os.Stdout = stdout
+		_ = devNull.Close()
+	}
+}
+
+// BenchmarkRunOnce measures what the harness costs each run of an
+// operation, with an operation that does nothing, so that it can be kept
+// small next to the difference between the wrappers.
+func BenchmarkRunOnce(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		err  error
+	}{
+		{"ok", nil},
+		{"error", errors.New("failed")},
+	} {
+		c := c
+		// The scenario registers its metrics, so it is shared by every
+		// run of the sub-benchmark.
+		s := NewScenario(&BenchmarkOpts{
+			Name:     "run-once-" + c.name,
+			Provider: NewSQLiteDBProvider(),
+			Wrapper:  SQLWrapper{},
+		})
+		def := DBOperationDef{
+			OpName: "noop",
+			Op:     func(context.Context, DB) (OpResult, error) { return OpResult{}, c.err },
+			Freq:   time.Second,
+		}
+		env := newOperationEnv(s, NewPhaseClock(s.opts.Phases, time.Now()), NewStageClock(s.opts.Stages, time.Now()), []DBOperationDef{def})
+		db := SQLWrapper{}.Wrap(nil, "noop", false)
+		b.Run(c.name, func(b *testing.B) {
+			defer quietStdout(b)()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				env.runOnce(def, db, time.Now(), nil)
+			}
+		})
+	}
+}
+
+// BenchmarkObserveParallel compares observing the latency of an operation
+// from many workers at once with a plain Prometheus histogram and with the
+// sharded one the harness uses. Run with -mutexprofile or -cpu to see the
+// contention each leaves.
+func BenchmarkObserveParallel(b *testing.B) {
+	opts := prometheus.HistogramOpts{
+		Name:    "observe_parallel",
+		Buckets: timeBucketSplits,
+	}
+	for _, c := range []struct {
+		name     string
+		observer prometheus.Observer
+	}{
+		{"prometheus", prometheus.NewHistogramVec(opts, []string{"phase"}).WithLabelValues("steady")},
+		{"sharded", newShardedHistogramVec(opts, []string{"phase"}).WithLabelValues("steady")},
+	} {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			// Workers far outnumber the processors, as they do in a run.
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.observer.Observe(0.002)
+				}
+			})
+		})
+	}
+}
+
+// The parts of the harness with logic of their own are tested below, table
+// driven, against the cases that decide what a run measures.
+
+func TestLoadConfig(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"empty", "", ""},
+		{"unknown field", "agnets: 5", "field agnets not found"},
+		{"negative agents", "agents: -1", "agents cannot be negative"},
+		{"unknown scheduler", "scheduler: threads", "threads"},
+		{"negative max ops", "max_ops_per_sec: -1", "max_ops_per_sec cannot be negative"},
+		{"bad journal", "sqlite_journal: fast", `sqlite journal mode "fast"`},
+		{"step ramp", "ramp: {kind: step, step: 50, every: 10s, max_dbs: 400}", ""},
+		{"step ramp without every", "ramp: {kind: step, step: 50, max_dbs: 400}", "step ramp needs step and every"},
+		{"ramp without max", "ramp: {kind: linear, per_second: 1}", "ramp needs max_dbs"},
+		{"unknown ramp", "ramp: {kind: square, max_dbs: 10}", `unknown ramp kind "square"`},
+		{"sine ramp min above max", "ramp: {kind: sine, period: 1m, min_dbs: 20, max_dbs: 10}", "min_dbs below max_dbs"},
+		{"points on a linear ramp", "ramp: {kind: linear, per_second: 1, max_dbs: 10, points: [{at: 0s, dbs: 1}]}", "linear ramp takes no points"},
+		{"schedule ramp", "ramp: {kind: schedule, points: [{at: 0s, dbs: 50}, {at: 10m, dbs: 200}]}", ""},
+		{"schedule ramp with max", "ramp: {kind: schedule, max_dbs: 10, points: [{at: 0s, dbs: 5}]}", "takes no max_dbs"},
+		{"schedule ramp out of order", "ramp: {kind: schedule, points: [{at: 10m, dbs: 50}, {at: 5m, dbs: 200}]}", "point 1 at 5m0s is not after"},
+		{"schedule ramp of nothing", "ramp: {kind: schedule, points: [{at: 0s, dbs: 0}]}", "never has any dbs"},
+		{"operations", `
+operations:
+  - name: db-init
+    kind: seed-agents
+  - name: agent-status-active
+    kind: agent-status
+    freq: 5s
+    status: active`, ""},
+		{"operation without name", "operations: [{kind: seed-agents}]", "operation 0 has no name"},
+		{"operation twice", "operations: [{name: db-init, kind: seed-agents}, {name: db-init, kind: seed-agents}]", "db-init defined more than once"},
+		{"unknown kind", "operations: [{name: db-init, kind: seed}]", `unknown kind "seed"`},
+		{"param the kind does not take", "operations: [{name: db-init, kind: seed-agents, status: active}]", "takes no status"},
+		{"missing status", "operations: [{name: db-init, kind: seed-agents}, {name: s, kind: agent-status, freq: 5s}]", "s needs a status"},
+		{"sample above agents", "agents: 5\noperations: [{name: db-init, kind: seed-agents}, {name: s, kind: agent-status, freq: 5s, status: active, sample: 6}]", "samples 6 of 5 agents"},
+		{"picks without seeding", "operations: [{name: s, kind: agent-status, freq: 5s, status: active}]", "needs a seed-agents operation"},
+		{"stages", "stages: [{name: write, duration: 1m, ops: {agent-events: 1s}}, {name: read, ops: {agents-count: 1s}}]", ""},
+		{"stage without duration", "stages: [{name: write, ops: {agent-events: 1s}}, {name: read}]", "stage write needs a duration"},
+		{"stage twice", "stages: [{name: write, duration: 1m}, {name: write}]", "stage write defined more than once"},
+		{"stage negative freq", "stages: [{name: write, ops: {agent-events: -1s}}]", "negative freq"},
+		{"stage unknown op", "operations: [{name: db-init, kind: seed-agents}]\nstages: [{name: write, ops: {agent-events: 1s}}]", "stage write runs unknown operation agent-events"},
+		{"chaos", "chaos: [{what: partition, at: 1m, for: 30s}, {what: leadership-transfer, at: 2m}]", ""},
+		{"unknown fault", "chaos: [{what: meteor, at: 1m}]", `unknown fault "meteor"`},
+		{"fault without for", "chaos: [{what: node-restart, at: 1m}]", "how long the node-restart lasts"},
+		{"instant fault with for", "chaos: [{what: leadership-transfer, at: 1m, for: 1s}]", "takes no for"},
+		{"negative chaos", "chaos: [{what: connection-kill, at: -1m}]", "cannot be negative"},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bench.yaml")
+			if err := os.WriteFile(path, []byte(c.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(path)
+			switch {
+			case c.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case c.err != "" && err == nil:
+				t.Fatalf("no error, want one containing %q", c.err)
+			case c.err != "" && !strings.Contains(err.Error(), c.err):
+				t.Fatalf("error %q does not contain %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{Operations: []OperationConfig{
+		{Name: "db-init", Kind: "seed-agents"},
+		{Name: "agent-status-active", Kind: "agent-status", Freq: time.Second, Status: "active"},
+		{Name: "cull-agent-events", Freq: time.Second},
+	}}
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Agents != 60 {
+		t.Errorf("agents %d, want 60", c.Agents)
+	}
+	if got := c.Operations[1].Sample; got != 10 {
+		t.Errorf("sample %d, want 10", got)
+	}
+	if got := c.Operations[2].Kind; got != "cull-agent-events" {
+		t.Errorf("kind %q, want the name", got)
+	}
+	if got := c.Operations[2].MaxEvents; got != 30 {
+		t.Errorf("max events %d, want 30", got)
+	}
+}
+
+func TestTransientReason(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"injected busy", errInjectedBusy, RetryBusy},
+		{"injected leader change", errInjectedLeaderChange, RetryNotLeader},
+		{"no leader", fmt.Errorf("exec: %w", driver.ErrNoAvailableLeader), RetryNotLeader},
+		{"bad conn", sqldriver.ErrBadConn, RetryBadConn},
+		{"sqlite busy", sqlite3.Error{Code: sqlite3.ErrBusy}, RetryBusy},
+		{"sqlite locked", fmt.Errorf("commit: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), RetryLocked},
+		{"sqlite constraint", sqlite3.Error{Code: sqlite3.ErrConstraint}, ""},
+		{"dqlite not leader", driver.Error{Code: dqliteErrNotLeader}, RetryNotLeader},
+		{"dqlite leadership lost", driver.Error{Code: dqliteErrLeadershipLost}, RetryNotLeader},
+		{"dqlite legacy not leader", driver.Error{Code: dqliteErrNotLeaderLegacy}, RetryNotLeader},
+		{"dqlite busy", driver.Error{Code: driver.ErrBusyRecovery}, RetryBusy},
+		{"dqlite locked", driver.Error{Code: int(sqlite3.ErrLocked)}, RetryLocked},
+		{"dqlite constraint", driver.Error{Code: sqliteConstraint}, ""},
+		{"other", errors.New("no such table: agent"), ""},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if got := transientReason(c.err); got != c.want {
+				t.Errorf("transientReason(%v) = %q, want %q", c.err, got, c.want)
+			}
+			if got := IsTransient(c.err); got != (c.want != "") {
+				t.Errorf("IsTransient(%v) = %v", c.err, got)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	for _, c := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{"expired context", expired, sql.ErrTxDone, ErrorClassTimeout},
+		{"deadline", nil, fmt.Errorf("query: %w", context.DeadlineExceeded), ErrorClassTimeout},
+		{"os deadline", nil, os.ErrDeadlineExceeded, ErrorClassTimeout},
+		{"net timeout", nil, &net.OpError{Op: "read", Err: timeoutError{}}, ErrorClassTimeout},
+		{"net error", nil, &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, ErrorClassConnection},
+		{"conn done", nil, sql.ErrConnDone, ErrorClassConnection},
+		{"bad conn", nil, sqldriver.ErrBadConn, ErrorClassConnection},
+		{"dqlite not leader", nil, driver.Error{Code: dqliteErrLeadershipLost}, ErrorClassConnection},
+		{"sqlite busy", nil, sqlite3.Error{Code: sqlite3.ErrBusy}, ErrorClassBusy},
+		{"sqlite locked", nil, sqlite3.Error{Code: sqlite3.ErrLocked}, ErrorClassBusy},
+		{"busy message", nil, errors.New("database is locked"), ErrorClassBusy},
+		{"sqlite constraint", nil, sqlite3.Error{Code: sqlite3.ErrConstraint}, ErrorClassConstraint},
+		{"dqlite constraint", nil, driver.Error{Code: sqliteConstraint | 8<<8}, ErrorClassConstraint},
+		{"constraint message", nil, errors.New("UNIQUE constraint failed: agent.uuid"), ErrorClassConstraint},
+		{"other", nil, errors.New("no such table: agent"), ErrorClassOther},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx := c.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := errorClass(ctx, c.err); got != c.want {
+				t.Errorf("errorClass(%v) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRampProfiles(t *testing.T) {
+	schedule := ScheduleRamp{{At: 10 * time.Minute, DBs: 200}, {At: 0, DBs: 50}, {At: 30 * time.Minute, DBs: 100}}
+	for _, c := range []struct {
+		name    string
+		profile RampProfile
+		elapsed time.Duration
+		want    int
+	}{
+		{"linear start", LinearRamp{PerSecond: 2, MaxDBs: 100}, 0, 0},
+		{"linear", LinearRamp{PerSecond: 2, MaxDBs: 100}, 10 * time.Second, 20},
+		{"linear max", LinearRamp{PerSecond: 2, MaxDBs: 100}, time.Hour, 100},
+		{"step before first", StepRamp{Step: 50, Every: 10 * time.Second, MaxDBs: 400}, 9 * time.Second, 0},
+		{"step", StepRamp{Step: 50, Every: 10 * time.Second, MaxDBs: 400}, 25 * time.Second, 100},
+		{"step max", StepRamp{Step: 50, Every: 10 * time.Second, MaxDBs: 400}, time.Hour, 400},
+		{"exponential before first", ExponentialRamp{Initial: 10, Factor: 2, Every: time.Minute, MaxDBs: 100}, 0, 0},
+		{"exponential first", ExponentialRamp{Initial: 10, Factor: 2, Every: time.Minute, MaxDBs: 100}, time.Minute, 10},
+		{"exponential", ExponentialRamp{Initial: 10, Factor: 2, Every: time.Minute, MaxDBs: 100}, 3 * time.Minute, 40},
+		{"exponential max", ExponentialRamp{Initial: 10, Factor: 2, Every: time.Minute, MaxDBs: 100}, time.Hour, 100},
+		{"sine start", SineRamp{MinDBs: 10, MaxDBs: 110, Period: time.Hour}, 0, 10},
+		{"sine peak", SineRamp{MinDBs: 10, MaxDBs: 110, Period: time.Hour}, 30 * time.Minute, 110},
+		{"sine quarter", SineRamp{MinDBs: 10, MaxDBs: 110, Period: time.Hour}, 15 * time.Minute, 60},
+		{"sine period", SineRamp{MinDBs: 10, MaxDBs: 110, Period: time.Hour}, time.Hour, 10},
+		{"schedule start", schedule, 0, 50},
+		{"schedule between", schedule, 20 * time.Minute, 200},
+		{"schedule down", schedule, 30 * time.Minute, 100},
+		{"schedule before first", ScheduleRamp{{At: time.Minute, DBs: 5}}, 0, 0},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.profile.Target(c.elapsed); got != c.want {
+				t.Errorf("Target(%v) = %d, want %d", c.elapsed, got, c.want)
+			}
+			if got := c.profile.Target(c.elapsed); got > c.profile.Max() {
+				t.Errorf("Target(%v) = %d, above Max %d", c.elapsed, got, c.profile.Max())
+			}
+		})
+	}
+	if got := schedule.Max(); got != 200 {
+		t.Errorf("schedule Max = %d, want 200", got)
+	}
+}
+
+func TestRampsDown(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		profile RampProfile
+		want    bool
+	}{
+		{"linear", LinearRamp{PerSecond: 1, MaxDBs: 10}, false},
+		{"step", StepRamp{Step: 1, Every: time.Second, MaxDBs: 10}, false},
+		{"sine", SineRamp{MinDBs: 1, MaxDBs: 10, Period: time.Minute}, true},
+		{"rising schedule", ScheduleRamp{{At: time.Minute, DBs: 20}, {At: 0, DBs: 10}}, false},
+		{"falling schedule", ScheduleRamp{{At: 0, DBs: 50}, {At: 10 * time.Minute, DBs: 200}, {At: 30 * time.Minute, DBs: 100}}, true},
+	} {
+		if got := rampsDown(c.profile); got != c.want {
+			t.Errorf("rampsDown(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSQLiteDSNOpts(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		opts   SQLiteDSNOpts
+		err    string
+		params string
+	}{
+		{name: "none"},
+		{
+			name: "all",
+			opts: SQLiteDSNOpts{
+				BusyTimeout: 5 * time.Second,
+				TxLock:      "immediate",
+				Journal:     "wal",
+				ForeignKeys: true,
+				Synchronous: "normal",
+				CacheSize:   -2000,
+				MmapSize:    1 << 20,
+			},
+			params: "_busy_timeout=5000&_txlock=immediate&_journal=WAL&_fk=1&_sync=NORMAL&_cache_size=-2000",
+		},
+		{name: "bad txlock", opts: SQLiteDSNOpts{TxLock: "eager"}, err: `sqlite txlock "eager"`},
+		{name: "bad journal", opts: SQLiteDSNOpts{Journal: "fast"}, err: `sqlite journal mode "fast"`},
+		{name: "negative busy timeout", opts: SQLiteDSNOpts{BusyTimeout: -time.Second}, err: "busy timeout -1s is negative"},
+		{name: "bad synchronous", opts: SQLiteDSNOpts{Synchronous: "always"}, err: `sqlite synchronous "always"`},
+		{name: "negative mmap size", opts: SQLiteDSNOpts{MmapSize: -1}, err: "mmap size -1 is negative"},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := c.opts.Validate()
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("error %v, want one containing %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := c.opts.Params(); got != c.params {
+				t.Errorf("params %q, want %q", got, c.params)
+			}
+		})
+	}
+}
+
+func TestWorkloadSeeds(t *testing.T) {
+	if newWorkloadSeeds(0) != nil {
+		t.Fatal("a zero seed is seeded")
+	}
+	var unseeded *workloadSeeds
+	unseeded.add("db-0")
+	if unseeded.rand("db-0", "agent-events") != nil {
+		t.Fatal("an unseeded workload has a stream")
+	}
+
+	// Two scenarios name their databases differently but create them in
+	// the same order, so their databases get the same streams.
+	a, b := newWorkloadSeeds(42), newWorkloadSeeds(42)
+	for i := 0; i < 3; i++ {
+		a.add(fmt.Sprintf("sql-%d", i))
+		b.add(fmt.Sprintf("sqlair-%d", i))
+	}
+	first := func(r *rand.Rand) int64 {
+		if r == nil {
+			t.Fatal("no stream for a database of the scenario")
+		}
+		return r.Int63()
+	}
+	for _, c := range []struct {
+		name   string
+		a, b   *rand.Rand
+		differ bool
+	}{
+		{"same database and operation", a.rand("sql-1", "agent-events"), b.rand("sqlair-1", "agent-events"), false},
+		{"same operation again", a.rand("sql-1", "agent-events"), a.rand("sql-1", "agent-events"), false},
+		{"other database", a.rand("sql-1", "agent-events"), b.rand("sqlair-2", "agent-events"), true},
+		{"other operation", a.rand("sql-1", "agent-events"), b.rand("sqlair-1", "agents-count"), true},
+		{"other seed", a.rand("sql-1", "agent-events"), func() *rand.Rand {
+			other := newWorkloadSeeds(43)
+			other.add("sql-0")
+			other.add("sql-1")
+			return other.rand("sql-1", "agent-events")
+		}(), true},
+	} {
+		if differ := first(c.a) != first(c.b); differ != c.differ {
+			t.Errorf("%s: streams differ %v, want %v", c.name, differ, c.differ)
+		}
+	}
+	if a.rand("resumed-0", "agent-events") != nil {
+		t.Error("a database the scenario did not create has a stream")
+	}
+}
+
+func TestMannWhitney(t *testing.T) {
+	// The histograms are cumulative, keyed by the upper bound of each
+	// bucket.
+	fast := map[float64]uint64{0.001: 40, 0.01: 45, 0.1: 50}
+	slow := map[float64]uint64{0.001: 0, 0.01: 5, 0.1: 50}
+	for _, c := range []struct {
+		name        string
+		a, b        map[float64]uint64
+		slower      float64
+		significant bool
+		z           int
+	}{
+		{"empty", nil, fast, 0.5, false, 0},
+		{"same", fast, fast, 0.5, false, 0},
+		{"one bucket", map[float64]uint64{0.01: 10}, map[float64]uint64{0.01: 20}, 0.5, false, 0},
+		{"slower", slow, fast, 0.94, true, 1},
+		{"faster", fast, slow, 0.06, true, -1},
+		// Bounds missing from one histogram carry its count from the
+		// bucket before.
+		{"sparse", map[float64]uint64{0.1: 30}, map[float64]uint64{0.001: 30, 0.1: 30}, 1, true, 1},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			slower, z, p := mannWhitney(c.a, c.b)
+			if math.Abs(slower-c.slower) > 1e-9 {
+				t.Errorf("slower %v, want %v", slower, c.slower)
+			}
+			if got := (Significance{P: p}).Significant(); got != c.significant {
+				t.Errorf("significant %v with p %v, want %v", got, p, c.significant)
+			}
+			if (z > 0) != (c.z > 0) || (z < 0) != (c.z < 0) {
+				t.Errorf("z %v, want the sign of %d", z, c.z)
+			}
+		})
+	}
+}
@@ -0,0 +1,710 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package bench is a harness for benchmarking database access code against
+// many databases at once. Scenarios pair a database provider with a
+// wrapper and a set of operations, and Run runs them side by side.
+package bench
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/tomb.v2"
+)
+
+// DBOperationDef is an operation run against every database of a scenario.
+// Operations with no frequency initialise new databases and run once.
+type DBOperationDef struct {
+	OpName string
+	Op     DBOperation
+	Freq   time.Duration
+}
+
+// BenchmarkOpts configures a scenario.
+type BenchmarkOpts struct {
+	// Name identifies the scenario in metrics and logs. It defaults to
+	// the wrapper name.
+	Name       string
+	Provider   DBProvider
+	Wrapper    DBWrapper
+	RunInTx    bool
+	Phases     PhaseSchedule
+	Supervisor SupervisorOpts
+	// CreateParallelism is the maximum number of databases that are
+	// created at the same time.
+	CreateParallelism int
+	// Scheduler is the kind of scheduler operations run on, one of
+	// SchedulerKinds. Empty is SchedulerPool.
+	Scheduler string
+	// SchedulerWorkers is the number of workers that run operations
+	// against all the databases of the scenario, with SchedulerPool.
+	SchedulerWorkers int
+	// Seed seeds the agents each database is seeded with, the agents its
+	// operations pick and when they first run, so that runs with the same
+	// seed, and the scenarios of a run, put the same logical workload on
+	// their databases. Zero picks them at random.
+	Seed int64
+	// AgentDistribution is the distribution the operations pick the
+	// agents they touch from. It defaults to UniformAgents.
+	AgentDistribution AgentDistribution
+	// OpenLoop keeps operations due at their frequency however long they
+	// take, measuring each run from when it was due, so that latency
+	// under saturation includes the time spent waiting behind slow runs.
+	// By default a slow run delays the next one, hiding that wait. It does
+	// not apply to fixed work mode.
+	OpenLoop bool
+	// RateLimit caps the number of operations started per second across
+	// all databases of every scenario given the same limiter, so that a
+	// run has one limit on its total throughput. Nil means no limit.
+	RateLimit *RateLimiter
+	// Pool configures the connection pool of every database.
+	Pool PoolOpts
+	// Ramp decides how many databases exist over the course of the run.
+	Ramp RampProfile
+	// Stages changes the mix of operations over the course of the run.
+	Stages WorkloadSchedule
+	// Iterations switches the scenario to fixed work mode: every
+	// operation runs this many times back to back against each database
+	// and the scenario stops once all the work is done. Zero runs
+	// operations at their frequency until the run is stopped.
+	Iterations int
+	// Deterministic replaces the timers with a seeded sequence of
+	// operations run one after another against each database. It takes
+	// precedence over Iterations.
+	Deterministic DeterministicOpts
+	// Chaos injects faults while the benchmark runs.
+	Chaos ChaosOpts
+	// RollbackFraction is the fraction of transactions that are rolled
+	// back and retried instead of committed.
+	RollbackFraction float64
+	// CommitFailureFraction is the fraction of commits that fail
+	// transiently, as if the database were busy or its leader changed.
+	// Every operation is then checked to have been applied exactly once
+	// at the end of the run.
+	CommitFailureFraction float64
+	// Retry retries transactions that fail transiently.
+	Retry bool
+	// Checkpoint periodically saves the state of the run so that it can
+	// be resumed.
+	Checkpoint CheckpointOpts
+	// Curve holds at several numbers of databases in turn and measures
+	// the scenario at each, replacing the Ramp.
+	Curve CurveOpts
+	// Paired gives the scenario clones of the same databases as every
+	// other scenario sharing the pairing.
+	Paired *Pairing
+	// Operations returns the operations run against each database,
+	// reporting to the scenario's metrics. It defaults to
+	// DefaultOperations. Operations for a schema of their own can reach
+	// the database underneath the wrapper through PlainDB.
+	Operations func(*ScenarioMetrics) []DBOperationDef
+	// Invariants checks the row counts of every database while the
+	// scenario runs.
+	Invariants InvariantOpts
+	// Differential periodically reads databases of the scenario through
+	// both database/sql and sqlair and compares the results.
+	Differential DifferentialOpts
+	// Snapshots copies databases of the scenario to disk on request, or
+	// when checks find an anomaly in them.
+	Snapshots SnapshotOpts
+	// OpConcurrency runs this many copies of each periodic operation
+	// against each database at once. Above one, an operation that
+	// increments a version is added, and the increments lost to
+	// concurrent writers are counted at the end of the run.
+	OpConcurrency int
+	// OpTimeout bounds each run of an operation. Runs that take longer
+	// are cancelled and count as errors. Zero does not bound them.
+	OpTimeout time.Duration
+	// Churn removes the oldest databases at an interval for the ramp to
+	// replace. It does not apply to fixed work mode.
+	Churn ChurnOpts
+	// SpawnQueueSize is how many databases can be created ahead of their
+	// operations starting. The ramp waits for room once it is full. It
+	// defaults to DefaultSpawnQueueSize.
+	SpawnQueueSize int
+	// Validate keeps a model of what the operations should leave in each
+	// database and checks the databases against it once the run is over.
+	Validate bool
+}
+
+// operations returns the operations the scenario runs against each
+// database.
+func (o BenchmarkOpts) operations(metrics *ScenarioMetrics) []DBOperationDef {
+	var ops []DBOperationDef
+	if o.Operations != nil {
+		ops = o.Operations(metrics)
+	} else {
+		ops = DefaultOperations(metrics)
+	}
+	if o.OpConcurrency > 1 {
+		ops = append(ops, DBOperationDef{
+			OpName: "version-increment",
+			Op:     incrementVersion(),
+			Freq:   time.Second,
+		})
+	}
+	if o.CommitFailureFraction > 0 {
+		ops = append(ops, DBOperationDef{
+			OpName: "log-operation",
+			Op:     logOperation(DefaultUUIDPool()),
+			Freq:   time.Second,
+		})
+	}
+	return ops
+}
+
+const (
+	// Control the number of models created in the test and the frequency at
+	// which they are added when a scenario does not set a ramp profile.
+	AddDBRate            = 400
+	DatabaseAddFrequency = time.Second
+	MaxNumberOfDatabases = 400
+
+	// RampCheckFrequency is how often the ramp profile is consulted.
+	RampCheckFrequency = time.Second
+
+	// SpawnBatchWindow is how long the spawner waits after the first new
+	// database arrives before starting operations, so databases created
+	// together are started together.
+	SpawnBatchWindow = 100 * time.Millisecond
+)
+
+// Schema is the schema providers create new databases with. Projects
+// embedding the harness with operations of their own can replace it before
+// starting any scenarios.
+var Schema = `
+CREATE TABLE agent (
+    uuid TEXT PRIMARY KEY,
+    model_name TEXT NOT NULL,
+    status TEXT NOT NULL
+);
+
+CREATE INDEX idx_agent_model_name ON agent (model_name);
+CREATE INDEX idx_agent_status ON agent (status);
+
+CREATE TABLE agent_events (
+ 	agent_uuid TEXT NOT NULL,   
+ 	event TEXT NOT NULL,
+ 	CONSTRAINT fk_agent_uuid
+    	FOREIGN KEY (agent_uuid)
+        REFERENCES agent(uuid)
+);
+
+CREATE INDEX idx_agent_events_event ON agent_events (event);
+
+CREATE TABLE version (
+    id INTEGER PRIMARY KEY,
+    version INTEGER NOT NULL
+);
+
+INSERT INTO version VALUES (1, 0);
+
+CREATE TABLE operation_log (
+    id TEXT NOT NULL
+);
+`
+
+// DefaultOperations returns the operations to be performed per db and their
+// frequency.
+func DefaultOperations(metrics *ScenarioMetrics) []DBOperationDef {
+	agents := newAgentDirectory()
+	return []DBOperationDef{
+		{
+			OpName: "db-init",
+			Op:     seedModelAgents(60, DefaultUUIDPool(), agents),
+			Freq:   time.Duration(0),
+		},
+		{
+			OpName: "agent-status-active",
+			Op:     updateModelAgentStatus(agents, agentSample{size: 60, n: 10}, "active"),
+			Freq:   time.Second * 5,
+		},
+		{
+			OpName: "agent-status-inactive",
+			Op:     updateModelAgentStatus(agents, agentSample{size: 60, n: 10}, "inactive"),
+			Freq:   time.Second * 8,
+		},
+		{
+			OpName: "agent-events",
+			Op:     generateAgentEvents(agents, agentSample{size: 60, n: 10}),
+			Freq:   time.Second * 15,
+		},
+		{
+			OpName: "cull-agent-events",
+			Op:     cullAgentEvents(30),
+			Freq:   time.Second * 30,
+		},
+		{
+			OpName: "agents-count",
+			Op:     agentModelCount(metrics.dbAgentGauge),
+			Freq:   time.Second * 30,
+		},
+		{
+			OpName: "agent-events-count",
+			Op:     agentEventModelCount(metrics.dbAgentEventsGauge),
+			Freq:   time.Second * 30,
+		},
+		{
+			OpName: "orphaned-agent-events",
+			Op:     orphanedAgentEvents(metrics.dbOrphanedEvents),
+			Freq:   time.Second * 30,
+		},
+	}
+}
+
+// initOperations returns the operations that initialise a new database.
+func initOperations(ops []DBOperationDef) []DBOperation {
+	var initOps []DBOperation
+	for _, op := range ops {
+		if op.Freq == time.Duration(0) {
+			initOps = append(initOps, op.Op)
+		}
+	}
+	return initOps
+}
+
+// newOperationEnv creates the environment that the scenario's operations run
+// in. The operation metrics are created once up front.
+func newOperationEnv(
+	s *Scenario,
+	phases *PhaseClock,
+	stages *StageClock,
+	perDBOperations []DBOperationDef,
+) *OperationEnv {
+	env := &OperationEnv{
+		iterations: s.opts.Iterations,
+		timeout:    s.opts.OpTimeout,
+		scheduler:  s.scheduler,
+		phases:     phases,
+		stages:     stages,
+		metrics:    make(map[string]*opMetrics),
+
+		recentErrors: s.recentErrors,
+		opCSV:        s.opCSV,
+		scenario:     s.name,
+		wrapper:      s.opts.Wrapper.Name(),
+		workloads:    s.workloads,
+	}
+	for _, op := range perDBOperations {
+		env.metrics[op.OpName] = &opMetrics{
+			labels: withAgentSamplers(profileLabels(s, op.OpName), s.samplers),
+			hdr:    s.latencies.get(op.OpName),
+			histogram: newShardedHistogramVec(prometheus.HistogramOpts{
+				Name: "db_operation_time",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+				Buckets: timeBucketSplits,
+			}, []string{"phase", "stage", "fault"}),
+			firstRow: newShardedHistogramVec(prometheus.HistogramOpts{
+				Name: "db_operation_first_row_time",
+				Help: "The time reads took from issuing their query until their first row was available",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+				Buckets: timeBucketSplits,
+			}, []string{"phase", "stage", "fault"}),
+			scan: newShardedHistogramVec(prometheus.HistogramOpts{
+				Name: "db_operation_scan_time",
+				Help: "The time reads spent scanning their rows after the first was available",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+				Buckets: timeBucketSplits,
+			}, []string{"phase", "stage", "fault"}),
+			errCount: s.metrics.factory.NewCounterVec(prometheus.CounterOpts{
+				Name: "db_operation_errors",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+			}, []string{"phase", "stage", "fault"}),
+			busy: s.metrics.factory.NewCounter(prometheus.CounterOpts{
+				Name: "db_operation_busy_errors",
+				Help: "The number of operations that failed because the db was locked",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+			}),
+			errClass: s.metrics.factory.NewCounterVec(prometheus.CounterOpts{
+				Name: "db_operation_error_classes",
+				Help: "The number of operations that failed, by the class of their error",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+			}, []string{"class"}),
+			rowsAffected: s.metrics.factory.NewCounter(prometheus.CounterOpts{
+				Name: "db_operation_rows_affected",
+				Help: "The number of rows written by operations",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+			}),
+			rowsScanned: s.metrics.factory.NewCounter(prometheus.CounterOpts{
+				Name: "db_operation_rows_scanned",
+				Help: "The number of rows read by operations",
+				ConstLabels: prometheus.Labels{
+					"wrapper":   s.opts.Wrapper.Name(),
+					"operation": op.OpName,
+				},
+			}),
+		}
+	}
+	for _, m := range env.metrics {
+		m.histogram = register(s.metrics.registerer, m.histogram)
+		m.firstRow = register(s.metrics.registerer, m.firstRow)
+		m.scan = register(s.metrics.registerer, m.scan)
+		for _, class := range ErrorClasses() {
+			m.errClass.WithLabelValues(class)
+		}
+	}
+	env.fault.Store(NoFault)
+	return env
+}
+
+// fixedWork reports whether the scenario stops once a fixed amount of work
+// has been done, rather than when it is interrupted.
+func (o BenchmarkOpts) fixedWork() bool {
+	return o.Iterations > 0 || o.Deterministic.Steps > 0
+}
+
+// dbSpawner starts operations for databases as they arrive on the channel.
+// Operations are only ever started for newly arrived databases, so the
+// workers of existing databases are never interrupted. Resumed and paired
+// databases have already been initialised and are started straight away.
+func dbSpawner(
+	s *Scenario,
+	env *OperationEnv,
+	queue *spawnQueue,
+	resumed []DB,
+	perDBOperations []DBOperationDef,
+) {
+	var sequence []DBOperationDef
+	if s.opts.Deterministic.Steps > 0 {
+		sequence = operationSequence(perDBOperations, s.opts.Deterministic)
+		s.SetMetadata("sequence_digest", sequenceDigest(sequence))
+	}
+
+	startPerDBOperations := func(opTomb *tomb.Tomb, dbs []DB, initialised bool) {
+		s.addDBs(dbs)
+		for _, db := range dbs {
+			db := db
+			superviseDB(opTomb, s, db, initialised, func(dbTomb *tomb.Tomb, restart bool) {
+				// The operations run on the shared scheduler, this
+				// goroutine keeps the tomb alive until it is killed.
+				dbTomb.Go(func() error {
+					<-dbTomb.Dying()
+					return nil
+				})
+				var ops []DBOperationDef
+				for _, op := range perDBOperations {
+					// Initialisation is not repeated when
+					// operations are restarted.
+					if restart && op.Freq == time.Duration(0) {
+						continue
+					}
+					ops = append(ops, op)
+				}
+				if s.opts.Chaos.NoisyNeighbourEvery > 0 {
+					runNoisyNeighbour(dbTomb, s, db, s.opts.Chaos)
+				}
+				if s.opts.Deterministic.Steps > 0 {
+					var seq []DBOperationDef
+					for _, op := range sequence {
+						if restart && op.Freq == time.Duration(0) {
+							continue
+						}
+						seq = append(seq, op)
+					}
+					runOperationSequence(dbTomb, env, seq, db)
+					return
+				}
+				if env.iterations == 0 {
+					for _, op := range ops {
+						copies := 1
+						if op.Freq != time.Duration(0) && s.opts.OpConcurrency > 1 {
+							copies = s.opts.OpConcurrency
+						}
+						for i := 0; i < copies; i++ {
+							RunDBOperation(dbTomb, env, op, db, nil)
+						}
+					}
+					return
+				}
+				// In fixed work mode the operations run one after
+				// another so that they do not contend with each
+				// other, and the database is finished once they have
+				// all done their iterations.
+				var runOp func(i int)
+				runOp = func(i int) {
+					if i == len(ops) {
+						dbTomb.Kill(nil)
+						return
+					}
+					RunDBOperation(dbTomb, env, ops[i], db, func() {
+						runOp(i + 1)
+					})
+				}
+				runOp(0)
+			})
+		}
+	}
+
+	// Paired databases are cloned from an initialised template, so
+	// initialisation is never run against them.
+	var initOps []DBOperation
+	if s.opts.Paired == nil {
+		initOps = initOperations(perDBOperations)
+	}
+
+	t := &s.tomb
+	log := scenarioLog(s, "spawner")
+	safeGo(t, func() error {
+		var ch <-chan DB = queue.ch
+		opTomb := &tomb.Tomb{}
+		started := false
+		numDBs := 0
+		dbs := []DB{}
+
+		if len(resumed) > 0 {
+			for i, db := range resumed {
+				resumed[i] = NewSupervisedDB(s, db, initOps)
+			}
+			numDBs += len(resumed)
+			log.Info("resuming operations", "dbs", len(resumed))
+			startPerDBOperations(opTomb, resumed, true)
+			started = true
+		}
+
+		// batchReady fires once the current batch of new databases is
+		// complete. It is nil while there are no new databases, so the
+		// loop blocks rather than spinning when idle.
+		var batchReady <-chan time.Time
+
+		// finished reports whether all the work of a fixed work run is
+		// done, in which case the scenario stops.
+		finished := func() bool {
+			if !s.opts.fixedWork() || ch != nil || started || len(dbs) > 0 {
+				return false
+			}
+			if err := printFixedWorkResults(os.Stdout, s); err != nil {
+				log.Error("reporting results", "err", err)
+			}
+			t.Kill(nil)
+			return true
+		}
+
+		for {
+			select {
+			case db, ok := <-ch:
+				if !ok {
+					ch = nil
+					if len(dbs) > 0 {
+						batchReady = time.After(0)
+					}
+					if finished() {
+						return nil
+					}
+					break
+				}
+				dbs = append(dbs, NewSupervisedDB(s, db, initOps))
+				if batchReady == nil {
+					batchReady = time.After(SpawnBatchWindow)
+				}
+			case <-t.Dying():
+				if !started {
+					return nil
+				}
+				opTomb.Kill(nil)
+				return opTomb.Wait()
+			case <-opTomb.Dead():
+				err := opTomb.Wait()
+				if err != nil {
+					log.Error("operations died", "err", err)
+					return err
+				}
+				// Every database supervisor has stopped without
+				// error, which happens when all databases have been
+				// dropped or quarantined, or have finished their
+				// fixed work.
+				opTomb = &tomb.Tomb{}
+				started = false
+				if finished() {
+					return nil
+				}
+			case <-batchReady:
+				batchReady = nil
+				numDBs += len(dbs)
+				log.Info("spawning operations", "new_dbs", len(dbs), "dbs", numDBs)
+				startPerDBOperations(opTomb, dbs, s.opts.Paired != nil)
+				queue.started(len(dbs))
+				started = true
+				dbs = []DB{}
+			}
+		}
+	})
+}
+
+// dbRamper creates DBs following the ramp profile, checking every freq how
+// many databases the profile wants. DBs are queued for the spawner once they
+// are ready, and are only created once there is room for them in the queue.
+// Unless the scenario does a fixed amount of work, the oldest DBs are
+// removed when the profile wants fewer, and churned if churn is on.
+func dbRamper(
+	s *Scenario,
+	freq time.Duration,
+	profile RampProfile,
+	start time.Time,
+	numDBS int,
+) *spawnQueue {
+	queue := newSpawnQueue(s, s.opts.SpawnQueueSize)
+	t := &s.tomb
+	safeGo(t, func() error {
+		defer close(queue.ch)
+		ticker := time.NewTicker(freq)
+		defer ticker.Stop()
+		var churn <-chan time.Time
+		if s.opts.Churn.Every > 0 && !s.opts.fixedWork() {
+			churnTicker := time.NewTicker(s.opts.Churn.Every)
+			defer churnTicker.Stop()
+			churn = churnTicker.C
+		}
+		// Once the profile has reached its maximum the ramper is only
+		// needed to remove DBs.
+		removes := churn != nil || (rampsDown(profile) && !s.opts.fixedWork())
+		for numDBS < profile.Max() || removes {
+			select {
+			case <-t.Dying():
+				return nil
+			case <-churn:
+				numDBS -= removeDBs(s, s.opts.Churn.Count)
+				continue
+			case <-ticker.C:
+			}
+			target := profile.Target(time.Since(start))
+			if removes && target < numDBS {
+				numDBS -= removeDBs(s, numDBS-target)
+			}
+			for inc := target - numDBS; inc > 0; {
+				n, ok := queue.reserve(t, inc)
+				if !ok {
+					return nil
+				}
+				dbs, makeErr := makeDBs(s, n)
+				queue.release(n - len(dbs))
+				numDBS += len(dbs)
+				inc -= len(dbs)
+				s.metrics.dbTotal.Add(float64(len(dbs)))
+
+				for _, db := range dbs {
+					queue.send(db)
+				}
+
+				if makeErr != nil {
+					return makeErr
+				}
+			}
+		}
+		return nil
+	})
+	return queue
+}
+
+// newDB creates and wraps a single database with a random name.
+func newDB(s *Scenario) (DB, error) {
+	opts := s.opts
+	timer := prometheus.NewTimer(s.metrics.dbCreationTime)
+	defer timer.ObserveDuration()
+	var (
+		sqldb *sql.DB
+		name  string
+		err   error
+	)
+	if opts.Paired != nil {
+		sqldb, name, err = opts.Paired.NewDB(s, initOperations(opts.operations(s.metrics)))
+	} else {
+		name = uuid.New().String()
+		sqldb, err = opts.Provider.NewDB(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	opts.Pool.apply(sqldb)
+	s.workloads.add(name)
+	db := opts.Wrapper.Wrap(sqldb, name, opts.RunInTx)
+	// The seeding of paired databases happened on their template, out of
+	// sight of the model, which then leaves them unvalidated.
+	if s.model != nil {
+		db = s.model.track(db)
+	}
+	if s.versions != nil {
+		db = s.versions.track(db)
+	}
+	if s.ledger != nil {
+		db = s.ledger.track(db)
+	}
+	return db, nil
+}
+
+// makeDBs creates x databases with a bounded pool of workers. If creation
+// fails, the databases created so far are returned alongside the error.
+func makeDBs(s *Scenario, x int) ([]DB, error) {
+	workers := s.opts.CreateParallelism
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > x {
+		workers = x
+	}
+
+	jobs := make(chan struct{}, x)
+	for i := 0; i < x; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		dbs      = make([]DB, 0, x)
+		firstErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				s.metrics.dbCreationInFlight.Inc()
+				db, err := newDB(s)
+				s.metrics.dbCreationInFlight.Dec()
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					dbs = append(dbs, db)
+				}
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return dbs, firstErr
+}
@@ -0,0 +1,651 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/tomb.v2"
+)
+
+// ChaosOpts configures the faults injected into a run.
+type ChaosOpts struct {
+	// NodeRestartEvery is how often a cluster node is stopped. Zero
+	// disables node restarts.
+	NodeRestartEvery time.Duration
+	// NodeDowntime is how long a stopped node stays down before it is
+	// started again.
+	NodeDowntime time.Duration
+	// NodeKill stops nodes without handing over their roles first, as a
+	// crash would, so that losing the leader is followed by an election
+	// rather than a handover.
+	NodeKill bool
+	// LeadershipTransferEvery is how often cluster leadership is handed
+	// to another node. Zero disables leadership transfers.
+	LeadershipTransferEvery time.Duration
+	// PartitionEvery is how often a node is cut off from the rest of the
+	// cluster for PartitionFor. Partitions need a provider with a
+	// Network. Zero disables partitions.
+	PartitionEvery time.Duration
+	PartitionFor   time.Duration
+	// DiskFullEvery is how often the disk holding the databases is filled
+	// for DiskFullFor. The databases must be on a small dedicated
+	// filesystem, such as a tmpfs mounted with a size limit. Zero
+	// disables filling the disk.
+	DiskFullEvery time.Duration
+	DiskFullFor   time.Duration
+	// NoisyNeighbourEvery is roughly how often a background worker per
+	// database takes a write lock, holding it for NoisyNeighbourHold.
+	// Zero disables the noisy neighbours.
+	NoisyNeighbourEvery time.Duration
+	NoisyNeighbourHold  time.Duration
+	// ConnKillEvery is how often a random pooled connection of a random
+	// database is closed, forcing the driver to reconnect. Zero disables
+	// connection kills.
+	ConnKillEvery time.Duration
+	// MembershipChurnEvery is how often a node joins the cluster, or the
+	// node that joined last time leaves it again. Zero disables churn.
+	MembershipChurnEvery time.Duration
+	// Schedule is a timeline of faults injected at fixed times, so that
+	// a chaos experiment can be repeated exactly. It runs alongside any
+	// periodic faults.
+	Schedule []ChaosEvent
+}
+
+// ChaosEvent is a fault injected at a fixed time in a run.
+type ChaosEvent struct {
+	// At is when the fault is injected, from the start of the run.
+	At time.Duration
+	// Fault is the fault injected, one of the Fault constants.
+	Fault string
+	// For is how long the fault lasts. Faults that happen at an instant,
+	// such as leadership transfers, ignore it.
+	For time.Duration
+}
+
+func (e ChaosEvent) String() string {
+	if e.For > 0 {
+		return fmt.Sprintf("%s@%s/%s", e.Fault, e.At, e.For)
+	}
+	return fmt.Sprintf("%s@%s", e.Fault, e.At)
+}
+
+// ClusterProvider is a DBProvider backed by a cluster whose nodes can be
+// stopped and started while the benchmark runs.
+type ClusterProvider interface {
+	DBProvider
+	// Nodes returns the number of nodes in the cluster.
+	Nodes() int
+	// StopNode stops the i'th node.
+	StopNode(i int) error
+	// KillNode stops the i'th node without handing over its roles.
+	KillNode(i int) error
+	// StartNode starts the i'th node again and waits for it to rejoin
+	// the cluster.
+	StartNode(ctx context.Context, i int) error
+	// TransferLeadership hands leadership from the current leader to
+	// another node.
+	TransferLeadership(ctx context.Context) (from, to uint64, err error)
+	// Network returns the network between the nodes, or nil if they
+	// talk to each other directly.
+	Network() *Network
+	// NodeAddress returns the address of the i'th node.
+	NodeAddress(i int) string
+	// JoinNode adds a new node to the cluster.
+	JoinNode(ctx context.Context) (string, error)
+	// RemoveNode removes the most recently joined node.
+	RemoveNode(ctx context.Context) (string, error)
+}
+
+// NodeRejoinTimeout bounds how long a restarted node has to rejoin the
+// cluster.
+const NodeRejoinTimeout = 5 * time.Minute
+
+// ReconnectSettleTime is how long operations are attributed to a killed
+// connection after it was closed.
+const ReconnectSettleTime = time.Second
+
+// ElectionSettleTime is how long operations are still attributed to a
+// leadership transfer after it completes, to cover transactions that were
+// in flight when leadership moved.
+const ElectionSettleTime = time.Second
+
+// DirProvider is a DBProvider that keeps its databases in a directory.
+type DirProvider interface {
+	DBProvider
+	// Dir returns the directory the databases are in.
+	Dir() string
+}
+
+// MaxDiskFill is the most free space the disk full fault will fill, so that
+// it is never pointed at a disk the rest of the machine depends on.
+const MaxDiskFill = 1 << 30
+
+// The faults that can be injected, as they are named in schedules, events
+// and metric labels.
+const (
+	FaultNodeRestart        = "node-restart"
+	FaultLeadershipTransfer = "leadership-transfer"
+	FaultMembershipChurn    = "membership-churn"
+	FaultPartition          = "partition"
+	FaultDiskFull           = "disk-full"
+	FaultConnKill           = "connection-kill"
+)
+
+// Faults returns every fault that can be injected.
+func Faults() []string {
+	return []string{FaultNodeRestart, FaultLeadershipTransfer, FaultMembershipChurn, FaultPartition, FaultDiskFull, FaultConnKill}
+}
+
+// faultLasts reports whether the fault lasts for a while, rather than
+// happening at an instant.
+func faultLasts(fault string) bool {
+	return fault == FaultNodeRestart || fault == FaultPartition || fault == FaultDiskFull
+}
+
+// chaos injects faults into a running scenario.
+type chaos struct {
+	s   *Scenario
+	env *OperationEnv
+	t   *tomb.Tomb
+	// cluster is nil if the provider is not a cluster, and dir is empty
+	// if it does not keep its databases in a directory.
+	cluster ClusterProvider
+	dir     string
+
+	// mu serialises membership changes. joined is set while a node added
+	// by membership churn is part of the cluster.
+	mu     sync.Mutex
+	joined bool
+}
+
+// runChaos starts the fault injectors configured for the scenario. Scheduled
+// faults are timed from start.
+func runChaos(s *Scenario, env *OperationEnv, start time.Time) {
+	opts := s.opts.Chaos
+	c := &chaos{s: s, env: env, t: &s.tomb}
+	c.cluster, _ = s.opts.Provider.(ClusterProvider)
+	if p, ok := s.opts.Provider.(DirProvider); ok {
+		c.dir = p.Dir()
+	}
+
+	c.every(FaultDiskFull, opts.DiskFullEvery, opts.DiskFullFor)
+	c.every(FaultConnKill, opts.ConnKillEvery, 0)
+	c.every(FaultNodeRestart, opts.NodeRestartEvery, opts.NodeDowntime)
+	c.every(FaultLeadershipTransfer, opts.LeadershipTransferEvery, 0)
+	c.every(FaultMembershipChurn, opts.MembershipChurnEvery, 0)
+	c.every(FaultPartition, opts.PartitionEvery, opts.PartitionFor)
+	c.runSchedule(opts.Schedule, start)
+	if c.cluster != nil {
+		c.leaveOnStop()
+	}
+}
+
+// check returns an error if fault cannot be injected into the scenario.
+func (c *chaos) check(fault string) error {
+	switch fault {
+	case FaultConnKill:
+		return nil
+	case FaultDiskFull:
+		if c.dir == "" {
+			return fmt.Errorf("%s faults need databases in a directory, %T does not have one", fault, c.s.opts.Provider)
+		}
+		return nil
+	case FaultNodeRestart, FaultLeadershipTransfer, FaultMembershipChurn, FaultPartition:
+	default:
+		return fmt.Errorf("unknown fault %q", fault)
+	}
+	if c.cluster == nil {
+		return fmt.Errorf("%s faults need a cluster, %T is not one", fault, c.s.opts.Provider)
+	}
+	if (fault == FaultNodeRestart || fault == FaultPartition) && c.cluster.Nodes() < 2 {
+		return fmt.Errorf("%s faults need at least two nodes", fault)
+	}
+	if fault == FaultPartition && c.cluster.Network() == nil {
+		return fmt.Errorf("%s faults need a cluster with a network", fault)
+	}
+	return nil
+}
+
+// inject injects fault for d and returns once it is over. Faults that happen
+// at an instant ignore d. It reports false if the fault cannot be injected
+// again.
+func (c *chaos) inject(fault string, d time.Duration) bool {
+	switch fault {
+	case FaultNodeRestart:
+		c.nodeRestart(d)
+	case FaultLeadershipTransfer:
+		c.leadershipTransfer()
+	case FaultMembershipChurn:
+		c.membershipChurn()
+	case FaultPartition:
+		c.partition(d)
+	case FaultDiskFull:
+		return c.diskFull(d)
+	case FaultConnKill:
+		c.connKill()
+	}
+	return true
+}
+
+// every injects fault for d every interval until the scenario stops. A zero
+// interval disables the fault.
+func (c *chaos) every(fault string, interval, d time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if err := c.check(fault); err != nil {
+		c.s.recordEvent("chaos", "%v", err)
+		return
+	}
+	safeGo(c.t, func() error {
+		for c.wait(interval) {
+			if !c.inject(fault, d) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// runSchedule injects each fault of the schedule at its time. Faults due
+// before the scenario started, as when it resumes from a checkpoint, are
+// skipped.
+func (c *chaos) runSchedule(schedule []ChaosEvent, start time.Time) {
+	if len(schedule) == 0 {
+		return
+	}
+	planned := make([]string, len(schedule))
+	for i, e := range schedule {
+		planned[i] = e.String()
+	}
+	c.s.SetMetadata("chaos_schedule", strings.Join(planned, ","))
+
+	for _, e := range schedule {
+		e := e
+		if err := c.check(e.Fault); err != nil {
+			c.s.recordEvent("chaos", "not scheduling %s: %v", e, err)
+			continue
+		}
+		at := start.Add(e.At)
+		if at.Before(c.s.started) {
+			continue
+		}
+		safeGo(c.t, func() error {
+			if !c.wait(time.Until(at)) {
+				return nil
+			}
+			c.s.recordEvent("chaos", "scheduled %s", e)
+			c.inject(e.Fault, e.For)
+			return nil
+		})
+	}
+}
+
+// wait sleeps for d and reports whether it did so without the scenario
+// starting to stop.
+func (c *chaos) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-c.t.Dying():
+		return false
+	}
+}
+
+// nodeRestart stops, or kills, a random node, other than the one databases
+// are opened through, and starts it again after the downtime. The operation
+// errors seen while the node is down or rejoining, and the time it takes to
+// rejoin, are recorded.
+func (c *chaos) nodeRestart(downtime time.Duration) {
+	const fault = FaultNodeRestart
+	s, env := c.s, c.env
+
+	node := 1 + rand.Intn(c.cluster.Nodes()-1)
+	errorsBefore := env.errorCount()
+	stop, stopped := c.cluster.StopNode, "stopped"
+	if s.opts.Chaos.NodeKill {
+		stop, stopped = c.cluster.KillNode, "killed"
+	}
+	if err := stop(node); err != nil {
+		s.recordEvent("chaos", "stopping node %d: %v", node, err)
+		return
+	}
+	env.setFault(fault)
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+	s.recordEvent("chaos", "%s node %d for %s", stopped, node, downtime)
+
+	// The node is started even if the scenario is stopping, so the
+	// cluster is left whole for any others.
+	c.wait(downtime)
+	restarted := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), NodeRejoinTimeout)
+	err := c.cluster.StartNode(ctx, node)
+	cancel()
+	env.setFault(NoFault)
+	recovery := time.Since(restarted)
+	failed := env.errorCount() - errorsBefore
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(failed))
+	if err != nil {
+		s.recordEvent("chaos", "node %d failed to rejoin after %s: %v", node, recovery, err)
+		return
+	}
+	s.metrics.chaosRecoveryTime.WithLabelValues(fault).Observe(recovery.Seconds())
+	s.recordEvent("chaos", "node %d rejoined after %s, %d operations failed", node, recovery, failed)
+}
+
+// leadershipTransfer hands cluster leadership to another node. Operations
+// run during the transfer and for ElectionSettleTime after it are labelled
+// with the fault, so the cost of elections on in-flight transactions can be
+// compared against the rest of the run.
+func (c *chaos) leadershipTransfer() {
+	const fault = FaultLeadershipTransfer
+	s, env := c.s, c.env
+
+	errorsBefore := env.errorCount()
+	env.setFault(fault)
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	from, to, err := c.cluster.TransferLeadership(ctx)
+	cancel()
+	took := time.Since(started)
+	if err != nil {
+		env.setFault(NoFault)
+		s.recordEvent("chaos", "leadership transfer from node %d failed after %s: %v", from, took, err)
+		return
+	}
+	s.recordEvent("chaos", "leadership transferred from node %d to node %d in %s", from, to, took)
+
+	c.wait(ElectionSettleTime)
+	env.setFault(NoFault)
+	failed := env.errorCount() - errorsBefore
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(failed))
+	s.metrics.chaosRecoveryTime.WithLabelValues(fault).Observe(took.Seconds())
+}
+
+// membershipChurn joins a node to the cluster, or removes the one it joined
+// last time, as happens when the HA settings of a controller change.
+// Operations run while the membership changes and for ElectionSettleTime
+// after are labelled with the fault.
+func (c *chaos) membershipChurn() {
+	const fault = FaultMembershipChurn
+	s, env := c.s, c.env
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errorsBefore := env.errorCount()
+	env.setFault(fault)
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), NodeRejoinTimeout)
+	action := "joined"
+	var addr string
+	var err error
+	if c.joined {
+		action = "removed"
+		addr, err = c.cluster.RemoveNode(ctx)
+		c.joined = false
+	} else {
+		addr, err = c.cluster.JoinNode(ctx)
+		c.joined = addr != ""
+	}
+	cancel()
+	took := time.Since(started)
+
+	c.wait(ElectionSettleTime)
+	env.setFault(NoFault)
+	failed := env.errorCount() - errorsBefore
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(failed))
+	if err != nil {
+		s.recordEvent("chaos", "node %s not %s after %s: %v", addr, action, took, err)
+		return
+	}
+	s.metrics.chaosRecoveryTime.WithLabelValues(fault).Observe(took.Seconds())
+	s.recordEvent("chaos", "node %s %s in %s, %d operations failed", addr, action, took, failed)
+}
+
+// leaveOnStop removes any node joined by membership churn once the scenario
+// stops, leaving the cluster as it was found.
+func (c *chaos) leaveOnStop() {
+	safeGo(c.t, func() error {
+		<-c.t.Dying()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.joined {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, _ = c.cluster.RemoveNode(ctx)
+			c.joined = false
+		}
+		return nil
+	})
+}
+
+// partition cuts a random node, other than the one databases are opened
+// through, off from the rest of the cluster and heals the partition after d.
+func (c *chaos) partition(d time.Duration) {
+	const fault = FaultPartition
+	s, env := c.s, c.env
+	network := c.cluster.Network()
+
+	node := 1 + rand.Intn(c.cluster.Nodes()-1)
+	addr := c.cluster.NodeAddress(node)
+	errorsBefore := env.errorCount()
+	env.setFault(fault)
+	network.Partition(addr)
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+	s.recordEvent("chaos", "partitioned node %d (%s) for %s", node, addr, d)
+
+	c.wait(d)
+	network.Heal(addr)
+	env.setFault(NoFault)
+	failed := env.errorCount() - errorsBefore
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(failed))
+	s.recordEvent("chaos", "healed partition of node %d, %d operations failed", node, failed)
+}
+
+// diskFull fills the disk holding the databases with a ballast file so that
+// writes fail with ENOSPC, then removes it after d. The last error seen and
+// the time until operations succeed again after the ballast is removed are
+// recorded. It reports false if the disk is too big to fill.
+func (c *chaos) diskFull(d time.Duration) bool {
+	const fault = FaultDiskFull
+	s, env, dir := c.s, c.env, c.dir
+	ballast := filepath.Join(dir, ".ballast")
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		s.recordEvent("chaos", "checking free space in %s: %v", dir, err)
+		return true
+	}
+	if free := fs.Bavail * uint64(fs.Bsize); free > MaxDiskFill {
+		s.recordEvent("chaos", "not filling %s, %d MiB free is more than the %d MiB limit",
+			dir, free>>20, MaxDiskFill>>20)
+		return false
+	}
+
+	errorsBefore := env.errorCount()
+	env.setFault(fault)
+	filled, err := fillDisk(ballast)
+	if err != nil {
+		env.setFault(NoFault)
+		_ = os.Remove(ballast)
+		s.recordEvent("chaos", "filling %s: %v", dir, err)
+		return true
+	}
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+	s.recordEvent("chaos", "filled %s with %d MiB for %s", dir, filled>>20, d)
+
+	c.wait(d)
+	if err := os.Remove(ballast); err != nil {
+		s.recordEvent("chaos", "removing ballast from %s: %v", dir, err)
+	}
+	env.setFault(NoFault)
+	failed := env.errorCount() - errorsBefore
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(failed))
+	s.recordEvent("chaos", "freed %s, %d operations failed, last error: %s", dir, failed, env.lastErrorString())
+
+	// Wait for operations to succeed again.
+	freed := time.Now()
+	successes := env.successCount()
+	for env.successCount() == successes {
+		if !c.wait(100 * time.Millisecond) {
+			return true
+		}
+	}
+	recovery := time.Since(freed)
+	s.metrics.chaosRecoveryTime.WithLabelValues(fault).Observe(recovery.Seconds())
+	s.recordEvent("chaos", "operations recovered %s after %s was freed", recovery, dir)
+	return true
+}
+
+// fillDisk writes to path until the disk is full and returns how much was
+// written.
+func fillDisk(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	chunk := make([]byte, 1<<20)
+	var written int64
+	for {
+		n, err := f.Write(chunk)
+		written += int64(n)
+		if errors.Is(err, syscall.ENOSPC) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if written > MaxDiskFill {
+			return written, errors.New("disk did not fill up")
+		}
+	}
+}
+
+// connKill closes a pooled connection of a random database. Operations run
+// in the following ReconnectSettleTime are labelled with the fault, so the
+// cost of reconnecting can be seen. The last connection to an in-memory
+// database is never closed, since that would destroy it.
+func (c *chaos) connKill() {
+	const fault = FaultConnKill
+	s, env := c.s, c.env
+	_, inMemory := s.opts.Provider.(*SQLiteDBProvider)
+	minConns := 1
+	if inMemory {
+		minConns = 2
+	}
+
+	dbs := s.DBs()
+	if len(dbs) == 0 {
+		return
+	}
+	db := dbs[rand.Intn(len(dbs))]
+	plain, ok := db.(PlainDB)
+	if !ok {
+		return
+	}
+	sqldb := plain.PlainDB()
+	if sqldb == nil || sqldb.Stats().OpenConnections < minConns {
+		return
+	}
+	if err := killConn(sqldb); err != nil {
+		s.recordEvent("chaos", "killing connection to db %s: %v", db.Name(), err)
+		return
+	}
+	errorsBefore := env.errorCount()
+	env.setFault(fault)
+	s.metrics.chaosFaults.WithLabelValues(fault).Inc()
+
+	c.wait(ReconnectSettleTime)
+	env.setFault(NoFault)
+	s.metrics.chaosFaultErrors.WithLabelValues(fault).Add(float64(env.errorCount() - errorsBefore))
+}
+
+// killConn takes a connection from the pool and closes it.
+func killConn(sqldb *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := sqldb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	// Telling the pool the connection is bad makes it close it rather
+	// than return it to the pool.
+	err = conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+	if errors.Is(err, driver.ErrBadConn) {
+		return nil
+	}
+	return err
+}
+
+// runNoisyNeighbour holds a write lock on db for NoisyNeighbourHold every
+// NoisyNeighbourEvery, with jitter, until the tomb is dying. Operations that
+// run into the lock fail with busy or locked errors, which are counted
+// separately so the wrappers can be compared.
+func runNoisyNeighbour(t *tomb.Tomb, s *Scenario, db DB, opts ChaosOpts) {
+	plain, ok := db.(PlainDB)
+	if !ok {
+		return
+	}
+	safeGo(t, func() error {
+		for {
+			jitter := time.Duration(rand.Int63n(int64(opts.NoisyNeighbourEvery)))
+			select {
+			case <-time.After(opts.NoisyNeighbourEvery/2 + jitter):
+			case <-t.Dying():
+				return nil
+			}
+
+			sqldb := plain.PlainDB()
+			if sqldb == nil {
+				continue
+			}
+			tx, err := sqldb.Begin()
+			if err != nil {
+				continue
+			}
+			// A write that changes nothing still takes the lock.
+			if _, err := tx.Exec("UPDATE agent SET status = status WHERE rowid = (SELECT MIN(rowid) FROM agent)"); err != nil {
+				_ = tx.Rollback()
+				continue
+			}
+			s.metrics.noisyNeighbourLocks.Inc()
+			select {
+			case <-time.After(opts.NoisyNeighbourHold):
+			case <-t.Dying():
+			}
+			_ = tx.Rollback()
+		}
+	})
+}
+
+// isBusy reports whether err is SQLite telling us the database or a table
+// is locked by someone else.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "table is locked")
+}
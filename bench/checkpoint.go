@@ -0,0 +1,167 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CheckpointOpts configures saving the state of a run so that an
+// interrupted run can be resumed. Only providers whose databases outlive the
+// process can be resumed.
+type CheckpointOpts struct {
+	// Dir is where checkpoints are written, one file per scenario. An
+	// empty Dir disables checkpoints.
+	Dir string
+	// Interval is how often checkpoints are saved. It defaults to a
+	// minute.
+	Interval time.Duration
+	// Resume carries on from an existing checkpoint at start up.
+	Resume bool
+}
+
+// Checkpoint is the saved state of a scenario.
+type Checkpoint struct {
+	Scenario string               `json:"scenario"`
+	Saved    time.Time            `json:"saved"`
+	Elapsed  time.Duration        `json:"elapsed"`
+	Phase    Phase                `json:"phase"`
+	Stage    string               `json:"stage"`
+	DBs      []string             `json:"dbs"`
+	Ops      map[string]OpCounter `json:"ops"`
+}
+
+// OpCounter is the number of times an operation ran and failed.
+type OpCounter struct {
+	Runs   int64 `json:"runs"`
+	Errors int64 `json:"errors"`
+}
+
+func (s *Scenario) checkpointPath() string {
+	return filepath.Join(s.opts.Checkpoint.Dir, s.name+".checkpoint.json")
+}
+
+// loadCheckpoint returns the checkpoint to resume from, or nil if the run is
+// not being resumed or there is no checkpoint yet.
+func (s *Scenario) loadCheckpoint() (*Checkpoint, error) {
+	opts := s.opts.Checkpoint
+	if opts.Dir == "" || !opts.Resume {
+		return nil, nil
+	}
+	data, err := os.ReadFile(s.checkpointPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// restoreCounts carries the operation counters on from the checkpoint.
+func (c *Checkpoint) restoreCounts(env *OperationEnv) {
+	for name, counter := range c.Ops {
+		if m, ok := env.metrics[name]; ok {
+			m.runs.Store(counter.Runs)
+			m.errors.Store(counter.Errors)
+		}
+	}
+}
+
+// resumeDBs reopens the databases recorded in the checkpoint. Databases that
+// can no longer be opened are left out of the run.
+func resumeDBs(s *Scenario, checkpoint *Checkpoint) []DB {
+	dbs := make([]DB, 0, len(checkpoint.DBs))
+	for _, name := range checkpoint.DBs {
+		sqldb, err := s.opts.Provider.OpenDB(name)
+		if err != nil {
+			scenarioLog(s, "checkpoint").Warn("cannot resume db", "db", name, "err", err)
+			continue
+		}
+		s.opts.Pool.apply(sqldb)
+		dbs = append(dbs, s.opts.Wrapper.Wrap(sqldb, name, s.opts.RunInTx))
+	}
+	return dbs
+}
+
+// runCheckpoints writes a checkpoint every interval and once more when the
+// scenario stops.
+func runCheckpoints(s *Scenario, start time.Time, phases *PhaseClock, stages *StageClock, env *OperationEnv) {
+	opts := s.opts.Checkpoint
+	if opts.Dir == "" {
+		return
+	}
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		scenarioLog(s, "checkpoint").Error("cannot create checkpoint dir", "err", err)
+		return
+	}
+
+	save := func() {
+		dbs := s.DBs()
+		checkpoint := Checkpoint{
+			Scenario: s.name,
+			Saved:    time.Now(),
+			Elapsed:  time.Since(start),
+			Phase:    phases.Current(),
+			Stage:    stages.Name(),
+			DBs:      make([]string, 0, len(dbs)),
+			Ops:      make(map[string]OpCounter, len(env.metrics)),
+		}
+		for _, db := range dbs {
+			checkpoint.DBs = append(checkpoint.DBs, db.Name())
+		}
+		for name, m := range env.metrics {
+			checkpoint.Ops[name] = OpCounter{
+				Runs:   m.runs.Load(),
+				Errors: m.errors.Load(),
+			}
+		}
+		if err := writeFileAtomic(s.checkpointPath(), checkpoint); err != nil {
+			scenarioLog(s, "checkpoint").Error("writing checkpoint", "err", err)
+		}
+	}
+
+	t := &s.tomb
+	safeGo(t, func() error {
+		interval := opts.Interval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-t.Dying():
+				save()
+				return nil
+			}
+		}
+	})
+}
+
+// writeFileAtomic writes v as JSON to path so that readers never see a
+// partially written file.
+func writeFileAtomic(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ChurnOpts configures database churn. Every Every, the Count oldest
+// databases are removed from the run and the ramp replaces them with new
+// ones, so that the cost of tearing databases down, and the effect of
+// databases coming and going on the rest, are measured as well as growth.
+type ChurnOpts struct {
+	// Every is how often databases are removed. Zero disables churn.
+	Every time.Duration
+	// Count is how many databases are removed each time. It defaults to
+	// one.
+	Count int
+}
+
+// DBRemover is a DBProvider that can delete a database once it has been
+// closed, so that removed databases do not take up space.
+type DBRemover interface {
+	RemoveDB(name string) error
+}
+
+// RemoveDB deletes the files of the database.
+func (dbp *SQLiteFileDBProvider) RemoveDB(name string) error {
+	if dbp.cleanup != nil {
+		dbp.cleanup.mu.Lock()
+		delete(dbp.cleanup.names, name)
+		dbp.cleanup.mu.Unlock()
+	}
+	path := filepath.Join(dbp.dir, name+".db")
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveDBs are the databases of a scenario whose operations are running,
+// oldest first, so that they can be stopped and removed from the run.
+type liveDBs struct {
+	mu  sync.Mutex
+	dbs []*liveDB
+}
+
+// liveDB is a database whose operations are running. Closing stop stops
+// them, and done is closed once they have.
+type liveDB struct {
+	db   DB
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (l *liveDBs) add(db DB) *liveDB {
+	live := &liveDB{
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	l.mu.Lock()
+	l.dbs = append(l.dbs, live)
+	l.mu.Unlock()
+	return live
+}
+
+// remove forgets a database whose operations have stopped.
+func (l *liveDBs) remove(live *liveDB) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, other := range l.dbs {
+		if other == live {
+			l.dbs = append(l.dbs[:i], l.dbs[i+1:]...)
+			return
+		}
+	}
+}
+
+// takeOldest forgets up to n of the oldest databases and returns them.
+func (l *liveDBs) takeOldest(n int) []*liveDB {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = min(n, len(l.dbs))
+	taken := append([]*liveDB(nil), l.dbs[:n]...)
+	l.dbs = l.dbs[n:]
+	return taken
+}
+
+// removeDBs stops the operations of up to n of the oldest running databases
+// of the scenario, closes them and removes them from the run, timing each
+// teardown. It returns how many it removed.
+func removeDBs(s *Scenario, n int) int {
+	log := scenarioLog(s, "ramp")
+	remover, _ := s.opts.Provider.(DBRemover)
+	if s.opts.Paired != nil {
+		// Paired databases are clones the provider knows nothing of.
+		remover = nil
+	}
+	taken := s.live.takeOldest(n)
+	for _, live := range taken {
+		timer := prometheus.NewTimer(s.metrics.dbTeardownTime)
+		close(live.stop)
+		<-live.done
+		name := live.db.Name()
+		if err := live.db.Close(); err != nil {
+			log.Warn("closing removed db", "db", name, "err", err)
+		}
+		if remover != nil {
+			if err := remover.RemoveDB(name); err != nil {
+				log.Warn("deleting removed db", "db", name, "err", err)
+			}
+		}
+		timer.ObserveDuration()
+		s.removeDB(live.db)
+		s.metrics.dbRemoved.Inc()
+	}
+	if len(taken) > 0 {
+		log.Info("removed dbs", "dbs", len(taken))
+	}
+	return len(taken)
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// CIOpts configures CI mode, which runs a short fixed workload and checks
+// the results against thresholds.
+type CIOpts struct {
+	// DBs is the number of databases created by each scenario.
+	DBs int
+	// Iterations is how many times each operation runs per database.
+	Iterations int
+
+	// MaxP99 is the highest p99 latency allowed for an operation. Zero
+	// disables the check. OpMaxP99 overrides it for single operations.
+	MaxP99   time.Duration
+	OpMaxP99 map[string]time.Duration
+	// MaxErrorRate is the highest fraction of runs of an operation that
+	// may fail.
+	MaxErrorRate float64
+
+	// Output is the path of the JUnit result file.
+	Output string
+}
+
+var DefaultCIOpts = CIOpts{
+	DBs:          10,
+	Iterations:   20,
+	MaxP99:       time.Second,
+	MaxErrorRate: 0,
+	Output:       "sqlair-bench-ci.xml",
+}
+
+// apply replaces the workload of the benchmark with the short CI one.
+func (c CIOpts) apply(opts *BenchmarkOpts) {
+	opts.Iterations = c.Iterations
+	opts.Deterministic = DeterministicOpts{}
+	opts.Curve = CurveOpts{}
+	opts.Ramp = StepRamp{
+		Step:   c.DBs,
+		Every:  time.Second,
+		MaxDBs: c.DBs,
+	}
+	opts.Phases = PhaseSchedule{}
+	opts.Stages = nil
+	opts.Checkpoint = CheckpointOpts{}
+}
+
+// check returns the reason the operation breaks a threshold, or an empty
+// string if it passes.
+func (c CIOpts) check(op OpStats) string {
+	if op.Count > 0 {
+		rate := float64(op.Errors) / float64(op.Count)
+		if rate > c.MaxErrorRate {
+			return fmt.Sprintf("error rate %.3f above %.3f (%d of %d runs failed)",
+				rate, c.MaxErrorRate, op.Errors, op.Count)
+		}
+	}
+	limit := c.MaxP99
+	if l, ok := c.OpMaxP99[op.Operation]; ok {
+		limit = l
+	}
+	if limit > 0 && op.P99 > limit {
+		return fmt.Sprintf("p99 latency %s above %s", op.P99, limit)
+	}
+	return ""
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+	// SystemOut holds the event log of the scenario, so that failures
+	// can be lined up with injected faults.
+	SystemOut string `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// reportCI checks the results of every scenario against the thresholds,
+// writes them as a JUnit file and, when running under GitHub Actions, as
+// annotations. It returns false if any check failed. Scenarios in failed
+// died before finishing their work.
+func reportCI(c CIOpts, scenarios []*Scenario, failed map[string]error) (bool, error) {
+	stats, err := gatherOpStats()
+	if err != nil {
+		return false, err
+	}
+	annotate := os.Getenv("GITHUB_ACTIONS") == "true"
+
+	var result junitTestSuites
+	for _, s := range scenarios {
+		suite := junitTestSuite{Name: s.Name()}
+		fail := func(tc junitTestCase, msg string) junitTestCase {
+			tc.Failure = &junitFailure{Message: msg}
+			suite.Failures++
+			if annotate {
+				fmt.Printf("::error title=%s::%s\n", tc.ClassName+"/"+tc.Name, msg)
+			}
+			return tc
+		}
+
+		if err, ok := failed[s.Name()]; ok {
+			tc := junitTestCase{Name: "run", ClassName: s.Name()}
+			suite.Cases = append(suite.Cases, fail(tc, err.Error()))
+		}
+		for _, op := range stats {
+			if op.Scenario != s.Name() {
+				continue
+			}
+			tc := junitTestCase{
+				Name:      op.Operation,
+				ClassName: s.Name(),
+				Time:      (op.Mean * time.Duration(op.Count)).Seconds(),
+			}
+			if msg := c.check(op); msg != "" {
+				tc = fail(tc, msg)
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		var events strings.Builder
+		for _, e := range s.Events() {
+			fmt.Fprintf(&events, "%s %s: %s\n", e.Time.Format(time.RFC3339), e.Kind, e.Detail)
+		}
+		suite.SystemOut = events.String()
+		suite.Tests = len(suite.Cases)
+		result.Tests += suite.Tests
+		result.Failures += suite.Failures
+		result.Suites = append(result.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := os.WriteFile(c.Output, data, 0640); err != nil {
+		return false, err
+	}
+	fmt.Printf("ci: %d checks, %d failed, results written to %s\n", result.Tests, result.Failures, c.Output)
+	return result.Failures == 0, nil
+}
@@ -0,0 +1,398 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/tomb.v2"
+)
+
+// The agents of a distributed run each stream their stats to a collector,
+// which merges them into one results file and one /metrics endpoint, so
+// that a distributed run is reported on like a run of a single process.
+
+// collectorInterval is how often agents send their stats to the collector.
+const collectorInterval = 10 * time.Second
+
+// AgentReport is the stats of an agent's run so far.
+type AgentReport struct {
+	Agent string    `json:"agent"`
+	Time  time.Time `json:"time"`
+	// Final is set on the report sent once the agent's run has finished.
+	Final     bool              `json:"final"`
+	Scenarios []ScenarioResults `json:"scenarios"`
+	Plans     []PlanComparison  `json:"plans,omitempty"`
+	// Metrics are every metric of the agent, in the Prometheus text
+	// format.
+	Metrics string `json:"metrics"`
+}
+
+// newAgentReport reports on the scenarios run by the agent so far.
+func newAgentReport(agent string, scenarios []*Scenario) (AgentReport, error) {
+	r := AgentReport{
+		Agent:     agent,
+		Time:      time.Now(),
+		Scenarios: scenarioResults(scenarios),
+	}
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return r, err
+	}
+	var metrics strings.Builder
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&metrics, family); err != nil {
+			return r, err
+		}
+	}
+	r.Metrics = metrics.String()
+	return r, nil
+}
+
+// sendAgentReport sends a report to the collector at url.
+func sendAgentReport(url string, r AgentReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url+"/stats", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sending stats to collector: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// runCollectorReports sends a report on the scenarios to the collector at
+// url every collectorInterval until the tomb is dying. The final report is
+// sent by Run once the scenarios have stopped.
+func runCollectorReports(t *tomb.Tomb, url, agent string, scenarios []*Scenario) {
+	safeGo(t, func() error {
+		ticker := time.NewTicker(collectorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.Dying():
+				return nil
+			case <-ticker.C:
+			}
+			r, err := newAgentReport(agent, scenarios)
+			if err == nil {
+				err = sendAgentReport(url, r)
+			}
+			if err != nil {
+				runLog.Error("reporting to collector", "err", err)
+			}
+		}
+	})
+}
+
+// CollectorOpts configures the collector of a distributed run.
+type CollectorOpts struct {
+	// Addr is the address agents send their stats to, and the merged
+	// metrics are served on. It defaults to :3335.
+	Addr string
+	// Results is the path the merged results are written to, for the
+	// compare and report commands. Empty writes no results.
+	Results string
+	// Agents, if set, stops the collector once that many agents have
+	// finished. Otherwise it runs until interrupted.
+	Agents int
+}
+
+type collector struct {
+	opts CollectorOpts
+
+	mu       sync.Mutex
+	reports  map[string]AgentReport
+	families map[string][]*dto.MetricFamily
+	finished int
+	done     chan struct{}
+}
+
+// RunCollector collects the stats of the agents of a distributed run until
+// they have all finished or it is interrupted, writing the merged results
+// as each agent finishes.
+func RunCollector(opts CollectorOpts) error {
+	if opts.Addr == "" {
+		opts.Addr = ":3335"
+	}
+	c := &collector{
+		opts:     opts,
+		reports:  make(map[string]AgentReport),
+		families: make(map[string][]*dto.MetricFamily),
+		done:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", c.receive)
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.GathererFunc(c.gather), promhttp.HandlerOpts{}))
+	server := http.Server{Addr: opts.Addr, Handler: mux}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	runLog.Info("collector receiving stats", "addr", opts.Addr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-served:
+		return err
+	case <-c.done:
+	case <-sig:
+	}
+	server.Close()
+	return c.writeResults()
+}
+
+// receive stores the latest report of an agent, replacing its previous one
+// since the metrics of a run only ever accumulate.
+func (c *collector) receive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "stats must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	var report AgentReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(strings.NewReader(report.Metrics))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, family := range parsed {
+		families = append(families, family)
+	}
+
+	c.mu.Lock()
+	previous, seen := c.reports[report.Agent]
+	if previous.Final {
+		c.mu.Unlock()
+		http.Error(w, fmt.Sprintf("agent %s has already finished", report.Agent), http.StatusConflict)
+		return
+	}
+	c.reports[report.Agent] = report
+	c.families[report.Agent] = families
+	if !seen {
+		runLog.Info("agent reporting", "agent", report.Agent)
+	}
+	finished := false
+	if report.Final {
+		c.finished++
+		finished = c.opts.Agents > 0 && c.finished == c.opts.Agents
+		runLog.Info("agent finished", "agent", report.Agent, "finished", c.finished)
+	}
+	c.mu.Unlock()
+
+	if report.Final {
+		if err := c.writeResults(); err != nil {
+			runLog.Error("writing results", "err", err)
+		}
+	}
+	if finished {
+		close(c.done)
+	}
+}
+
+// gather merges the metrics of every agent, labelling each with the agent
+// it came from.
+func (c *collector) gather() ([]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	merged := make(map[string]*dto.MetricFamily)
+	for _, agent := range registeredNames(c.families) {
+		for _, family := range c.families[agent] {
+			m, ok := merged[family.GetName()]
+			if !ok {
+				m = &dto.MetricFamily{
+					Name: family.Name,
+					Help: family.Help,
+					Type: family.Type,
+				}
+				merged[family.GetName()] = m
+			}
+			for _, metric := range family.GetMetric() {
+				metric := proto.Clone(metric).(*dto.Metric)
+				metric.Label = append(metric.Label, &dto.LabelPair{
+					Name:  proto.String("agent"),
+					Value: proto.String(agent),
+				})
+				sort.Slice(metric.Label, func(i, j int) bool {
+					return metric.Label[i].GetName() < metric.Label[j].GetName()
+				})
+				m.Metric = append(m.Metric, metric)
+			}
+		}
+	}
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, name := range registeredNames(merged) {
+		families = append(families, merged[name])
+	}
+	return families, nil
+}
+
+// results merges the reports of every agent into the results of one run.
+// The stats of each operation are summed across the agents.
+func (c *collector) results() (RunResults, error) {
+	families, err := c.gather()
+	if err != nil {
+		return RunResults{}, err
+	}
+	aggs := histograms(families)
+	r := RunResults{
+		Generated: time.Now(),
+		Ops:       opStats(aggs),
+		Latencies: latencyDistributions(aggs),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var reports []AgentReport
+	for _, agent := range registeredNames(c.reports) {
+		reports = append(reports, c.reports[agent])
+	}
+	r.Scenarios = mergeScenarioResults(reports)
+	for _, report := range reports {
+		if len(report.Plans) > 0 {
+			r.Plans = report.Plans
+			break
+		}
+	}
+	return r, nil
+}
+
+func (c *collector) writeResults() error {
+	if c.opts.Results == "" {
+		return nil
+	}
+	r, err := c.results()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.opts.Results, r)
+}
+
+// mergeScenarioResults merges the scenarios of the same name run by each
+// agent. Databases are summed, events are attributed to their agent and
+// timelines are summed over time. Curves are per agent so are not kept.
+func mergeScenarioResults(reports []AgentReport) []ScenarioResults {
+	var merged []ScenarioResults
+	agents := make(map[string][]string)
+	timelines := make(map[string][][]TimelinePoint)
+	index := make(map[string]int)
+	for _, report := range reports {
+		for _, s := range report.Scenarios {
+			i, ok := index[s.Name]
+			if !ok {
+				i = len(merged)
+				index[s.Name] = i
+				metadata := make(map[string]string)
+				for k, v := range s.Metadata {
+					metadata[k] = v
+				}
+				merged = append(merged, ScenarioResults{Name: s.Name, Metadata: metadata})
+			}
+			m := &merged[i]
+			m.DBs += s.DBs
+			for _, e := range s.Events {
+				e.Detail = fmt.Sprintf("agent %s: %s", report.Agent, e.Detail)
+				m.Events = append(m.Events, e)
+			}
+			agents[s.Name] = append(agents[s.Name], report.Agent)
+			timelines[s.Name] = append(timelines[s.Name], s.Timeline)
+		}
+	}
+	for i := range merged {
+		m := &merged[i]
+		m.Metadata["agents"] = strings.Join(agents[m.Name], ",")
+		sort.SliceStable(m.Events, func(i, j int) bool {
+			return m.Events[i].Time.Before(m.Events[j].Time)
+		})
+		m.Timeline = mergeTimelines(timelines[m.Name])
+	}
+	return merged
+}
+
+// mergeTimelines sums timelines sampled at different times. At each sample
+// time of any timeline, each timeline contributes its latest point so far.
+func mergeTimelines(timelines [][]TimelinePoint) []TimelinePoint {
+	var times []time.Time
+	for _, timeline := range timelines {
+		for _, p := range timeline {
+			times = append(times, p.Time)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	var merged []TimelinePoint
+	next := make([]int, len(timelines))
+	for i, t := range times {
+		if i > 0 && t.Equal(times[i-1]) {
+			continue
+		}
+		p := TimelinePoint{Time: t}
+		for j, timeline := range timelines {
+			for next[j] < len(timeline) && !timeline[next[j]].Time.After(t) {
+				next[j]++
+			}
+			if next[j] == 0 {
+				continue
+			}
+			latest := timeline[next[j]-1]
+			p.DBs += latest.DBs
+			p.Ops += latest.Ops
+			p.Errors += latest.Errors
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// CollectorCommand implements `collector [-listen addr] [-results path] [-agents n]`,
+// collecting the stats of the agents of a distributed run.
+func CollectorCommand(args []string) error {
+	fs := flag.NewFlagSet("collector", flag.ContinueOnError)
+	var opts CollectorOpts
+	fs.StringVar(&opts.Addr, "listen", ":3335", "address agents send their stats to and the merged metrics are served on")
+	fs.StringVar(&opts.Results, "results", "", "path to write the merged results to, for the compare and report commands")
+	fs.IntVar(&opts.Agents, "agents", 0, "number of agents to wait for, or zero to run until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.Agents < 0 {
+		return errors.New("the number of agents cannot be negative")
+	}
+	return RunCollector(opts)
+}
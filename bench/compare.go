@@ -0,0 +1,200 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// CompareThreshold is the relative change in latency, in percent, above
+// which the compare command flags an operation as having regressed or
+// improved.
+const CompareThreshold = 5.0
+
+const (
+	colourRed   = "\033[31m"
+	colourGreen = "\033[32m"
+	colourReset = "\033[0m"
+)
+
+// ErrRegressed is returned by the compare command when an operation's p95
+// regressed by more than -max-p95-regression.
+var ErrRegressed = errors.New("p95 regressed")
+
+// compareCommand implements
+// `compare [-max-p95-regression percent] baseline.json run.json`, printing
+// how every operation changed between two runs. With -max-p95-regression
+// it fails if the p95 of any operation in both runs grew by more than that
+// percentage over the baseline, to gate changes on performance.
+func CompareCommand(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	maxRegression := fs.Float64("max-p95-regression", 0, "percentage the p95 of an operation may grow by over the baseline before the comparison fails, or zero not to fail")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) != 2 {
+		return errors.New("usage: compare [-max-p95-regression percent] baseline.json run.json")
+	}
+	if *maxRegression < 0 {
+		return errors.New("-max-p95-regression cannot be negative")
+	}
+	before, err := readResults(args[0])
+	if err != nil {
+		return err
+	}
+	after, err := readResults(args[1])
+	if err != nil {
+		return err
+	}
+	colour := false
+	if fi, err := os.Stdout.Stat(); err == nil {
+		colour = fi.Mode()&os.ModeCharDevice != 0
+	}
+	if err := printComparison(os.Stdout, before, after, colour); err != nil {
+		return err
+	}
+	if *maxRegression == 0 {
+		return nil
+	}
+	regressions := p95Regressions(before, after, *maxRegression)
+	for _, r := range regressions {
+		fmt.Println(r)
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("%w by more than %.1f%% in %d operations", ErrRegressed, *maxRegression, len(regressions))
+	}
+	return nil
+}
+
+// p95Regressions describes the operations in both runs whose p95 grew by
+// more than threshold percent, sorted by scenario and operation.
+func p95Regressions(before, after RunResults, threshold float64) []string {
+	base := make(map[opKey]OpStats)
+	for _, op := range before.Ops {
+		base[opKey{op.Scenario, op.Operation}] = op
+	}
+	var regressions []string
+	for _, b := range after.Ops {
+		a, ok := base[opKey{b.Scenario, b.Operation}]
+		if !ok {
+			continue
+		}
+		if delta := percentChange(float64(a.P95), float64(b.P95)); delta > threshold {
+			regressions = append(regressions, fmt.Sprintf("%s/%s p95 regressed %+.1f%%, from %s to %s",
+				b.Scenario, b.Operation, delta, a.P95, b.P95))
+		}
+	}
+	sort.Strings(regressions)
+	return regressions
+}
+
+// printComparison writes a table per operation comparing the statistics of
+// two runs. Regressions are marked with "!" and improvements with "*", and
+// coloured if colour is set. Operations in only one of the runs are listed
+// with the missing side left blank.
+func printComparison(w io.Writer, before, after RunResults, colour bool) error {
+	ops := make(map[opKey][2]*OpStats)
+	for i, run := range []RunResults{before, after} {
+		for j := range run.Ops {
+			op := &run.Ops[j]
+			k := opKey{op.Scenario, op.Operation}
+			pair := ops[k]
+			pair[i] = op
+			ops[k] = pair
+		}
+	}
+	keys := make([]opKey, 0, len(ops))
+	for k := range ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].scenario != keys[j].scenario {
+			return keys[i].scenario < keys[j].scenario
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	mark := func(delta float64, worse bool) string {
+		marker, c := "", ""
+		switch {
+		case worse:
+			marker, c = "!", colourRed
+		case delta < -CompareThreshold:
+			marker, c = "*", colourGreen
+		}
+		text := fmt.Sprintf("%+.1f%%", delta)
+		if marker == "" {
+			return text
+		}
+		text += " " + marker
+		if colour {
+			return c + text + colourReset
+		}
+		return text
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, k := range keys {
+		pair := ops[k]
+		a, b := pair[0], pair[1]
+		fmt.Fprintf(tw, "%s/%s\n", k.scenario, k.operation)
+		fmt.Fprintln(tw, "\tSTAT\tRUN1\tRUN2\tDELTA")
+		if a == nil || b == nil {
+			fmt.Fprintf(tw, "\tcount\t%s\t%s\t\n", countOrBlank(a), countOrBlank(b))
+			continue
+		}
+		latencies := []struct {
+			name   string
+			before time.Duration
+			after  time.Duration
+		}{
+			{"mean", a.Mean, b.Mean},
+			{"p50", a.P50, b.P50},
+			{"p95", a.P95, b.P95},
+			{"p99", a.P99, b.P99},
+		}
+		for _, l := range latencies {
+			delta := percentChange(float64(l.before), float64(l.after))
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\n", l.name, l.before, l.after,
+				mark(delta, delta > CompareThreshold))
+		}
+		delta := percentChange(errorRate(a), errorRate(b))
+		fmt.Fprintf(tw, "\terrors\t%d/%d\t%d/%d\t%s\n", a.Errors, a.Count, b.Errors, b.Count,
+			mark(delta, errorRate(b) > errorRate(a)))
+	}
+	return tw.Flush()
+}
+
+// percentChange returns the change from before to after in percent.
+func percentChange(before, after float64) float64 {
+	if before == 0 {
+		if after == 0 {
+			return 0
+		}
+		return 100
+	}
+	return (after - before) / before * 100
+}
+
+func errorRate(op *OpStats) float64 {
+	if op.Count == 0 {
+		return 0
+	}
+	return float64(op.Errors) / float64(op.Count)
+}
+
+func countOrBlank(op *OpStats) string {
+	if op == nil {
+		return "-"
+	}
+	return fmt.Sprint(op.Count)
+}
@@ -0,0 +1,498 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is a benchmark definition read from a YAML file, so that workloads
+// can be shared and reproduced without changing the source. For example:
+//
+//	provider: sqlite-file
+//	provider_dir: /tmp/dbs
+//	wrappers: [sql, sqlair]
+//	tx: true
+//	ramp:
+//	  kind: step
+//	  step: 50
+//	  every: 10s
+//	  max_dbs: 400
+//	agents: 60
+//	scheduler: pool
+//	scheduler_workers: 64
+//	operations:
+//	  - name: db-init
+//	    kind: seed-agents
+//	  - name: agent-status-active
+//	    kind: agent-status
+//	    freq: 5s
+//	    status: active
+//	    sample: 10
+//	  - name: cull-agent-events
+//	    freq: 30s
+//	    max_events: 30
+//
+// Fields left out keep the value of the matching flag.
+type Config struct {
+	// Provider is the name of a registered provider, configured by the
+	// provider fields below it.
+	Provider       string        `yaml:"provider"`
+	ProviderDir    string        `yaml:"provider_dir"`
+	ProviderNodes  int           `yaml:"provider_nodes"`
+	SyncDelay      time.Duration `yaml:"sync_delay"`
+	NetworkLatency time.Duration `yaml:"network_latency"`
+	NetworkJitter  time.Duration `yaml:"network_jitter"`
+	// ProviderCleanup deletes the databases created in ProviderDir when
+	// the run ends.
+	ProviderCleanup bool `yaml:"provider_cleanup"`
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the
+	// connection pool of each database.
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	// The sqlite fields tune the databases of the SQLite providers, as
+	// the -sqlite- flags.
+	SQLiteBusyTimeout time.Duration `yaml:"sqlite_busy_timeout"`
+	SQLiteTxLock      string        `yaml:"sqlite_txlock"`
+	SQLiteJournal     string        `yaml:"sqlite_journal"`
+	SQLiteSynchronous string        `yaml:"sqlite_synchronous"`
+	SQLiteCacheSize   int           `yaml:"sqlite_cache_size"`
+	SQLiteMmapSize    int64         `yaml:"sqlite_mmap_size"`
+	SQLiteForeignKeys bool          `yaml:"sqlite_foreign_keys"`
+	// Wrappers are the names of registered wrappers, each run as a
+	// scenario.
+	Wrappers []string `yaml:"wrappers"`
+	// Tx runs the queries of each operation in a transaction.
+	Tx *bool `yaml:"tx"`
+	// Ramp decides how many databases exist over the course of the run.
+	Ramp *RampConfig `yaml:"ramp"`
+	// ChurnEvery and ChurnCount remove the ChurnCount oldest databases
+	// every ChurnEvery for the ramp to replace.
+	ChurnEvery time.Duration `yaml:"churn_every"`
+	ChurnCount int           `yaml:"churn_count"`
+	// Seed makes runs put the same logical workload on their databases.
+	Seed int64 `yaml:"seed"`
+	// Warmup is how long operations run before they are measured.
+	Warmup *time.Duration `yaml:"warmup"`
+	// Duration is how long the run goes on for before it stops by itself.
+	Duration time.Duration `yaml:"duration"`
+	// Scheduler is the kind of scheduler operations run on, one of
+	// SchedulerKinds, with SchedulerWorkers workers if it is a pool.
+	Scheduler        string `yaml:"scheduler"`
+	SchedulerWorkers int    `yaml:"scheduler_workers"`
+	// OpenLoop keeps operations due at their freq however long they take.
+	OpenLoop bool `yaml:"open_loop"`
+	// MaxOpsPerSec caps the operations the run starts per second in
+	// total, across every scenario and database.
+	MaxOpsPerSec float64 `yaml:"max_ops_per_sec"`
+	// Agents is how many agents each database is seeded with, which the
+	// operations that pick agents pick from. It defaults to 60.
+	Agents int `yaml:"agents"`
+	// Operations are run against each database, instead of a registered
+	// set of operations.
+	Operations []OperationConfig `yaml:"operations"`
+	// Stages change the mix of operations over the course of the run.
+	Stages []StageConfig `yaml:"stages"`
+	// Chaos is a timeline of faults injected at fixed times.
+	Chaos []ChaosEventConfig `yaml:"chaos"`
+}
+
+// RampConfig configures one of the ramps by kind: linear adds PerSecond
+// databases a second, step adds Step every Every, exponential starts at
+// Initial and multiplies by Factor every Every, and sine rises from MinDBs
+// to MaxDBs and back every Period. Each stops at MaxDBs. schedule instead
+// follows Points, reaching each point's DBs at its At, for example:
+//
+//	ramp:
+//	  kind: schedule
+//	  points:
+//	    - {at: 0s, dbs: 50}
+//	    - {at: 10m, dbs: 200}
+//	    - {at: 30m, dbs: 400}
+type RampConfig struct {
+	Kind      string            `yaml:"kind"`
+	PerSecond float64           `yaml:"per_second"`
+	Step      int               `yaml:"step"`
+	Initial   int               `yaml:"initial"`
+	Factor    float64           `yaml:"factor"`
+	Every     time.Duration     `yaml:"every"`
+	MinDBs    int               `yaml:"min_dbs"`
+	Period    time.Duration     `yaml:"period"`
+	MaxDBs    int               `yaml:"max_dbs"`
+	Points    []RampPointConfig `yaml:"points"`
+}
+
+// RampPointConfig is a point of a schedule ramp.
+type RampPointConfig struct {
+	At  time.Duration `yaml:"at"`
+	DBs int           `yaml:"dbs"`
+}
+
+// StageConfig is a workload stage, during which only the operations in Ops
+// run, at the freq given for them or at their own if it is zero. The last
+// stage lasts until the end of the run, for example:
+//
+//	stages:
+//	  - name: write-heavy
+//	    duration: 15m
+//	    ops: {agent-status-active: 1s, agent-events: 2s}
+//	  - name: read-heavy
+//	    ops: {agents-count: 1s, agent-events-count: 0s}
+type StageConfig struct {
+	Name     string                   `yaml:"name"`
+	Duration time.Duration            `yaml:"duration"`
+	Ops      map[string]time.Duration `yaml:"ops"`
+}
+
+// ChaosEventConfig is a fault of the chaos timeline: What is one of Faults,
+// injected At from the start of the run. Node restarts, partitions and
+// full disks last For, for example:
+//
+//	chaos:
+//	  - {what: partition, at: 5m, for: 30s}
+//	  - {what: leadership-transfer, at: 10m}
+type ChaosEventConfig struct {
+	What string        `yaml:"what"`
+	At   time.Duration `yaml:"at"`
+	For  time.Duration `yaml:"for"`
+}
+
+// OperationConfig is an operation run against each database.
+type OperationConfig struct {
+	// Name identifies the operation in metrics and stages.
+	Name string `yaml:"name"`
+	// Kind is what the operation does, one of OperationKinds. It
+	// defaults to the name.
+	Kind string `yaml:"kind"`
+	// Freq is how often the operation runs. Zero runs it once, when the
+	// database is created.
+	Freq time.Duration `yaml:"freq"`
+	// Status is the status agent-status sets.
+	Status string `yaml:"status"`
+	// Sample is how many agents agent-status and agent-events pick each
+	// run. It defaults to 10.
+	Sample int `yaml:"sample"`
+	// MaxEvents is how many events of an agent cull-agent-events leaves.
+	// It defaults to 30.
+	MaxEvents int `yaml:"max_events"`
+}
+
+// operationKinds describes each kind of operation a config can define, and
+// the parameters it takes.
+var operationKinds = map[string]struct {
+	params string
+	newOp  func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation
+}{
+	"seed-agents": {"", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return seedModelAgents(agents, DefaultUUIDPool(), dir)
+	}},
+	"agent-status": {"status sample", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return updateModelAgentStatus(dir, agentSample{size: agents, n: op.Sample}, op.Status)
+	}},
+	"agent-events": {"sample", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return generateAgentEvents(dir, agentSample{size: agents, n: op.Sample})
+	}},
+	"cull-agent-events": {"max_events", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return cullAgentEvents(op.MaxEvents)
+	}},
+	"agents-count": {"", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return agentModelCount(metrics.dbAgentGauge)
+	}},
+	"agent-events-count": {"", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return agentEventModelCount(metrics.dbAgentEventsGauge)
+	}},
+	"orphaned-agent-events": {"", func(op OperationConfig, agents int, dir *agentDirectory, metrics *ScenarioMetrics) DBOperation {
+		return orphanedAgentEvents(metrics.dbOrphanedEvents)
+	}},
+}
+
+// OperationKinds returns the kinds of operation a config can define.
+func OperationKinds() []string {
+	return registeredNames(operationKinds)
+}
+
+// LoadConfig reads and checks the benchmark definition at path. Unknown
+// fields are errors, so that typos are not silently ignored.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// check fills in the defaults of the config and returns an error if it is
+// inconsistent.
+func (c *Config) check() error {
+	if c.Agents == 0 {
+		c.Agents = 60
+	}
+	if c.Agents < 0 {
+		return errors.New("agents cannot be negative")
+	}
+	if c.Duration < 0 {
+		return errors.New("duration cannot be negative")
+	}
+	if c.Warmup != nil && *c.Warmup < 0 {
+		return errors.New("warmup cannot be negative")
+	}
+	if c.ChurnEvery < 0 || c.ChurnCount < 0 {
+		return errors.New("churn_every and churn_count cannot be negative")
+	}
+	if err := CheckSchedulerKind(c.Scheduler); err != nil {
+		return err
+	}
+	if c.SchedulerWorkers < 0 {
+		return errors.New("scheduler_workers cannot be negative")
+	}
+	if c.MaxOpsPerSec < 0 {
+		return errors.New("max_ops_per_sec cannot be negative")
+	}
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetime < 0 {
+		return errors.New("max_open_conns, max_idle_conns and conn_max_lifetime cannot be negative")
+	}
+	sqlite := SQLiteDSNOpts{
+		BusyTimeout: c.SQLiteBusyTimeout,
+		TxLock:      c.SQLiteTxLock,
+		Journal:     c.SQLiteJournal,
+		Synchronous: c.SQLiteSynchronous,
+		CacheSize:   c.SQLiteCacheSize,
+		MmapSize:    c.SQLiteMmapSize,
+	}
+	if err := sqlite.Validate(); err != nil {
+		return err
+	}
+	if c.Ramp != nil {
+		if _, err := c.Ramp.profile(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	seeded, picks := false, ""
+	for i := range c.Operations {
+		op := &c.Operations[i]
+		if op.Name == "" {
+			return fmt.Errorf("operation %d has no name", i)
+		}
+		if names[op.Name] {
+			return fmt.Errorf("operation %s defined more than once", op.Name)
+		}
+		names[op.Name] = true
+		if op.Kind == "" {
+			op.Kind = op.Name
+		}
+		kind, ok := operationKinds[op.Kind]
+		if !ok {
+			return fmt.Errorf("operation %s has unknown kind %q, have %v", op.Name, op.Kind, OperationKinds())
+		}
+		takes := func(param string) bool {
+			return strings.Contains(" "+kind.params+" ", " "+param+" ")
+		}
+		for param, set := range map[string]bool{
+			"status":     op.Status != "",
+			"sample":     op.Sample != 0,
+			"max_events": op.MaxEvents != 0,
+		} {
+			if set && !takes(param) {
+				return fmt.Errorf("operation %s of kind %s takes no %s", op.Name, op.Kind, param)
+			}
+		}
+		if takes("status") && op.Status == "" {
+			return fmt.Errorf("operation %s needs a status", op.Name)
+		}
+		if takes("sample") && op.Sample == 0 {
+			op.Sample = 10
+		}
+		if op.Sample < 0 || op.Sample > c.Agents {
+			return fmt.Errorf("operation %s samples %d of %d agents", op.Name, op.Sample, c.Agents)
+		}
+		if takes("max_events") && op.MaxEvents == 0 {
+			op.MaxEvents = 30
+		}
+		if op.Freq < 0 {
+			return fmt.Errorf("operation %s has a negative freq", op.Name)
+		}
+		if op.Kind == "seed-agents" && op.Freq == 0 {
+			seeded = true
+		}
+		if takes("sample") {
+			picks = op.Name
+		}
+	}
+	if picks != "" && !seeded {
+		return fmt.Errorf("operation %s picks agents, which needs a seed-agents operation run once", picks)
+	}
+	stages := make(map[string]bool)
+	for i, st := range c.Stages {
+		if st.Name == "" {
+			return fmt.Errorf("stage %d has no name", i)
+		}
+		if stages[st.Name] {
+			return fmt.Errorf("stage %s defined more than once", st.Name)
+		}
+		stages[st.Name] = true
+		if st.Duration < 0 || (st.Duration == 0 && i < len(c.Stages)-1) {
+			return fmt.Errorf("stage %s needs a duration, only the last stage lasts until the end of the run", st.Name)
+		}
+		for op, freq := range st.Ops {
+			if freq < 0 {
+				return fmt.Errorf("stage %s runs operation %s at a negative freq", st.Name, op)
+			}
+			// Without operations in the config, the stages name those
+			// of a registered set, which are not known until the run.
+			if len(c.Operations) != 0 && !names[op] {
+				return fmt.Errorf("stage %s runs unknown operation %s", st.Name, op)
+			}
+		}
+	}
+	for i, e := range c.Chaos {
+		known := false
+		for _, fault := range Faults() {
+			known = known || e.What == fault
+		}
+		switch {
+		case !known:
+			return fmt.Errorf("chaos event %d has unknown fault %q, have %v", i, e.What, Faults())
+		case e.At < 0 || e.For < 0:
+			return fmt.Errorf("chaos event %d cannot be negative", i)
+		case faultLasts(e.What) && e.For == 0:
+			return fmt.Errorf("chaos event %d needs to say how long the %s lasts for", i, e.What)
+		case !faultLasts(e.What) && e.For != 0:
+			return fmt.Errorf("chaos event %d is a %s, which happens at an instant and takes no for", i, e.What)
+		}
+	}
+	return nil
+}
+
+// profile returns the ramp the config describes.
+func (r RampConfig) profile() (RampProfile, error) {
+	if r.Kind == "schedule" {
+		return r.schedule()
+	}
+	if len(r.Points) != 0 {
+		return nil, fmt.Errorf("%s ramp takes no points", r.Kind)
+	}
+	if r.MaxDBs <= 0 {
+		return nil, errors.New("ramp needs max_dbs")
+	}
+	switch r.Kind {
+	case "linear":
+		if r.PerSecond <= 0 {
+			return nil, errors.New("linear ramp needs per_second")
+		}
+		return LinearRamp{PerSecond: r.PerSecond, MaxDBs: r.MaxDBs}, nil
+	case "step":
+		if r.Step <= 0 || r.Every <= 0 {
+			return nil, errors.New("step ramp needs step and every")
+		}
+		return StepRamp{Step: r.Step, Every: r.Every, MaxDBs: r.MaxDBs}, nil
+	case "exponential":
+		if r.Initial <= 0 || r.Factor <= 1 || r.Every <= 0 {
+			return nil, errors.New("exponential ramp needs initial, a factor above 1 and every")
+		}
+		return ExponentialRamp{Initial: r.Initial, Factor: r.Factor, Every: r.Every, MaxDBs: r.MaxDBs}, nil
+	case "sine":
+		if r.Period <= 0 || r.MinDBs < 0 || r.MinDBs >= r.MaxDBs {
+			return nil, errors.New("sine ramp needs a period and min_dbs below max_dbs")
+		}
+		return SineRamp{MinDBs: r.MinDBs, MaxDBs: r.MaxDBs, Period: r.Period}, nil
+	}
+	return nil, fmt.Errorf("unknown ramp kind %q, have linear, step, exponential, sine and schedule", r.Kind)
+}
+
+// schedule returns the schedule ramp the config describes. Its points are
+// given in order of time, and the ramp tops out at the most databases of
+// any of them, so it takes no max_dbs.
+func (r RampConfig) schedule() (RampProfile, error) {
+	if r.MaxDBs != 0 {
+		return nil, errors.New("schedule ramp takes no max_dbs, it reaches the most dbs of its points")
+	}
+	if len(r.Points) == 0 {
+		return nil, errors.New("schedule ramp needs points")
+	}
+	ramp := make(ScheduleRamp, 0, len(r.Points))
+	for i, p := range r.Points {
+		if p.At < 0 || p.DBs < 0 {
+			return nil, fmt.Errorf("schedule ramp point %d cannot be negative", i)
+		}
+		if i > 0 && p.At <= r.Points[i-1].At {
+			return nil, fmt.Errorf("schedule ramp point %d at %v is not after the one before it", i, p.At)
+		}
+		ramp = append(ramp, RampPoint{At: p.At, DBs: p.DBs})
+	}
+	if ramp.Max() == 0 {
+		return nil, errors.New("schedule ramp never has any dbs")
+	}
+	return ramp, nil
+}
+
+// RampProfile returns the ramp of the config, or nil if it has none.
+func (c *Config) RampProfile() RampProfile {
+	if c.Ramp == nil {
+		return nil
+	}
+	// The ramp was checked when the config was loaded.
+	ramp, _ := c.Ramp.profile()
+	return ramp
+}
+
+// WorkloadSchedule returns the stages of the config, for
+// BenchmarkOpts.Stages, or nil if it has none.
+func (c *Config) WorkloadSchedule() WorkloadSchedule {
+	if len(c.Stages) == 0 {
+		return nil
+	}
+	schedule := make(WorkloadSchedule, 0, len(c.Stages))
+	for _, st := range c.Stages {
+		schedule = append(schedule, WorkloadStage{Name: st.Name, Duration: st.Duration, Ops: st.Ops})
+	}
+	return schedule
+}
+
+// ChaosSchedule returns the chaos timeline of the config, for
+// ChaosOpts.Schedule, or nil if it has none.
+func (c *Config) ChaosSchedule() []ChaosEvent {
+	if len(c.Chaos) == 0 {
+		return nil
+	}
+	schedule := make([]ChaosEvent, 0, len(c.Chaos))
+	for _, e := range c.Chaos {
+		schedule = append(schedule, ChaosEvent{At: e.At, Fault: e.What, For: e.For})
+	}
+	return schedule
+}
+
+// OperationsFunc returns the operations of the config, for
+// BenchmarkOpts.Operations, or nil if it has none.
+func (c *Config) OperationsFunc() func(*ScenarioMetrics) []DBOperationDef {
+	if len(c.Operations) == 0 {
+		return nil
+	}
+	return func(metrics *ScenarioMetrics) []DBOperationDef {
+		dir := newAgentDirectory()
+		ops := make([]DBOperationDef, 0, len(c.Operations))
+		for _, op := range c.Operations {
+			ops = append(ops, DBOperationDef{
+				OpName: op.Name,
+				Op:     operationKinds[op.Kind].newOp(op, c.Agents, dir, metrics),
+				Freq:   op.Freq,
+			})
+		}
+		return ops
+	}
+}
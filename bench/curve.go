@@ -0,0 +1,305 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// CurveOpts configures scaling curve mode. The scenario holds at each number
+// of databases in turn and measures how it performs there, giving the curve
+// of throughput and latency against the number of databases. The scenario
+// stops once the last count has been measured.
+type CurveOpts struct {
+	// Counts are the numbers of databases held at, in increasing order.
+	// No counts disables curve mode.
+	Counts []int
+	// Settle is how long to wait once a count is reached before measuring,
+	// so that the cost of starting the new databases is left out. It
+	// defaults to thirty seconds.
+	Settle time.Duration
+	// Hold is how long each count is measured for. It defaults to two
+	// minutes.
+	Hold time.Duration
+
+	// MaxP99 and MaxErrorRate are the latency and error rate a count must
+	// stay within, across all operations. Setting either turns on breaking
+	// point detection: the scenario stops at the first count that breaks
+	// them and, if none of Counts do, carries on multiplying the last count
+	// by Growth until one does or Limit is reached. The last count that
+	// kept within them is the knee of the curve.
+	MaxP99       time.Duration
+	MaxErrorRate float64
+	// Growth defaults to doubling, and Limit to MaxNumberOfDatabases.
+	Growth float64
+	Limit  int
+}
+
+// searching reports whether breaking point detection is on.
+func (o CurveOpts) searching() bool {
+	return o.MaxP99 > 0 || o.MaxErrorRate > 0
+}
+
+// broken returns the way p breaks the limits, or an empty string if it keeps
+// within them.
+func (o CurveOpts) broken(p CurvePoint) string {
+	if o.MaxP99 > 0 && p.P99 > o.MaxP99 {
+		return fmt.Sprintf("p99 latency %s above %s", p.P99, o.MaxP99)
+	}
+	var ops uint64
+	for _, op := range p.Ops {
+		ops += op.Count
+	}
+	if o.MaxErrorRate > 0 && ops > 0 && float64(p.Errors)/float64(ops) > o.MaxErrorRate {
+		return fmt.Sprintf("error rate %.3f above %.3f", float64(p.Errors)/float64(ops), o.MaxErrorRate)
+	}
+	return ""
+}
+
+// CurvePoint is how a scenario performed while holding at a number of
+// databases.
+type CurvePoint struct {
+	DBs int `json:"dbs"`
+	// Throughput is in operations per second.
+	Throughput float64       `json:"throughput"`
+	Mean       time.Duration `json:"mean"`
+	P99        time.Duration `json:"p99"`
+	Errors     uint64        `json:"errors"`
+	Ops        []OpStats     `json:"ops"`
+	// Broken is how the count broke the limits of breaking point
+	// detection, if it did.
+	Broken string `json:"broken,omitempty"`
+}
+
+// curveRamp holds at each count of a scaling curve until it has been
+// measured.
+type curveRamp struct {
+	mu     sync.Mutex
+	target int
+	max    int
+}
+
+func newCurveRamp(opts CurveOpts) *curveRamp {
+	r := &curveRamp{
+		target: opts.Counts[0],
+		max:    opts.Counts[len(opts.Counts)-1],
+	}
+	if opts.searching() {
+		r.max = max(r.max, opts.limit())
+	}
+	return r
+}
+
+func (r *curveRamp) Target(time.Duration) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.target
+}
+
+func (r *curveRamp) Max() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.max
+}
+
+// hold moves the ramp on to the next count.
+func (r *curveRamp) hold(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.target = count
+}
+
+// stop stops the ramp adding databases.
+func (r *curveRamp) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.max = r.target
+}
+
+func (r *curveRamp) String() string {
+	return "curve"
+}
+
+func (o CurveOpts) limit() int {
+	if o.Limit > 0 {
+		return o.Limit
+	}
+	return MaxNumberOfDatabases
+}
+
+// next returns the count to measure after the i'th, or false if the curve
+// is complete.
+func (o CurveOpts) next(i, count int) (int, bool) {
+	if i+1 < len(o.Counts) {
+		return o.Counts[i+1], true
+	}
+	if !o.searching() || count >= o.limit() {
+		return 0, false
+	}
+	growth := o.Growth
+	if growth <= 1 {
+		growth = 2
+	}
+	return min(max(int(float64(count)*growth), count+1), o.limit()), true
+}
+
+// runCurve measures the scenario at each count of its curve, moving the ramp
+// on to the next count once done, then prints the curve and stops the
+// scenario. With breaking point detection it stops at the first count that
+// breaks the limits.
+func runCurve(s *Scenario, ramp *curveRamp) {
+	opts := s.opts.Curve
+	if opts.Settle <= 0 {
+		opts.Settle = 30 * time.Second
+	}
+	if opts.Hold <= 0 {
+		opts.Hold = 2 * time.Minute
+	}
+
+	t := &s.tomb
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-t.Dying():
+			return false
+		}
+	}
+	ownStats := func() (map[opKey]*histogramAgg, error) {
+		all, err := gatherHistograms()
+		if err != nil {
+			return nil, err
+		}
+		own := make(map[opKey]*histogramAgg)
+		for k, h := range all {
+			if k.scenario == s.name {
+				own[k] = h
+			}
+		}
+		return own, nil
+	}
+
+	safeGo(t, func() error {
+		count := opts.Counts[0]
+		for i := 0; ; i++ {
+			for len(s.DBs()) < count {
+				if !wait(time.Second) {
+					return nil
+				}
+			}
+			if !wait(opts.Settle) {
+				return nil
+			}
+			before, err := ownStats()
+			if err != nil {
+				return err
+			}
+			started := time.Now()
+			if !wait(opts.Hold) {
+				return nil
+			}
+			after, err := ownStats()
+			if err != nil {
+				return err
+			}
+			held := time.Since(started)
+
+			window := make(map[opKey]*histogramAgg, len(after))
+			total := &histogramAgg{buckets: make(map[float64]uint64)}
+			for k, h := range after {
+				w := h.since(before[k])
+				window[k] = w
+				total.add(w)
+			}
+			p := CurvePoint{
+				DBs:        count,
+				Throughput: float64(total.count) / held.Seconds(),
+				P99:        total.quantile(0.99),
+				Errors:     total.errors,
+				Ops:        opStats(window),
+			}
+			if total.count > 0 {
+				p.Mean = seconds(total.sum / float64(total.count))
+			}
+			p.Broken = opts.broken(p)
+			s.mu.Lock()
+			s.curve = append(s.curve, p)
+			s.mu.Unlock()
+			s.recordEvent("curve", "%d dbs: %.1f ops/s, mean %s, p99 %s, %d errors",
+				p.DBs, p.Throughput, p.Mean, p.P99, p.Errors)
+			if p.Broken != "" {
+				s.recordEvent("curve", "breaking point at %d dbs: %s", p.DBs, p.Broken)
+				break
+			}
+
+			next, ok := opts.next(i, count)
+			if !ok {
+				break
+			}
+			count = next
+			ramp.hold(count)
+		}
+		ramp.stop()
+		if err := printCurve(os.Stdout, s); err != nil {
+			scenarioLog(s, "curve").Error("reporting curve", "err", err)
+		}
+		t.Kill(nil)
+		return nil
+	})
+}
+
+// Curve returns the points of the scaling curve measured so far.
+func (s *Scenario) Curve() []CurvePoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CurvePoint(nil), s.curve...)
+}
+
+// Knee returns the largest number of databases measured that kept within
+// the limits of breaking point detection, or zero if none did or no limit
+// was broken.
+func (s *Scenario) Knee() int {
+	curve := s.Curve()
+	if len(curve) == 0 || curve[len(curve)-1].Broken == "" {
+		return 0
+	}
+	knee := 0
+	for _, p := range curve {
+		if p.Broken == "" {
+			knee = p.DBs
+		}
+	}
+	return knee
+}
+
+// printCurve writes the scaling curve of the scenario, and its knee if it
+// reached its breaking point.
+func printCurve(w io.Writer, s *Scenario) error {
+	metadata := s.Metadata()
+	fmt.Fprintf(w, "scenario %s scaling curve (%s on %s):\n", s.Name(), metadata["wrapper"], metadata["provider"])
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DBS\tOPS/S\tMEAN\tP99\tERRORS\tBROKEN")
+	curve := s.Curve()
+	for _, p := range curve {
+		fmt.Fprintf(tw, "%d\t%.1f\t%s\t%s\t%d\t%s\n", p.DBs, p.Throughput, p.Mean, p.P99, p.Errors, p.Broken)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(curve) > 0 && curve[len(curve)-1].Broken != "" {
+		if knee := s.Knee(); knee > 0 {
+			fmt.Fprintf(w, "knee at %d dbs, broke at %d dbs\n", knee, curve[len(curve)-1].DBs)
+		} else {
+			fmt.Fprintf(w, "broke at the first count, %d dbs\n", curve[0].DBs)
+		}
+	} else if s.opts.Curve.searching() && len(curve) > 0 {
+		fmt.Fprintf(w, "no breaking point up to %d dbs\n", curve[len(curve)-1].DBs)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// UUIDBatchSize is how many UUIDs a UUIDPool generates at a time.
+	UUIDBatchSize = 256
+	// UUIDPoolBatches is how many batches the default pool keeps ready,
+	// enough to seed a full ramp step of databases without waiting.
+	UUIDPoolBatches = 128
+)
+
+// UUIDPool hands out UUIDs generated ahead of time by a background
+// goroutine, so that the operations using them do not pay for generating
+// them while they are timed.
+type UUIDPool struct {
+	batches chan []string
+
+	mu    sync.Mutex
+	spare []string
+	// misses counts the times the pool had no UUIDs ready, and they were
+	// generated inline.
+	misses atomic.Int64
+}
+
+// NewUUIDPool starts generating batches of UUIDs, keeping up to the given
+// number of batches ready.
+func NewUUIDPool(batches int) *UUIDPool {
+	p := &UUIDPool{batches: make(chan []string, batches)}
+	go func() {
+		for {
+			p.batches <- generateUUIDs(UUIDBatchSize)
+		}
+	}()
+	return p
+}
+
+var (
+	defaultUUIDPoolOnce sync.Once
+	defaultUUIDPool     *UUIDPool
+)
+
+// DefaultUUIDPool returns the pool the default operations take their UUIDs
+// from, starting it the first time.
+func DefaultUUIDPool() *UUIDPool {
+	defaultUUIDPoolOnce.Do(func() {
+		defaultUUIDPool = NewUUIDPool(UUIDPoolBatches)
+	})
+	return defaultUUIDPool
+}
+
+// Take returns n UUIDs. If the pool has fallen behind, those it does not
+// have ready are generated inline.
+func (p *UUIDPool) Take(n int) []string {
+	uuids := make([]string, 0, n)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(uuids) < n {
+		if len(p.spare) == 0 {
+			select {
+			case p.spare = <-p.batches:
+			default:
+				p.misses.Add(1)
+				p.spare = generateUUIDs(n - len(uuids))
+			}
+		}
+		k := min(n-len(uuids), len(p.spare))
+		uuids = append(uuids, p.spare[:k]...)
+		p.spare = p.spare[k:]
+	}
+	return uuids
+}
+
+// Misses returns the number of times the pool had no UUIDs ready.
+func (p *UUIDPool) Misses() int64 {
+	return p.misses.Load()
+}
+
+// generateUUIDs returns n time based UUIDs, as agents have always been
+// seeded with, falling back to random ones if the clock cannot be read.
+func generateUUIDs(n int) []string {
+	uuids := make([]string, n)
+	for i := range uuids {
+		id, err := uuid.NewUUID()
+		if err != nil {
+			id = uuid.New()
+		}
+		uuids[i] = id.String()
+	}
+	return uuids
+}
@@ -0,0 +1,1205 @@
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/sqlair"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/collections/transform"
+	"gorm.io/gorm"
+)
+
+// DB is a database the operations run against. Every call takes a context
+// that bounds it and carries the labels of the operation, and returns what
+// it did alongside its error.
+type DB interface {
+	Name() string
+	SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error)
+	// UpdateModelAgentStatus sets the status of the given agents.
+	UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error)
+	// GenerateAgentEvents inserts an event for each of the given agents.
+	GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error)
+	CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error)
+	// AgentUUIDs returns the agents of the model in the order they were
+	// seeded.
+	AgentUUIDs(ctx context.Context) ([]string, OpResult, error)
+	AgentModelCount(ctx context.Context) (int, OpResult, error)
+	AgentEventModelCount(ctx context.Context) (int, OpResult, error)
+	// OrphanedAgentEventCount counts the events whose agent does not
+	// exist. Foreign keys are not enforced, so nothing but the
+	// operations stops them from being left behind.
+	OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error)
+	// IncrementVersion reads the version of the database and writes it
+	// back incremented, in separate statements, so that concurrent
+	// increments outside of a transaction can be lost.
+	IncrementVersion(ctx context.Context) (OpResult, error)
+	// LogOperation records that the logical operation of the given id
+	// was applied.
+	LogOperation(ctx context.Context, id string) (OpResult, error)
+	Close() error
+}
+
+// OpResult is what an operation did to the database.
+type OpResult struct {
+	// RowsAffected counts the rows written.
+	RowsAffected int64
+	// RowsScanned counts the rows read.
+	RowsScanned int64
+	// FirstRowTime is how long reads took from issuing their query to
+	// their first row being available, and ScanTime how long from then
+	// until every row had been scanned. Both are zero if nothing was
+	// read.
+	FirstRowTime time.Duration
+	ScanTime     time.Duration
+}
+
+// Add returns the sum of the results.
+func (r OpResult) Add(other OpResult) OpResult {
+	return OpResult{
+		RowsAffected: r.RowsAffected + other.RowsAffected,
+		RowsScanned:  r.RowsScanned + other.RowsScanned,
+		FirstRowTime: r.FirstRowTime + other.FirstRowTime,
+		ScanTime:     r.ScanTime + other.ScanTime,
+	}
+}
+
+// scanTiming times a read, splitting the time until its first row is
+// available from the time spent scanning its rows.
+type scanTiming struct {
+	start, firstRow time.Time
+	rows            int64
+}
+
+// startScan starts timing a read. It is called before the query is issued.
+func startScan() scanTiming {
+	return scanTiming{start: time.Now()}
+}
+
+// row notes that a row is available, before it is scanned.
+func (t *scanTiming) row() {
+	if t.rows == 0 {
+		t.firstRow = time.Now()
+	}
+	t.rows++
+}
+
+// done returns the result of the read once every row has been scanned.
+func (t *scanTiming) done() OpResult {
+	if t.rows == 0 {
+		return OpResult{}
+	}
+	return OpResult{
+		RowsScanned:  t.rows,
+		FirstRowTime: t.firstRow.Sub(t.start),
+		ScanTime:     time.Since(t.firstRow),
+	}
+}
+
+// execResult returns the rows affected by a statement. Drivers that cannot
+// tell report none.
+func execResult(res sql.Result) OpResult {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return OpResult{}
+	}
+	return OpResult{RowsAffected: n}
+}
+
+// outcomeResult returns the rows affected by a sqlair statement.
+func outcomeResult(outcome sqlair.Outcome) OpResult {
+	if outcome.Result() == nil {
+		return OpResult{}
+	}
+	return execResult(outcome.Result())
+}
+
+// PlainDB is a DB that gives access to the database underneath it, for
+// fault injection that works below the wrapper.
+type PlainDB interface {
+	PlainDB() *sql.DB
+}
+
+// SQLQuerySubstate can be a transaction or a db.
+type SQLQuerySubstrate interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}
+
+type SQLDB struct {
+	db     *sql.DB
+	name   string
+	runner SQLRunner
+	// stmts, if set, holds the statements prepared for the database, so
+	// that each query is parsed once rather than every time it runs.
+	stmts *stmtCache
+}
+
+func (db *SQLDB) Name() string {
+	return db.name
+}
+
+func (db *SQLDB) Close() error {
+	if db.stmts != nil {
+		db.stmts.close()
+	}
+	return db.db.Close()
+}
+
+// run runs fn with the runner, through the database's prepared statements
+// if it has them.
+func (db *SQLDB) run(ctx context.Context, fn func(SQLQuerySubstrate) error) error {
+	if db.stmts == nil {
+		return db.runner(ctx, db.db, fn)
+	}
+	return db.runner(ctx, db.db, func(qs SQLQuerySubstrate) error {
+		return fn(preparedSubstrate{qs: qs, stmts: db.stmts})
+	})
+}
+
+// stmtCache prepares each query run against a database once, and reuses the
+// statement from then on.
+type stmtCache struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// prepare returns the statement for the query, preparing it the first time.
+func (c *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, stmt := range c.stmts {
+		_ = stmt.Close()
+		delete(c.stmts, query)
+	}
+}
+
+// preparedSubstrate runs queries through the prepared statements of a
+// database, within the transaction if qs is one.
+type preparedSubstrate struct {
+	qs    SQLQuerySubstrate
+	stmts *stmtCache
+}
+
+func (p preparedSubstrate) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := p.stmts.prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if tx, ok := p.qs.(*sql.Tx); ok {
+		return tx.StmtContext(ctx, stmt), nil
+	}
+	return stmt, nil
+}
+
+func (p preparedSubstrate) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (p preparedSubstrate) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := p.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (db *SQLDB) PlainDB() *sql.DB {
+	return db.db
+}
+
+func (db *SQLDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		var insertStrings []string
+		for i := 0; i < len(agentUUIDs)/3; i++ {
+			insertStrings = append(insertStrings, "(?, ?, ?)")
+		}
+		res, err := qs.ExecContext(ctx, "INSERT INTO agent VALUES "+strings.Join(insertStrings, ","),
+			agentUUIDs...)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		args := transform.Slice(agentUUIDs, func(uuid string) any { return uuid })
+		res, err := qs.ExecContext(ctx, "UPDATE agent SET status = '"+status+"' WHERE uuid IN ("+SliceToPlaceholder(args)+")",
+			args...)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		args := make([]any, 0, len(agentUUIDs)*2)
+		insertStrings := make([]string, 0, len(agentUUIDs))
+		for _, agentUUID := range agentUUIDs {
+			args = append(args, agentUUID, "event")
+			insertStrings = append(insertStrings, "(?, ?)")
+		}
+
+		res, err := qs.ExecContext(ctx, "INSERT INTO agent_events VALUES "+strings.Join(insertStrings, ","),
+			args...)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		// delete from agent_events where agent_uuid in (select agent_uuid from agent_events group by agent_uuid having count(*) > 1
+		res, err := qs.ExecContext(ctx, "DELETE FROM agent_events WHERE agent_uuid IN (SELECT agent_uuid from agent_events INNER JOIN agent ON agent.uuid = agent_events.agent_uuid WHERE agent.model_name = ? GROUP BY agent_uuid HAVING COUNT(*) > ?)",
+			db.Name(), maxEvents)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent
+		WHERE model_name = ?
+		`, db.Name())
+}
+
+func (db *SQLDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		INNER JOIN agent ON agent.uuid = agent_events.agent_uuid
+		WHERE agent.model_name = ?
+		`, db.Name())
+}
+
+func (db *SQLDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		agentUUIDs = nil
+		timing := startScan()
+		rows, err := qs.QueryContext(ctx, "SELECT uuid FROM agent WHERE model_name = ? ORDER BY rowid", db.Name())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			timing.row()
+			var agentUUID string
+			if err := rows.Scan(&agentUUID); err != nil {
+				return err
+			}
+			agentUUIDs = append(agentUUIDs, agentUUID)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return agentUUIDs, result, err
+}
+
+func (db *SQLDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		WHERE agent_uuid NOT IN (SELECT uuid FROM agent)
+		`)
+}
+
+// count runs a query returning a single count.
+func (db *SQLDB) count(ctx context.Context, query string, args ...any) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		count = 0
+		timing := startScan()
+		rows, err := qs.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if rows.Next() {
+			timing.row()
+			if err := rows.Scan(&count); err != nil {
+				return err
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return count, result, err
+}
+
+func (db *SQLDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		rows, err := qs.QueryContext(ctx, "SELECT version FROM version WHERE id = 1")
+		if err != nil {
+			return err
+		}
+		var version int
+		var scanned int64
+		if rows.Next() {
+			err = rows.Scan(&version)
+			scanned++
+		}
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		res, err := qs.ExecContext(ctx, "UPDATE version SET version = ? WHERE id = 1", version+1)
+		if err != nil {
+			return err
+		}
+		result = execResult(res).Add(OpResult{RowsScanned: scanned})
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs SQLQuerySubstrate) error {
+		res, err := qs.ExecContext(ctx, "INSERT INTO operation_log VALUES (?)", id)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func SliceToPlaceholder[T any](in []T) string {
+	return strings.Join(transform.Slice(in, func(item T) string { return "?" }), ",")
+}
+
+// SQLairQuerySubstate can be a transaction or a db.
+type SQLairQuerySubstrate interface {
+	Query(context.Context, *sqlair.Statement, ...any) *sqlair.Query
+}
+
+type SQLairDB struct {
+	db     *sqlair.DB
+	name   string
+	runner SQLairRunner
+	// stmts, if set, holds the statements prepared for the database, so
+	// that each query is prepared once rather than every time it runs.
+	stmts *sqlairStmtCache
+}
+
+func (db *SQLairDB) Name() string {
+	return db.name
+}
+
+func (db *SQLairDB) Close() error {
+	return db.db.PlainDB().Close()
+}
+
+func (db *SQLairDB) PlainDB() *sql.DB {
+	return db.db.PlainDB()
+}
+
+// prepare returns the statement for the query, from the database's
+// prepared statements if it has them.
+func (db *SQLairDB) prepare(query string, typeSamples ...any) (*sqlair.Statement, error) {
+	if db.stmts == nil {
+		return sqlair.Prepare(query, typeSamples...)
+	}
+	return db.stmts.prepare(query, typeSamples...)
+}
+
+// sqlairStmtCache prepares each query run against a database once, and
+// reuses the statement from then on. Statements are keyed by the query
+// alone, as every query is prepared with the same type samples each time.
+type sqlairStmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sqlair.Statement
+}
+
+func newSQLairStmtCache() *sqlairStmtCache {
+	return &sqlairStmtCache{
+		stmts: make(map[string]*sqlair.Statement),
+	}
+}
+
+// prepare returns the statement for the query, preparing it the first time.
+func (c *sqlairStmtCache) prepare(query string, typeSamples ...any) (*sqlair.Statement, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := sqlair.Prepare(query, typeSamples...)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (db *SQLairDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		m := sqlair.M{}
+		var insertStrings []string
+		for i := 0; i < len(agentUUIDs)/3; i++ {
+			s := fmt.Sprintf("($M.id%d, $M.id%d, $M.id%d)", i*3, i*3+1, i*3+2)
+			insertStrings = append(insertStrings, s)
+			m["id"+strconv.Itoa(i*3)] = agentUUIDs[i*3]
+			m["id"+strconv.Itoa(i*3+1)] = agentUUIDs[i*3+1]
+			m["id"+strconv.Itoa(i*3+2)] = agentUUIDs[i*3+2]
+		}
+		stmt, err := db.prepare("INSERT INTO agent VALUES "+strings.Join(insertStrings, ","), sqlair.M{})
+		if err != nil {
+			return err
+		}
+		var outcome sqlair.Outcome
+		err = qs.Query(ctx, stmt, m).Get(&outcome)
+		if err != nil {
+			return err
+		}
+		result = outcomeResult(outcome)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLairDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		createTable, err := db.prepare("CREATE TEMPORARY TABLE temp_agent_uuids ( uuid INT )")
+		if err != nil {
+			return err
+		}
+		err = qs.Query(ctx, createTable).Run()
+		if err != nil {
+			return nil
+		}
+
+		insertUUID, err := db.prepare("INSERT INTO temp_agent_uuids VALUES ($M.uuid)", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		for _, agentUUID := range agentUUIDs {
+			// INSERT agentUUID into temp table.
+			err = qs.Query(ctx, insertUUID, sqlair.M{"uuid": agentUUID}).Run()
+			if err != nil {
+				return nil
+			}
+		}
+
+		updateStatus, err := db.prepare("UPDATE agent SET status = $M.status WHERE uuid IN (SELECT uuid FROM temp_agent_uuids)", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		var outcome sqlair.Outcome
+		err = qs.Query(ctx, updateStatus, sqlair.M{"status": status}).Get(&outcome)
+		if err != nil {
+			return err
+		}
+		result = outcomeResult(outcome)
+
+		dropTable, err := db.prepare("DROP TABLE temp.temp_agent_uuids")
+		if err != nil {
+			return err
+		}
+		return qs.Query(ctx, dropTable).Run()
+	})
+	return result, err
+}
+
+func (db *SQLairDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		insertAgentStrings, err := db.prepare("INSERT INTO agent_events VALUES ($M.uuid, $M.event)", sqlair.M{})
+		if err != nil {
+			return err
+		}
+
+		result = OpResult{}
+		for _, agentUUID := range agentUUIDs {
+			var outcome sqlair.Outcome
+			err := qs.Query(ctx, insertAgentStrings, sqlair.M{"uuid": agentUUID, "event": "event"}).Get(&outcome)
+			if err != nil {
+				return err
+			}
+			result = result.Add(outcomeResult(outcome))
+		}
+
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLairDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		cullAgents, err := db.prepare("DELETE FROM agent_events WHERE agent_uuid IN (SELECT agent_uuid from agent_events INNER JOIN agent ON agent.uuid = agent_events.agent_uuid WHERE agent.model_name = $M.name GROUP BY agent_uuid HAVING COUNT(*) > $M.maxEvents)", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		var outcome sqlair.Outcome
+		err = qs.Query(ctx, cullAgents, sqlair.M{"maxEvents": maxEvents, "name": db.Name()}).Get(&outcome)
+		if err != nil {
+			return err
+		}
+		result = outcomeResult(outcome)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLairDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+			SELECT &M.c FROM (
+			SELECT count(*) AS c
+			FROM agent
+			WHERE model_name = $M.name)
+		`, sqlair.M{"name": db.Name()})
+}
+
+func (db *SQLairDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+			SELECT &M.c FROM (
+			SELECT count(*) AS c
+			FROM agent_events
+			INNER JOIN agent ON agent.uuid = agent_events.agent_uuid
+			WHERE agent.model_name = $M.name)
+			`, sqlair.M{"name": db.Name()})
+}
+
+func (db *SQLairDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		agentUUIDs = nil
+		selectUUIDs, err := db.prepare("SELECT &M.uuid FROM agent WHERE model_name = $M.name ORDER BY rowid", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		timing := startScan()
+		iter := qs.Query(ctx, selectUUIDs, sqlair.M{"name": db.Name()}).Iter()
+		for iter.Next() {
+			timing.row()
+			m := sqlair.M{}
+			if err := iter.Get(m); err != nil {
+				_ = iter.Close()
+				return err
+			}
+			agentUUIDs = append(agentUUIDs, m["uuid"].(string))
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return agentUUIDs, result, err
+}
+
+func (db *SQLairDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+			SELECT &M.c FROM (
+			SELECT count(*) AS c
+			FROM agent_events
+			WHERE agent_uuid NOT IN (SELECT uuid FROM agent))
+			`)
+}
+
+// count runs a query returning a single count as M.c. The query is iterated
+// rather than read with Get, so that scanning it can be timed apart from
+// running it.
+func (db *SQLairDB) count(ctx context.Context, query string, args ...any) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		count = 0
+		stmt, err := db.prepare(query, sqlair.M{})
+		if err != nil {
+			return err
+		}
+		timing := startScan()
+		iter := qs.Query(ctx, stmt, args...).Iter()
+		if iter.Next() {
+			timing.row()
+			m := sqlair.M{}
+			if err := iter.Get(m); err != nil {
+				_ = iter.Close()
+				return err
+			}
+			count = int(m["c"].(int64))
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return count, result, err
+}
+
+func (db *SQLairDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		getVersion, err := db.prepare("SELECT &M.version FROM version WHERE id = 1", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		m := sqlair.M{}
+		if err := qs.Query(ctx, getVersion).Get(m); err != nil {
+			return err
+		}
+		setVersion, err := db.prepare("UPDATE version SET version = $M.version WHERE id = 1", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		var outcome sqlair.Outcome
+		if err := qs.Query(ctx, setVersion, sqlair.M{"version": m["version"].(int64) + 1}).Get(&outcome); err != nil {
+			return err
+		}
+		result = outcomeResult(outcome).Add(OpResult{RowsScanned: 1})
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLairDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLairQuerySubstrate) error {
+		logOperation, err := db.prepare("INSERT INTO operation_log VALUES ($M.id)", sqlair.M{})
+		if err != nil {
+			return err
+		}
+		var outcome sqlair.Outcome
+		if err := qs.Query(ctx, logOperation, sqlair.M{"id": id}).Get(&outcome); err != nil {
+			return err
+		}
+		result = outcomeResult(outcome)
+		return nil
+	})
+	return result, err
+}
+
+// SQLairPreparedDB runs the operations through sqlair like SQLairDB, but
+// prepares each statement once and reuses it across operation runs, to
+// measure what reusing sqlair statements saves.
+type SQLairPreparedDB struct {
+	*SQLairDB
+}
+
+// SQLXQuerySubstrate can be a transaction or a db.
+type SQLXQuerySubstrate interface {
+	sqlx.ExtContext
+}
+
+// sqlxAgent is a row of the agent table, mapped by sqlx.
+type sqlxAgent struct {
+	UUID      string `db:"uuid"`
+	ModelName string `db:"model_name"`
+	Status    string `db:"status"`
+}
+
+// sqlxAgentEvent is a row of the agent_events table, mapped by sqlx.
+type sqlxAgentEvent struct {
+	AgentUUID string `db:"agent_uuid"`
+	Event     string `db:"event"`
+}
+
+// SQLXDB runs the operations through sqlx, using its named parameters,
+// struct mapping and slice expansion where the other wrappers build their
+// queries by hand.
+type SQLXDB struct {
+	db     *sqlx.DB
+	name   string
+	runner SQLXRunner
+}
+
+func (db *SQLXDB) Name() string {
+	return db.name
+}
+
+func (db *SQLXDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *SQLXDB) PlainDB() *sql.DB {
+	return db.db.DB
+}
+
+func (db *SQLXDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		agents := make([]sqlxAgent, 0, len(agentUUIDs)/3)
+		for i := 0; i < len(agentUUIDs)/3; i++ {
+			agents = append(agents, sqlxAgent{
+				UUID:      agentUUIDs[i*3].(string),
+				ModelName: agentUUIDs[i*3+1].(string),
+				Status:    agentUUIDs[i*3+2].(string),
+			})
+		}
+		res, err := sqlx.NamedExecContext(ctx, qs, "INSERT INTO agent (uuid, model_name, status) VALUES (:uuid, :model_name, :status)", agents)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLXDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		query, args, err := sqlx.In("UPDATE agent SET status = ? WHERE uuid IN (?)", status, agentUUIDs)
+		if err != nil {
+			return err
+		}
+		res, err := qs.ExecContext(ctx, qs.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLXDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		events := make([]sqlxAgentEvent, 0, len(agentUUIDs))
+		for _, agentUUID := range agentUUIDs {
+			events = append(events, sqlxAgentEvent{AgentUUID: agentUUID, Event: "event"})
+		}
+		res, err := sqlx.NamedExecContext(ctx, qs, "INSERT INTO agent_events (agent_uuid, event) VALUES (:agent_uuid, :event)", events)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLXDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		res, err := sqlx.NamedExecContext(ctx, qs, "DELETE FROM agent_events WHERE agent_uuid IN (SELECT agent_uuid from agent_events INNER JOIN agent ON agent.uuid = agent_events.agent_uuid WHERE agent.model_name = :name GROUP BY agent_uuid HAVING COUNT(*) > :max_events)",
+			map[string]any{"name": db.Name(), "max_events": maxEvents})
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLXDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent
+		WHERE model_name = ?
+		`, db.Name())
+}
+
+func (db *SQLXDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		INNER JOIN agent ON agent.uuid = agent_events.agent_uuid
+		WHERE agent.model_name = ?
+		`, db.Name())
+}
+
+func (db *SQLXDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		agentUUIDs = nil
+		timing := startScan()
+		rows, err := qs.QueryxContext(ctx, qs.Rebind("SELECT uuid FROM agent WHERE model_name = ? ORDER BY rowid"), db.Name())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			timing.row()
+			var agent sqlxAgent
+			if err := rows.StructScan(&agent); err != nil {
+				return err
+			}
+			agentUUIDs = append(agentUUIDs, agent.UUID)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return agentUUIDs, result, err
+}
+
+func (db *SQLXDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		WHERE agent_uuid NOT IN (SELECT uuid FROM agent)
+		`)
+}
+
+// count runs a query returning a single count. The query is iterated rather
+// than read with Get, so that scanning it can be timed apart from running
+// it.
+func (db *SQLXDB) count(ctx context.Context, query string, args ...any) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		count = 0
+		timing := startScan()
+		rows, err := qs.QueryxContext(ctx, qs.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if rows.Next() {
+			timing.row()
+			if err := rows.Scan(&count); err != nil {
+				return err
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return count, result, err
+}
+
+func (db *SQLXDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		var version int
+		if err := sqlx.GetContext(ctx, qs, &version, "SELECT version FROM version WHERE id = 1"); err != nil {
+			return err
+		}
+		res, err := qs.ExecContext(ctx, qs.Rebind("UPDATE version SET version = ? WHERE id = 1"), version+1)
+		if err != nil {
+			return err
+		}
+		result = execResult(res).Add(OpResult{RowsScanned: 1})
+		return nil
+	})
+	return result, err
+}
+
+func (db *SQLXDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := db.runner(ctx, db.db, func(qs SQLXQuerySubstrate) error {
+		res, err := qs.ExecContext(ctx, qs.Rebind("INSERT INTO operation_log VALUES (?)"), id)
+		if err != nil {
+			return err
+		}
+		result = execResult(res)
+		return nil
+	})
+	return result, err
+}
+
+// gormAgent is a row of the agent table, as a GORM model.
+type gormAgent struct {
+	UUID      string `gorm:"column:uuid;primaryKey"`
+	ModelName string `gorm:"column:model_name"`
+	Status    string `gorm:"column:status"`
+}
+
+func (gormAgent) TableName() string {
+	return "agent"
+}
+
+// gormAgentEvent is a row of the agent_events table, as a GORM model.
+type gormAgentEvent struct {
+	AgentUUID string `gorm:"column:agent_uuid"`
+	Event     string `gorm:"column:event"`
+}
+
+func (gormAgentEvent) TableName() string {
+	return "agent_events"
+}
+
+// gormVersion is the row of the version table, as a GORM model.
+type gormVersion struct {
+	ID      int `gorm:"column:id;primaryKey"`
+	Version int `gorm:"column:version"`
+}
+
+func (gormVersion) TableName() string {
+	return "version"
+}
+
+// gormOperation is a row of the operation_log table, as a GORM model.
+type gormOperation struct {
+	ID string `gorm:"column:id"`
+}
+
+func (gormOperation) TableName() string {
+	return "operation_log"
+}
+
+// GormDB runs the operations through the GORM models of the tables, so that
+// the overhead of a full ORM can be compared with sqlair's.
+type GormDB struct {
+	db     *gorm.DB
+	sqldb  *sql.DB
+	name   string
+	runner GormRunner
+	// err is why the database could not be opened with GORM, returned by
+	// every operation.
+	err error
+}
+
+func (db *GormDB) Name() string {
+	return db.name
+}
+
+func (db *GormDB) Close() error {
+	return db.sqldb.Close()
+}
+
+func (db *GormDB) PlainDB() *sql.DB {
+	return db.sqldb
+}
+
+// run runs fn with the runner, once the database has been opened.
+func (db *GormDB) run(ctx context.Context, fn func(*gorm.DB) error) error {
+	if db.err != nil {
+		return db.err
+	}
+	return db.runner(ctx, db.db, fn)
+}
+
+func (db *GormDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		agents := make([]gormAgent, 0, len(agentUUIDs)/3)
+		for i := 0; i < len(agentUUIDs)/3; i++ {
+			agents = append(agents, gormAgent{
+				UUID:      agentUUIDs[i*3].(string),
+				ModelName: agentUUIDs[i*3+1].(string),
+				Status:    agentUUIDs[i*3+2].(string),
+			})
+		}
+		res := qs.Create(&agents)
+		result = OpResult{RowsAffected: res.RowsAffected}
+		return res.Error
+	})
+	return result, err
+}
+
+func (db *GormDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		res := qs.Model(&gormAgent{}).Where("uuid IN ?", agentUUIDs).Update("status", status)
+		result = OpResult{RowsAffected: res.RowsAffected}
+		return res.Error
+	})
+	return result, err
+}
+
+func (db *GormDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		events := make([]gormAgentEvent, 0, len(agentUUIDs))
+		for _, agentUUID := range agentUUIDs {
+			events = append(events, gormAgentEvent{AgentUUID: agentUUID, Event: "event"})
+		}
+		res := qs.Create(&events)
+		result = OpResult{RowsAffected: res.RowsAffected}
+		return res.Error
+	})
+	return result, err
+}
+
+func (db *GormDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		culled := qs.Model(&gormAgentEvent{}).
+			Select("agent_uuid").
+			Joins("INNER JOIN agent ON agent.uuid = agent_events.agent_uuid").
+			Where("agent.model_name = ?", db.Name()).
+			Group("agent_uuid").
+			Having("COUNT(*) > ?", maxEvents)
+		res := qs.Where("agent_uuid IN (?)", culled).Delete(&gormAgentEvent{})
+		result = OpResult{RowsAffected: res.RowsAffected}
+		return res.Error
+	})
+	return result, err
+}
+
+func (db *GormDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, func(qs *gorm.DB) *gorm.DB {
+		return qs.Model(&gormAgent{}).Where("model_name = ?", db.Name())
+	})
+}
+
+func (db *GormDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, func(qs *gorm.DB) *gorm.DB {
+		return qs.Model(&gormAgentEvent{}).
+			Joins("INNER JOIN agent ON agent.uuid = agent_events.agent_uuid").
+			Where("agent.model_name = ?", db.Name())
+	})
+}
+
+func (db *GormDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		agentUUIDs = nil
+		timing := startScan()
+		rows, err := qs.Model(&gormAgent{}).Select("uuid").Where("model_name = ?", db.Name()).Order("rowid").Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			timing.row()
+			var agent gormAgent
+			if err := qs.ScanRows(rows, &agent); err != nil {
+				return err
+			}
+			agentUUIDs = append(agentUUIDs, agent.UUID)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return agentUUIDs, result, err
+}
+
+func (db *GormDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, func(qs *gorm.DB) *gorm.DB {
+		return qs.Model(&gormAgentEvent{}).Where("agent_uuid NOT IN (?)", qs.Model(&gormAgent{}).Select("uuid"))
+	})
+}
+
+// count counts the rows of the query built by query. The rows are iterated
+// rather than read with Count, so that scanning them can be timed apart from
+// running the query.
+func (db *GormDB) count(ctx context.Context, query func(*gorm.DB) *gorm.DB) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		count = 0
+		timing := startScan()
+		rows, err := query(qs).Select("count(*)").Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if rows.Next() {
+			timing.row()
+			if err := rows.Scan(&count); err != nil {
+				return err
+			}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return count, result, err
+}
+
+func (db *GormDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		var version gormVersion
+		if err := qs.First(&version, 1).Error; err != nil {
+			return err
+		}
+		res := qs.Model(&version).Update("version", version.Version+1)
+		result = OpResult{RowsAffected: res.RowsAffected, RowsScanned: 1}
+		return res.Error
+	})
+	return result, err
+}
+
+func (db *GormDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(qs *gorm.DB) error {
+		res := qs.Create(&gormOperation{ID: id})
+		result = OpResult{RowsAffected: res.RowsAffected}
+		return res.Error
+	})
+	return result, err
+}
@@ -0,0 +1,946 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/mattn/go-sqlite3"
+)
+
+type DBProvider interface {
+	// NewDB creates a database with the benchmark schema.
+	NewDB(name string) (*sql.DB, error)
+	// OpenDB opens a database previously created by NewDB.
+	OpenDB(name string) (*sql.DB, error)
+}
+
+// ErrNotPersistent is returned when opening an existing database with a
+// provider that does not keep databases beyond the life of the process.
+var ErrNotPersistent = errors.New("provider databases are not persistent")
+
+// SQLiteDSNOpts are the go-sqlite3 driver options the databases of a SQLite
+// provider are opened with. Zero values leave the driver's defaults, so
+// that the locking regime of production, such as Juju's immediate
+// transactions with a busy timeout, can be measured as well as the driver's.
+// The in-memory databases of SQLiteDBProvider share a cache between their
+// connections, whose table locks fail at once rather than waiting out the
+// busy timeout, so immediate transactions against them fail under
+// contention; the production regime needs SQLiteFileDBProvider.
+type SQLiteDSNOpts struct {
+	// BusyTimeout is how long a connection waits for a lock before
+	// failing with SQLITE_BUSY, as _busy_timeout.
+	BusyTimeout time.Duration
+	// TxLock is the lock transactions take when they begin, deferred,
+	// immediate or exclusive, as _txlock.
+	TxLock string
+	// Journal is the journal mode, such as WAL, as _journal.
+	Journal string
+	// ForeignKeys enforces foreign keys, as _fk.
+	ForeignKeys bool
+	// Synchronous is how often SQLite syncs to disk, OFF, NORMAL, FULL
+	// or EXTRA, as _sync.
+	Synchronous string
+	// CacheSize is the size of the page cache of each connection, in
+	// pages if positive or in KiB if negative, as _cache_size.
+	CacheSize int
+	// MmapSize is how many bytes of the database are read through memory
+	// mapped I/O. The driver has no parameter for it, so it is set with
+	// a pragma as each connection opens.
+	MmapSize int64
+}
+
+// Validate checks the options are ones the driver accepts.
+func (o SQLiteDSNOpts) Validate() error {
+	switch o.TxLock {
+	case "", "deferred", "immediate", "exclusive":
+	default:
+		return fmt.Errorf("sqlite txlock %q is not deferred, immediate or exclusive", o.TxLock)
+	}
+	switch strings.ToUpper(o.Journal) {
+	case "", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return fmt.Errorf("sqlite journal mode %q is not DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF", o.Journal)
+	}
+	switch strings.ToUpper(o.Synchronous) {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return fmt.Errorf("sqlite synchronous %q is not OFF, NORMAL, FULL or EXTRA", o.Synchronous)
+	}
+	if o.BusyTimeout < 0 {
+		return fmt.Errorf("sqlite busy timeout %s is negative", o.BusyTimeout)
+	}
+	if o.MmapSize < 0 {
+		return fmt.Errorf("sqlite mmap size %d is negative", o.MmapSize)
+	}
+	return nil
+}
+
+// Params returns the options as DSN query parameters, without a leading
+// separator.
+func (o SQLiteDSNOpts) Params() string {
+	var params []string
+	if o.BusyTimeout > 0 {
+		params = append(params, "_busy_timeout="+strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	}
+	if o.TxLock != "" {
+		params = append(params, "_txlock="+o.TxLock)
+	}
+	if o.Journal != "" {
+		params = append(params, "_journal="+strings.ToUpper(o.Journal))
+	}
+	if o.ForeignKeys {
+		params = append(params, "_fk=1")
+	}
+	if o.Synchronous != "" {
+		params = append(params, "_sync="+strings.ToUpper(o.Synchronous))
+	}
+	if o.CacheSize != 0 {
+		params = append(params, "_cache_size="+strconv.Itoa(o.CacheSize))
+	}
+	return strings.Join(params, "&")
+}
+
+// driver returns a go-sqlite3 driver that sets the options the DSN cannot
+// on each connection it opens.
+func (o SQLiteDSNOpts) driver() *sqlite3.SQLiteDriver {
+	if o.MmapSize == 0 {
+		return &sqlite3.SQLiteDriver{}
+	}
+	pragma := "PRAGMA mmap_size = " + strconv.FormatInt(o.MmapSize, 10)
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(pragma, nil)
+			return err
+		},
+	}
+}
+
+// withParams appends the options to a DSN that already has a query.
+func (o SQLiteDSNOpts) withParams(dsn string) string {
+	if params := o.Params(); params != "" {
+		dsn += "&" + params
+	}
+	return dsn
+}
+
+// SQLiteDSNConfigurer is a DBProvider whose databases are opened with
+// go-sqlite3 driver options.
+type SQLiteDSNConfigurer interface {
+	DBProvider
+	// DSNOpts returns the options the databases are opened with.
+	DSNOpts() SQLiteDSNOpts
+	// WithDSNOpts returns a provider of the same databases opened with
+	// the given options instead.
+	WithDSNOpts(SQLiteDSNOpts) DBProvider
+}
+
+type SQLiteDBProvider struct {
+	dsnOpts SQLiteDSNOpts
+}
+
+func NewSQLiteDBProvider() *SQLiteDBProvider {
+	return &SQLiteDBProvider{}
+}
+
+// WithForeignKeys returns a provider whose databases enforce foreign keys.
+func (dbp *SQLiteDBProvider) WithForeignKeys() DBProvider {
+	fk := *dbp
+	fk.dsnOpts.ForeignKeys = true
+	return &fk
+}
+
+func (dbp *SQLiteDBProvider) EnforcesForeignKeys() bool {
+	return dbp.dsnOpts.ForeignKeys
+}
+
+func (dbp *SQLiteDBProvider) DSNOpts() SQLiteDSNOpts {
+	return dbp.dsnOpts
+}
+
+func (dbp *SQLiteDBProvider) WithDSNOpts(opts SQLiteDSNOpts) DBProvider {
+	p := *dbp
+	p.dsnOpts = opts
+	return &p
+}
+
+func (dbp *SQLiteDBProvider) NewDB(name string) (*sql.DB, error) {
+	dsn := dbp.dsnOpts.withParams("file:" + name + ".db?cache=shared&mode=memory")
+	connector, err := newMemoryConnector(dbp.dsnOpts.driver(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqldb := sql.OpenDB(connector)
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(providerSchema(dbp.dsnOpts.ForeignKeys)); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return sqldb, tx.Commit()
+}
+
+func (*SQLiteDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return nil, ErrNotPersistent
+}
+
+// memoryConnector opens connections to a shared in-memory SQLite database.
+// The database is lost once its last connection closes, which happens when
+// database/sql discards the connections of transactions whose context is
+// cancelled, so the connector holds a connection of its own until the pool
+// is closed.
+type memoryConnector struct {
+	driver driver.Driver
+	dsn    string
+	keep   driver.Conn
+}
+
+func newMemoryConnector(d driver.Driver, dsn string) (*memoryConnector, error) {
+	c := &memoryConnector{driver: d, dsn: dsn}
+	keep, err := c.Driver().Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c.keep = keep
+	return c, nil
+}
+
+func (c *memoryConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.Driver().Open(c.dsn)
+}
+
+func (c *memoryConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close releases the database once the pool has closed its connections.
+func (c *memoryConnector) Close() error {
+	return c.keep.Close()
+}
+
+// SQLiteFileDBProvider creates SQLite databases as files in a directory, so
+// that they outlive the process and are subject to the limits of the disk.
+type SQLiteFileDBProvider struct {
+	dir       string
+	syncDelay time.Duration
+	dsnOpts   SQLiteDSNOpts
+	// cleanup, if set, records the databases created so that they can be
+	// deleted when the provider is closed. It is shared by the copies
+	// made by WithDSNOpts and WithForeignKeys, which create databases in
+	// the same directory.
+	cleanup *fileCleanup
+}
+
+// fileCleanup records the databases a SQLiteFileDBProvider created.
+type fileCleanup struct {
+	mu    sync.Mutex
+	names map[string]bool
+	// removeDir also removes the directory, which was made for the run.
+	removeDir bool
+}
+
+// NewSQLiteFileDBProvider returns a provider of databases in dir, opened
+// with immediate transactions, a five second busy timeout and WAL
+// journaling. It creates dir if it does not exist.
+func NewSQLiteFileDBProvider(dir string) (*SQLiteFileDBProvider, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &SQLiteFileDBProvider{
+		dir: dir,
+		dsnOpts: SQLiteDSNOpts{
+			BusyTimeout: 5 * time.Second,
+			TxLock:      "immediate",
+			Journal:     "WAL",
+		},
+	}, nil
+}
+
+// NewTempSQLiteFileDBProvider returns a provider of databases in a new
+// temporary directory, which is removed with them when the provider is
+// closed.
+func NewTempSQLiteFileDBProvider() (*SQLiteFileDBProvider, error) {
+	dir, err := os.MkdirTemp("", "sqlair-bench-")
+	if err != nil {
+		return nil, err
+	}
+	dbp, err := NewSQLiteFileDBProvider(dir)
+	if err != nil {
+		return nil, err
+	}
+	dbp = dbp.WithCleanup()
+	dbp.cleanup.removeDir = true
+	return dbp, nil
+}
+
+// WithCleanup makes the provider delete the databases it creates when it
+// is closed. Databases that were already in the directory are left alone.
+func (dbp *SQLiteFileDBProvider) WithCleanup() *SQLiteFileDBProvider {
+	dbp.cleanup = &fileCleanup{names: make(map[string]bool)}
+	return dbp
+}
+
+// Close deletes the databases the provider created, if it cleans up after
+// itself. The databases must have been closed.
+func (dbp *SQLiteFileDBProvider) Close() error {
+	if dbp.cleanup == nil {
+		return nil
+	}
+	dbp.cleanup.mu.Lock()
+	names := dbp.cleanup.names
+	dbp.cleanup.names = make(map[string]bool)
+	dbp.cleanup.mu.Unlock()
+	var errs []error
+	for name := range names {
+		if err := dbp.RemoveDB(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if dbp.cleanup.removeDir {
+		if err := os.Remove(dbp.dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithSyncDelay makes every durable write to the databases take an extra
+// delay, to study how sensitive commits are to a slow disk.
+func (dbp *SQLiteFileDBProvider) WithSyncDelay(delay time.Duration) *SQLiteFileDBProvider {
+	dbp.syncDelay = delay
+	return dbp
+}
+
+// WithForeignKeys returns a provider of databases in the same directory
+// that enforce foreign keys.
+func (dbp *SQLiteFileDBProvider) WithForeignKeys() DBProvider {
+	fk := *dbp
+	fk.dsnOpts.ForeignKeys = true
+	return &fk
+}
+
+func (dbp *SQLiteFileDBProvider) EnforcesForeignKeys() bool {
+	return dbp.dsnOpts.ForeignKeys
+}
+
+func (dbp *SQLiteFileDBProvider) DSNOpts() SQLiteDSNOpts {
+	return dbp.dsnOpts
+}
+
+func (dbp *SQLiteFileDBProvider) WithDSNOpts(opts SQLiteDSNOpts) DBProvider {
+	p := *dbp
+	p.dsnOpts = opts
+	return &p
+}
+
+// Dir returns the directory the database files are in.
+func (dbp *SQLiteFileDBProvider) Dir() string {
+	return dbp.dir
+}
+
+func (dbp *SQLiteFileDBProvider) dsn(name, mode string) string {
+	return dbp.dsnOpts.withParams("file:" + filepath.Join(dbp.dir, name+".db") + "?mode=" + mode)
+}
+
+func (dbp *SQLiteFileDBProvider) open(name, mode string) (*sql.DB, error) {
+	if dbp.syncDelay > 0 {
+		return sql.OpenDB(&slowSyncConnector{
+			driver: dbp.dsnOpts.driver(),
+			dsn:    dbp.dsn(name, mode),
+			delay:  dbp.syncDelay,
+		}), nil
+	}
+	return sql.OpenDB(&dsnConnector{driver: dbp.dsnOpts.driver(), dsn: dbp.dsn(name, mode)}), nil
+}
+
+// dsnConnector opens connections to the DSN with the driver, as sql.Open
+// does with a registered driver.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (dbp *SQLiteFileDBProvider) NewDB(name string) (*sql.DB, error) {
+	sqldb, err := dbp.open(name, "rwc")
+	if err != nil {
+		return nil, err
+	}
+	if dbp.cleanup != nil {
+		dbp.cleanup.mu.Lock()
+		dbp.cleanup.names[name] = true
+		dbp.cleanup.mu.Unlock()
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(providerSchema(dbp.dsnOpts.ForeignKeys)); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return sqldb, tx.Commit()
+}
+
+func (dbp *SQLiteFileDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return dbp.open(name, "rw")
+}
+
+type DQLite1NodeDBProvider struct {
+	a   *app.App
+	dir string
+}
+
+func NewDQLite1NodeDBProvider() *DQLite1NodeDBProvider {
+	appDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		panic(err)
+	}
+
+	app, err := app.New(appDir)
+	if err != nil {
+		panic(err)
+	}
+	if err := app.Ready(context.Background()); err != nil {
+		panic(err)
+	}
+
+	return &DQLite1NodeDBProvider{a: app, dir: appDir}
+}
+
+func (dbp *DQLite1NodeDBProvider) NewDB(name string) (*sql.DB, error) {
+	db, err := dbp.a.Open(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(Schema); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return db, tx.Commit()
+}
+
+func (dbp *DQLite1NodeDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return dbp.a.Open(context.Background(), name)
+}
+
+// DQLiteClusterProvider creates databases on a cluster of dqlite nodes run
+// in this process.
+type DQLiteClusterProvider struct {
+	a *app.App
+
+	// mu guards nodes, which are stopped and started by chaos
+	// injection. Databases are always opened through the first node.
+	mu    sync.Mutex
+	nodes []*app.App
+	dirs  []string
+	addrs []string
+
+	// voters is how many voters the nodes keep in the cluster.
+	voters int
+	// basePort is the port of the first node, the others and those that
+	// join later listening on the ports after it.
+	basePort int
+
+	// network, if set, carries the traffic between nodes. stopListening
+	// stops accepting connections for each node.
+	network       *Network
+	stopListening []context.CancelFunc
+
+	// joined are the nodes added by membership churn, most recent last.
+	joined      []joinedNode
+	joinedTotal int
+}
+
+// DefaultClusterReadyTimeout is how long each node of a cluster, and then
+// the cluster as a whole, is given to become ready.
+const DefaultClusterReadyTimeout = time.Minute
+
+// ClusterRolesAdjustment is how often the leader of a cluster checks the
+// roles of its nodes. It is far more often than dqlite's default, so that
+// nodes joining the cluster, or restarted by chaos injection, are promoted
+// to voters within the readiness timeout.
+const ClusterRolesAdjustment = time.Second
+
+// ClusterOption configures a cluster created by NewDQLiteClusterProvider.
+type ClusterOption func(*clusterOptions)
+
+type clusterOptions struct {
+	network      *Network
+	addrs        []string
+	basePort     int
+	readyTimeout time.Duration
+}
+
+// WithClusterNetwork makes the nodes talk to each other over the network.
+func WithClusterNetwork(network *Network) ClusterOption {
+	return func(o *clusterOptions) {
+		o.network = network
+	}
+}
+
+// WithClusterBasePort listens on consecutive ports from port, rather than
+// from 9001.
+func WithClusterBasePort(port int) ClusterOption {
+	return func(o *clusterOptions) {
+		o.basePort = port
+	}
+}
+
+// WithClusterAddrs runs the nodes on the given addresses, one node for
+// each, rather than on consecutive ports.
+func WithClusterAddrs(addrs []string) ClusterOption {
+	return func(o *clusterOptions) {
+		o.addrs = addrs
+	}
+}
+
+// WithClusterReadyTimeout gives each node, and then the cluster, timeout to
+// become ready, rather than DefaultClusterReadyTimeout.
+func WithClusterReadyTimeout(timeout time.Duration) ClusterOption {
+	return func(o *clusterOptions) {
+		o.readyTimeout = timeout
+	}
+}
+
+// NewDQLiteClusterProvider starts a cluster of n nodes, each joining the
+// ones started before it, and waits until the cluster is healthy. A node
+// or cluster that does not become ready in time is an error, rather than
+// hanging the run.
+func NewDQLiteClusterProvider(n int, opts ...ClusterOption) (*DQLiteClusterProvider, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("a dqlite cluster needs at least one node, not %d", n)
+	}
+	o := clusterOptions{
+		basePort:     9001,
+		readyTimeout: DefaultClusterReadyTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dbp := &DQLiteClusterProvider{
+		nodes:         make([]*app.App, n),
+		dirs:          make([]string, n),
+		addrs:         make([]string, n),
+		voters:        clusterVoters(n),
+		basePort:      o.basePort,
+		network:       o.network,
+		stopListening: make([]context.CancelFunc, n),
+	}
+	for i := range dbp.addrs {
+		dbp.addrs[i] = fmt.Sprintf("127.0.0.1:%d", o.basePort+i)
+	}
+	if o.addrs != nil {
+		if len(o.addrs) != n {
+			return nil, fmt.Errorf("a cluster of %d nodes needs %d addresses, not %d", n, n, len(o.addrs))
+		}
+		copy(dbp.addrs, o.addrs)
+	}
+	for i := 0; i < n; i++ {
+		if err := dbp.startNewNode(i, o.readyTimeout); err != nil {
+			_ = dbp.Close()
+			return nil, fmt.Errorf("starting node %d at %s: %w", i+1, dbp.addrs[i], err)
+		}
+	}
+	dbp.a = dbp.nodes[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.readyTimeout)
+	defer cancel()
+	if err := dbp.waitHealthy(ctx); err != nil {
+		_ = dbp.Close()
+		return nil, fmt.Errorf("waiting for the cluster: %w", err)
+	}
+	ids := make([]string, n)
+	for i, node := range dbp.nodes {
+		ids[i] = fmt.Sprintf("%s (%d)", node.Address(), node.ID())
+	}
+	runLog.Info("dqlite cluster ready", "nodes", n, "members", strings.Join(ids, ", "))
+	return dbp, nil
+}
+
+// clusterVoters returns how many voters a cluster of n nodes keeps, which
+// dqlite needs to be odd and at least 3.
+func clusterVoters(n int) int {
+	if n%2 == 0 {
+		n--
+	}
+	return max(n, 3)
+}
+
+// startNewNode creates the i'th node in a new data directory, joining the
+// nodes before it, and waits until it is ready.
+func (dbp *DQLiteClusterProvider) startNewNode(i int, timeout time.Duration) error {
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return err
+	}
+	dbp.dirs[i] = dir
+	opts, err := dbp.nodeOptions(i, dbp.addrs[:i])
+	if err != nil {
+		return err
+	}
+	node, err := app.New(dir, opts...)
+	if err != nil {
+		return err
+	}
+	dbp.nodes[i] = node
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return node.Ready(ctx)
+}
+
+// Close hands over the roles of the nodes and stops them, those that joined
+// last first so that the cluster keeps a leader for as long as possible,
+// and removes their data.
+func (dbp *DQLiteClusterProvider) Close() error {
+	dbp.mu.Lock()
+	defer dbp.mu.Unlock()
+	var errs []error
+	stop := func(node *app.App, dir string, stopListening context.CancelFunc) {
+		if node != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_ = node.Handover(ctx)
+			cancel()
+			if err := node.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing node %s: %w", node.Address(), err))
+			}
+		}
+		if stopListening != nil {
+			stopListening()
+		}
+		if dir != "" {
+			_ = os.RemoveAll(dir)
+		}
+	}
+	for i := len(dbp.joined) - 1; i >= 0; i-- {
+		stop(dbp.joined[i].node, dbp.joined[i].dir, dbp.joined[i].stop)
+	}
+	dbp.joined = nil
+	for i := len(dbp.nodes) - 1; i >= 0; i-- {
+		stop(dbp.nodes[i], dbp.dirs[i], dbp.stopListening[i])
+		dbp.nodes[i] = nil
+	}
+	return errors.Join(errs...)
+}
+
+// Healthy returns an error unless the leader of the cluster can be reached,
+// every running node is a member and the cluster has as many voters as it
+// can.
+func (dbp *DQLiteClusterProvider) Healthy(ctx context.Context) error {
+	dbp.mu.Lock()
+	var first *app.App
+	running := len(dbp.joined)
+	for _, node := range dbp.nodes {
+		if node != nil {
+			running++
+			if first == nil {
+				first = node
+			}
+		}
+	}
+	dbp.mu.Unlock()
+	if first == nil {
+		return errors.New("no node is running")
+	}
+
+	cli, err := first.Leader(ctx)
+	if err != nil {
+		return fmt.Errorf("finding the leader: %w", err)
+	}
+	defer cli.Close()
+	members, err := cli.Cluster(ctx)
+	if err != nil {
+		return fmt.Errorf("listing the cluster: %w", err)
+	}
+	voters := 0
+	for _, member := range members {
+		if member.Role == client.Voter {
+			voters++
+		}
+	}
+	if len(members) < running {
+		return fmt.Errorf("%d of %d running nodes are members", len(members), running)
+	}
+	if want := min(running, dbp.voters); voters < want {
+		return fmt.Errorf("%d of %d voters", voters, want)
+	}
+	return nil
+}
+
+// waitHealthy waits until the cluster is healthy, returning why it is not
+// if ctx is done first.
+func (dbp *DQLiteClusterProvider) waitHealthy(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := dbp.Healthy(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// nodeOptions returns the options of the i'th node, joining the nodes in
+// cluster. If the provider has a network, the node talks to the others over
+// it.
+func (dbp *DQLiteClusterProvider) nodeOptions(i int, cluster []string) ([]app.Option, error) {
+	opts, stop, err := dbp.addrOptions(dbp.addrs[i], cluster)
+	if err != nil {
+		return nil, err
+	}
+	dbp.stopListening[i] = stop
+	return opts, nil
+}
+
+// addrOptions returns the options of a node at addr joining the nodes in
+// cluster, and the function to call once the node stops to stop listening
+// on the network, which is nil if there is no network.
+func (dbp *DQLiteClusterProvider) addrOptions(addr string, cluster []string) ([]app.Option, context.CancelFunc, error) {
+	opts := []app.Option{
+		app.WithAddress(addr),
+		app.WithVoters(dbp.voters),
+		app.WithRolesAdjustmentFrequency(ClusterRolesAdjustment),
+	}
+	if len(cluster) > 0 {
+		opts = append(opts, app.WithCluster(cluster))
+	}
+	if dbp.network == nil {
+		return opts, nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	accepted, err := dbp.network.listen(ctx, addr)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	opts = append(opts, app.WithExternalConn(dbp.network.dialer(addr), accepted))
+	return opts, cancel, nil
+}
+
+// joinedNode is a node added to the cluster after it was created.
+type joinedNode struct {
+	node *app.App
+	dir  string
+	stop context.CancelFunc
+}
+
+// JoinNode adds a new node to the cluster and waits until it is ready. It
+// returns the address of the node.
+func (dbp *DQLiteClusterProvider) JoinNode(ctx context.Context) (string, error) {
+	dbp.mu.Lock()
+	defer dbp.mu.Unlock()
+	dbp.joinedTotal++
+	addr := fmt.Sprintf("127.0.0.1:%d", dbp.basePort+len(dbp.addrs)-1+dbp.joinedTotal)
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return "", err
+	}
+	opts, stop, err := dbp.addrOptions(addr, dbp.addrs)
+	if err != nil {
+		return "", err
+	}
+	node, err := app.New(dir, opts...)
+	if err != nil {
+		if stop != nil {
+			stop()
+		}
+		return "", err
+	}
+	dbp.joined = append(dbp.joined, joinedNode{node: node, dir: dir, stop: stop})
+	return addr, node.Ready(ctx)
+}
+
+// RemoveNode hands over the roles of the most recently joined node, removes
+// it from the cluster and stops it. It returns the address of the node.
+func (dbp *DQLiteClusterProvider) RemoveNode(ctx context.Context) (string, error) {
+	dbp.mu.Lock()
+	defer dbp.mu.Unlock()
+	if len(dbp.joined) == 0 {
+		return "", errors.New("no joined nodes to remove")
+	}
+	joined := dbp.joined[len(dbp.joined)-1]
+	dbp.joined = dbp.joined[:len(dbp.joined)-1]
+	addr := joined.node.Address()
+
+	_ = joined.node.Handover(ctx)
+	cli, err := dbp.a.Leader(ctx)
+	if err == nil {
+		err = cli.Remove(ctx, joined.node.ID())
+		cli.Close()
+	}
+	_ = joined.node.Close()
+	if joined.stop != nil {
+		joined.stop()
+	}
+	_ = os.RemoveAll(joined.dir)
+	return addr, err
+}
+
+// Network returns the network between the nodes, or nil if they talk to
+// each other directly.
+func (dbp *DQLiteClusterProvider) Network() *Network {
+	return dbp.network
+}
+
+// NodeAddress returns the address of the i'th node.
+func (dbp *DQLiteClusterProvider) NodeAddress(i int) string {
+	return dbp.addrs[i]
+}
+
+// Nodes returns the number of nodes in the cluster.
+func (dbp *DQLiteClusterProvider) Nodes() int {
+	return len(dbp.addrs)
+}
+
+// StopNode hands over any roles the node holds and stops it. The first node
+// is used to open databases and cannot be stopped.
+func (dbp *DQLiteClusterProvider) StopNode(i int) error {
+	return dbp.stopNode(i, true)
+}
+
+// KillNode stops the node without handing over its roles, as a crash
+// would. The first node is used to open databases and cannot be killed.
+func (dbp *DQLiteClusterProvider) KillNode(i int) error {
+	return dbp.stopNode(i, false)
+}
+
+func (dbp *DQLiteClusterProvider) stopNode(i int, handover bool) error {
+	if i == 0 {
+		return errors.New("cannot stop the node databases are opened through")
+	}
+	dbp.mu.Lock()
+	defer dbp.mu.Unlock()
+	node := dbp.nodes[i]
+	if node == nil {
+		return fmt.Errorf("node %d already stopped", i)
+	}
+	if handover {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_ = node.Handover(ctx)
+		cancel()
+	}
+	dbp.nodes[i] = nil
+	err := node.Close()
+	if cancel := dbp.stopListening[i]; cancel != nil {
+		cancel()
+	}
+	return err
+}
+
+// TransferLeadership hands leadership of the cluster from the current leader
+// to another voter.
+func (dbp *DQLiteClusterProvider) TransferLeadership(ctx context.Context) (from, to uint64, err error) {
+	cli, err := dbp.a.Leader(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cli.Close()
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	var candidates []uint64
+	for _, node := range nodes {
+		if node.ID != leader.ID && node.Role == client.Voter {
+			candidates = append(candidates, node.ID)
+		}
+	}
+	if len(candidates) == 0 {
+		return leader.ID, 0, errors.New("no other voter to transfer leadership to")
+	}
+	to = candidates[rand.Intn(len(candidates))]
+	return leader.ID, to, cli.Transfer(ctx, to)
+}
+
+// StartNode starts a stopped node from its data directory and waits until
+// it has rejoined the cluster or ctx is done.
+func (dbp *DQLiteClusterProvider) StartNode(ctx context.Context, i int) error {
+	dbp.mu.Lock()
+	defer dbp.mu.Unlock()
+	if dbp.nodes[i] != nil {
+		return fmt.Errorf("node %d already running", i)
+	}
+	var cluster []string
+	for j, addr := range dbp.addrs {
+		if j != i {
+			cluster = append(cluster, addr)
+		}
+	}
+	opts, err := dbp.nodeOptions(i, cluster)
+	if err != nil {
+		return err
+	}
+	node, err := app.New(dbp.dirs[i], opts...)
+	if err != nil {
+		return err
+	}
+	dbp.nodes[i] = node
+	return node.Ready(ctx)
+}
+
+func (dbp *DQLiteClusterProvider) NewDB(name string) (*sql.DB, error) {
+	db, err := dbp.a.Open(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(Schema); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return db, tx.Commit()
+}
+
+func (dbp *DQLiteClusterProvider) OpenDB(name string) (*sql.DB, error) {
+	return dbp.a.Open(context.Background(), name)
+}
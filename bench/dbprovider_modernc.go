@@ -0,0 +1,118 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+//go:build modernc
+
+package bench
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	moderncsqlite "modernc.org/sqlite"
+)
+
+// The pure Go modernc.org/sqlite driver is only built in with the modernc
+// build tag, so that the default build does not carry a second SQLite. The
+// binary still links go-sqlite3 and go-dqlite, and so still needs cgo; the
+// provider compares the drivers rather than making the benchmark CGO-free.
+
+func init() {
+	RegisterProvider("sqlite-modernc", "in-memory SQLite databases through the pure Go modernc.org/sqlite driver",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if err := opts.check("sqlite-modernc", false, false); err != nil {
+				return nil, err
+			}
+			return NewModerncSQLiteDBProvider(), nil
+		})
+}
+
+// ModerncSQLiteDBProvider creates in-memory SQLite databases like
+// SQLiteDBProvider, but opens them with the pure Go modernc.org/sqlite
+// driver rather than go-sqlite3, to compare the drivers.
+type ModerncSQLiteDBProvider struct {
+	dsnOpts SQLiteDSNOpts
+}
+
+func NewModerncSQLiteDBProvider() *ModerncSQLiteDBProvider {
+	return &ModerncSQLiteDBProvider{}
+}
+
+// WithForeignKeys returns a provider whose databases enforce foreign keys.
+func (dbp *ModerncSQLiteDBProvider) WithForeignKeys() DBProvider {
+	fk := *dbp
+	fk.dsnOpts.ForeignKeys = true
+	return &fk
+}
+
+func (dbp *ModerncSQLiteDBProvider) EnforcesForeignKeys() bool {
+	return dbp.dsnOpts.ForeignKeys
+}
+
+func (dbp *ModerncSQLiteDBProvider) DSNOpts() SQLiteDSNOpts {
+	return dbp.dsnOpts
+}
+
+func (dbp *ModerncSQLiteDBProvider) WithDSNOpts(opts SQLiteDSNOpts) DBProvider {
+	p := *dbp
+	p.dsnOpts = opts
+	return &p
+}
+
+func (dbp *ModerncSQLiteDBProvider) NewDB(name string) (*sql.DB, error) {
+	dsn := "file:" + name + ".db?cache=shared&mode=memory"
+	if params := moderncParams(dbp.dsnOpts); params != "" {
+		dsn += "&" + params
+	}
+	connector, err := newMemoryConnector(&moderncsqlite.Driver{}, dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqldb := sql.OpenDB(connector)
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(providerSchema(dbp.dsnOpts.ForeignKeys)); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return sqldb, tx.Commit()
+}
+
+func (*ModerncSQLiteDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return nil, ErrNotPersistent
+}
+
+// moderncParams returns the options as modernc.org/sqlite DSN query
+// parameters, which set most of them as pragmas rather than as the
+// go-sqlite3 parameters of SQLiteDSNOpts.Params.
+func moderncParams(o SQLiteDSNOpts) string {
+	var params []string
+	if o.BusyTimeout > 0 {
+		params = append(params, "_pragma=busy_timeout("+strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10)+")")
+	}
+	if o.TxLock != "" {
+		params = append(params, "_txlock="+o.TxLock)
+	}
+	if o.Journal != "" {
+		params = append(params, "_pragma=journal_mode("+strings.ToUpper(o.Journal)+")")
+	}
+	if o.ForeignKeys {
+		params = append(params, "_pragma=foreign_keys(1)")
+	}
+	if o.Synchronous != "" {
+		params = append(params, "_pragma=synchronous("+strings.ToUpper(o.Synchronous)+")")
+	}
+	if o.CacheSize != 0 {
+		params = append(params, "_pragma=cache_size("+strconv.Itoa(o.CacheSize)+")")
+	}
+	if o.MmapSize != 0 {
+		params = append(params, "_pragma=mmap_size("+strconv.FormatInt(o.MmapSize, 10)+")")
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+//go:build zombiezen
+
+package bench
+
+import (
+	"database/sql"
+
+	moderncsqlite "modernc.org/sqlite"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func init() {
+	RegisterProvider("sqlite-zombiezen", "in-memory SQLite databases created through zombiezen.com/go/sqlite, for the zombiezen wrapper",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if err := opts.check("sqlite-zombiezen", false, false); err != nil {
+				return nil, err
+			}
+			return NewZombiezenSQLiteDBProvider(), nil
+		})
+}
+
+// ZombiezenSQLiteDBProvider creates in-memory SQLite databases through
+// zombiezen.com/go/sqlite. The parts of the benchmark that need a *sql.DB
+// get one opened with modernc.org/sqlite, which runs the same SQLite as
+// zombiezen and so shares its in-memory databases.
+type ZombiezenSQLiteDBProvider struct{}
+
+func NewZombiezenSQLiteDBProvider() *ZombiezenSQLiteDBProvider {
+	return &ZombiezenSQLiteDBProvider{}
+}
+
+// zombiezenURI is the URI of the in-memory database called name, shared by
+// every connection to it in the process.
+func zombiezenURI(name string) string {
+	return "file:" + name + ".db?cache=shared&mode=memory"
+}
+
+func (*ZombiezenSQLiteDBProvider) NewDB(name string) (*sql.DB, error) {
+	uri := zombiezenURI(name)
+	conn, err := sqlite.OpenConn(uri, sqlite.OpenReadWrite|sqlite.OpenCreate|sqlite.OpenURI)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := sqlitex.ExecuteScript(conn, Schema, nil); err != nil {
+		return nil, err
+	}
+
+	// The connector holds the database open once conn is closed.
+	connector, err := newMemoryConnector(&moderncsqlite.Driver{}, uri)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+func (*ZombiezenSQLiteDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return nil, ErrNotPersistent
+}
@@ -0,0 +1,282 @@
+package bench
+
+import (
+	"database/sql"
+
+	"github.com/canonical/sqlair"
+	"github.com/jmoiron/sqlx"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type DBWrapper interface {
+	Wrap(db *sql.DB, name string, runInTX bool) DB
+	Name() string
+}
+
+type SQLWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (SQLWrapper) Name() string {
+	return "sql"
+}
+
+func (w SQLWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w SQLWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w SQLWrapper) Wrap(db *sql.DB, name string, runInTX bool) DB {
+	runner := SQLPlainRunner
+	if runInTX {
+		runner = SQLTxRunner
+		if w.Rollbacks != nil {
+			runner = SQLTxRunnerWithRollbacks(w.Rollbacks)
+		} else if w.CommitFailures != nil {
+			runner = SQLTxRunnerWithCommitFailures(w.CommitFailures)
+		}
+		if w.Retrier != nil {
+			runner = SQLRetryRunner(runner, w.Retrier)
+		}
+	}
+	return &SQLDB{
+		db:     db,
+		name:   name,
+		runner: runner,
+	}
+}
+
+// PreparedSQLWrapper runs the operations through database/sql like
+// SQLWrapper, but prepares each statement once per database and reuses it,
+// rather than having every query parsed anew. It is the baseline for
+// PreparedSQLairWrapper.
+type PreparedSQLWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (PreparedSQLWrapper) Name() string {
+	return "sql-prepared"
+}
+
+func (w PreparedSQLWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w PreparedSQLWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w PreparedSQLWrapper) Wrap(db *sql.DB, name string, runInTX bool) DB {
+	sqldb := SQLWrapper{
+		Rollbacks:      w.Rollbacks,
+		CommitFailures: w.CommitFailures,
+		Retrier:        w.Retrier,
+	}.Wrap(db, name, runInTX).(*SQLDB)
+	sqldb.stmts = newStmtCache(db)
+	return sqldb
+}
+
+type SQLairWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (SQLairWrapper) Name() string {
+	return "sqlair"
+}
+
+func (w SQLairWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w SQLairWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w SQLairWrapper) Wrap(db *sql.DB, name string, runInTx bool) DB {
+	runner := SQLairPlainRunner
+	if runInTx {
+		runner = SQLairTxRunner
+		if w.Rollbacks != nil {
+			runner = SQLairTxRunnerWithRollbacks(w.Rollbacks)
+		} else if w.CommitFailures != nil {
+			runner = SQLairTxRunnerWithCommitFailures(w.CommitFailures)
+		}
+		if w.Retrier != nil {
+			runner = SQLairRetryRunner(runner, w.Retrier)
+		}
+	}
+	return &SQLairDB{
+		db:     sqlair.NewDB(db),
+		name:   name,
+		runner: runner,
+	}
+}
+
+// PreparedSQLairWrapper runs the operations through sqlair like
+// SQLairWrapper, but prepares each statement once per database and reuses
+// it, rather than preparing it every time an operation runs.
+type PreparedSQLairWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (PreparedSQLairWrapper) Name() string {
+	return "sqlair-prepared"
+}
+
+func (w PreparedSQLairWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w PreparedSQLairWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w PreparedSQLairWrapper) Wrap(db *sql.DB, name string, runInTx bool) DB {
+	sqlairdb := SQLairWrapper{
+		Rollbacks:      w.Rollbacks,
+		CommitFailures: w.CommitFailures,
+		Retrier:        w.Retrier,
+	}.Wrap(db, name, runInTx).(*SQLairDB)
+	sqlairdb.stmts = newSQLairStmtCache()
+	return &SQLairPreparedDB{SQLairDB: sqlairdb}
+}
+
+// SQLXWrapper runs the operations through jmoiron/sqlx, the most widely
+// used lightweight mapping library, for comparison with sqlair.
+type SQLXWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (SQLXWrapper) Name() string {
+	return "sqlx"
+}
+
+func (w SQLXWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w SQLXWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w SQLXWrapper) Wrap(db *sql.DB, name string, runInTx bool) DB {
+	runner := SQLXPlainRunner
+	if runInTx {
+		runner = SQLXTxRunner
+		if w.Rollbacks != nil {
+			runner = SQLXTxRunnerWithRollbacks(w.Rollbacks)
+		} else if w.CommitFailures != nil {
+			runner = SQLXTxRunnerWithCommitFailures(w.CommitFailures)
+		}
+		if w.Retrier != nil {
+			runner = SQLXRetryRunner(runner, w.Retrier)
+		}
+	}
+	// Every provider's driver takes ? placeholders, as go-sqlite3 does.
+	return &SQLXDB{
+		db:     sqlx.NewDb(db, "sqlite3"),
+		name:   name,
+		runner: runner,
+	}
+}
+
+// GormWrapper runs the operations through GORM models of the tables, to
+// compare the overhead of a full ORM with sqlair's.
+type GormWrapper struct {
+	// Rollbacks, if set, rolls back and retries some transactions.
+	Rollbacks *RollbackInjector
+	// CommitFailures, if set, fails some commits.
+	CommitFailures *CommitFailureInjector
+	// Retrier, if set, retries transactions that fail transiently.
+	Retrier *Retrier
+}
+
+func (GormWrapper) Name() string {
+	return "gorm"
+}
+
+func (w GormWrapper) WithRollbacks(injector *RollbackInjector) DBWrapper {
+	w.Rollbacks = injector
+	return w
+}
+
+func (w GormWrapper) WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper {
+	w.CommitFailures = injector
+	w.Retrier = retrier
+	return w
+}
+
+func (w GormWrapper) Wrap(db *sql.DB, name string, runInTx bool) DB {
+	runner := GormPlainRunner
+	if runInTx {
+		runner = GormTxRunner
+		if w.Rollbacks != nil {
+			runner = GormTxRunnerWithRollbacks(w.Rollbacks)
+		} else if w.CommitFailures != nil {
+			runner = GormTxRunnerWithCommitFailures(w.CommitFailures)
+		}
+		if w.Retrier != nil {
+			runner = GormRetryRunner(runner, w.Retrier)
+		}
+	}
+	// Every provider speaks SQLite. GORM's own transactions around each
+	// write are skipped, leaving transactions to the runner as for the
+	// other wrappers, and it logs nothing, since slow queries are what
+	// the benchmark measures.
+	gormdb, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	return &GormDB{
+		db:     gormdb,
+		sqldb:  db,
+		name:   name,
+		runner: runner,
+		err:    err,
+	}
+}
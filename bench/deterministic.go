@@ -0,0 +1,91 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// DeterministicOpts configures deterministic mode. Instead of running on
+// timers, each database runs the same seeded sequence of operations one after
+// another, so that two scenarios given the same options do exactly the same
+// work and differences between them come only from the query layer.
+type DeterministicOpts struct {
+	// Steps is the number of operations run against each database after
+	// it has been initialised. Zero disables deterministic mode.
+	Steps int
+	// Seed picks the sequence of operations.
+	Seed int64
+}
+
+// operationSequence returns the operations to run against each database in
+// deterministic mode. The initialisation operations come first, then the
+// remaining operations are drawn in proportion to how often they run in
+// timed mode.
+func operationSequence(ops []DBOperationDef, opts DeterministicOpts) []DBOperationDef {
+	var seq, periodic []DBOperationDef
+	var weights []float64
+	total := 0.0
+	for _, op := range ops {
+		if op.Freq == time.Duration(0) {
+			seq = append(seq, op)
+			continue
+		}
+		w := float64(time.Second) / float64(op.Freq)
+		periodic = append(periodic, op)
+		weights = append(weights, w)
+		total += w
+	}
+	if len(periodic) == 0 {
+		return seq
+	}
+
+	r := rand.New(rand.NewSource(opts.Seed))
+	for i := 0; i < opts.Steps; i++ {
+		x := r.Float64() * total
+		pick := len(periodic) - 1
+		for j, w := range weights {
+			if x < w {
+				pick = j
+				break
+			}
+			x -= w
+		}
+		seq = append(seq, periodic[pick])
+	}
+	return seq
+}
+
+// runOperationSequence runs the operations against db in order, stopping
+// early if the tomb is dying. A panic in an operation kills the tomb.
+func runOperationSequence(t *tomb.Tomb, env *OperationEnv, seq []DBOperationDef, db DB) {
+	safeGo(t, func() error {
+		for _, def := range seq {
+			if !t.Alive() {
+				return nil
+			}
+			if dropped := env.runOnce(def, db, time.Now(), nil); dropped {
+				break
+			}
+		}
+		t.Kill(nil)
+		return nil
+	})
+}
+
+// sequenceDigest identifies a sequence so that runs can be checked to have
+// done the same work.
+func sequenceDigest(seq []DBOperationDef) string {
+	h := fnv.New64a()
+	for _, def := range seq {
+		h.Write([]byte(def.OpName))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
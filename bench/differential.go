@@ -0,0 +1,272 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/canonical/sqlair"
+)
+
+// DifferentialOpts configures differential verification, which runs the
+// same read queries through database/sql and through sqlair against the
+// databases of a scenario while it runs, and compares what each scans.
+type DifferentialOpts struct {
+	// Interval is how often databases are verified. Zero disables
+	// verification.
+	Interval time.Duration
+	// DBs is how many databases, picked at random, are verified each
+	// interval. It defaults to one.
+	DBs int
+}
+
+const (
+	// Results of a differential check, as counted by the
+	// differential_checks metric.
+	DifferentialMatch    = "match"
+	DifferentialMismatch = "mismatch"
+	// DifferentialInconclusive is a check during which the data changed
+	// underneath it, so the results could not be compared, or of a
+	// database that has since been closed.
+	DifferentialInconclusive = "inconclusive"
+	DifferentialError        = "error"
+)
+
+// verifyAgent is an agent as scanned by both substrates.
+type verifyAgent struct {
+	UUID      string `db:"uuid"`
+	ModelName string `db:"model_name"`
+	Status    string `db:"status"`
+}
+
+// verifyEventCount is the number of events of an agent.
+type verifyEventCount struct {
+	AgentUUID string `db:"agent_uuid"`
+	Count     int    `db:"count"`
+}
+
+// verifyResults is everything the queries of a differential check scan.
+type verifyResults struct {
+	Agents []verifyAgent
+	Events []verifyEventCount
+}
+
+var (
+	verifyAgentsStmt = sqlair.MustPrepare(`
+		SELECT &verifyAgent.*
+		FROM agent
+		WHERE model_name = $verifyAgent.model_name
+		ORDER BY uuid`, verifyAgent{})
+	verifyEventsStmt = sqlair.MustPrepare(`
+		SELECT &verifyEventCount.* FROM (
+		SELECT agent_uuid, count(*) AS count
+		FROM agent_events
+		GROUP BY agent_uuid)
+		ORDER BY agent_uuid`, verifyEventCount{})
+)
+
+// normalised treats no rows scanned and an empty slice scanned alike.
+func (r verifyResults) normalised() verifyResults {
+	if len(r.Agents) == 0 {
+		r.Agents = nil
+	}
+	if len(r.Events) == 0 {
+		r.Events = nil
+	}
+	return r
+}
+
+// readSQL runs the queries of a differential check with database/sql.
+func readSQL(ctx context.Context, db *sql.DB, runner SQLRunner, model string) (verifyResults, error) {
+	var r verifyResults
+	err := runner(ctx, db, func(qs SQLQuerySubstrate) error {
+		r = verifyResults{}
+		rows, err := qs.QueryContext(ctx, `
+			SELECT uuid, model_name, status
+			FROM agent
+			WHERE model_name = ?
+			ORDER BY uuid`, model)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var a verifyAgent
+			if err := rows.Scan(&a.UUID, &a.ModelName, &a.Status); err != nil {
+				rows.Close()
+				return err
+			}
+			r.Agents = append(r.Agents, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = qs.QueryContext(ctx, `
+			SELECT agent_uuid, count(*)
+			FROM agent_events
+			GROUP BY agent_uuid
+			ORDER BY agent_uuid`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e verifyEventCount
+			if err := rows.Scan(&e.AgentUUID, &e.Count); err != nil {
+				return err
+			}
+			r.Events = append(r.Events, e)
+		}
+		return rows.Err()
+	})
+	return r, err
+}
+
+// readSQLair runs the queries of a differential check with sqlair.
+func readSQLair(ctx context.Context, db *sqlair.DB, runner SQLairRunner, model string) (verifyResults, error) {
+	var r verifyResults
+	err := runner(ctx, db, func(qs SQLairQuerySubstrate) error {
+		r = verifyResults{}
+		err := qs.Query(ctx, verifyAgentsStmt, verifyAgent{ModelName: model}).GetAll(&r.Agents)
+		if err != nil && !errors.Is(err, sqlair.ErrNoRows) {
+			return err
+		}
+		err = qs.Query(ctx, verifyEventsStmt).GetAll(&r.Events)
+		if err != nil && !errors.Is(err, sqlair.ErrNoRows) {
+			return err
+		}
+		return nil
+	})
+	return r, err
+}
+
+// differentialCheck reads the database with database/sql, then sqlair, then
+// database/sql again. If the two plain reads differ the data changed during
+// the check, and it is inconclusive. Otherwise sqlair must have scanned the
+// same. A check cut short by ctx is inconclusive.
+func differentialCheck(ctx context.Context, s *Scenario, db DB) (string, error) {
+	plain, ok := db.(PlainDB)
+	if !ok || plain.PlainDB() == nil {
+		return DifferentialInconclusive, nil
+	}
+	sqldb := plain.PlainDB()
+	if err := sqldb.Ping(); err != nil {
+		// The database has been closed by its supervisor.
+		return DifferentialInconclusive, nil
+	}
+	sqlRunner, sqlairRunner := SQLPlainRunner, SQLairPlainRunner
+	if s.opts.RunInTx {
+		sqlRunner, sqlairRunner = SQLTxRunner, SQLairTxRunner
+	}
+	model := db.Name()
+
+	before, err := readSQL(ctx, sqldb, sqlRunner, model)
+	if ctx.Err() != nil {
+		return DifferentialInconclusive, nil
+	}
+	if err != nil {
+		return DifferentialError, err
+	}
+	viaSQLair, err := readSQLair(ctx, sqlair.NewDB(sqldb), sqlairRunner, model)
+	if ctx.Err() != nil {
+		return DifferentialInconclusive, nil
+	}
+	if err != nil {
+		return DifferentialError, err
+	}
+	after, err := readSQL(ctx, sqldb, sqlRunner, model)
+	if ctx.Err() != nil {
+		return DifferentialInconclusive, nil
+	}
+	if err != nil {
+		return DifferentialError, err
+	}
+	before, viaSQLair, after = before.normalised(), viaSQLair.normalised(), after.normalised()
+	if !reflect.DeepEqual(before, after) {
+		return DifferentialInconclusive, nil
+	}
+	if !reflect.DeepEqual(before, viaSQLair) {
+		return DifferentialMismatch, fmt.Errorf("sql scanned %d agents and %d event counts, sqlair %d and %d: %s",
+			len(before.Agents), len(before.Events), len(viaSQLair.Agents), len(viaSQLair.Events),
+			firstDifference(before, viaSQLair))
+	}
+	return DifferentialMatch, nil
+}
+
+// firstDifference describes the first row scanned differently.
+func firstDifference(want, got verifyResults) string {
+	for i := 0; i < len(want.Agents) || i < len(got.Agents); i++ {
+		if i >= len(want.Agents) || i >= len(got.Agents) || want.Agents[i] != got.Agents[i] {
+			return fmt.Sprintf("agent %d is %+v, not %+v", i, rowAt(got.Agents, i), rowAt(want.Agents, i))
+		}
+	}
+	for i := 0; i < len(want.Events) || i < len(got.Events); i++ {
+		if i >= len(want.Events) || i >= len(got.Events) || want.Events[i] != got.Events[i] {
+			return fmt.Sprintf("event count %d is %+v, not %+v", i, rowAt(got.Events, i), rowAt(want.Events, i))
+		}
+	}
+	return "no row differs"
+}
+
+func rowAt[T any](rows []T, i int) any {
+	if i < len(rows) {
+		return rows[i]
+	}
+	return "missing"
+}
+
+// runDifferentialChecks verifies random databases of the scenario every
+// interval. Mismatches are recorded in the scenario's event log.
+func runDifferentialChecks(s *Scenario) {
+	opts := s.opts.Differential
+	if opts.Interval <= 0 {
+		return
+	}
+	if opts.DBs <= 0 {
+		opts.DBs = 1
+	}
+	for _, result := range []string{DifferentialMatch, DifferentialMismatch, DifferentialInconclusive, DifferentialError} {
+		s.metrics.differentialChecks.WithLabelValues(result)
+	}
+
+	check := func(ctx context.Context) {
+		dbs := s.DBs()
+		rand.Shuffle(len(dbs), func(i, j int) {
+			dbs[i], dbs[j] = dbs[j], dbs[i]
+		})
+		for _, db := range dbs[:min(opts.DBs, len(dbs))] {
+			result, err := differentialCheck(ctx, s, db)
+			s.metrics.differentialChecks.WithLabelValues(result).Inc()
+			switch result {
+			case DifferentialMismatch:
+				s.recordEvent("differential-mismatch", "db %s: %v", db.Name(), err)
+				s.snapshotOnAnomaly(db, "differential-mismatch")
+			case DifferentialError:
+				scenarioLog(s, "differential").Error("checking db", "db", db.Name(), "err", err)
+			}
+		}
+	}
+
+	t := &s.tomb
+	safeGo(t, func() error {
+		ctx := t.Context(nil)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				check(ctx)
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The disk the databases take up is reported whenever the metrics are
+// gathered, so that the growth of agent_events can be set against latency.
+// A SQLite database is its own files, but dqlite keeps every database of a
+// node in the node's raft log and snapshots, so for dqlite the data
+// directory of each node is reported instead.
+
+// DBSizer is a DBProvider that can tell how much disk a database takes up.
+type DBSizer interface {
+	DBSize(name string) (int64, error)
+}
+
+// NodeSizer is a DBProvider whose nodes keep the databases on disk
+// together, which can tell how much disk each node's data takes up, keyed
+// by the node's address.
+type NodeSizer interface {
+	NodeSizes() (map[string]int64, error)
+}
+
+// DBSize returns the size of the files of the database, including its WAL.
+func (dbp *SQLiteFileDBProvider) DBSize(name string) (int64, error) {
+	path := filepath.Join(dbp.dir, name+".db")
+	var size int64
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		info, err := os.Stat(path + suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// NodeSizes returns the size of the data directory of the node.
+func (dbp *DQLite1NodeDBProvider) NodeSizes() (map[string]int64, error) {
+	size, err := dirSize(dbp.dir)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int64{dbp.a.Address(): size}, nil
+}
+
+// NodeSizes returns the size of the data directory of every node, whether
+// or not it is running.
+func (dbp *DQLiteClusterProvider) NodeSizes() (map[string]int64, error) {
+	dbp.mu.Lock()
+	dirs := make(map[string]string, len(dbp.dirs)+len(dbp.joined))
+	for i, dir := range dbp.dirs {
+		dirs[dbp.addrs[i]] = dir
+	}
+	for _, joined := range dbp.joined {
+		if joined.node != nil {
+			dirs[joined.node.Address()] = joined.dir
+		}
+	}
+	dbp.mu.Unlock()
+	sizes := make(map[string]int64, len(dirs))
+	for addr, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		size, err := dirSize(dir)
+		if err != nil {
+			return nil, err
+		}
+		sizes[addr] = size
+	}
+	return sizes, nil
+}
+
+// dirSize returns the total size of the files under dir. Files removed
+// while it is walked, as raft segments are when they are compacted, are
+// left out.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// diskUsageSource is what a diskUsageCollector reports on.
+type diskUsageSource struct {
+	dbs      func() []DB
+	provider DBProvider
+}
+
+// diskUsageCollector reports the disk taken up by the databases of a
+// scenario, by database or by node as the provider allows, whenever the
+// metrics are gathered.
+type diskUsageCollector struct {
+	source atomic.Pointer[diskUsageSource]
+
+	db   *prometheus.Desc
+	node *prometheus.Desc
+}
+
+func newDiskUsageCollector() *diskUsageCollector {
+	return &diskUsageCollector{
+		db:   prometheus.NewDesc("db_disk_bytes", "The size of the files of the db, including its WAL", []string{"db"}, nil),
+		node: prometheus.NewDesc("db_node_disk_bytes", "The size of the data of a dqlite node, the raft log and snapshots of every db on it", []string{"node"}, nil),
+	}
+}
+
+// watch makes the collector report the databases returned by dbs, created
+// by provider.
+func (c *diskUsageCollector) watch(dbs func() []DB, provider DBProvider) {
+	c.source.Store(&diskUsageSource{dbs: dbs, provider: provider})
+}
+
+func (c *diskUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.db
+	ch <- c.node
+}
+
+func (c *diskUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	source := c.source.Load()
+	if source == nil {
+		return
+	}
+	if sizer, ok := source.provider.(DBSizer); ok {
+		for _, db := range source.dbs() {
+			size, err := sizer.DBSize(db.Name())
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(c.db, err)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.db, prometheus.GaugeValue, float64(size), db.Name())
+		}
+	}
+	if sizer, ok := source.provider.(NodeSizer); ok {
+		sizes, err := sizer.NodeSizes()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.node, err)
+			return
+		}
+		for node, size := range sizes {
+			ch <- prometheus.MustNewConstMetric(c.node, prometheus.GaugeValue, float64(size), node)
+		}
+	}
+}
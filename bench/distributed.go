@@ -0,0 +1,281 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A distributed run spreads the load of a run over several agent
+// processes, possibly on different machines, so that more load can be
+// generated against a shared cluster than one process can manage. A
+// coordinator waits for every agent to register, then assigns each of them
+// a range of the databases and the operations to run, and a time for all
+// of them to start at.
+
+// CoordinatorOpts configures the coordinator of a distributed run.
+type CoordinatorOpts struct {
+	// Addr is the address agents register on. It defaults to :3334.
+	Addr string
+	// Agents is the number of agents taking part.
+	Agents int
+	// DBs is the number of databases shared between the agents. It
+	// defaults to MaxNumberOfDatabases.
+	DBs int
+	// Operations names the registered operations the agents run. It
+	// defaults to the default operations.
+	Operations string
+	// StartDelay is how long after the last agent registers the run
+	// starts, to give every agent time to hear of it. It defaults to ten
+	// seconds.
+	StartDelay time.Duration
+}
+
+// Assignment is the part of a distributed run given to an agent.
+type Assignment struct {
+	Agent  string `json:"agent"`
+	Index  int    `json:"index"`
+	Agents int    `json:"agents"`
+	// FirstDB and DBs are the range of the run's databases the agent
+	// creates. Databases have random names, so the range only numbers
+	// the agent's share.
+	FirstDB    int       `json:"first_db"`
+	DBs        int       `json:"dbs"`
+	Operations string    `json:"operations"`
+	Start      time.Time `json:"start"`
+}
+
+// Apply makes the scenario run the assigned operations against the
+// assigned share of the databases. The scenario keeps the shape of its ramp,
+// scaled down to the share.
+func (a Assignment) Apply(opts *BenchmarkOpts) error {
+	ops, err := RegisteredOperations(a.Operations)
+	if err != nil {
+		return err
+	}
+	opts.Operations = ops
+	ramp := opts.Ramp
+	if ramp == nil {
+		ramp = StepRamp{
+			Step:   AddDBRate,
+			Every:  DatabaseAddFrequency,
+			MaxDBs: MaxNumberOfDatabases,
+		}
+	}
+	opts.Ramp = ShareRamp{Ramp: ramp, DBs: a.DBs}
+	return nil
+}
+
+// ShareRamp scales a ramp down to an agent's share of the databases of a
+// distributed run, reaching DBs when the ramp reaches its maximum.
+type ShareRamp struct {
+	Ramp RampProfile
+	DBs  int
+}
+
+func (r ShareRamp) Target(elapsed time.Duration) int {
+	max := r.Ramp.Max()
+	if max == 0 {
+		return 0
+	}
+	return clampDBs(r.Ramp.Target(elapsed)*r.DBs/max, r.DBs)
+}
+
+func (r ShareRamp) Max() int {
+	return r.DBs
+}
+
+// registration is what an agent sends the coordinator.
+type registration struct {
+	Agent string `json:"agent"`
+}
+
+type coordinator struct {
+	opts CoordinatorOpts
+
+	mu     sync.Mutex
+	agents []*pendingAgent
+	// assignments are the assignments made once every agent has
+	// registered.
+	assignments []Assignment
+	// delivered receives once for each assignment sent.
+	delivered chan struct{}
+}
+
+// pendingAgent is an agent waiting for its assignment.
+type pendingAgent struct {
+	name       string
+	assignment chan Assignment
+}
+
+// RunCoordinator waits for every agent of a distributed run to register,
+// sends each its assignment and returns once they all have them.
+func RunCoordinator(opts CoordinatorOpts) error {
+	if opts.Agents < 1 {
+		return errors.New("a distributed run needs at least one agent")
+	}
+	if opts.Addr == "" {
+		opts.Addr = ":3334"
+	}
+	if opts.DBs == 0 {
+		opts.DBs = MaxNumberOfDatabases
+	}
+	if opts.Operations == "" {
+		opts.Operations = DefaultOperationsName
+	}
+	if opts.StartDelay == 0 {
+		opts.StartDelay = 10 * time.Second
+	}
+	if _, err := RegisteredOperations(opts.Operations); err != nil {
+		return err
+	}
+
+	c := &coordinator{opts: opts, delivered: make(chan struct{}, opts.Agents)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", c.register)
+	server := http.Server{Addr: opts.Addr, Handler: mux}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	runLog.Info("coordinator waiting for agents", "agents", opts.Agents, "addr", opts.Addr)
+
+	for i := 0; i < opts.Agents; i++ {
+		select {
+		case err := <-served:
+			return err
+		case <-c.delivered:
+		}
+	}
+	for _, a := range c.assignments {
+		runLog.Info("agent assigned", "agent", a.Agent, "first_db", a.FirstDB, "last_db", a.FirstDB+a.DBs-1, "start", a.Start.Format(time.RFC3339))
+	}
+	return server.Shutdown(context.Background())
+}
+
+// register adds an agent to the run, then waits until every agent has
+// registered to reply with its assignment. An agent that goes away before
+// then gives up its place to another.
+func (c *coordinator) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "registration must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	var reg registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agent := &pendingAgent{name: reg.Agent, assignment: make(chan Assignment, 1)}
+	c.mu.Lock()
+	if c.assignments != nil {
+		c.mu.Unlock()
+		http.Error(w, "every agent has already registered", http.StatusConflict)
+		return
+	}
+	c.agents = append(c.agents, agent)
+	runLog.Info("agent registered", "agent", reg.Agent, "registered", len(c.agents), "agents", c.opts.Agents)
+	if len(c.agents) == c.opts.Agents {
+		c.assign()
+	}
+	c.mu.Unlock()
+
+	var a Assignment
+	select {
+	case a = <-agent.assignment:
+	case <-r.Context().Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.assignments != nil {
+			// Too late, the run was assigned as the agent left.
+			c.delivered <- struct{}{}
+			return
+		}
+		for i, other := range c.agents {
+			if other == agent {
+				c.agents = append(c.agents[:i], c.agents[i+1:]...)
+			}
+		}
+		runLog.Warn("agent went away before the run started", "agent", reg.Agent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		runLog.Error("sending assignment", "agent", reg.Agent, "err", err)
+	}
+	c.delivered <- struct{}{}
+}
+
+// assign splits the databases between the agents as evenly as possible and
+// hands each agent its assignment.
+func (c *coordinator) assign() {
+	start := time.Now().Add(c.opts.StartDelay)
+	first := 0
+	for i, agent := range c.agents {
+		dbs := c.opts.DBs / len(c.agents)
+		if i < c.opts.DBs%len(c.agents) {
+			dbs++
+		}
+		a := Assignment{
+			Agent:      agent.name,
+			Index:      i,
+			Agents:     len(c.agents),
+			FirstDB:    first,
+			DBs:        dbs,
+			Operations: c.opts.Operations,
+			Start:      start,
+		}
+		c.assignments = append(c.assignments, a)
+		agent.assignment <- a
+		first += dbs
+	}
+}
+
+// JoinCoordinator registers as an agent with the coordinator at url and
+// waits for the agent's assignment.
+func JoinCoordinator(url, agent string) (Assignment, error) {
+	var a Assignment
+	body, err := json.Marshal(registration{Agent: agent})
+	if err != nil {
+		return a, err
+	}
+	resp, err := http.Post(url+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return a, fmt.Errorf("registering with coordinator: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&a)
+	return a, err
+}
+
+// CoordinatorCommand implements
+// `coordinator [-listen addr] [-dbs n] [-operations name] [-start-delay d] -agents n`,
+// coordinating a distributed run.
+func CoordinatorCommand(args []string) error {
+	fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	var opts CoordinatorOpts
+	fs.StringVar(&opts.Addr, "listen", ":3334", "address agents register on")
+	fs.IntVar(&opts.Agents, "agents", 0, "number of agents taking part")
+	fs.IntVar(&opts.DBs, "dbs", MaxNumberOfDatabases, "number of databases shared between the agents")
+	fs.StringVar(&opts.Operations, "operations", DefaultOperationsName, "name of the registered operations the agents run")
+	fs.DurationVar(&opts.StartDelay, "start-delay", 10*time.Second, "how long after the last agent registers the run starts")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return RunCoordinator(opts)
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/canonical/go-dqlite/driver"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Classes the errors of operations are counted by in the
+// db_operation_error_classes metric, so that errors in the workload can be
+// told apart from those of the driver or the database.
+const (
+	// ErrorClassConstraint is a constraint of the schema being violated,
+	// which usually means the workload is wrong.
+	ErrorClassConstraint = "constraint"
+	// ErrorClassBusy is the database being busy or locked.
+	ErrorClassBusy = "busy"
+	// ErrorClassTimeout is the operation running out of time.
+	ErrorClassTimeout = "timeout"
+	// ErrorClassConnection is the connection to the database, or to the
+	// dqlite leader, being lost.
+	ErrorClassConnection = "connection"
+	ErrorClassOther      = "other"
+)
+
+// ErrorClasses returns every class of error.
+func ErrorClasses() []string {
+	return []string{ErrorClassConstraint, ErrorClassBusy, ErrorClassTimeout, ErrorClassConnection, ErrorClassOther}
+}
+
+// sqliteConstraint is the primary result code of a constraint violation,
+// shared by SQLite and dqlite.
+const sqliteConstraint = 19
+
+// errorClass returns the class of an error returned by an operation run
+// with ctx. An operation whose context expired has timed out, whatever the
+// driver made of the expiry, such as its transaction being rolled back under
+// it. The drivers without typed errors are classified by their messages.
+func errorClass(ctx context.Context, err error) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	switch transientReason(err) {
+	case RetryBusy, RetryLocked:
+		return ErrorClassBusy
+	case RetryNotLeader, RetryBadConn:
+		return ErrorClassConnection
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	if errors.Is(err, sql.ErrConnDone) {
+		return ErrorClassConnection
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassConnection
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		return ErrorClassConstraint
+	}
+	var dqliteErr driver.Error
+	if errors.As(err, &dqliteErr) && dqliteErr.Code&0xff == sqliteConstraint {
+		return ErrorClassConstraint
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "constraint failed"):
+		return ErrorClassConstraint
+	case isBusy(err):
+		return ErrorClassBusy
+	}
+	return ErrorClassOther
+}
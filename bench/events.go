@@ -0,0 +1,38 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event is something notable that happened during a run, such as an
+// injected fault, kept so that changes in the results can be lined up with
+// their cause.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// recordEvent adds an event to the event log of the scenario.
+func (s *Scenario) recordEvent(kind, format string, args ...any) {
+	e := Event{
+		Time:   time.Now(),
+		Kind:   kind,
+		Detail: fmt.Sprintf(format, args...),
+	}
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+	scenarioLog(s, e.Kind).Info(e.Detail)
+}
+
+// Events returns the event log of the scenario.
+func (s *Scenario) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// When commits are made to fail, every database logs logical operations
+// under unique ids, and the ledger remembers which of them the caller was
+// told succeeded. Once the run is over the log is checked against the
+// ledger: an operation logged more than once is a duplicate, such as a
+// retry of a commit that had taken effect, and one that succeeded but was
+// not logged is an omission.
+
+// operationLedger holds the logical operations run against each database
+// of a scenario by name.
+type operationLedger struct {
+	mu  sync.Mutex
+	dbs map[string]*ledgerEntries
+}
+
+// ledgerEntries are the ids of the operations that succeeded and failed
+// against a database, and how many retries a constraint rejected as
+// duplicates, such as those of seeding its agents.
+type ledgerEntries struct {
+	succeeded map[string]bool
+	failed    map[string]bool
+	rejected  int
+}
+
+func newOperationLedger() *operationLedger {
+	return &operationLedger{dbs: make(map[string]*ledgerEntries)}
+}
+
+// track returns db with the operations it logs recorded in the ledger.
+func (l *operationLedger) track(db DB) DB {
+	l.mu.Lock()
+	l.dbs[db.Name()] = &ledgerEntries{
+		succeeded: make(map[string]bool),
+		failed:    make(map[string]bool),
+	}
+	l.mu.Unlock()
+	return &ledgerDB{DB: db, ledger: l}
+}
+
+func (l *operationLedger) record(name, id string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries, ok := l.dbs[name]
+	if !ok {
+		return
+	}
+	if err == nil {
+		entries.succeeded[id] = true
+	} else {
+		entries.failed[id] = true
+	}
+}
+
+// reject records that a retry against the database of the given name was
+// rejected as a duplicate.
+func (l *operationLedger) reject(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entries, ok := l.dbs[name]; ok {
+		entries.rejected++
+	}
+}
+
+// entries returns the operations of the database of the given name, or
+// nil if they were not recorded.
+func (l *operationLedger) entries(name string) *ledgerEntries {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dbs[name]
+}
+
+// ledgerDB records the operations logged against a database.
+type ledgerDB struct {
+	DB
+	ledger *operationLedger
+}
+
+func (db *ledgerDB) PlainDB() *sql.DB {
+	if plain, ok := db.DB.(PlainDB); ok {
+		return plain.PlainDB()
+	}
+	return nil
+}
+
+func (db *ledgerDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	result, err := db.DB.SeedModelAgents(ctx, agentUUIDs)
+	if errors.Is(err, errDuplicateRetry) {
+		db.ledger.reject(db.Name())
+	}
+	return result, err
+}
+
+func (db *ledgerDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	result, err := db.DB.LogOperation(ctx, id)
+	db.ledger.record(db.Name(), id, err)
+	return result, err
+}
+
+// ExactlyOnceResult is the outcome of checking the operations of a
+// scenario against its ledger.
+type ExactlyOnceResult struct {
+	Scenario string `json:"scenario"`
+	Wrapper  string `json:"wrapper"`
+	Retry    bool   `json:"retry"`
+	// Checked counts the databases whose log was read, and Skipped those
+	// whose operations were not recorded, such as resumed or paired
+	// databases, or that could not be read.
+	Checked int `json:"checked"`
+	Skipped int `json:"skipped"`
+	// Succeeded and Failed count the operations by what the caller was
+	// told.
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// Duplicates counts the extra times operations were applied, or
+	// retried once applied and rejected by a constraint, and Omissions
+	// the operations that succeeded but were not applied.
+	// FailedApplied counts the operations that failed but were applied
+	// anyway, which callers cannot tell from those that were not.
+	Duplicates    int `json:"duplicates"`
+	Omissions     int `json:"omissions"`
+	FailedApplied int `json:"failed_applied"`
+}
+
+// checkExactlyOnce checks the log of every database of the scenario
+// against the ledger.
+func checkExactlyOnce(s *Scenario) ExactlyOnceResult {
+	result := ExactlyOnceResult{
+		Scenario: s.name,
+		Wrapper:  s.opts.Wrapper.Name(),
+		Retry:    s.opts.Retry,
+	}
+	for _, db := range s.DBs() {
+		name, plain, unpin := pinPlainDB(db)
+		entries := s.ledger.entries(name)
+		if entries == nil || plain == nil {
+			unpin()
+			result.Skipped++
+			continue
+		}
+		applied, err := appliedOperations(plain)
+		unpin()
+		if err != nil {
+			scenarioLog(s, "exactly-once").Warn("cannot read operation log", "db", name, "err", err)
+			result.Skipped++
+			continue
+		}
+		result.Checked++
+
+		s.ledger.mu.Lock()
+		result.Succeeded += len(entries.succeeded)
+		result.Failed += len(entries.failed)
+		result.Duplicates += entries.rejected
+		for id := range entries.succeeded {
+			if applied[id] == 0 {
+				result.Omissions++
+			}
+		}
+		for id, n := range applied {
+			if n > 1 {
+				result.Duplicates += n - 1
+			}
+			if entries.failed[id] {
+				result.FailedApplied++
+			}
+		}
+		s.ledger.mu.Unlock()
+	}
+	return result
+}
+
+// appliedOperations returns how many times each operation was logged.
+func appliedOperations(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query("SELECT id, count(*) FROM operation_log GROUP BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		applied[id] = n
+	}
+	return applied, rows.Err()
+}
+
+// checkScenariosExactlyOnce checks the operations of every scenario that
+// keeps a ledger.
+func checkScenariosExactlyOnce(scenarios []*Scenario) []ExactlyOnceResult {
+	var results []ExactlyOnceResult
+	for _, s := range scenarios {
+		if s.ledger != nil {
+			results = append(results, checkExactlyOnce(s))
+		}
+	}
+	return results
+}
+
+// printExactlyOnceReport writes how many times the operations of each
+// scenario were applied.
+func printExactlyOnceReport(w io.Writer, results []ExactlyOnceResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "exactly once verification:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tRETRY\tCHECKED\tSKIPPED\tSUCCEEDED\tFAILED\tDUPLICATES\tOMISSIONS\tFAILED_APPLIED")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", r.Scenario, r.Wrapper, strconv.FormatBool(r.Retry),
+			r.Checked, r.Skipped, r.Succeeded, r.Failed, r.Duplicates, r.Omissions, r.FailedApplied)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"text/tabwriter"
+	"time"
+)
+
+// ForeignKeyEnforcer is a DBProvider that can create databases enforcing
+// foreign keys. The schema of those databases deletes rows along with the
+// rows they reference, so that deleting an agent deletes its events.
+type ForeignKeyEnforcer interface {
+	DBProvider
+	// WithForeignKeys returns a provider of databases that enforce
+	// foreign keys.
+	WithForeignKeys() DBProvider
+	// EnforcesForeignKeys reports whether the provider's databases
+	// enforce foreign keys.
+	EnforcesForeignKeys() bool
+}
+
+var referencesClause = regexp.MustCompile(`REFERENCES\s+\w+\s*\([^)]*\)`)
+
+// providerSchema returns the Schema, with every foreign key cascading
+// deletes if foreign keys are enforced.
+func providerSchema(foreignKeys bool) string {
+	if !foreignKeys {
+		return Schema
+	}
+	return referencesClause.ReplaceAllString(Schema, "$0 ON DELETE CASCADE")
+}
+
+// ForeignKeyCost is the cost of enforcing foreign keys for one operation,
+// in percent relative to not enforcing them.
+type ForeignKeyCost struct {
+	Operation string
+
+	OffMean, OnMean time.Duration
+	MeanCost        float64
+	OffP99, OnP99   time.Duration
+	P99Cost         float64
+
+	OffErrors, OnErrors uint64
+}
+
+// OrphanAudit is the outcome of auditing the events of every database of a
+// scenario for agents that do not exist.
+type OrphanAudit struct {
+	Audited   int
+	Unaudited int
+	Orphans   int
+}
+
+// auditOrphans counts the events of the scenario's databases whose agent
+// does not exist.
+func auditOrphans(s *Scenario) OrphanAudit {
+	var audit OrphanAudit
+	for _, db := range s.DBs() {
+		count, _, err := db.OrphanedAgentEventCount(context.Background())
+		if err != nil {
+			audit.Unaudited++
+			continue
+		}
+		audit.Audited++
+		audit.Orphans += count
+	}
+	return audit
+}
+
+// foreignKeyPairs pairs every scenario enforcing foreign keys with the
+// first scenario that runs the same wrapper in the same way without.
+func foreignKeyPairs(scenarios []*Scenario) [][2]*Scenario {
+	var pairs [][2]*Scenario
+	for _, on := range scenarios {
+		onMeta := on.Metadata()
+		if onMeta["foreign_keys"] != "true" {
+			continue
+		}
+		for _, off := range scenarios {
+			offMeta := off.Metadata()
+			if offMeta["foreign_keys"] != "true" && offMeta["wrapper"] == onMeta["wrapper"] && offMeta["run_in_tx"] == onMeta["run_in_tx"] {
+				pairs = append(pairs, [2]*Scenario{off, on})
+				break
+			}
+		}
+	}
+	return pairs
+}
+
+// printForeignKeyReport writes the cost of enforcing foreign keys for every
+// operation run by each pair of scenarios with and without enforcement,
+// and the results of auditing both for orphaned events. Runs without such
+// a pair have no report.
+func printForeignKeyReport(w io.Writer, scenarios []*Scenario) error {
+	pairs := foreignKeyPairs(scenarios)
+	if len(pairs) == 0 {
+		return nil
+	}
+	stats, err := gatherOpStats(measuredPhases...)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		off, on := pair[0], pair[1]
+		byOp := make(map[string]OpStats)
+		for _, op := range stats {
+			if op.Scenario == off.Name() {
+				byOp[op.Operation] = op
+			}
+		}
+		var costs []ForeignKeyCost
+		for _, op := range stats {
+			base, ok := byOp[op.Operation]
+			if op.Scenario != on.Name() || !ok || base.Count == 0 || op.Count == 0 {
+				continue
+			}
+			costs = append(costs, ForeignKeyCost{
+				Operation: op.Operation,
+				OffMean:   base.Mean,
+				OnMean:    op.Mean,
+				MeanCost:  percentChange(float64(base.Mean), float64(op.Mean)),
+				OffP99:    base.P99,
+				OnP99:     op.P99,
+				P99Cost:   percentChange(float64(base.P99), float64(op.P99)),
+				OffErrors: base.Errors,
+				OnErrors:  op.Errors,
+			})
+		}
+
+		fmt.Fprintf(w, "foreign key enforcement cost (%s vs %s):\n", on.Name(), off.Name())
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "OPERATION\tOFF MEAN\tON MEAN\tCOST\tOFF P99\tON P99\tCOST\tOFF ERRORS\tON ERRORS")
+		for _, c := range costs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%+.1f%%\t%s\t%s\t%+.1f%%\t%d\t%d\n",
+				c.Operation, c.OffMean, c.OnMean, c.MeanCost,
+				c.OffP99, c.OnP99, c.P99Cost, c.OffErrors, c.OnErrors)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, s := range []*Scenario{off, on} {
+			audit := auditOrphans(s)
+			fmt.Fprintf(w, "%s: %d orphaned events in %d dbs audited, %d unaudited\n",
+				s.Name(), audit.Orphans, audit.Audited, audit.Unaudited)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// GCOpts tunes the garbage collector for the duration of a run, so that GC
+// pauses can be told apart from the cost of the wrappers. The settings are
+// process wide, so they apply to every scenario of the run.
+type GCOpts struct {
+	// Percent sets GOGC, a negative value turning the collector off. Nil
+	// leaves it as the environment set it.
+	Percent *int
+	// MemoryLimit sets GOMEMLIMIT, in bytes. Zero leaves it as the
+	// environment set it.
+	MemoryLimit int64
+	// Ballast is the size, in bytes, of an allocation held for the run,
+	// raising the heap size the collector aims for without using the
+	// memory until it is touched. Zero holds none.
+	Ballast int64
+}
+
+// gcBallast keeps the ballast of the run reachable.
+var gcBallast []byte
+
+// ParseGCPercent parses a GOGC value, a percentage or off.
+func ParseGCPercent(s string) (int, error) {
+	if s == "off" {
+		return -1, nil
+	}
+	percent, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing gc percent %q: %w", s, err)
+	}
+	return percent, nil
+}
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseBytes parses a size in bytes as GOMEMLIMIT does, a number with an
+// optional B, KiB, MiB, GiB or TiB suffix.
+func ParseBytes(s string) (int64, error) {
+	n, unit := s, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, unit = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * unit, nil
+}
+
+// formatBytes formats a size in the largest unit that divides it.
+func formatBytes(n int64) string {
+	for _, u := range byteUnits {
+		if n != 0 && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return "0B"
+}
+
+// GCSettings are the collector settings a run had.
+type GCSettings struct {
+	Percent     int
+	MemoryLimit int64
+	Ballast     int64
+}
+
+func (s GCSettings) gogc() string {
+	if s.Percent < 0 {
+		return "off"
+	}
+	return strconv.Itoa(s.Percent)
+}
+
+func (s GCSettings) gomemlimit() string {
+	if s.MemoryLimit == math.MaxInt64 {
+		return "off"
+	}
+	return formatBytes(s.MemoryLimit)
+}
+
+// applyGC applies the options and returns the settings the run has, along
+// with a function that restores the previous ones and drops the ballast.
+func applyGC(opts GCOpts) (GCSettings, func()) {
+	prevPercent := debug.SetGCPercent(100)
+	debug.SetGCPercent(prevPercent)
+	prevLimit := debug.SetMemoryLimit(-1)
+
+	settings := GCSettings{Percent: prevPercent, MemoryLimit: prevLimit, Ballast: opts.Ballast}
+	if opts.Percent != nil {
+		settings.Percent = *opts.Percent
+		debug.SetGCPercent(settings.Percent)
+	}
+	if opts.MemoryLimit > 0 {
+		settings.MemoryLimit = opts.MemoryLimit
+		debug.SetMemoryLimit(settings.MemoryLimit)
+	}
+	if opts.Ballast > 0 {
+		gcBallast = make([]byte, opts.Ballast)
+	}
+	return settings, func() {
+		gcBallast = nil
+		debug.SetGCPercent(prevPercent)
+		debug.SetMemoryLimit(prevLimit)
+	}
+}
+
+// setGCMetadata records the collector settings in the metadata of the
+// scenario, so that runs with different settings can be compared.
+func setGCMetadata(s *Scenario, settings GCSettings) {
+	s.SetMetadata("gogc", settings.gogc())
+	s.SetMetadata("gomemlimit", settings.gomemlimit())
+	if settings.Ballast > 0 {
+		s.SetMetadata("gc_ballast", formatBytes(settings.Ballast))
+	}
+}
+
+// gcPausesMetric is the distribution of the stop the world pauses of the
+// collector.
+const gcPausesMetric = "/gc/pauses:seconds"
+
+// gcSnapshot is the state of the collector at a point in the run.
+type gcSnapshot struct {
+	cycles      uint32
+	pauseTotal  time.Duration
+	cpuFraction float64
+	pauses      *metrics.Float64Histogram
+}
+
+func takeGCSnapshot() gcSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	sample := []metrics.Sample{{Name: gcPausesMetric}}
+	metrics.Read(sample)
+	snap := gcSnapshot{
+		cycles:      mem.NumGC,
+		pauseTotal:  time.Duration(mem.PauseTotalNs),
+		cpuFraction: mem.GCCPUFraction,
+	}
+	if sample[0].Value.Kind() == metrics.KindFloat64Histogram {
+		snap.pauses = sample[0].Value.Float64Histogram()
+	}
+	return snap
+}
+
+// pauseHistogram holds the pauses between two snapshots, in the buckets of
+// the runtime.
+type pauseHistogram struct {
+	counts  []uint64
+	buckets []float64
+	total   uint64
+}
+
+func (s gcSnapshot) pausesSince(prev gcSnapshot) pauseHistogram {
+	var h pauseHistogram
+	if s.pauses == nil {
+		return h
+	}
+	h.buckets = s.pauses.Buckets
+	h.counts = make([]uint64, len(s.pauses.Counts))
+	for i, c := range s.pauses.Counts {
+		if prev.pauses != nil && i < len(prev.pauses.Counts) {
+			c -= prev.pauses.Counts[i]
+		}
+		h.counts[i] = c
+		h.total += c
+	}
+	return h
+}
+
+// quantile returns the upper bound of the bucket holding the quantile, or
+// its lower bound for the unbounded last bucket.
+func (h pauseHistogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= max(rank, 1) {
+			return h.bound(i)
+		}
+	}
+	return h.bound(len(h.counts) - 1)
+}
+
+func (h pauseHistogram) bound(i int) time.Duration {
+	if math.IsInf(h.buckets[i+1], 1) {
+		return seconds(h.buckets[i])
+	}
+	return seconds(h.buckets[i+1])
+}
+
+// longerThan returns how many pauses were at least d long.
+func (h pauseHistogram) longerThan(d time.Duration) uint64 {
+	var n uint64
+	for i, c := range h.counts {
+		if seconds(h.buckets[i]) >= d {
+			n += c
+		}
+	}
+	return n
+}
+
+// GCScenarioEffect compares the collector pauses of a run with the tail
+// latency of the operations of one of its scenarios.
+type GCScenarioEffect struct {
+	Scenario string
+	OpP99    time.Duration
+	// LongPauses is how many pauses were at least as long as OpP99, each
+	// of which is enough on its own to put the operations running during
+	// it in the tail.
+	LongPauses uint64
+}
+
+// printGCReport writes the collector settings of the run and the pauses it
+// made between start and end, against the tail latency of each scenario
+// over the measure phase, from its HDR histograms.
+func printGCReport(w io.Writer, settings GCSettings, start, end gcSnapshot, scenarios []*Scenario) error {
+	pauses := end.pausesSince(start)
+	var effects []GCScenarioEffect
+	for _, s := range scenarios {
+		latencies := s.latencies.merged()
+		if latencies.TotalCount() == 0 {
+			continue
+		}
+		p99 := time.Duration(latencies.ValueAtQuantile(99)) * time.Microsecond
+		effects = append(effects, GCScenarioEffect{
+			Scenario:   s.Name(),
+			OpP99:      p99,
+			LongPauses: pauses.longerThan(p99),
+		})
+	}
+	sort.Slice(effects, func(i, j int) bool {
+		return effects[i].Scenario < effects[j].Scenario
+	})
+
+	fmt.Fprintf(w, "gc: GOGC=%s GOMEMLIMIT=%s ballast %s, %d cycles pausing %s in total, pause p50 %s p99 %s max %s, %.2f%% of cpu\n",
+		settings.gogc(), settings.gomemlimit(), formatBytes(settings.Ballast),
+		end.cycles-start.cycles, end.pauseTotal-start.pauseTotal,
+		pauses.quantile(0.5), pauses.quantile(0.99), pauses.quantile(1),
+		end.cpuFraction*100)
+	if len(effects) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tOP P99\tPAUSES AT LEAST OP P99")
+	for _, e := range effects {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", e.Scenario, e.OpP99, e.LongPauses)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,195 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// The Prometheus histograms only know which of timeBucketSplits a latency
+// fell in, so their percentiles are interpolated within a bucket, which
+// above a millisecond spans an order of magnitude. The latencies are also
+// recorded in HDR histograms, which keep every latency to
+// HDRSignificantFigures, so that the tail and the maximum can be reported
+// exactly at the end of the run.
+
+const (
+	// HDRSignificantFigures is the precision latencies are recorded to.
+	HDRSignificantFigures = 3
+	// HDRMaxLatency is the longest latency that can be recorded. Longer
+	// ones are recorded as it.
+	HDRMaxLatency = time.Hour
+)
+
+// shardedHDR is an HDR histogram of latencies in microseconds, spread
+// across shards like shardedHistogram so that concurrent workers rarely
+// wait on each other's locks.
+type shardedHDR struct {
+	shards []hdrShard
+}
+
+type hdrShard struct {
+	mu sync.Mutex
+	h  *hdrhistogram.Histogram
+	// Keep neighbouring shards off each other's cache lines.
+	_ [40]byte
+}
+
+func newShardedHDR() *shardedHDR {
+	h := &shardedHDR{shards: make([]hdrShard, max(MetricShards, 1))}
+	for i := range h.shards {
+		h.shards[i].h = newHDR()
+	}
+	return h
+}
+
+func newHDR() *hdrhistogram.Histogram {
+	return hdrhistogram.New(1, HDRMaxLatency.Microseconds(), HDRSignificantFigures)
+}
+
+// Record adds the latency to a shard picked at random.
+func (h *shardedHDR) Record(d time.Duration) {
+	us := min(max(d.Microseconds(), 1), HDRMaxLatency.Microseconds())
+	shard := &h.shards[rand.Intn(len(h.shards))]
+	shard.mu.Lock()
+	_ = shard.h.RecordValue(us)
+	shard.mu.Unlock()
+}
+
+// merge returns a histogram of the latencies recorded across the shards.
+func (h *shardedHDR) merge() *hdrhistogram.Histogram {
+	merged := newHDR()
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mu.Lock()
+		merged.Merge(shard.h)
+		shard.mu.Unlock()
+	}
+	return merged
+}
+
+// hdrLatencies are the HDR histograms of the operations of a scenario.
+type hdrLatencies struct {
+	mu  sync.Mutex
+	ops map[string]*shardedHDR
+}
+
+func newHDRLatencies() *hdrLatencies {
+	return &hdrLatencies{ops: make(map[string]*shardedHDR)}
+}
+
+// get returns the histogram of the operation, creating it the first time.
+func (l *hdrLatencies) get(op string) *shardedHDR {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.ops[op]
+	if !ok {
+		h = newShardedHDR()
+		l.ops[op] = h
+	}
+	return h
+}
+
+// merged returns a histogram of the latencies of every operation.
+func (l *hdrLatencies) merged() *hdrhistogram.Histogram {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	merged := newHDR()
+	for _, h := range l.ops {
+		merged.Merge(h.merge())
+	}
+	return merged
+}
+
+// HDRStats are the exact percentiles of the latency of an operation in a
+// scenario, to HDRSignificantFigures.
+type HDRStats struct {
+	Scenario  string
+	Operation string
+	Count     int64
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+	P999      time.Duration
+	P9999     time.Duration
+	Max       time.Duration
+}
+
+// hdrStats returns the percentiles of every operation of the scenarios,
+// sorted by scenario and operation.
+func hdrStats(scenarios []*Scenario) []HDRStats {
+	var stats []HDRStats
+	for _, s := range scenarios {
+		s.latencies.mu.Lock()
+		ops := make(map[string]*shardedHDR, len(s.latencies.ops))
+		for op, h := range s.latencies.ops {
+			ops[op] = h
+		}
+		s.latencies.mu.Unlock()
+		for op, h := range ops {
+			merged := h.merge()
+			if merged.TotalCount() == 0 {
+				continue
+			}
+			us := func(v int64) time.Duration { return time.Duration(v) * time.Microsecond }
+			stats = append(stats, HDRStats{
+				Scenario:  s.Name(),
+				Operation: op,
+				Count:     merged.TotalCount(),
+				P50:       us(merged.ValueAtQuantile(50)),
+				P95:       us(merged.ValueAtQuantile(95)),
+				P99:       us(merged.ValueAtQuantile(99)),
+				P999:      us(merged.ValueAtQuantile(99.9)),
+				P9999:     us(merged.ValueAtQuantile(99.99)),
+				Max:       us(merged.Max()),
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Scenario != stats[j].Scenario {
+			return stats[i].Scenario < stats[j].Scenario
+		}
+		return stats[i].Operation < stats[j].Operation
+	})
+	return stats
+}
+
+// withHDRPercentiles replaces the percentiles of the stats of the measure
+// phase, interpolated from the Prometheus buckets, with the exact ones of
+// the HDR histograms of the scenarios, so that the reports of a run agree.
+func withHDRPercentiles(stats []OpStats, scenarios []*Scenario) {
+	exact := make(map[opKey]HDRStats)
+	for _, h := range hdrStats(scenarios) {
+		exact[opKey{h.Scenario, h.Operation}] = h
+	}
+	for i := range stats {
+		if h, ok := exact[opKey{stats[i].Scenario, stats[i].Operation}]; ok {
+			stats[i].P50, stats[i].P95, stats[i].P99 = h.P50, h.P95, h.P99
+		}
+	}
+}
+
+// printHDRReport writes the exact percentiles of every operation.
+func printHDRReport(w io.Writer, scenarios []*Scenario) error {
+	stats := hdrStats(scenarios)
+	if len(stats) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "latency percentiles of the measure phase to %d significant figures:\n", HDRSignificantFigures)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tOPERATION\tCOUNT\tP50\tP99\tP99.9\tP99.99\tMAX")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			s.Scenario, s.Operation, s.Count, s.P50, s.P99, s.P999, s.P9999, s.Max)
+	}
+	return tw.Flush()
+}
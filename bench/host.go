@@ -0,0 +1,115 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// A run can be split between a database host, which runs the dqlite nodes,
+// and a load generator, which runs the scenarios against them over the
+// network. Each process then only pays for its own side, so the CPU cost
+// of the client and of the server can be measured independently.
+
+// HostOpts configures a database host.
+type HostOpts struct {
+	// Addr is the address the node addresses, health and metrics of the
+	// host are served on. It defaults to :3336.
+	Addr string
+	// Nodes are the addresses of the dqlite nodes to run, which load
+	// generators connect to. It defaults to a single node on
+	// 127.0.0.1:9001.
+	Nodes []string
+}
+
+// RunHost runs dqlite nodes for load generators to connect to until it is
+// interrupted.
+func RunHost(opts HostOpts) error {
+	if opts.Addr == "" {
+		opts.Addr = ":3336"
+	}
+	if len(opts.Nodes) == 0 {
+		opts.Nodes = []string{"127.0.0.1:9001"}
+	}
+
+	cluster, err := NewDQLiteClusterProvider(len(opts.Nodes), WithClusterAddrs(opts.Nodes))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := cluster.Close(); err != nil {
+			runLog.Error("closing cluster", "err", err)
+		}
+	}()
+
+	var ready atomic.Bool
+	ready.Store(true)
+	mux := http.NewServeMux()
+	handleHealth(mux, &ready, []HealthChecker{cluster})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(opts.Nodes)
+	})
+	server := http.Server{Addr: opts.Addr, Handler: mux}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	runLog.Info("database host serving", "addr", opts.Addr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-served:
+		return err
+	case <-sig:
+	}
+	ready.Store(false)
+	return server.Close()
+}
+
+// HostCommand implements `host [-listen addr] [-node addr]...`, running
+// the dqlite nodes of a database host.
+func HostCommand(args []string) error {
+	fs := flag.NewFlagSet("host", flag.ContinueOnError)
+	var opts HostOpts
+	fs.StringVar(&opts.Addr, "listen", ":3336", "address the node addresses, health and metrics are served on")
+	fs.Func("node", "address of a dqlite node to run, may be repeated, defaults to 127.0.0.1:9001", func(addr string) error {
+		opts.Nodes = append(opts.Nodes, addr)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return RunHost(opts)
+}
+
+// NewHostedDBProvider connects to the nodes of the database host serving on
+// url, for example http://host:3336.
+func NewHostedDBProvider(url string, opts RemoteDQLiteOpts) (*RemoteDQLiteDBProvider, error) {
+	resp, err := http.Get(url + "/nodes")
+	if err != nil {
+		return nil, fmt.Errorf("getting nodes of database host %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting nodes of database host %s: %s", url, resp.Status)
+	}
+	var addrs []string
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("reading nodes of database host %s: %w", url, err)
+	}
+	return NewRemoteDQLiteDBProvider(addrs, opts)
+}
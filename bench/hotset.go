@@ -0,0 +1,375 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations that touch some of the agents of a database pick them in Go,
+// from the agents the database was seeded with, rather than with ORDER BY
+// RANDOM() in the query. Sorting every agent of the model by a random key
+// costs more the bigger the model is, which would otherwise dominate what
+// is measured, and a uniform pick is not how real workloads touch agents.
+// Which agents are picked follows the AgentDistribution of the scenario,
+// and the picks are sampled ahead of time so that sampling is not timed
+// either.
+
+// AgentDistribution decides which of the agents of a database an operation
+// touches.
+type AgentDistribution interface {
+	// Name describes the distribution, as it is given to
+	// ParseAgentDistribution.
+	Name() string
+	// Sample returns n distinct indices below size, or all of them if
+	// there are no more than n.
+	Sample(r *rand.Rand, size, n int) []int
+}
+
+// UniformAgents picks every agent with the same probability.
+type UniformAgents struct{}
+
+func (UniformAgents) Name() string {
+	return "uniform"
+}
+
+func (UniformAgents) Sample(r *rand.Rand, size, n int) []int {
+	if n >= size {
+		return allIndices(size)
+	}
+	return r.Perm(size)[:n]
+}
+
+// ZipfAgents picks agents with a probability that falls off with their rank,
+// the agent seeded kth being picked in proportion to 1/k^S, so that a few
+// agents are busy and most are rarely touched. S must be greater than one.
+type ZipfAgents struct {
+	S float64
+}
+
+func (d ZipfAgents) Name() string {
+	return "zipf:" + strconv.FormatFloat(d.S, 'g', -1, 64)
+}
+
+func (d ZipfAgents) Sample(r *rand.Rand, size, n int) []int {
+	if n >= size {
+		return allIndices(size)
+	}
+	zipf := rand.NewZipf(r, d.S, 1, uint64(size-1))
+	return distinctIndices(size, n, func() int {
+		return int(zipf.Uint64())
+	})
+}
+
+// HotSetAgents picks agents from the first Fraction of them with probability
+// Probability, and from the rest otherwise.
+type HotSetAgents struct {
+	Fraction    float64
+	Probability float64
+}
+
+func (d HotSetAgents) Name() string {
+	return fmt.Sprintf("hotset:%s:%s",
+		strconv.FormatFloat(d.Fraction, 'g', -1, 64),
+		strconv.FormatFloat(d.Probability, 'g', -1, 64))
+}
+
+func (d HotSetAgents) Sample(r *rand.Rand, size, n int) []int {
+	if n >= size {
+		return allIndices(size)
+	}
+	hot := min(max(int(math.Ceil(d.Fraction*float64(size))), 1), size)
+	return distinctIndices(size, n, func() int {
+		if hot == size || r.Float64() < d.Probability {
+			return r.Intn(hot)
+		}
+		return hot + r.Intn(size-hot)
+	})
+}
+
+// ParseAgentDistribution parses a distribution given as uniform, zipf[:s]
+// or hotset[:fraction[:probability]].
+func ParseAgentDistribution(spec string) (AgentDistribution, error) {
+	name, params, _ := strings.Cut(spec, ":")
+	var values []float64
+	if params != "" {
+		for _, param := range strings.Split(params, ":") {
+			v, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing agent distribution %q: %w", spec, err)
+			}
+			values = append(values, v)
+		}
+	}
+	switch {
+	case name == "uniform" && len(values) == 0:
+		return UniformAgents{}, nil
+	case name == "zipf" && len(values) <= 1:
+		d := ZipfAgents{S: 1.1}
+		if len(values) > 0 {
+			d.S = values[0]
+		}
+		if d.S <= 1 {
+			return nil, fmt.Errorf("agent distribution %q: zipf exponent must be greater than one", spec)
+		}
+		return d, nil
+	case name == "hotset" && len(values) <= 2:
+		d := HotSetAgents{Fraction: 0.2, Probability: 0.8}
+		if len(values) > 0 {
+			d.Fraction = values[0]
+		}
+		if len(values) > 1 {
+			d.Probability = values[1]
+		}
+		if d.Fraction <= 0 || d.Fraction > 1 || d.Probability < 0 || d.Probability > 1 {
+			return nil, fmt.Errorf("agent distribution %q: fraction and probability must be between zero and one", spec)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown agent distribution %q", spec)
+}
+
+func allIndices(size int) []int {
+	indices := make([]int, size)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+// distinctIndices draws indices until it has n distinct ones. Skewed
+// distributions can take many draws to find the last few, so after a
+// bounded number it fills up with the lowest indices not yet drawn.
+func distinctIndices(size, n int, draw func() int) []int {
+	seen := make(map[int]bool, n)
+	indices := make([]int, 0, n)
+	for attempts := 0; len(indices) < n && attempts < 100*n; attempts++ {
+		if i := draw(); !seen[i] {
+			seen[i] = true
+			indices = append(indices, i)
+		}
+	}
+	for i := 0; len(indices) < n; i++ {
+		if !seen[i] {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// AgentSamplerSize is how many samples an AgentSampler keeps ready.
+const AgentSamplerSize = 1024
+
+// AgentSampler hands out samples of the agents of databases with a given
+// number of them, drawn ahead of time by a background goroutine until its
+// context is done.
+type AgentSampler struct {
+	dist    AgentDistribution
+	size, n int
+	samples chan []int
+	// misses counts the samples that were drawn inline, because none
+	// were ready or the database did not have the expected number of
+	// agents.
+	misses atomic.Int64
+
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NewAgentSampler starts drawing samples of n of size agents from dist,
+// until ctx is done.
+func NewAgentSampler(ctx context.Context, dist AgentDistribution, size, n int) *AgentSampler {
+	s := &AgentSampler{
+		dist:    dist,
+		size:    size,
+		n:       n,
+		samples: make(chan []int, AgentSamplerSize),
+		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	go func() {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for {
+			select {
+			case s.samples <- dist.Sample(r, size, n):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Take returns the indices of the agents to touch in a database with size
+// agents.
+func (s *AgentSampler) Take(size int) []int {
+	if size == s.size {
+		select {
+		case sample := <-s.samples:
+			return sample
+		default:
+		}
+	}
+	s.misses.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dist.Sample(s.r, size, s.n)
+}
+
+// agentSample is how many agents an operation picks from databases it
+// expects to have size of them. The picks are drawn by the agent samplers
+// of the scenario the operation runs in.
+type agentSample struct {
+	size, n int
+}
+
+// agentSamplers are the samplers of a scenario, started the first time an
+// operation asks for each size and number of agents, which draw from the
+// scenario's distribution until its context is done.
+type agentSamplers struct {
+	ctx  context.Context
+	dist AgentDistribution
+
+	mu       sync.Mutex
+	samplers map[agentSample]*AgentSampler
+}
+
+func newAgentSamplers(ctx context.Context, dist AgentDistribution) *agentSamplers {
+	return &agentSamplers{
+		ctx:      ctx,
+		dist:     dist,
+		samplers: make(map[agentSample]*AgentSampler),
+	}
+}
+
+// get returns the sampler of the sample, starting it the first time.
+func (s *agentSamplers) get(sample agentSample) *AgentSampler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sampler, ok := s.samplers[sample]
+	if !ok {
+		sampler = NewAgentSampler(s.ctx, s.dist, sample.size, sample.n)
+		s.samplers[sample] = sampler
+	}
+	return sampler
+}
+
+// misses returns how many samples the samplers drew inline.
+func (s *agentSamplers) misses() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var misses int64
+	for _, sampler := range s.samplers {
+		misses += sampler.misses.Load()
+	}
+	return misses
+}
+
+type agentSamplersKey struct{}
+
+// withAgentSamplers returns a context carrying the samplers the operations
+// run with it pick agents with.
+func withAgentSamplers(ctx context.Context, samplers *agentSamplers) context.Context {
+	return context.WithValue(ctx, agentSamplersKey{}, samplers)
+}
+
+// inlineAgentSamplers pick agents uniformly for operations run outside of a
+// scenario. Their context is done, so they draw every sample inline.
+var inlineAgentSamplers = func() *agentSamplers {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return newAgentSamplers(ctx, UniformAgents{})
+}()
+
+// agentSamplersOf returns the samplers carried by ctx, or ones drawing
+// uniformly inline if it carries none.
+func agentSamplersOf(ctx context.Context) *agentSamplers {
+	if samplers, ok := ctx.Value(agentSamplersKey{}).(*agentSamplers); ok {
+		return samplers
+	}
+	return inlineAgentSamplers
+}
+
+// agentDirectory holds the agents of each database of a scenario by name,
+// in the order they were seeded, and the samples of them its operations
+// take.
+type agentDirectory struct {
+	mu      sync.Mutex
+	dbs     map[string][]string
+	samples map[agentSample]bool
+}
+
+func newAgentDirectory() *agentDirectory {
+	return &agentDirectory{
+		dbs:     make(map[string][]string),
+		samples: make(map[agentSample]bool),
+	}
+}
+
+// takes records that an operation takes the sample, so that its sampler
+// is started by the first seeding, before the operation first runs.
+func (d *agentDirectory) takes(sample agentSample) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples[sample] = true
+}
+
+// startSamplers starts drawing the samples the operations take, with the
+// samplers carried by ctx.
+func (d *agentDirectory) startSamplers(ctx context.Context) {
+	samplers := agentSamplersOf(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for sample := range d.samples {
+		samplers.get(sample)
+	}
+}
+
+// seeded records the agents a database was seeded with.
+func (d *agentDirectory) seeded(name string, agentUUIDs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dbs[name] = agentUUIDs
+}
+
+// sample returns the agents of db picked by the scenario's sampler, or in a
+// seeded workload picked from its stream by the scenario's distribution. The agents
+// of databases that were not seeded in this run, such as resumed or paired
+// ones, are read from the database the first time, and the result is that
+// of reading them.
+func (d *agentDirectory) sample(ctx context.Context, db DB, sample agentSample) ([]string, OpResult, error) {
+	d.mu.Lock()
+	agentUUIDs, ok := d.dbs[db.Name()]
+	d.mu.Unlock()
+	var result OpResult
+	if !ok {
+		var err error
+		if agentUUIDs, result, err = db.AgentUUIDs(ctx); err != nil {
+			return nil, result, err
+		}
+		d.seeded(db.Name(), agentUUIDs)
+	}
+	if len(agentUUIDs) == 0 {
+		return nil, result, nil
+	}
+	samplers := agentSamplersOf(ctx)
+	var indices []int
+	if r, ok := workloadRand(ctx); ok {
+		indices = samplers.dist.Sample(r, len(agentUUIDs), sample.n)
+	} else {
+		indices = samplers.get(sample).Take(len(agentUUIDs))
+	}
+	picked := make([]string, len(indices))
+	for i, index := range indices {
+		picked[i] = agentUUIDs[index]
+	}
+	return picked, result, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"time"
+)
+
+// InvariantOpts configures checks of the row counts of every database while
+// the scenario runs, so that corruption shows up as it happens.
+type InvariantOpts struct {
+	// Interval is how often the databases are checked. Zero disables the
+	// checks.
+	Interval time.Duration
+	// MaxEventsPerAgent is the number of events per agent that culling
+	// keeps each database below. It defaults to the cull threshold of the
+	// default operations.
+	MaxEventsPerAgent int
+	// Grace is how long a database can have more events than culling
+	// allows before it is a violation, since events build up between
+	// culls. It defaults to twice the cull frequency of the default
+	// operations.
+	Grace time.Duration
+}
+
+const (
+	// Invariants checked by runInvariantChecks.
+	InvariantAgentCount = "agent-count"
+	InvariantEventCount = "event-count"
+)
+
+// invariantState is what the checks remember about a database.
+type invariantState struct {
+	// agents is the number of agents once seeded.
+	agents int
+	// overSince is when the database first had more events than culling
+	// allows, or zero if it has not since it last had fewer.
+	overSince time.Time
+}
+
+// runInvariantChecks checks the databases of the scenario every interval:
+// the number of agents never changes once seeded, and the number of events
+// does not stay above what culling allows for longer than the grace period.
+// Violations are counted by the invariant_violations metric. Databases that
+// are replaced by their supervisor are checked afresh.
+func runInvariantChecks(s *Scenario) {
+	opts := s.opts.Invariants
+	if opts.Interval <= 0 {
+		return
+	}
+	if opts.MaxEventsPerAgent == 0 {
+		opts.MaxEventsPerAgent = 30
+	}
+	if opts.Grace == 0 {
+		opts.Grace = time.Minute
+	}
+	// Export both invariants from the start so that no violations reads
+	// as zero rather than missing.
+	s.metrics.invariantViolations.WithLabelValues(InvariantAgentCount)
+	s.metrics.invariantViolations.WithLabelValues(InvariantEventCount)
+
+	states := make(map[string]*invariantState)
+	check := func() {
+		for _, db := range s.DBs() {
+			plain, ok := db.(PlainDB)
+			if !ok || plain.PlainDB() == nil {
+				continue
+			}
+			var agents, events int
+			err := plain.PlainDB().QueryRow(
+				"SELECT (SELECT count(*) FROM agent), (SELECT count(*) FROM agent_events)",
+			).Scan(&agents, &events)
+			if err != nil {
+				// The database may be busy or being replaced, it
+				// is checked again next time.
+				continue
+			}
+			name := db.Name()
+			state, ok := states[name]
+			if !ok {
+				if agents == 0 {
+					// Not seeded yet.
+					continue
+				}
+				state = &invariantState{agents: agents}
+				states[name] = state
+			}
+			if agents != state.agents {
+				s.invariantViolation(db, InvariantAgentCount, "db %s has %d agents, seeded with %d", name, agents, state.agents)
+				state.agents = agents
+			}
+			if events <= agents*opts.MaxEventsPerAgent {
+				state.overSince = time.Time{}
+				continue
+			}
+			if state.overSince.IsZero() {
+				state.overSince = time.Now()
+			} else if over := time.Since(state.overSince); over > opts.Grace {
+				s.invariantViolation(db, InvariantEventCount, "db %s has had more than %d events per agent for %s, %d events for %d agents",
+					name, opts.MaxEventsPerAgent, over.Round(time.Second), events, agents)
+				// Report a database once per grace period.
+				state.overSince = time.Now()
+			}
+		}
+	}
+
+	t := &s.tomb
+	safeGo(t, func() error {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
+
+// invariantViolation counts a violation of the invariant by db and records
+// it in the scenario's event log.
+func (s *Scenario) invariantViolation(db DB, invariant, format string, args ...any) {
+	s.metrics.invariantViolations.WithLabelValues(invariant).Inc()
+	s.recordEvent("invariant-violation", "%s: %s", invariant, fmt.Sprintf(format, args...))
+	s.snapshotOnAnomaly(db, "invariant-violation-"+invariant)
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Running as a Kubernetes Job or Deployment needs the run to be configured
+// from the environment, probed for health and readiness, and to finish
+// writing its results within the pod's termination grace period.
+
+// FlagsFromEnv sets every flag of fs not given on the command line from the
+// environment variable named by prefix and the flag name in upper case, with
+// dashes as underscores. For example with the prefix SQLAIR_BENCH_, -results
+// is set from SQLAIR_BENCH_RESULTS. This lets a ConfigMap configure a run
+// through envFrom. Repeatable flags can only be given once this way. It
+// must be called after fs.Parse.
+func FlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("setting -%s from %s: %w", f.Name, name, setErr)
+		}
+	})
+	return err
+}
+
+// HealthChecker is a DBProvider that can tell whether it is able to serve
+// databases, such as a cluster that has a leader.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// HealthCheckTimeout bounds how long a readiness probe waits for the health
+// of a provider.
+const HealthCheckTimeout = 5 * time.Second
+
+// handleHealth serves /healthz, which succeeds while the process serves
+// requests, and /readyz, which succeeds while the scenarios are running and
+// the providers among checkers are healthy.
+func handleHealth(mux *http.ServeMux, ready *atomic.Bool, checkers []HealthChecker) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not running", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+		defer cancel()
+		for _, c := range checkers {
+			if err := c.Healthy(ctx); err != nil {
+				http.Error(w, fmt.Sprintf("%T not healthy: %v", c, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// healthCheckers returns the providers of the scenarios that can check
+// their health, each once.
+func healthCheckers(scenarioOpts []*BenchmarkOpts) []HealthChecker {
+	var checkers []HealthChecker
+	seen := make(map[HealthChecker]bool)
+	for _, o := range scenarioOpts {
+		c, ok := o.Provider.(HealthChecker)
+		if !ok || seen[c] {
+			continue
+		}
+		seen[c] = true
+		checkers = append(checkers, c)
+	}
+	return checkers
+}
+
+// waitStopped waits for the scenarios to stop, giving up after timeout so
+// that the run can still be reported on before the pod is killed. A zero
+// timeout waits for as long as they take.
+func waitStopped(allDead <-chan struct{}, timeout time.Duration) {
+	if timeout <= 0 {
+		<-allDead
+		return
+	}
+	select {
+	case <-allDead:
+	case <-time.After(timeout):
+		runLog.Warn("scenarios did not stop in time, reporting on them anyway", "timeout", timeout)
+	}
+}
+
+// uploadResults puts the results file at path to url, such as a presigned
+// object store URL.
+func uploadResults(path, url string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
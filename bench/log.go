@@ -0,0 +1,85 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/pprof"
+	"strings"
+)
+
+// The run logs through slog, so that what it logs can be filtered by level
+// and read by machines as JSON. What operation workers log goes through the
+// worker log, so that logging never holds up a timed operation, and
+// everything else is written straight to stdout. Reports are not logs and
+// are still printed as they are.
+
+var (
+	logLevel  = new(slog.LevelVar)
+	runLog    = slog.New(slog.NewTextHandler(stdout{}, &slog.HandlerOptions{Level: logLevel}))
+	workerLog = slog.New(slog.NewTextHandler(workerLogWriter{}, &slog.HandlerOptions{Level: logLevel}))
+)
+
+// ConfigureLogging sets the level logs are written at, one of debug, info,
+// warn or error, and their format, text or json. It must be called before
+// the run starts.
+func ConfigureLogging(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q, have debug, info, warn and error", level)
+	}
+	var newHandler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch format {
+	case "text":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) }
+	case "json":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) }
+	default:
+		return fmt.Errorf("unknown log format %q, have text and json", format)
+	}
+	logLevel.Set(l)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	runLog = slog.New(newHandler(stdout{}, opts))
+	workerLog = slog.New(newHandler(workerLogWriter{}, opts))
+	return nil
+}
+
+// Logger returns the logger of the run.
+func Logger() *slog.Logger {
+	return runLog
+}
+
+// scenarioLog returns the logger of a component of the scenario.
+func scenarioLog(s *Scenario, component string) *slog.Logger {
+	return runLog.With("component", component, "scenario", s.name, "wrapper", s.opts.Wrapper.Name())
+}
+
+// logOp logs from inside an operation, through the worker log, with the
+// scenario, wrapper and operation taken from the profiler labels of ctx and
+// the database the operation runs against.
+func logOp(ctx context.Context, level slog.Level, db DB, msg string, args ...any) {
+	if !workerLog.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]any, 0, 8+len(args))
+	for _, key := range []string{"scenario", "wrapper", "operation"} {
+		if v, ok := pprof.Label(ctx, key); ok {
+			attrs = append(attrs, key, v)
+		}
+	}
+	attrs = append(attrs, "db", db.Name())
+	workerLog.Log(ctx, level, msg, append(attrs, args...)...)
+}
+
+// workerLogWriter writes the lines of a log handler to the default worker
+// log.
+type workerLogWriter struct{}
+
+func (workerLogWriter) Write(p []byte) (int, error) {
+	DefaultWorkerLog().Println(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// With more than one copy of each operation running against a database at
+// once, writes can race. Lost-update detection quantifies what that costs
+// each wrapper and transaction mode: every database has a version that an
+// operation reads and writes back incremented, and the increments that
+// succeeded are counted as they happen. Once the run is over, any
+// shortfall of the version against that count is increments lost to
+// concurrent writers.
+
+// versionCounts counts the successful increments of the version of each
+// database of a scenario by name.
+type versionCounts struct {
+	mu  sync.Mutex
+	dbs map[string]int
+}
+
+func newVersionCounts() *versionCounts {
+	return &versionCounts{dbs: make(map[string]int)}
+}
+
+// track returns db with its successful increments counted.
+func (c *versionCounts) track(db DB) DB {
+	c.mu.Lock()
+	c.dbs[db.Name()] = 0
+	c.mu.Unlock()
+	return &versionedDB{DB: db, counts: c}
+}
+
+// count returns the increments of the database of the given name, and
+// whether they were counted at all.
+func (c *versionCounts) count(name string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.dbs[name]
+	return n, ok
+}
+
+// versionedDB counts the successful increments of a database's version.
+type versionedDB struct {
+	DB
+	counts *versionCounts
+}
+
+func (db *versionedDB) PlainDB() *sql.DB {
+	if plain, ok := db.DB.(PlainDB); ok {
+		return plain.PlainDB()
+	}
+	return nil
+}
+
+func (db *versionedDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	result, err := db.DB.IncrementVersion(ctx)
+	if err == nil {
+		db.counts.mu.Lock()
+		db.counts.dbs[db.Name()]++
+		db.counts.mu.Unlock()
+	}
+	return result, err
+}
+
+// LostUpdateResult is the outcome of checking the versions of the
+// databases of a scenario.
+type LostUpdateResult struct {
+	Scenario string `json:"scenario"`
+	Wrapper  string `json:"wrapper"`
+	RunInTx  bool   `json:"run_in_tx"`
+	// Checked counts the databases whose version was read, and Skipped
+	// those whose increments were not counted, such as resumed or paired
+	// databases, or that could not be read.
+	Checked int `json:"checked"`
+	Skipped int `json:"skipped"`
+	// Increments is how many increments succeeded, and Lost how many of
+	// those the versions do not reflect.
+	Increments int `json:"increments"`
+	Lost       int `json:"lost"`
+	// Ahead is how many increments the versions reflect beyond those
+	// that succeeded, left by increments that failed but were applied
+	// anyway, which are not lost updates.
+	Ahead int `json:"ahead"`
+}
+
+// checkLostUpdates compares the version of every database of the scenario
+// with the increments counted.
+func checkLostUpdates(s *Scenario) LostUpdateResult {
+	result := LostUpdateResult{
+		Scenario: s.name,
+		Wrapper:  s.opts.Wrapper.Name(),
+		RunInTx:  s.opts.RunInTx,
+	}
+	aheadDBs := 0
+	for _, db := range s.DBs() {
+		name, plain, unpin := pinPlainDB(db)
+		increments, counted := s.versions.count(name)
+		if !counted || plain == nil {
+			unpin()
+			result.Skipped++
+			continue
+		}
+		var version int
+		err := plain.QueryRow("SELECT version FROM version WHERE id = 1").Scan(&version)
+		unpin()
+		if err != nil {
+			scenarioLog(s, "lost-updates").Warn("cannot read version", "db", name, "err", err)
+			result.Skipped++
+			continue
+		}
+		result.Checked++
+		result.Increments += increments
+		if version < increments {
+			result.Lost += increments - version
+		} else if version > increments {
+			result.Ahead += version - increments
+			aheadDBs++
+		}
+	}
+	if aheadDBs > 0 {
+		scenarioLog(s, "lost-updates").Info("db versions ahead of their successful increments",
+			"dbs", aheadDBs, "ahead", result.Ahead)
+	}
+	return result
+}
+
+// checkScenariosLostUpdates checks the versions of every scenario that
+// counts its increments.
+func checkScenariosLostUpdates(scenarios []*Scenario) []LostUpdateResult {
+	var results []LostUpdateResult
+	for _, s := range scenarios {
+		if s.versions != nil {
+			results = append(results, checkLostUpdates(s))
+		}
+	}
+	return results
+}
+
+// printLostUpdateReport writes the updates lost by each scenario.
+func printLostUpdateReport(w io.Writer, results []LostUpdateResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "lost updates:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tRUN_IN_TX\tCHECKED\tSKIPPED\tINCREMENTS\tLOST\tLOST%\tAHEAD")
+	for _, r := range results {
+		rate := 0.0
+		if r.Increments > 0 {
+			rate = 100 * float64(r.Lost) / float64(r.Increments)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%.2f\t%d\n", r.Scenario, r.Wrapper, strconv.FormatBool(r.RunInTx),
+			r.Checked, r.Skipped, r.Increments, r.Lost, rate, r.Ahead)
+	}
+	return tw.Flush()
+}
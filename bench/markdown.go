@@ -0,0 +1,139 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// writeMarkdownReport writes the results as GitHub flavoured Markdown, to be
+// pasted into issues and pull requests. Runs with both a plain SQL and a
+// sqlair scenario get a table of the difference between them and any
+// difference in their query plans, and if a baseline run is given every
+// operation is also compared against it.
+func writeMarkdownReport(w io.Writer, r RunResults, baseline *RunResults) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## sqlair-bench results\n\n")
+	fmt.Fprintf(&b, "Generated %s.\n\n", r.Generated.Format("2006-01-02 15:04:05 MST"))
+
+	b.WriteString("| scenario | wrapper | provider | run in tx | dbs |\n")
+	b.WriteString("|---|---|---|---|--:|\n")
+	for _, s := range r.Scenarios {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d |\n", markdownEscape(s.Name),
+			markdownEscape(s.Metadata["wrapper"]), markdownEscape(s.Metadata["provider"]),
+			markdownEscape(s.Metadata["run_in_tx"]), s.DBs)
+	}
+
+	b.WriteString("\n### Operations\n\n")
+	b.WriteString("| scenario | operation | count | errors | mean | p50 | p95 | p99 |\n")
+	b.WriteString("|---|---|--:|--:|--:|--:|--:|--:|\n")
+	for _, op := range r.Ops {
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %s | %s | %s | %s |\n",
+			markdownEscape(op.Scenario), markdownEscape(op.Operation), op.Count, op.Errors,
+			op.Mean, op.P50, op.P95, op.P99)
+	}
+
+	// sqlair against plain SQL within the run.
+	var sqlName, sqlairName string
+	for _, s := range r.Scenarios {
+		switch s.Metadata["wrapper"] {
+		case SQLWrapper{}.Name():
+			if sqlName == "" {
+				sqlName = s.Name
+			}
+		case SQLairWrapper{}.Name():
+			if sqlairName == "" {
+				sqlairName = s.Name
+			}
+		}
+	}
+	if sqlName != "" && sqlairName != "" {
+		fmt.Fprintf(&b, "\n### %s compared with %s\n\n", markdownEscape(sqlairName), markdownEscape(sqlName))
+		base := make(map[string]OpStats)
+		for _, op := range r.Ops {
+			if op.Scenario == sqlName {
+				base[op.Operation] = op
+			}
+		}
+		var pairs [][2]OpStats
+		for _, op := range r.Ops {
+			if prev, ok := base[op.Operation]; ok && op.Scenario == sqlairName {
+				pairs = append(pairs, [2]OpStats{prev, op})
+			}
+		}
+		writeMarkdownDeltas(&b, pairs, func(op OpStats) string { return op.Operation })
+	}
+
+	if len(r.Plans) > 0 {
+		b.WriteString("\n### Query plans\n\n")
+		same := true
+		for _, c := range r.Plans {
+			if len(c.Diff) == 0 {
+				continue
+			}
+			same = false
+			fmt.Fprintf(&b, "%s differs (`-` plain SQL, `+` sqlair):\n\n```diff\n%s\n```\n\n",
+				markdownEscape(c.Operation), strings.Join(c.Diff, "\n"))
+		}
+		if same {
+			b.WriteString("sqlair and plain SQL get the same query plan for every operation.\n")
+		}
+	}
+
+	if baseline != nil {
+		fmt.Fprintf(&b, "\n### Compared with baseline from %s\n\n", baseline.Generated.Format("2006-01-02 15:04:05 MST"))
+		base := make(map[opKey]OpStats)
+		for _, op := range baseline.Ops {
+			base[opKey{op.Scenario, op.Operation}] = op
+		}
+		var pairs [][2]OpStats
+		for _, op := range r.Ops {
+			if prev, ok := base[opKey{op.Scenario, op.Operation}]; ok {
+				pairs = append(pairs, [2]OpStats{prev, op})
+			}
+		}
+		writeMarkdownDeltas(&b, pairs, func(op OpStats) string { return op.Scenario + "/" + op.Operation })
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMarkdownDeltas writes a table of how each pair of statistics changed
+// from the first to the second. Changes worse than CompareThreshold are in
+// bold.
+func writeMarkdownDeltas(b *strings.Builder, pairs [][2]OpStats, name func(OpStats) string) {
+	b.WriteString("| operation | mean | Δ mean | p50 | Δ p50 | p95 | Δ p95 | p99 | Δ p99 | errors | Δ errors |\n")
+	b.WriteString("|---|--:|--:|--:|--:|--:|--:|--:|--:|--:|--:|\n")
+	delta := func(before, after time.Duration) string {
+		d := percentChange(float64(before), float64(after))
+		if d > CompareThreshold {
+			return fmt.Sprintf("**%+.1f%%**", d)
+		}
+		return fmt.Sprintf("%+.1f%%", d)
+	}
+	for _, p := range pairs {
+		a, z := p[0], p[1]
+		errs := fmt.Sprintf("%+d", int64(z.Errors)-int64(a.Errors))
+		if errorRate(&z) > errorRate(&a) {
+			errs = "**" + errs + "**"
+		}
+		fmt.Fprintf(b, "| %s | %s | %s | %s | %s | %s | %s | %s | %s | %d | %s |\n",
+			markdownEscape(name(z)),
+			z.Mean, delta(a.Mean, z.Mean),
+			z.P50, delta(a.P50, z.P50),
+			z.P95, delta(a.P95, z.P95),
+			z.P99, delta(a.P99, z.P99),
+			z.Errors, errs)
+	}
+}
+
+// markdownEscape stops text from breaking out of a table cell or being
+// rendered as markup.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "*", `\*`, "_", `\_`, "\n", " ").Replace(s)
+}
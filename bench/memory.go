@@ -0,0 +1,285 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// MemorySampleInterval is how often memory use is sampled. Garbage is not
+// collected before sampling, since that would disturb the run, so the
+// estimates rely on there being many samples.
+const MemorySampleInterval = 10 * time.Second
+
+// MemorySample is the memory use of the process alongside the number of
+// databases each scenario had at the time.
+type MemorySample struct {
+	Time      time.Time      `json:"time"`
+	HeapAlloc uint64         `json:"heap_alloc"`
+	RSS       uint64         `json:"rss"`
+	DBs       map[string]int `json:"dbs"`
+}
+
+// MemoryEstimate is the estimated memory each extra database of a scenario
+// costs, in bytes.
+type MemoryEstimate struct {
+	Scenario  string  `json:"scenario"`
+	Wrapper   string  `json:"wrapper"`
+	Provider  string  `json:"provider"`
+	HeapPerDB float64 `json:"heap_per_db"`
+	RSSPerDB  float64 `json:"rss_per_db"`
+	// Combined is set when the scenarios added databases in step with
+	// each other, so their costs could not be told apart and the estimate
+	// is the cost of a database of any of them.
+	Combined bool `json:"combined,omitempty"`
+}
+
+// MemorySampler samples the memory use of the process as the scenarios add
+// databases.
+type MemorySampler struct {
+	mu      sync.Mutex
+	samples []MemorySample
+}
+
+// runMemorySampler samples memory use every MemorySampleInterval until the
+// tomb is dying.
+func runMemorySampler(t *tomb.Tomb, scenarios []*Scenario) *MemorySampler {
+	m := &MemorySampler{}
+	sample := func() {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s := MemorySample{
+			Time:      time.Now(),
+			HeapAlloc: mem.HeapAlloc,
+			RSS:       readRSS(),
+			DBs:       make(map[string]int, len(scenarios)),
+		}
+		for _, sc := range scenarios {
+			s.DBs[sc.Name()] = len(sc.DBs())
+		}
+		m.mu.Lock()
+		m.samples = append(m.samples, s)
+		m.mu.Unlock()
+	}
+
+	t.Go(func() error {
+		ticker := time.NewTicker(MemorySampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+	return m
+}
+
+// Samples returns the samples taken so far.
+func (m *MemorySampler) Samples() []MemorySample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MemorySample(nil), m.samples...)
+}
+
+// readRSS returns the resident set size of the process, or zero if it
+// cannot be read.
+func readRSS() uint64 {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// estimateMemoryPerDB fits memory use against the number of databases of
+// every scenario by least squares, giving the memory each database of each
+// scenario costs. If the scenarios added databases in step, their costs
+// cannot be separated and the memory is fitted against the total number of
+// databases instead.
+func estimateMemoryPerDB(scenarios []*Scenario, samples []MemorySample) []MemoryEstimate {
+	if len(samples) < 3 || len(scenarios) == 0 {
+		return nil
+	}
+	names := make([]string, len(scenarios))
+	for i, s := range scenarios {
+		names[i] = s.Name()
+	}
+	series := make([][]float64, len(names))
+	for i, name := range names {
+		series[i] = make([]float64, len(samples))
+		for j, sample := range samples {
+			series[i][j] = float64(sample.DBs[name])
+		}
+	}
+	heap := make([]float64, len(samples))
+	rss := make([]float64, len(samples))
+	for j, sample := range samples {
+		heap[j] = float64(sample.HeapAlloc)
+		rss[j] = float64(sample.RSS)
+	}
+
+	combined := false
+	for i := range series {
+		for j := i + 1; j < len(series); j++ {
+			if math.Abs(correlation(series[i], series[j])) > 0.95 {
+				combined = true
+			}
+		}
+	}
+	var heapSlopes, rssSlopes []float64
+	if !combined {
+		heapSlopes = leastSquares(series, heap)
+		rssSlopes = leastSquares(series, rss)
+		combined = heapSlopes == nil || rssSlopes == nil
+	}
+	if combined {
+		total := make([]float64, len(samples))
+		for _, s := range series {
+			for j, v := range s {
+				total[j] += v
+			}
+		}
+		heapSlope, rssSlope := leastSquares([][]float64{total}, heap), leastSquares([][]float64{total}, rss)
+		if heapSlope == nil || rssSlope == nil {
+			return nil
+		}
+		heapSlopes = make([]float64, len(names))
+		rssSlopes = make([]float64, len(names))
+		for i := range names {
+			heapSlopes[i], rssSlopes[i] = heapSlope[0], rssSlope[0]
+		}
+	}
+
+	estimates := make([]MemoryEstimate, len(scenarios))
+	for i, s := range scenarios {
+		metadata := s.Metadata()
+		estimates[i] = MemoryEstimate{
+			Scenario:  s.Name(),
+			Wrapper:   metadata["wrapper"],
+			Provider:  metadata["provider"],
+			HeapPerDB: heapSlopes[i],
+			RSSPerDB:  rssSlopes[i],
+			Combined:  combined,
+		}
+	}
+	return estimates
+}
+
+// printMemoryReport writes the estimated memory per database of each
+// scenario.
+func printMemoryReport(w io.Writer, estimates []MemoryEstimate) error {
+	if len(estimates) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "estimated memory per database:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tPROVIDER\tHEAP/DB\tRSS/DB")
+	for _, e := range estimates {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f KiB\t%.1f KiB\n",
+			e.Scenario, e.Wrapper, e.Provider, e.HeapPerDB/1024, e.RSSPerDB/1024)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if estimates[0].Combined {
+		fmt.Fprintln(w, "the scenarios added databases together, so the estimate is shared; run them separately to tell them apart")
+	}
+	return nil
+}
+
+// leastSquares fits y = c + Σ b_i x_i and returns the coefficients b, or nil
+// if they cannot be determined.
+func leastSquares(x [][]float64, y []float64) []float64 {
+	k := len(x) + 1
+	// Build the normal equations, with the constant as the last column.
+	a := make([][]float64, k)
+	for i := range a {
+		a[i] = make([]float64, k+1)
+	}
+	row := make([]float64, k)
+	for j := range y {
+		for i := range x {
+			row[i] = x[i][j]
+		}
+		row[k-1] = 1
+		for r := 0; r < k; r++ {
+			for c := 0; c < k; c++ {
+				a[r][c] += row[r] * row[c]
+			}
+			a[r][k] += row[r] * y[j]
+		}
+	}
+
+	// Gaussian elimination with partial pivoting.
+	for col := 0; col < k; col++ {
+		pivot := col
+		for r := col + 1; r < k; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return nil
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for r := 0; r < k; r++ {
+			if r == col {
+				continue
+			}
+			f := a[r][col] / a[col][col]
+			for c := col; c <= k; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+		}
+	}
+	b := make([]float64, k-1)
+	for i := range b {
+		b[i] = a[i][k] / a[i][i]
+	}
+	return b
+}
+
+// correlation returns the Pearson correlation of x and y, or zero if either
+// does not vary.
+func correlation(x, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+	}
+	mx, my := sx/n, sy/n
+	var cov, vx, vy float64
+	for i := range x {
+		cov += (x[i] - mx) * (y[i] - my)
+		vx += (x[i] - mx) * (x[i] - mx)
+		vy += (y[i] - my) * (y[i] - my)
+	}
+	if vx == 0 || vy == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vx*vy)
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ScenarioMetrics are the metrics recorded by a single scenario. Every
+// metric carries a scenario label so that scenarios running side by side
+// never share a time series.
+type ScenarioMetrics struct {
+	registerer prometheus.Registerer
+	factory    metricFactory
+
+	dbCreationTime      prometheus.Histogram
+	dbCreationInFlight  prometheus.Gauge
+	dbTotal             prometheus.Counter
+	dbRemoved           prometheus.Counter
+	dbTeardownTime      prometheus.Histogram
+	dbAgentGauge        *prometheus.GaugeVec
+	dbAgentEventsGauge  *prometheus.GaugeVec
+	dbOrphanedEvents    *prometheus.GaugeVec
+	phase               *prometheus.GaugeVec
+	stage               *prometheus.GaugeVec
+	supervisorIncidents *prometheus.CounterVec
+	metadata            *prometheus.GaugeVec
+	rateLimitWait       prometheus.Counter
+	chaosFaults         *prometheus.CounterVec
+	chaosFaultErrors    *prometheus.CounterVec
+	chaosRecoveryTime   *prometheus.HistogramVec
+	injectedRollbacks   prometheus.Counter
+	noisyNeighbourLocks prometheus.Counter
+	rollbackRetryCost   prometheus.Histogram
+	invariantViolations *prometheus.CounterVec
+	differentialChecks  *prometheus.CounterVec
+	commitFailures      *prometheus.CounterVec
+	txRetries           *prometheus.CounterVec
+	spawnQueueDepth     prometheus.Gauge
+	spawnStalls         prometheus.Counter
+	spawnStallTime      prometheus.Counter
+	schedulerLag        prometheus.Histogram
+	schedulerBacklog    prometheus.Gauge
+	poolStats           *poolStatsCollector
+	diskUsage           *diskUsageCollector
+}
+
+func newScenarioMetrics(scenario string) *ScenarioMetrics {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{
+		"scenario": scenario,
+	}, prometheus.DefaultRegisterer)
+	factory := metricFactory{reg: reg}
+
+	return &ScenarioMetrics{
+		registerer: reg,
+		factory:    factory,
+
+		dbCreationTime: factory.NewHistogram(prometheus.HistogramOpts{
+			Name: "db_creation_time",
+			Buckets: []float64{
+				0.001,
+				0.01,
+				0.1,
+				1.0,
+				10.0,
+			},
+		}),
+
+		dbCreationInFlight: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "db_creation_in_flight",
+			Help: "The number of dbs currently being created",
+		}),
+
+		dbTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "db_total",
+			Help: "The total number of dbs",
+		}),
+
+		dbRemoved: factory.NewCounter(prometheus.CounterOpts{
+			Name: "db_removed",
+			Help: "The number of dbs removed from the run by the ramp or churn",
+		}),
+
+		dbTeardownTime: factory.NewHistogram(prometheus.HistogramOpts{
+			Name: "db_teardown_time",
+			Help: "The time taken to stop the operations of a removed db, close it and delete it",
+			Buckets: []float64{
+				0.001,
+				0.01,
+				0.1,
+				1.0,
+				10.0,
+			},
+		}),
+
+		dbAgentGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "db_agents",
+		}, []string{"db"}),
+
+		dbAgentEventsGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "db_agent_events",
+		}, []string{"db"}),
+
+		dbOrphanedEvents: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "db_orphaned_agent_events",
+			Help: "The number of events whose agent does not exist",
+		}, []string{"db"}),
+
+		phase: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "benchmark_phase",
+			Help: "Set to 1 for the phase the benchmark is currently in",
+		}, []string{"phase"}),
+
+		stage: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "benchmark_workload_stage",
+			Help: "Set to 1 for the workload stage the benchmark is currently in",
+		}, []string{"stage"}),
+
+		supervisorIncidents: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_supervisor_incidents",
+			Help: "The number of times a failing db was recreated or dropped",
+		}, []string{"action"}),
+
+		rateLimitWait: factory.NewCounter(prometheus.CounterOpts{
+			Name: "rate_limit_wait_seconds",
+			Help: "The total time operations were held back by the rate limiter",
+		}),
+
+		chaosFaults: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "chaos_faults",
+			Help: "The number of faults injected",
+		}, []string{"fault"}),
+
+		chaosFaultErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "chaos_fault_errors",
+			Help: "The number of operations that failed while a fault was in place",
+		}, []string{"fault"}),
+
+		chaosRecoveryTime: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "chaos_recovery_time",
+			Help: "The time taken to recover once a fault was removed",
+			Buckets: []float64{
+				0.1,
+				1.0,
+				10.0,
+				60.0,
+			},
+		}, []string{"fault"}),
+
+		injectedRollbacks: factory.NewCounter(prometheus.CounterOpts{
+			Name: "tx_injected_rollbacks",
+			Help: "The number of transactions rolled back instead of committed",
+		}),
+
+		noisyNeighbourLocks: factory.NewCounter(prometheus.CounterOpts{
+			Name: "noisy_neighbour_locks",
+			Help: "The number of times a noisy neighbour held a write lock on a db",
+		}),
+
+		rollbackRetryCost: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tx_rollback_retry_cost",
+			Help:    "The time spent on transaction attempts that were rolled back",
+			Buckets: timeBucketSplits,
+		}),
+
+		invariantViolations: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "invariant_violations",
+			Help: "The number of times the row counts of a db broke an invariant",
+		}, []string{"invariant"}),
+
+		differentialChecks: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "differential_checks",
+			Help: "The number of databases read through both sql and sqlair, by whether the results matched",
+		}, []string{"result"}),
+
+		commitFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "tx_injected_commit_failures",
+			Help: "The number of commits made to fail transiently, by the failure they imitated",
+		}, []string{"kind"}),
+
+		txRetries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "tx_retries",
+			Help: "The number of transactions retried after failing transiently, by the failure",
+		}, []string{"reason"}),
+
+		spawnQueueDepth: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "db_spawn_queue_depth",
+			Help: "The number of dbs created whose operations have not started yet",
+		}),
+
+		spawnStalls: factory.NewCounter(prometheus.CounterOpts{
+			Name: "db_spawn_stalls",
+			Help: "The number of times db creation waited for operations to start on earlier dbs",
+		}),
+
+		spawnStallTime: factory.NewCounter(prometheus.CounterOpts{
+			Name: "db_spawn_stall_seconds",
+			Help: "The time db creation spent waiting for operations to start on earlier dbs",
+		}),
+
+		schedulerLag: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "scheduler_lag_seconds",
+			Help:    "How long after they were due operations started, including any wait for the rate limit",
+			Buckets: timeBucketSplits,
+		}),
+
+		schedulerBacklog: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "scheduler_backlog",
+			Help: "The number of runs of periodic operations that are due but have not started, in open loop",
+		}),
+
+		poolStats: register(reg, newPoolStatsCollector()),
+
+		diskUsage: register(reg, newDiskUsageCollector()),
+
+		metadata: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "benchmark_metadata",
+			Help: "Always 1, labelled with the settings the scenario was run with",
+		}, []string{"key", "value"}),
+	}
+}
+
+// metricFactory creates metrics and registers them, like promauto.Factory,
+// except that a metric already registered with the same name and labels is
+// returned instead of panicking. Metrics are keyed by their labels, which
+// carry the scenario, wrapper and operation, so however many times a
+// scenario is created in a run, and however many scenarios share a name, each
+// time series is registered once and shared.
+type metricFactory struct {
+	reg prometheus.Registerer
+}
+
+func (f metricFactory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	return register(f.reg, prometheus.NewCounter(opts))
+}
+
+func (f metricFactory) NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	return register(f.reg, prometheus.NewCounterVec(opts, labels))
+}
+
+func (f metricFactory) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	return register(f.reg, prometheus.NewGauge(opts))
+}
+
+func (f metricFactory) NewGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	return register(f.reg, prometheus.NewGaugeVec(opts, labels))
+}
+
+func (f metricFactory) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	return register(f.reg, prometheus.NewHistogram(opts))
+}
+
+func (f metricFactory) NewHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	return register(f.reg, prometheus.NewHistogramVec(opts, labels))
+}
+
+// register registers c with reg and returns it, or returns the collector
+// already registered in its place if that is of the same type. It panics if
+// the metric clashes with one of a different kind, which is a programming
+// error.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
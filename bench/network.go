@@ -0,0 +1,152 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/canonical/go-dqlite/client"
+)
+
+// Network sits between the nodes of a dqlite cluster, adding latency and
+// jitter to everything they send and partitioning nodes on demand, so that
+// WAN-like deployments can be benchmarked on a single machine.
+type Network struct {
+	// Latency is added to every write a node makes, and a random extra
+	// of up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	mu          sync.Mutex
+	partitioned map[string]bool
+	conns       map[*shapedConn]struct{}
+}
+
+func NewNetwork(latency, jitter time.Duration) *Network {
+	return &Network{
+		Latency:     latency,
+		Jitter:      jitter,
+		partitioned: make(map[string]bool),
+		conns:       make(map[*shapedConn]struct{}),
+	}
+}
+
+// Partition cuts the node at addr off from the rest of the cluster until it
+// is healed. Existing connections to and from the node are closed.
+func (n *Network) Partition(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitioned[addr] = true
+	for c := range n.conns {
+		if c.local == addr || c.remote == addr {
+			_ = c.Conn.Close()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// Heal reconnects a partitioned node.
+func (n *Network) Heal(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.partitioned, addr)
+}
+
+// dialer returns the function the node at local uses to dial other nodes.
+func (n *Network) dialer(local string) client.DialFunc {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if n.isPartitioned(local, addr) {
+			return nil, fmt.Errorf("network partitioned between %s and %s", local, addr)
+		}
+		conn, err := client.DefaultDialFunc(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return n.track(conn, local, addr), nil
+	}
+}
+
+// listen accepts connections to the node at addr and passes them to the
+// node on the returned channel until ctx is done.
+func (n *Network) listen(ctx context.Context, addr string) (chan net.Conn, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	accepted := make(chan net.Conn)
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if n.isPartitioned(addr) {
+				_ = conn.Close()
+				continue
+			}
+			select {
+			case accepted <- n.track(conn, addr, ""):
+			case <-ctx.Done():
+				_ = conn.Close()
+				return
+			}
+		}
+	}()
+	return accepted, nil
+}
+
+func (n *Network) isPartitioned(addrs ...string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, addr := range addrs {
+		if n.partitioned[addr] {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Network) track(conn net.Conn, local, remote string) net.Conn {
+	c := &shapedConn{Conn: conn, network: n, local: local, remote: remote}
+	n.mu.Lock()
+	n.conns[c] = struct{}{}
+	n.mu.Unlock()
+	return c
+}
+
+// shapedConn delays every write by the latency of the network.
+type shapedConn struct {
+	net.Conn
+	network *Network
+	// local is the node that owns this end of the connection and remote
+	// the node it dialled, if known.
+	local, remote string
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	delay := c.network.Latency
+	if c.network.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.network.Jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *shapedConn) Close() error {
+	c.network.mu.Lock()
+	delete(c.network.conns, c)
+	c.network.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpCSVSize is how many rows the operation CSV holds before it starts
+// dropping them.
+const OpCSVSize = 1 << 16
+
+// opCSVHeader names the columns of the operation CSV.
+var opCSVHeader = []string{"timestamp", "scenario", "wrapper", "operation", "db", "duration_seconds", "error"}
+
+// OpCSV appends a row to a CSV file for every operation run in the measure
+// phase, so that the timings can be analysed with other tools without
+// scraping Prometheus.
+// Rows are written by a WorkerLog, so recording one never waits on the
+// file.
+type OpCSV struct {
+	f   *os.File
+	log *WorkerLog
+}
+
+// OpenOpCSV opens the CSV file at path to append rows to, writing the
+// header first if the file is new or empty.
+func OpenOpCSV(path string) (*OpCSV, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	c := &OpCSV{f: f, log: NewWorkerLog(f, OpCSVSize)}
+	if info.Size() == 0 {
+		c.log.Println(csvLine(opCSVHeader))
+	}
+	return c, nil
+}
+
+// record queues a row for an operation that started at start and took
+// elapsed, failing with err if it is not nil.
+func (c *OpCSV) record(start time.Time, scenario, wrapper, op, db string, elapsed time.Duration, err error) {
+	errString := ""
+	if err != nil {
+		errString = err.Error()
+	}
+	c.log.Println(csvLine([]string{
+		start.UTC().Format(time.RFC3339Nano),
+		scenario,
+		wrapper,
+		op,
+		db,
+		strconv.FormatFloat(elapsed.Seconds(), 'f', -1, 64),
+		errString,
+	}))
+}
+
+// Dropped returns the number of rows dropped because the queue was full.
+func (c *OpCSV) Dropped() int64 {
+	return c.log.Dropped()
+}
+
+// Close writes out the rows queued so far and closes the file.
+func (c *OpCSV) Close() error {
+	c.log.Flush()
+	return c.f.Close()
+}
+
+// csvLine formats the fields as a line of CSV, without its line ending.
+func csvLine(fields []string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	_ = w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// opCSVRow is a row of the operation CSV.
+type opCSVRow struct {
+	start    time.Time
+	scenario string
+	wrapper  string
+	op       string
+	db       string
+	elapsed  time.Duration
+	failed   bool
+}
+
+// readOpCSV reads the operation CSV at path and summarises it as the
+// results of a run, with the latencies bucketed like the operation
+// histograms and a timeline sampled every TimelineInterval, so that it can
+// be reported on like the results file.
+func readOpCSV(path string) (RunResults, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RunResults{}, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = len(opCSVHeader)
+	header, err := r.Read()
+	if err != nil {
+		return RunResults{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if !slices.Equal(header, opCSVHeader) {
+		return RunResults{}, fmt.Errorf("%s is not an operation csv, its header is %v", path, header)
+	}
+	byScenario := make(map[string][]opCSVRow)
+	var names []string
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return RunResults{}, fmt.Errorf("reading %s: %w", path, err)
+		}
+		row, err := parseOpCSVRow(record)
+		if err != nil {
+			line, _ := r.FieldPos(0)
+			return RunResults{}, fmt.Errorf("reading %s line %d: %w", path, line, err)
+		}
+		if _, ok := byScenario[row.scenario]; !ok {
+			names = append(names, row.scenario)
+		}
+		byScenario[row.scenario] = append(byScenario[row.scenario], row)
+	}
+	sort.Strings(names)
+
+	results := RunResults{Generated: time.Now()}
+	aggs := make(map[opKey]*histogramAgg)
+	for _, name := range names {
+		rows := byScenario[name]
+		sort.Slice(rows, func(i, j int) bool { return rows[i].start.Before(rows[j].start) })
+		scenario := ScenarioResults{Name: name, Metadata: map[string]string{"wrapper": rows[0].wrapper}}
+		dbs := make(map[string]bool)
+		var ops, errs int64
+		next := rows[0].start
+		for _, row := range rows {
+			for !row.start.Before(next) {
+				scenario.Timeline = append(scenario.Timeline, TimelinePoint{Time: next, DBs: len(dbs), Ops: ops, Errors: errs})
+				next = next.Add(TimelineInterval)
+			}
+			dbs[row.db] = true
+			ops++
+			if row.failed {
+				errs++
+			}
+
+			k := opKey{row.scenario, row.op}
+			agg, ok := aggs[k]
+			if !ok {
+				agg = &histogramAgg{buckets: make(map[float64]uint64)}
+				aggs[k] = agg
+			}
+			agg.count++
+			agg.sum += row.elapsed.Seconds()
+			if row.failed {
+				agg.errors++
+			}
+			for _, bound := range timeBucketSplits {
+				if row.elapsed.Seconds() <= bound {
+					agg.buckets[bound]++
+				}
+			}
+			agg.buckets[math.Inf(1)]++
+		}
+		scenario.Timeline = append(scenario.Timeline, TimelinePoint{Time: next, DBs: len(dbs), Ops: ops, Errors: errs})
+		scenario.DBs = len(dbs)
+		results.Scenarios = append(results.Scenarios, scenario)
+	}
+	results.Ops = opStats(aggs)
+	results.Latencies = latencyDistributions(aggs)
+	return results, nil
+}
+
+// parseOpCSVRow parses a record of the operation CSV.
+func parseOpCSVRow(record []string) (opCSVRow, error) {
+	start, err := time.Parse(time.RFC3339Nano, record[0])
+	if err != nil {
+		return opCSVRow{}, err
+	}
+	seconds, err := strconv.ParseFloat(record[5], 64)
+	if err != nil {
+		return opCSVRow{}, err
+	}
+	return opCSVRow{
+		start:    start,
+		scenario: record[1],
+		wrapper:  record[2],
+		op:       record[3],
+		db:       record[4],
+		elapsed:  time.Duration(seconds * float64(time.Second)),
+		failed:   record[6] != "",
+	}, nil
+}
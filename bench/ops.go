@@ -0,0 +1,476 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"runtime/debug"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/tomb.v2"
+)
+
+// DBOperation is an operation run against a database. It returns what it
+// did alongside its error, and ctx bounds it.
+type DBOperation func(ctx context.Context, db DB) (OpResult, error)
+
+// seedModelAgents seeds the agents of a database, taking their UUIDs from
+// the pool so that generating them is not timed, and records them in the
+// directory for the operations that pick agents, whose samplers it starts.
+// In a seeded workload the UUIDs are drawn from its stream instead.
+func seedModelAgents(numAgents int, pool *UUIDPool, agents *agentDirectory) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "seeding agents")
+
+		var uuids []string
+		if r, ok := workloadRand(ctx); ok {
+			uuids = seededUUIDs(r, numAgents)
+		} else {
+			uuids = pool.Take(numAgents)
+		}
+		agentUUIDS := make([]any, 0, numAgents*3)
+
+		for _, uuid := range uuids {
+			agentUUIDS = append(agentUUIDS, uuid, db.Name(), "inactive")
+		}
+		result, err := db.SeedModelAgents(ctx, agentUUIDS)
+		if err != nil {
+			return result, err
+		}
+		agents.seeded(db.Name(), uuids)
+		agents.startSamplers(ctx)
+		return result, nil
+	}
+}
+
+// updateModelAgentStatus sets the status of a sample of the agents.
+func updateModelAgentStatus(agents *agentDirectory, sample agentSample, status string) DBOperation {
+	agents.takes(sample)
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "updating agent status")
+		agentUUIDs, read, err := agents.sample(ctx, db, sample)
+		if err != nil || len(agentUUIDs) == 0 {
+			return read, err
+		}
+		result, err := db.UpdateModelAgentStatus(ctx, agentUUIDs, status)
+		return read.Add(result), err
+	}
+}
+
+// generateAgentEvents inserts events for a sample of the agents.
+func generateAgentEvents(agents *agentDirectory, sample agentSample) DBOperation {
+	agents.takes(sample)
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "generating agent events")
+		agentUUIDs, read, err := agents.sample(ctx, db, sample)
+		if err != nil || len(agentUUIDs) == 0 {
+			return read, err
+		}
+		result, err := db.GenerateAgentEvents(ctx, agentUUIDs)
+		return read.Add(result), err
+	}
+}
+
+func cullAgentEvents(maxEvents int) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "culling agent events")
+		return db.CullAgentEvents(ctx, maxEvents)
+	}
+}
+
+func agentModelCount(gaugeVec *prometheus.GaugeVec) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "counting agents")
+
+		count, result, err := db.AgentModelCount(ctx)
+		if err != nil {
+			return result, err
+		}
+		if count == 0 {
+			return result, nil
+		}
+
+		gauge, err := gaugeVec.GetMetricWithLabelValues(db.Name())
+		if err != nil {
+			return result, err
+		}
+
+		gauge.Set(float64(count))
+		return result, nil
+	}
+}
+
+func agentEventModelCount(gaugeVec *prometheus.GaugeVec) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "counting agent events")
+
+		count, result, err := db.AgentEventModelCount(ctx)
+		if err != nil {
+			return result, err
+		}
+		if count == 0 {
+			return result, nil
+		}
+
+		gauge, err := gaugeVec.GetMetricWithLabelValues(db.Name())
+
+		if err != nil {
+			return result, err
+		}
+
+		gauge.Set(float64(count))
+		return result, nil
+	}
+}
+
+func incrementVersion() DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "incrementing version")
+		return db.IncrementVersion(ctx)
+	}
+}
+
+// logOperation records a logical operation under a new id from the pool, so
+// that how many times it was applied can be checked.
+func logOperation(pool *UUIDPool) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "logging operation")
+		return db.LogOperation(ctx, pool.Take(1)[0])
+	}
+}
+
+// orphanedAgentEvents audits the referential integrity of the events. Unlike
+// the other counts, zero is recorded too, since it is the expected value.
+func orphanedAgentEvents(gaugeVec *prometheus.GaugeVec) DBOperation {
+	return func(ctx context.Context, db DB) (OpResult, error) {
+		logOp(ctx, slog.LevelDebug, db, "counting orphaned agent events")
+
+		count, result, err := db.OrphanedAgentEventCount(ctx)
+		if err != nil {
+			return result, err
+		}
+
+		gauge, err := gaugeVec.GetMetricWithLabelValues(db.Name())
+		if err != nil {
+			return result, err
+		}
+
+		gauge.Set(float64(count))
+		return result, nil
+	}
+}
+
+var (
+	timeBucketSplits = []float64{
+		0.0001,
+		0.0002,
+		0.0003,
+		0.0004,
+		0.0005,
+		0.0006,
+		0.0007,
+		0.0008,
+		0.0009,
+		0.001,
+		0.01,
+		0.1,
+		1.0,
+	}
+)
+
+// runDBOp runs op against db and observes how long it took since start. It
+// is on the path of every operation, so it avoids allocating, unlike a
+// prometheus.Timer.
+func runDBOp(
+	ctx context.Context,
+	op DBOperation,
+	db DB,
+	obs prometheus.Observer,
+	start time.Time,
+) (OpResult, time.Duration, error) {
+	result, err := op(ctx, db)
+	elapsed := time.Since(start)
+	obs.Observe(elapsed.Seconds())
+	return result, elapsed, err
+}
+
+// OperationEnv is the part of a scenario that operations need to run.
+type OperationEnv struct {
+	// iterations is the number of times each operation runs against each
+	// database in fixed work mode, or zero.
+	iterations int
+	// timeout bounds each run of an operation, if set.
+	timeout   time.Duration
+	scheduler *Scheduler
+	phases    *PhaseClock
+	stages    *StageClock
+	metrics   map[string]*opMetrics
+	// fault is the fault currently injected into the run, or NoFault.
+	fault atomic.Value
+	// lastError holds the most recent error returned by an operation, in
+	// an opError. It is only formatted when read.
+	lastError atomic.Value
+	// recentErrors holds the most recent errors of the scenario.
+	recentErrors *errorRing
+	// opCSV, if set, has a row appended for every operation run, labelled
+	// with the scenario and wrapper.
+	opCSV    *OpCSV
+	scenario string
+	wrapper  string
+	// workloads, if set, seeds what the operations pick against each
+	// database.
+	workloads *workloadSeeds
+}
+
+// NoFault labels operations run while no fault is injected.
+const NoFault = "none"
+
+// setFault labels the operations run from now on with the given fault.
+func (env *OperationEnv) setFault(fault string) {
+	env.fault.Store(fault)
+}
+
+type opMetrics struct {
+	// labels carries the profiler labels of the operation, so CPU
+	// profiles can be broken down by scenario, wrapper and operation, and
+	// the agent samplers of the scenario.
+	labels    context.Context
+	histogram *shardedHistogramVec
+	// firstRow and scan split the time of the reads the operation makes
+	// into the time until their first row is available and the time
+	// spent scanning their rows.
+	firstRow *shardedHistogramVec
+	scan     *shardedHistogramVec
+	// hdr records the latency exactly, across every phase, stage and
+	// fault.
+	hdr      *shardedHDR
+	errCount *prometheus.CounterVec
+	// busy counts the errors caused by the database being locked.
+	busy prometheus.Counter
+	// errClass counts the errors by their errorClass.
+	errClass *prometheus.CounterVec
+	// rowsAffected and rowsScanned count the rows the operation wrote and
+	// read.
+	rowsAffected prometheus.Counter
+	rowsScanned  prometheus.Counter
+
+	// children are the histogram and error counter for the labels the
+	// operation last ran with, so they are not looked up every run.
+	children atomic.Pointer[opChildren]
+
+	runs   atomic.Int64
+	errors atomic.Int64
+}
+
+// opChildren are the metrics of an operation for one set of labels.
+type opChildren struct {
+	phase, stage, fault string
+
+	histogram prometheus.Observer
+	firstRow  prometheus.Observer
+	scan      prometheus.Observer
+	errCount  prometheus.Counter
+}
+
+// opError wraps errors stored in OperationEnv.lastError, which needs values
+// of a single concrete type.
+type opError struct {
+	err error
+}
+
+// resolve returns the metrics of the operation for the given labels. The
+// labels change only with the phase, stage or fault, so the last metrics
+// resolved are nearly always the ones needed.
+func (m *opMetrics) resolve(phase, stage, fault string) *opChildren {
+	c := m.children.Load()
+	if c != nil && c.phase == phase && c.stage == stage && c.fault == fault {
+		return c
+	}
+	c = &opChildren{
+		phase:     phase,
+		stage:     stage,
+		fault:     fault,
+		histogram: m.histogram.WithLabelValues(phase, stage, fault),
+		firstRow:  m.firstRow.WithLabelValues(phase, stage, fault),
+		scan:      m.scan.WithLabelValues(phase, stage, fault),
+		errCount:  m.errCount.WithLabelValues(phase, stage, fault),
+	}
+	m.children.Store(c)
+	return c
+}
+
+// lastErrorString returns the most recent error returned by an operation,
+// or the empty string if there has been none.
+func (env *OperationEnv) lastErrorString() string {
+	e, ok := env.lastError.Load().(opError)
+	if !ok {
+		return ""
+	}
+	return e.err.Error()
+}
+
+// errorCount returns the number of operations that have failed so far.
+func (env *OperationEnv) errorCount() int64 {
+	var n int64
+	for _, m := range env.metrics {
+		n += m.errors.Load()
+	}
+	return n
+}
+
+// runCount returns the number of operations that have run so far.
+func (env *OperationEnv) runCount() int64 {
+	var n int64
+	for _, m := range env.metrics {
+		n += m.runs.Load()
+	}
+	return n
+}
+
+// successCount returns the number of operations that have succeeded so far.
+func (env *OperationEnv) successCount() int64 {
+	var n int64
+	for _, m := range env.metrics {
+		n += m.runs.Load() - m.errors.Load()
+	}
+	return n
+}
+
+// runOnce runs the operation against db and records the outcome, with its
+// latency measured from start. The operation draws what it picks from
+// workload if it is not nil. It returns true if the database has been
+// dropped from the run.
+func (env *OperationEnv) runOnce(def DBOperationDef, db DB, start time.Time, workload *rand.Rand) bool {
+	metrics := env.metrics[def.OpName]
+	phase := env.phases.Current()
+	children := metrics.resolve(string(phase), env.stages.Name(), env.fault.Load().(string))
+	pprof.SetGoroutineLabels(metrics.labels)
+	// The profiler labels are passed on to the database with the context.
+	ctx := metrics.labels
+	if workload != nil {
+		ctx = withWorkloadRand(ctx, workload)
+	}
+	cancel := context.CancelFunc(nil)
+	if env.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, env.timeout)
+	}
+	result, elapsed, err := runDBOp(ctx, def.Op, db, children.histogram, start)
+	class := ""
+	if err != nil {
+		class = errorClass(ctx, err)
+	}
+	if cancel != nil {
+		cancel()
+	}
+	pprof.SetGoroutineLabels(context.Background())
+	if errors.Is(err, ErrDBDropped) {
+		return true
+	}
+	// Only the measure phase is recorded for the reports at the end of
+	// the run, the Prometheus metrics are labelled with the phase instead.
+	if phase == PhaseMeasure {
+		if env.opCSV != nil {
+			env.opCSV.record(start, env.scenario, env.wrapper, def.OpName, db.Name(), elapsed, err)
+		}
+		metrics.hdr.Record(elapsed)
+	}
+	metrics.runs.Add(1)
+	metrics.rowsAffected.Add(float64(result.RowsAffected))
+	metrics.rowsScanned.Add(float64(result.RowsScanned))
+	if result.RowsScanned > 0 {
+		children.firstRow.Observe(result.FirstRowTime.Seconds())
+		children.scan.Observe(result.ScanTime.Seconds())
+	}
+	if err != nil {
+		metrics.errors.Add(1)
+		children.errCount.Inc()
+		env.lastError.Store(opError{err: err})
+		if isBusy(err) {
+			metrics.busy.Inc()
+		}
+		metrics.errClass.WithLabelValues(class).Inc()
+		env.recentErrors.add(recentError{time: time.Now(), op: def.OpName, db: db.Name(), err: err})
+		logOp(metrics.labels, slog.LevelWarn, db, "operation failed", "err", err)
+	}
+	return false
+}
+
+// RunDBOperation schedules an operation to be run against db at the frequency
+// set by the current workload stage, or just once if its frequency is zero.
+// The operation stops being scheduled once the tomb is dying. A panic in the
+// operation kills the tomb.
+//
+// In fixed work mode the operation instead runs back to back for the
+// configured number of iterations, then calls done.
+func RunDBOperation(
+	t *tomb.Tomb,
+	env *OperationEnv,
+	def DBOperationDef,
+	db DB,
+	done func(),
+) {
+	iterations := 0
+	if env.iterations > 0 {
+		iterations = env.iterations
+		if def.Freq == time.Duration(0) {
+			iterations = 1
+		}
+	}
+
+	workload := env.workloads.rand(db.Name(), def.OpName)
+	run := func(start time.Time) (next time.Duration) {
+		if !t.Alive() {
+			return 0
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				t.Kill(fmt.Errorf("operation %s panicked: %v\n%s", def.OpName, r, debug.Stack()))
+				next = 0
+			}
+		}()
+
+		freq, enabled := def.Freq, true
+		if def.Freq != 0 {
+			freq, enabled = env.stages.Freq(def.OpName, def.Freq)
+		}
+		if !enabled {
+			// Check again later in case the stage has changed.
+			return freq
+		}
+
+		if dropped := env.runOnce(def, db, start, workload); dropped {
+			t.Kill(nil)
+			return 0
+		}
+		if iterations > 0 {
+			iterations--
+			if iterations == 0 {
+				done()
+				return 0
+			}
+			return time.Nanosecond
+		}
+		return freq
+	}
+
+	if def.Freq == time.Duration(0) || env.iterations > 0 {
+		env.scheduler.Schedule(0, run)
+		return
+	}
+
+	var initalDelay time.Duration
+	if workload != nil {
+		initalDelay = time.Duration(workload.Int63n(int64(def.Freq)))
+	} else {
+		initalDelay = time.Duration(rand.Int63n(int64(def.Freq)))
+	}
+	env.scheduler.Schedule(initalDelay, run)
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AllocSampleRuns is the number of times each operation is run when
+// measuring its allocations.
+const AllocSampleRuns = 20
+
+// Overhead is the cost of sqlair over plain SQL for one operation. The
+// overheads are relative to plain SQL, in percent.
+type Overhead struct {
+	Operation string
+
+	SQLMean, SQLairMean time.Duration
+	MeanOverhead        float64
+	SQLP99, SQLairP99   time.Duration
+	P99Overhead         float64
+
+	SQLAllocs, SQLairAllocs float64
+	AllocOverhead           float64
+}
+
+// overheadPairs are the wrappers sqlair's overhead is reported for, each a
+// plain SQL wrapper and the sqlair wrapper that works the same way.
+var overheadPairs = [][2]DBWrapper{
+	{SQLWrapper{}, SQLairWrapper{}},
+	{PreparedSQLWrapper{}, PreparedSQLairWrapper{}},
+}
+
+// overheadScenarios returns the first scenario using each of the given
+// plain SQL and sqlair wrappers, or nil if there is not one of each.
+func overheadScenarios(scenarios []*Scenario, sqlWrapper, sqlairWrapper DBWrapper) (sql, sqlair *Scenario) {
+	for _, s := range scenarios {
+		switch s.Metadata()["wrapper"] {
+		case sqlWrapper.Name():
+			if sql == nil {
+				sql = s
+			}
+		case sqlairWrapper.Name():
+			if sqlair == nil {
+				sqlair = s
+			}
+		}
+	}
+	if sql == nil || sqlair == nil {
+		return nil, nil
+	}
+	return sql, sqlair
+}
+
+// printOverheadReport writes sqlair's overhead over plain SQL for each of
+// the overheadPairs with a scenario of both wrappers in the run.
+func printOverheadReport(w io.Writer, scenarios []*Scenario) error {
+	var stats []OpStats
+	for _, pair := range overheadPairs {
+		sqlScenario, sqlairScenario := overheadScenarios(scenarios, pair[0], pair[1])
+		if sqlScenario == nil {
+			continue
+		}
+		if stats == nil {
+			var err error
+			if stats, err = gatherOpStats(measuredPhases...); err != nil {
+				return err
+			}
+			withHDRPercentiles(stats, scenarios)
+		}
+		if err := printOverhead(w, sqlScenario, sqlairScenario, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printOverhead writes sqlair's overhead over plain SQL for every operation
+// run by both scenarios, along with the overall overhead. Latencies come
+// from the run, the P99 from its HDR histograms. Allocations are measured afterwards by running each
+// operation on its own against a fresh in-memory database, since the
+// allocations of concurrent operations cannot be told apart.
+func printOverhead(w io.Writer, sqlScenario, sqlairScenario *Scenario, stats []OpStats) error {
+	sqlAllocs, err := measureAllocs(sqlScenario.opts.Wrapper, sqlScenario.opts.RunInTx, sqlScenario.opts.operations(unregisteredMetrics()))
+	if err != nil {
+		return fmt.Errorf("measuring %s allocations: %w", sqlScenario.Name(), err)
+	}
+	sqlairAllocs, err := measureAllocs(sqlairScenario.opts.Wrapper, sqlairScenario.opts.RunInTx, sqlairScenario.opts.operations(unregisteredMetrics()))
+	if err != nil {
+		return fmt.Errorf("measuring %s allocations: %w", sqlairScenario.Name(), err)
+	}
+
+	byOp := make(map[string]OpStats)
+	for _, op := range stats {
+		if op.Scenario == sqlScenario.Name() {
+			byOp[op.Operation] = op
+		}
+	}
+	var overheads []Overhead
+	var total [2]struct {
+		time   time.Duration
+		count  uint64
+		allocs float64
+	}
+	for _, op := range stats {
+		base, ok := byOp[op.Operation]
+		if op.Scenario != sqlairScenario.Name() || !ok || base.Count == 0 || op.Count == 0 {
+			continue
+		}
+		o := Overhead{
+			Operation:    op.Operation,
+			SQLMean:      base.Mean,
+			SQLairMean:   op.Mean,
+			MeanOverhead: percentChange(float64(base.Mean), float64(op.Mean)),
+			SQLP99:       base.P99,
+			SQLairP99:    op.P99,
+			P99Overhead:  percentChange(float64(base.P99), float64(op.P99)),
+			SQLAllocs:    sqlAllocs[op.Operation],
+			SQLairAllocs: sqlairAllocs[op.Operation],
+		}
+		o.AllocOverhead = percentChange(o.SQLAllocs, o.SQLairAllocs)
+		overheads = append(overheads, o)
+		for i, s := range []OpStats{base, op} {
+			total[i].time += s.Mean * time.Duration(s.Count)
+			total[i].count += s.Count
+		}
+		total[0].allocs += o.SQLAllocs
+		total[1].allocs += o.SQLairAllocs
+	}
+	if len(overheads) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "sqlair overhead over plain SQL (%s vs %s):\n", sqlairScenario.Name(), sqlScenario.Name())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tSQL MEAN\tSQLAIR MEAN\tOVERHEAD\tSQL P99\tSQLAIR P99\tOVERHEAD\tSQL ALLOCS\tSQLAIR ALLOCS\tOVERHEAD")
+	for _, o := range overheads {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%+.1f%%\t%s\t%s\t%+.1f%%\t%.0f\t%.0f\t%+.1f%%\n",
+			o.Operation, o.SQLMean, o.SQLairMean, o.MeanOverhead,
+			o.SQLP99, o.SQLairP99, o.P99Overhead,
+			o.SQLAllocs, o.SQLairAllocs, o.AllocOverhead)
+	}
+	sqlMean := total[0].time / time.Duration(total[0].count)
+	sqlairMean := total[1].time / time.Duration(total[1].count)
+	fmt.Fprintf(tw, "overall\t%s\t%s\t%+.1f%%\t\t\t\t%.0f\t%.0f\t%+.1f%%\n",
+		sqlMean, sqlairMean, percentChange(float64(sqlMean), float64(sqlairMean)),
+		total[0].allocs, total[1].allocs, percentChange(total[0].allocs, total[1].allocs))
+	return tw.Flush()
+}
+
+// measureAllocs returns the mean number of allocations made by each of ops
+// when it runs on its own against a fresh in-memory database
+// wrapped by wrapper. Each periodic operation is run once before measuring,
+// so that one-off costs such as preparing statements are left out.
+func measureAllocs(wrapper DBWrapper, runInTx bool, ops []DBOperationDef) (map[string]float64, error) {
+	name := uuid.New().String()
+	sqldb, err := NewSQLiteDBProvider().NewDB(name)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Close()
+	db := wrapper.Wrap(sqldb, name, runInTx)
+	// The agents are sampled ahead of time, as they are in a scenario,
+	// so that sampling them is not counted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = withAgentSamplers(ctx, newAgentSamplers(ctx, UniformAgents{}))
+
+	allocs := make(map[string]float64)
+	var before, after runtime.MemStats
+	for _, def := range ops {
+		// Initialisation can only run once, so it is measured without
+		// warming up.
+		runs := 1
+		if def.Freq != time.Duration(0) {
+			runs = AllocSampleRuns
+			if _, err := def.Op(ctx, db); err != nil {
+				return nil, fmt.Errorf("%s: %w", def.OpName, err)
+			}
+		}
+		runtime.ReadMemStats(&before)
+		for i := 0; i < runs; i++ {
+			if _, err := def.Op(ctx, db); err != nil {
+				return nil, fmt.Errorf("%s: %w", def.OpName, err)
+			}
+		}
+		runtime.ReadMemStats(&after)
+		allocs[def.OpName] = float64(after.Mallocs-before.Mallocs) / float64(runs)
+	}
+	return allocs, nil
+}
+
+// unregisteredMetrics returns metrics for running operations outside of a
+// scenario. The count operations report to gauges, which are not registered
+// so the runs do not show up in the run's metrics.
+func unregisteredMetrics() *ScenarioMetrics {
+	return &ScenarioMetrics{
+		dbAgentGauge:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "db_agents"}, []string{"db"}),
+		dbAgentEventsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "db_agent_events"}, []string{"db"}),
+		dbOrphanedEvents:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "db_orphaned_agent_events"}, []string{"db"}),
+	}
+}
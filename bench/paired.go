@@ -0,0 +1,137 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Pairing gives the scenarios that share it identical copies of the same
+// databases, so that wrappers can be compared without differences in the
+// data they run against. Each database is created and initialised once as
+// a template, using the plain SQL wrapper, and the n'th database of every
+// scenario is a clone of the n'th template. Used with the same
+// deterministic options, the scenarios then also run the same operations.
+// Only SQLite databases can be cloned.
+type Pairing struct {
+	mu        sync.Mutex
+	templates []*pairedTemplate
+	// created is the number of databases each scenario has created.
+	created map[string]int
+}
+
+// pairedTemplate is a database that is cloned for each scenario. It is kept
+// open for the whole run so that in-memory templates are not lost.
+type pairedTemplate struct {
+	once sync.Once
+	name string
+	db   *sql.DB
+	err  error
+}
+
+func NewPairing() *Pairing {
+	return &Pairing{created: make(map[string]int)}
+}
+
+// NewDB returns a clone of the next template for the scenario, creating the
+// template with initOps if no other scenario has yet. The clone is already
+// initialised and must be used under the returned name, since the template
+// data refers to it.
+func (p *Pairing) NewDB(s *Scenario, initOps []DBOperation) (*sql.DB, string, error) {
+	p.mu.Lock()
+	n := p.created[s.name]
+	p.created[s.name]++
+	for len(p.templates) <= n {
+		p.templates = append(p.templates, &pairedTemplate{name: uuid.New().String()})
+	}
+	template := p.templates[n]
+	p.mu.Unlock()
+
+	template.once.Do(func() {
+		template.db, template.err = newTemplate(s.opts.Provider, template.name, initOps)
+	})
+	if template.err != nil {
+		return nil, "", template.err
+	}
+
+	clone, err := s.opts.Provider.NewDB(template.name + "-" + s.name)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := cloneDB(clone, template.db); err != nil {
+		_ = clone.Close()
+		return nil, "", fmt.Errorf("cloning db %s: %w", template.name, err)
+	}
+	return clone, template.name, nil
+}
+
+// newTemplate creates and initialises a template database.
+func newTemplate(provider DBProvider, name string, initOps []DBOperation) (*sql.DB, error) {
+	sqldb, err := provider.NewDB(name)
+	if err != nil {
+		return nil, err
+	}
+	db := SQLWrapper{}.Wrap(sqldb, name, true)
+	for _, op := range initOps {
+		if _, err := op(context.Background(), db); err != nil {
+			_ = sqldb.Close()
+			return nil, err
+		}
+	}
+	return sqldb, nil
+}
+
+// cloneDB copies the contents of src over dst with the SQLite backup API.
+func cloneDB(dst, src *sql.DB) error {
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			to, ok := sqliteConn(dstDriverConn)
+			if !ok {
+				return fmt.Errorf("cannot clone into %T connections", dstDriverConn)
+			}
+			from, ok := sqliteConn(srcDriverConn)
+			if !ok {
+				return fmt.Errorf("cannot clone from %T connections", srcDriverConn)
+			}
+			backup, err := to.Backup("main", from, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				_ = backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// sqliteConn returns the SQLite connection underneath a driver connection.
+func sqliteConn(driverConn any) (*sqlite3.SQLiteConn, bool) {
+	switch conn := driverConn.(type) {
+	case *sqlite3.SQLiteConn:
+		return conn, true
+	case *slowSyncConn:
+		return conn.conn, true
+	}
+	return nil, false
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"time"
+)
+
+// Phase is the stage of a benchmark run that an operation was executed in.
+type Phase string
+
+const (
+	PhaseWarmup   Phase = "warmup"
+	PhaseMeasure  Phase = "measure"
+	PhaseCooldown Phase = "cooldown"
+	PhaseDone     Phase = "done"
+)
+
+var phases = []Phase{PhaseWarmup, PhaseMeasure, PhaseCooldown, PhaseDone}
+
+// measuredPhases are the phases whose samples are reported on at the end of
+// the run, so that cold caches and statements being prepared for the first
+// time during the warmup do not skew the comparison of wrappers.
+var measuredPhases = []Phase{PhaseMeasure}
+
+// PhaseSchedule declares how long each phase of a run lasts. Operations run
+// in every phase but only samples taken in the measure phase should be
+// aggregated when reporting. A zero Measure duration never ends the
+// measurement phase.
+type PhaseSchedule struct {
+	Warmup   time.Duration
+	Measure  time.Duration
+	Cooldown time.Duration
+}
+
+// PhaseClock reports the phase of a run based on the time since it started.
+type PhaseClock struct {
+	start    time.Time
+	schedule PhaseSchedule
+}
+
+func NewPhaseClock(schedule PhaseSchedule, start time.Time) *PhaseClock {
+	return &PhaseClock{
+		start:    start,
+		schedule: schedule,
+	}
+}
+
+// Current returns the phase the run is in now.
+func (c *PhaseClock) Current() Phase {
+	return c.phaseAt(time.Since(c.start))
+}
+
+func (c *PhaseClock) phaseAt(elapsed time.Duration) Phase {
+	if elapsed < c.schedule.Warmup {
+		return PhaseWarmup
+	}
+	if c.schedule.Measure == 0 {
+		return PhaseMeasure
+	}
+	elapsed -= c.schedule.Warmup
+	if elapsed < c.schedule.Measure {
+		return PhaseMeasure
+	}
+	elapsed -= c.schedule.Measure
+	if elapsed < c.schedule.Cooldown {
+		return PhaseCooldown
+	}
+	return PhaseDone
+}
+
+// measuredUntil returns how much of the run up to end was spent in the
+// measure phase.
+func (c *PhaseClock) measuredUntil(end time.Time) time.Duration {
+	elapsed := end.Sub(c.start) - c.schedule.Warmup
+	if elapsed < 0 {
+		return 0
+	}
+	if c.schedule.Measure > 0 && elapsed > c.schedule.Measure {
+		return c.schedule.Measure
+	}
+	return elapsed
+}
+
+// next returns the time left until the phase after the current one begins.
+// It returns false if the current phase never ends.
+func (c *PhaseClock) next() (time.Duration, bool) {
+	elapsed := time.Since(c.start)
+	var boundary time.Duration
+	switch c.phaseAt(elapsed) {
+	case PhaseWarmup:
+		boundary = c.schedule.Warmup
+	case PhaseMeasure:
+		if c.schedule.Measure == 0 {
+			return 0, false
+		}
+		boundary = c.schedule.Warmup + c.schedule.Measure
+	case PhaseCooldown:
+		boundary = c.schedule.Warmup + c.schedule.Measure + c.schedule.Cooldown
+	default:
+		return 0, false
+	}
+	return boundary - elapsed, true
+}
+
+// runPhases publishes the current phase of the run and kills the tomb once
+// the cooldown phase has finished.
+func runPhases(s *Scenario, clock *PhaseClock) {
+	setPhase := func(current Phase) {
+		for _, p := range phases {
+			v := 0.0
+			if p == current {
+				v = 1
+			}
+			s.metrics.phase.WithLabelValues(string(p)).Set(v)
+		}
+		scenarioLog(s, "phases").Info("entering phase", "phase", current)
+	}
+
+	t := &s.tomb
+	safeGo(t, func() error {
+		for {
+			current := clock.Current()
+			setPhase(current)
+			if current == PhaseDone {
+				t.Kill(nil)
+				return nil
+			}
+
+			wait, ok := clock.next()
+			if !ok {
+				<-t.Dying()
+				return nil
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,314 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+)
+
+// StatementPlan is the query plan SQLite chose for one statement run by an
+// operation.
+type StatementPlan struct {
+	SQL  string   `json:"sql"`
+	Plan []string `json:"plan"`
+}
+
+// PlanComparison compares the query plans of the statements an operation
+// runs under plain SQL with those it runs under sqlair.
+type PlanComparison struct {
+	Operation string          `json:"operation"`
+	SQL       []StatementPlan `json:"sql"`
+	SQLair    []StatementPlan `json:"sqlair"`
+	// Diff is the difference between the plans, one line per plan line
+	// prefixed by "-" if only plain SQL has it, "+" if only sqlair has it
+	// and " " if both do. It is empty if the plans are the same.
+	Diff []string `json:"diff,omitempty"`
+}
+
+// compareQueryPlans captures the query plan of every statement each
+// operation runs under the first plain SQL and sqlair scenarios, and
+// compares them. Runs without both have no comparison.
+func compareQueryPlans(scenarios []*Scenario) ([]PlanComparison, error) {
+	sqlScenario, sqlairScenario := overheadScenarios(scenarios, SQLWrapper{}, SQLairWrapper{})
+	if sqlScenario == nil {
+		return nil, nil
+	}
+	sqlPlans, err := captureQueryPlans(sqlScenario.opts.Wrapper, sqlScenario.opts.RunInTx, sqlScenario.opts.operations(unregisteredMetrics()))
+	if err != nil {
+		return nil, fmt.Errorf("capturing %s query plans: %w", sqlScenario.Name(), err)
+	}
+	sqlairPlans, err := captureQueryPlans(sqlairScenario.opts.Wrapper, sqlairScenario.opts.RunInTx, sqlairScenario.opts.operations(unregisteredMetrics()))
+	if err != nil {
+		return nil, fmt.Errorf("capturing %s query plans: %w", sqlairScenario.Name(), err)
+	}
+
+	var comparisons []PlanComparison
+	for _, def := range sqlScenario.opts.operations(unregisteredMetrics()) {
+		c := PlanComparison{
+			Operation: def.OpName,
+			SQL:       sqlPlans[def.OpName],
+			SQLair:    sqlairPlans[def.OpName],
+		}
+		before, after := planLines(c.SQL), planLines(c.SQLair)
+		if strings.Join(before, "\n") != strings.Join(after, "\n") {
+			c.Diff = diffLines(before, after)
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons, nil
+}
+
+// captureQueryPlans runs each of ops once against a fresh in-memory
+// database wrapped by wrapper and returns the plan SQLite chooses for each
+// statement it runs. Statements with no plan, such as BEGIN or inserting
+// values, are left out.
+func captureQueryPlans(wrapper DBWrapper, runInTx bool, ops []DBOperationDef) (map[string][]StatementPlan, error) {
+	name := uuid.New().String()
+	// The schema is created through a plain connection, which also keeps
+	// the shared in-memory database alive.
+	plain, err := NewSQLiteDBProvider().NewDB(name)
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	rec := &planRecorder{}
+	explained := sql.OpenDB(&explainingConnector{
+		dsn: "file:" + name + ".db?cache=shared&mode=memory",
+		rec: rec,
+	})
+	defer explained.Close()
+	db := wrapper.Wrap(explained, name, runInTx)
+
+	plans := make(map[string][]StatementPlan)
+	for _, def := range ops {
+		if _, err := def.Op(context.Background(), db); err != nil {
+			return nil, fmt.Errorf("%s: %w", def.OpName, err)
+		}
+		recorded, err := rec.reset()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", def.OpName, err)
+		}
+		plans[def.OpName] = recorded
+	}
+	return plans, nil
+}
+
+// planLines flattens the plans of an operation's statements into lines.
+func planLines(plans []StatementPlan) []string {
+	var lines []string
+	for i, p := range plans {
+		lines = append(lines, fmt.Sprintf("statement %d:", i+1))
+		for _, l := range p.Plan {
+			lines = append(lines, "  "+l)
+		}
+	}
+	return lines
+}
+
+// diffLines returns the lines of a and b in order, prefixed by "-" if only a
+// has them, "+" if only b has them and " " if both do.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// printQueryPlans writes the operations whose query plans differ between
+// plain SQL and sqlair, with the difference between them.
+func printQueryPlans(w io.Writer, comparisons []PlanComparison) {
+	if len(comparisons) == 0 {
+		return
+	}
+	var differ []PlanComparison
+	for _, c := range comparisons {
+		if len(c.Diff) > 0 {
+			differ = append(differ, c)
+		}
+	}
+	if len(differ) == 0 {
+		fmt.Fprintln(w, "sqlair and plain SQL get the same query plans for every operation")
+		return
+	}
+	fmt.Fprintf(w, "sqlair gets different query plans to plain SQL for %d operations:\n", len(differ))
+	for _, c := range differ {
+		fmt.Fprintf(w, "%s (- plain SQL, + sqlair):\n", c.Operation)
+		for _, l := range c.Diff {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+}
+
+// planRecorder collects the plans of the statements run through an
+// explainingConnector.
+type planRecorder struct {
+	mu    sync.Mutex
+	plans []StatementPlan
+	err   error
+}
+
+func (r *planRecorder) record(query string, plan []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		if r.err == nil {
+			r.err = fmt.Errorf("explaining %q: %w", query, err)
+		}
+		return
+	}
+	if len(plan) > 0 {
+		r.plans = append(r.plans, StatementPlan{SQL: query, Plan: plan})
+	}
+}
+
+// reset returns the plans recorded so far, or the first error explaining a
+// statement, and starts afresh.
+func (r *planRecorder) reset() ([]StatementPlan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	plans, err := r.plans, r.err
+	r.plans, r.err = nil, nil
+	return plans, err
+}
+
+// explainingConnector opens SQLite connections that record the query plan
+// of every statement before running it, so the plans of the SQL each
+// wrapper generates can be compared. Statements are explained on the
+// connection that runs them, as they may refer to its temporary tables.
+type explainingConnector struct {
+	dsn string
+	rec *planRecorder
+}
+
+func (c *explainingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &explainingConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), rec: c.rec}, nil
+}
+
+func (c *explainingConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+type explainingConn struct {
+	*sqlite3.SQLiteConn
+	rec *planRecorder
+}
+
+// explain records the query plan of query.
+func (c *explainingConn) explain(ctx context.Context, query string, args []driver.NamedValue) {
+	plan, err := c.queryPlan(ctx, query, args)
+	c.rec.record(query, plan, err)
+}
+
+// queryPlan returns the lines of the query plan of query, indented to show
+// how they nest.
+func (c *explainingConn) queryPlan(ctx context.Context, query string, args []driver.NamedValue) ([]string, error) {
+	rows, err := c.SQLiteConn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	depth := make(map[int64]int)
+	var plan []string
+	row := make([]driver.Value, len(rows.Columns()))
+	for {
+		if err := rows.Next(row); err == io.EOF {
+			return plan, nil
+		} else if err != nil {
+			return nil, err
+		}
+		id, _ := row[0].(int64)
+		parent, _ := row[1].(int64)
+		depth[id] = depth[parent] + 1
+		plan = append(plan, strings.Repeat("  ", depth[id]-1)+fmt.Sprint(row[3]))
+	}
+}
+
+func (c *explainingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *explainingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &explainingStmt{Stmt: stmt, query: query, conn: c}, nil
+}
+
+func (c *explainingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.explain(ctx, query, args)
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (c *explainingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.explain(ctx, query, args)
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+type explainingStmt struct {
+	driver.Stmt
+	query string
+	conn  *explainingConn
+}
+
+func (s *explainingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, errors.New("statement does not support ExecContext")
+	}
+	s.conn.explain(ctx, s.query, args)
+	return execer.ExecContext(ctx, args)
+}
+
+func (s *explainingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, errors.New("statement does not support QueryContext")
+	}
+	s.conn.explain(ctx, s.query, args)
+	return queryer.QueryContext(ctx, args)
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolOpts configures the database/sql connection pool of every database a
+// scenario gets from its provider. With hundreds of databases, each with a
+// pool of its own, how many connections are kept open and for how long
+// dominates latency. Zero values leave the database/sql defaults.
+type PoolOpts struct {
+	// MaxOpen bounds the open connections of each database, as
+	// sql.DB.SetMaxOpenConns.
+	MaxOpen int
+	// MaxIdle bounds the idle connections kept by each database, as
+	// sql.DB.SetMaxIdleConns.
+	MaxIdle int
+	// MaxLifetime is how long a connection is reused for before it is
+	// closed, as sql.DB.SetConnMaxLifetime.
+	MaxLifetime time.Duration
+}
+
+// Validate checks the options are not negative.
+func (o PoolOpts) Validate() error {
+	switch {
+	case o.MaxOpen < 0:
+		return errors.New("the maximum open connections cannot be negative")
+	case o.MaxIdle < 0:
+		return errors.New("the maximum idle connections cannot be negative")
+	case o.MaxLifetime < 0:
+		return errors.New("the maximum connection lifetime cannot be negative")
+	}
+	return nil
+}
+
+func (o PoolOpts) isZero() bool {
+	return o == PoolOpts{}
+}
+
+// apply configures the pool of sqldb.
+func (o PoolOpts) apply(sqldb *sql.DB) {
+	if o.MaxOpen > 0 {
+		sqldb.SetMaxOpenConns(o.MaxOpen)
+	}
+	if o.MaxIdle > 0 {
+		sqldb.SetMaxIdleConns(o.MaxIdle)
+	}
+	if o.MaxLifetime > 0 {
+		sqldb.SetConnMaxLifetime(o.MaxLifetime)
+	}
+}
+
+// poolStatsCollector reports the sql.DBStats of the databases of a scenario,
+// summed across them, whenever the metrics are gathered. Databases that are
+// removed take their statistics with them, so even the cumulative ones are
+// reported as gauges.
+type poolStatsCollector struct {
+	dbs atomic.Pointer[func() []DB]
+
+	maxOpen           *prometheus.Desc
+	open              *prometheus.Desc
+	inUse             *prometheus.Desc
+	idle              *prometheus.Desc
+	waitCount         *prometheus.Desc
+	waitDuration      *prometheus.Desc
+	maxIdleClosed     *prometheus.Desc
+	maxIdleTimeClosed *prometheus.Desc
+	maxLifetimeClosed *prometheus.Desc
+}
+
+func newPoolStatsCollector() *poolStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, nil, nil)
+	}
+	return &poolStatsCollector{
+		maxOpen:           desc("db_pool_max_open_connections", "The maximum open connections of the dbs, summed across them, zero for each without a limit"),
+		open:              desc("db_pool_open_connections", "The connections open to the dbs, in use or idle"),
+		inUse:             desc("db_pool_in_use_connections", "The connections to the dbs currently in use"),
+		idle:              desc("db_pool_idle_connections", "The idle connections kept open to the dbs"),
+		waitCount:         desc("db_pool_waits", "The number of times the dbs waited for a connection"),
+		waitDuration:      desc("db_pool_wait_seconds", "The time the dbs spent waiting for a connection"),
+		maxIdleClosed:     desc("db_pool_max_idle_closed", "The number of connections closed because the dbs had too many idle"),
+		maxIdleTimeClosed: desc("db_pool_max_idle_time_closed", "The number of connections closed because they were idle too long"),
+		maxLifetimeClosed: desc("db_pool_max_lifetime_closed", "The number of connections closed because they reached their maximum lifetime"),
+	}
+}
+
+// watch makes the collector report the databases returned by dbs.
+func (c *poolStatsCollector) watch(dbs func() []DB) {
+	c.dbs.Store(&dbs)
+}
+
+func (c *poolStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.maxIdleClosed
+	ch <- c.maxIdleTimeClosed
+	ch <- c.maxLifetimeClosed
+}
+
+func (c *poolStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	var total sql.DBStats
+	if dbs := c.dbs.Load(); dbs != nil {
+		for _, db := range (*dbs)() {
+			plain, ok := db.(PlainDB)
+			if !ok {
+				continue
+			}
+			sqldb := plain.PlainDB()
+			if sqldb == nil {
+				continue
+			}
+			stats := sqldb.Stats()
+			total.MaxOpenConnections += stats.MaxOpenConnections
+			total.OpenConnections += stats.OpenConnections
+			total.InUse += stats.InUse
+			total.Idle += stats.Idle
+			total.WaitCount += stats.WaitCount
+			total.WaitDuration += stats.WaitDuration
+			total.MaxIdleClosed += stats.MaxIdleClosed
+			total.MaxIdleTimeClosed += stats.MaxIdleTimeClosed
+			total.MaxLifetimeClosed += stats.MaxLifetimeClosed
+		}
+	}
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	gauge(c.maxOpen, float64(total.MaxOpenConnections))
+	gauge(c.open, float64(total.OpenConnections))
+	gauge(c.inUse, float64(total.InUse))
+	gauge(c.idle, float64(total.Idle))
+	gauge(c.waitCount, float64(total.WaitCount))
+	gauge(c.waitDuration, total.WaitDuration.Seconds())
+	gauge(c.maxIdleClosed, float64(total.MaxIdleClosed))
+	gauge(c.maxIdleTimeClosed, float64(total.MaxIdleTimeClosed))
+	gauge(c.maxLifetimeClosed, float64(total.MaxLifetimeClosed))
+}
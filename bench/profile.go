@@ -0,0 +1,412 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Profile layers are the parts of the stack the time of an operation is
+// split between.
+const (
+	LayerSQLair = "sqlair"
+	LayerSQLX   = "sqlx"
+	LayerGorm   = "gorm"
+	LayerSQL    = "database/sql"
+	LayerDriver = "driver"
+)
+
+var profileLayers = []string{LayerSQLair, LayerSQLX, LayerGorm, LayerSQL, LayerDriver}
+
+// layerOf returns the layer a function belongs to, or an empty string if it
+// is in none of them.
+func layerOf(function string) string {
+	switch {
+	case strings.HasPrefix(function, "github.com/canonical/sqlair"):
+		return LayerSQLair
+	case strings.HasPrefix(function, "github.com/jmoiron/sqlx"):
+		return LayerSQLX
+	case strings.HasPrefix(function, "gorm.io/gorm"):
+		return LayerGorm
+	case strings.HasPrefix(function, "database/sql."):
+		return LayerSQL
+	case strings.HasPrefix(function, "github.com/mattn/go-sqlite3"),
+		strings.HasPrefix(function, "github.com/canonical/go-dqlite"),
+		strings.HasPrefix(function, "modernc.org/"),
+		strings.HasPrefix(function, "zombiezen.com/go/sqlite"):
+		return LayerDriver
+	}
+	return ""
+}
+
+// profileLabels returns a context carrying the profiler labels of an
+// operation of the scenario.
+func profileLabels(s *Scenario, operation string) context.Context {
+	return pprof.WithLabels(context.Background(), pprof.Labels(
+		"scenario", s.name,
+		"wrapper", s.opts.Wrapper.Name(),
+		"operation", operation,
+	))
+}
+
+// CPUProfile is a CPU profile of the whole run being written to a file.
+type CPUProfile struct {
+	f *os.File
+}
+
+// startCPUProfile starts profiling the CPU use of the run to path.
+func startCPUProfile(path string) (*CPUProfile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &CPUProfile{f: f}, nil
+}
+
+// Stop stops profiling and finishes writing the profile.
+func (p *CPUProfile) Stop() error {
+	pprof.StopCPUProfile()
+	return p.f.Close()
+}
+
+// LayerTime is the CPU time a scenario spent in one layer. Cumulative time
+// includes the layers below, so sqlair's includes the database/sql and
+// driver time of the calls it makes, while own time only counts samples
+// where the layer is the innermost on the stack.
+type LayerTime struct {
+	Layer      string
+	Cumulative time.Duration
+	Own        time.Duration
+}
+
+// ProfileBreakdown is how the CPU time of a scenario's operations is split
+// between the layers.
+type ProfileBreakdown struct {
+	Scenario string
+	Wrapper  string
+	Total    time.Duration
+	Layers   []LayerTime
+}
+
+// breakdownProfile splits the CPU time of each scenario's operations in the
+// profile at path between the layers. Samples are attributed to scenarios
+// by the profiler labels set while operations run.
+func breakdownProfile(path string, scenarios []*Scenario) ([]ProfileBreakdown, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prof, err := parseProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	index := make(map[string]int)
+	breakdowns := make([]ProfileBreakdown, len(scenarios))
+	for i, s := range scenarios {
+		index[s.Name()] = i
+		breakdowns[i] = ProfileBreakdown{Scenario: s.Name(), Wrapper: s.opts.Wrapper.Name()}
+		for _, layer := range profileLayers {
+			breakdowns[i].Layers = append(breakdowns[i].Layers, LayerTime{Layer: layer})
+		}
+	}
+	for _, sample := range prof.samples {
+		i, ok := index[sample.labels["scenario"]]
+		if !ok {
+			continue
+		}
+		b := &breakdowns[i]
+		value := time.Duration(sample.value)
+		b.Total += value
+
+		seen := make([]bool, len(profileLayers))
+		own := ""
+		// Locations run from the leaf to the root.
+		for _, loc := range sample.locations {
+			for _, fn := range prof.locations[loc] {
+				layer := layerOf(prof.functions[fn])
+				if layer == "" {
+					continue
+				}
+				if own == "" {
+					own = layer
+				}
+				for j, l := range profileLayers {
+					if l == layer && !seen[j] {
+						seen[j] = true
+						b.Layers[j].Cumulative += value
+					}
+				}
+			}
+		}
+		for j, l := range profileLayers {
+			if l == own {
+				b.Layers[j].Own += value
+			}
+		}
+	}
+	return breakdowns, nil
+}
+
+// printProfileComparison writes how the CPU time of each scenario's
+// operations splits between sqlair, database/sql and the driver, so that
+// where sqlair's overhead lives can be read off by comparing the scenarios.
+func printProfileComparison(w io.Writer, path string, breakdowns []ProfileBreakdown) error {
+	fmt.Fprintf(w, "CPU time of operations by layer (profile in %s):\n", path)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tLAYER\tCUMULATIVE\tSHARE\tOWN\tSHARE")
+	share := func(d, total time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(d) / float64(total) * 100
+	}
+	for _, b := range breakdowns {
+		fmt.Fprintf(tw, "%s\t%s\ttotal\t%s\t\t\t\n", b.Scenario, b.Wrapper, b.Total)
+		var layered time.Duration
+		for _, l := range b.Layers {
+			layered += l.Own
+			fmt.Fprintf(tw, "\t\t%s\t%s\t%.1f%%\t%s\t%.1f%%\n", l.Layer,
+				l.Cumulative, share(l.Cumulative, b.Total), l.Own, share(l.Own, b.Total))
+		}
+		fmt.Fprintf(tw, "\t\tother\t\t\t%s\t%.1f%%\n", b.Total-layered, share(b.Total-layered, b.Total))
+	}
+	return tw.Flush()
+}
+
+// profileSample is a sample of a profile with the value of interest.
+type profileSample struct {
+	locations []uint64
+	value     int64
+	labels    map[string]string
+}
+
+// parsedProfile is the part of a pprof profile needed to attribute samples
+// to functions.
+type parsedProfile struct {
+	samples []profileSample
+	// locations maps location ids to the functions at them, innermost
+	// first when inlined.
+	locations map[uint64][]uint64
+	functions map[uint64]string
+}
+
+// parseProfile decodes a gzipped pprof profile, taking the CPU time of each
+// sample. The profile format is described in
+// https://github.com/google/pprof/blob/main/proto/profile.proto.
+func parseProfile(data []byte) (*parsedProfile, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strings are referred to by their index in the string table, which
+	// may come after the messages that refer to them, so references are
+	// resolved once everything has been read.
+	type rawSample struct {
+		locations []uint64
+		values    []int64
+		labels    [][2]int64
+	}
+	var (
+		strs       []string
+		sampleType []int64
+		samples    []rawSample
+		locations  = make(map[uint64][]uint64)
+		funcNames  = make(map[uint64]int64)
+	)
+	err = eachField(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case 1: // sample_type
+			return eachField(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+				if num == 1 {
+					sampleType = append(sampleType, int64(n))
+				}
+				return nil
+			})
+		case 2: // sample
+			var s rawSample
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					return appendVarints(&s.locations, typ, v, n)
+				case 2:
+					var values []uint64
+					if err := appendVarints(&values, typ, v, n); err != nil {
+						return err
+					}
+					for _, value := range values {
+						s.values = append(s.values, int64(value))
+					}
+				case 3:
+					var label [2]int64
+					err := eachField(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+						if num == 1 || num == 2 {
+							label[num-1] = int64(n)
+						}
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					s.labels = append(s.labels, label)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			samples = append(samples, s)
+		case 4: // location
+			var id uint64
+			var fns []uint64
+			err := eachField(v, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					id = n
+				case 4:
+					return eachField(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+						if num == 1 {
+							fns = append(fns, n)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			locations[id] = fns
+		case 5: // function
+			var id uint64
+			var name int64
+			err := eachField(v, func(num protowire.Number, _ protowire.Type, _ []byte, n uint64) error {
+				switch num {
+				case 1:
+					id = n
+				case 2:
+					name = int64(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			funcNames[id] = name
+		case 6: // string_table
+			strs = append(strs, string(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(i int64) string {
+		if i < 0 || i >= int64(len(strs)) {
+			return ""
+		}
+		return strs[i]
+	}
+	// CPU profiles have a sample count and the CPU time of each sample.
+	valueIndex := len(sampleType) - 1
+	for i, t := range sampleType {
+		if str(t) == "cpu" {
+			valueIndex = i
+		}
+	}
+	if valueIndex < 0 {
+		return nil, errors.New("profile has no sample types")
+	}
+	prof := &parsedProfile{
+		locations: locations,
+		functions: make(map[uint64]string, len(funcNames)),
+	}
+	for id, name := range funcNames {
+		prof.functions[id] = str(name)
+	}
+	for _, s := range samples {
+		if valueIndex >= len(s.values) {
+			continue
+		}
+		sample := profileSample{
+			locations: s.locations,
+			value:     s.values[valueIndex],
+			labels:    make(map[string]string, len(s.labels)),
+		}
+		for _, l := range s.labels {
+			sample.labels[str(l[0])] = str(l[1])
+		}
+		prof.samples = append(prof.samples, sample)
+	}
+	return prof, nil
+}
+
+// eachField calls fn with each field of a protobuf message. Length delimited
+// fields are passed as bytes, varints as n.
+func eachField(data []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(data) > 0 {
+		num, typ, l := protowire.ConsumeTag(data)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		data = data[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(data)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		data = data[l:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVarints appends a repeated varint field, which may be packed.
+func appendVarints(dst *[]uint64, typ protowire.Type, v []byte, n uint64) error {
+	if typ == protowire.VarintType {
+		*dst = append(*dst, n)
+		return nil
+	}
+	for len(v) > 0 {
+		n, l := protowire.ConsumeVarint(v)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		*dst = append(*dst, n)
+		v = v[l:]
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// RampProfile decides how many databases a scenario should have at a point
+// in the run.
+type RampProfile interface {
+	// Target returns the number of databases there should be once elapsed
+	// time has passed since the start of the run.
+	Target(elapsed time.Duration) int
+	// Max returns the largest number of databases the profile reaches.
+	Max() int
+}
+
+// LinearRamp adds databases at a constant rate until Max is reached.
+type LinearRamp struct {
+	PerSecond float64
+	MaxDBs    int
+}
+
+func (r LinearRamp) Target(elapsed time.Duration) int {
+	return clampDBs(int(r.PerSecond*elapsed.Seconds()), r.MaxDBs)
+}
+
+func (r LinearRamp) Max() int {
+	return r.MaxDBs
+}
+
+// StepRamp adds Step databases every Every until Max is reached. The first
+// step is taken after Every has passed.
+type StepRamp struct {
+	Step   int
+	Every  time.Duration
+	MaxDBs int
+}
+
+func (r StepRamp) Target(elapsed time.Duration) int {
+	return clampDBs(int(elapsed/r.Every)*r.Step, r.MaxDBs)
+}
+
+func (r StepRamp) Max() int {
+	return r.MaxDBs
+}
+
+// ExponentialRamp starts with Initial databases after Every has passed and
+// multiplies the number by Factor every Every after that, until Max is
+// reached.
+type ExponentialRamp struct {
+	Initial int
+	Factor  float64
+	Every   time.Duration
+	MaxDBs  int
+}
+
+func (r ExponentialRamp) Target(elapsed time.Duration) int {
+	steps := int(elapsed / r.Every)
+	if steps == 0 {
+		return 0
+	}
+	target := float64(r.Initial) * math.Pow(r.Factor, float64(steps-1))
+	if target > float64(r.MaxDBs) {
+		return r.MaxDBs
+	}
+	return clampDBs(int(target), r.MaxDBs)
+}
+
+func (r ExponentialRamp) Max() int {
+	return r.MaxDBs
+}
+
+// SineRamp rises from MinDBs to MaxDBs and falls back again every Period,
+// following a sine wave, to model load that comes and goes.
+type SineRamp struct {
+	MinDBs int
+	MaxDBs int
+	Period time.Duration
+}
+
+func (r SineRamp) Target(elapsed time.Duration) int {
+	wave := (1 - math.Cos(2*math.Pi*elapsed.Seconds()/r.Period.Seconds())) / 2
+	return clampDBs(r.MinDBs+int(math.Round(wave*float64(r.MaxDBs-r.MinDBs))), r.MaxDBs)
+}
+
+func (r SineRamp) Max() int {
+	return r.MaxDBs
+}
+
+// RampPoint is the number of databases a ScheduleRamp reaches at a time.
+type RampPoint struct {
+	At  time.Duration
+	DBs int
+}
+
+// ScheduleRamp follows an explicit schedule, for example 50 databases at the
+// start, 200 after ten minutes and 400 after thirty.
+type ScheduleRamp []RampPoint
+
+func (r ScheduleRamp) Target(elapsed time.Duration) int {
+	points := r.sorted()
+	target := 0
+	for _, p := range points {
+		if p.At > elapsed {
+			break
+		}
+		target = p.DBs
+	}
+	return target
+}
+
+func (r ScheduleRamp) Max() int {
+	max := 0
+	for _, p := range r {
+		if p.DBs > max {
+			max = p.DBs
+		}
+	}
+	return max
+}
+
+func (r ScheduleRamp) sorted() ScheduleRamp {
+	points := append(ScheduleRamp(nil), r...)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].At < points[j].At
+	})
+	return points
+}
+
+// rampsDown reports whether the profile ever wants fewer databases than it
+// did before, so that databases have to be removed to follow it.
+func rampsDown(profile RampProfile) bool {
+	switch r := profile.(type) {
+	case SineRamp:
+		return true
+	case ScheduleRamp:
+		points := r.sorted()
+		for i := 1; i < len(points); i++ {
+			if points[i].DBs < points[i-1].DBs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func clampDBs(n, max int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
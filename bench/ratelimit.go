@@ -0,0 +1,76 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting how many operations are started per
+// second. Holding the offered load constant makes it possible to compare
+// latency while varying the number of databases or the wrapper. It is safe
+// to share between scenarios, which then have one limit on their total.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate operations per second, with
+// bursts of up to burst operations. A burst below one is treated as one.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+	}
+}
+
+// Rate returns how many operations the limiter allows per second.
+func (l *RateLimiter) Rate() float64 {
+	return l.rate
+}
+
+// reserve takes a token and returns how long to wait before it may be used.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.lastFill).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lastFill = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until an operation may start. It returns false if abort was
+// closed first. A token reserved by an aborted wait is not returned.
+func (l *RateLimiter) Wait(abort <-chan struct{}) (time.Duration, bool) {
+	wait := l.reserve()
+	if wait == 0 {
+		return 0, true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, true
+	case <-abort:
+		return wait, false
+	}
+}
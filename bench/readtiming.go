@@ -0,0 +1,125 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ReadTiming splits the time the reads of one operation in one scenario
+// took into the time until their first row was available, which is mostly
+// the database's, and the time spent scanning their rows, which is where the
+// wrappers differ.
+type ReadTiming struct {
+	Scenario  string
+	Wrapper   string
+	Operation string
+	Reads     uint64
+
+	FirstRowMean, FirstRowP99 time.Duration
+	ScanMean, ScanP99         time.Duration
+}
+
+// gatherReadTimings reads the first row and scan histograms of every
+// scenario in the measure phase from the default registry, sorted by
+// scenario and operation. Operations that read no rows are left out.
+func gatherReadTimings() ([]ReadTiming, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	type timings struct {
+		wrapper        string
+		firstRow, scan *histogramAgg
+	}
+	aggs := make(map[opKey]*timings)
+	add := func(m *dto.Metric, scan bool) {
+		if !slices.Contains(measuredPhases, Phase(labelValue(m, "phase"))) {
+			return
+		}
+		k := opKey{labelValue(m, "scenario"), labelValue(m, "operation")}
+		t, ok := aggs[k]
+		if !ok {
+			t = &timings{
+				wrapper:  labelValue(m, "wrapper"),
+				firstRow: &histogramAgg{buckets: make(map[float64]uint64)},
+				scan:     &histogramAgg{buckets: make(map[float64]uint64)},
+			}
+			aggs[k] = t
+		}
+		agg := t.firstRow
+		if scan {
+			agg = t.scan
+		}
+		h := m.GetHistogram()
+		agg.count += h.GetSampleCount()
+		agg.sum += h.GetSampleSum()
+		for _, b := range h.GetBucket() {
+			agg.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+		}
+	}
+	for _, family := range families {
+		switch family.GetName() {
+		case "db_operation_first_row_time":
+			for _, m := range family.GetMetric() {
+				add(m, false)
+			}
+		case "db_operation_scan_time":
+			for _, m := range family.GetMetric() {
+				add(m, true)
+			}
+		}
+	}
+
+	var reads []ReadTiming
+	for k, t := range aggs {
+		if t.firstRow.count == 0 {
+			continue
+		}
+		reads = append(reads, ReadTiming{
+			Scenario:     k.scenario,
+			Wrapper:      t.wrapper,
+			Operation:    k.operation,
+			Reads:        t.firstRow.count,
+			FirstRowMean: seconds(t.firstRow.sum / float64(t.firstRow.count)),
+			FirstRowP99:  t.firstRow.quantile(0.99),
+			ScanMean:     seconds(t.scan.sum / float64(max(t.scan.count, 1))),
+			ScanP99:      t.scan.quantile(0.99),
+		})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].Scenario != reads[j].Scenario {
+			return reads[i].Scenario < reads[j].Scenario
+		}
+		return reads[i].Operation < reads[j].Operation
+	})
+	return reads, nil
+}
+
+// printReadTimingReport writes how long the reads of every operation took
+// to their first row and to scan their rows. Runs that read no rows have no
+// report.
+func printReadTimingReport(w io.Writer) error {
+	reads, err := gatherReadTimings()
+	if err != nil || len(reads) == 0 {
+		return err
+	}
+	fmt.Fprintln(w, "read timings:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tOPERATION\tREADS\tFIRST ROW MEAN\tFIRST ROW P99\tSCAN MEAN\tSCAN P99")
+	for _, r := range reads {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			r.Scenario, r.Wrapper, r.Operation, r.Reads,
+			r.FirstRowMean, r.FirstRowP99, r.ScanMean, r.ScanP99)
+	}
+	return tw.Flush()
+}
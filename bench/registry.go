@@ -0,0 +1,266 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The registry holds the providers, wrappers and sets of operations that
+// can be chosen by name, so that those compiled in or loaded from plugins
+// can be benchmarked without changing the harness.
+var registry = struct {
+	mu         sync.Mutex
+	providers  map[string]registeredProvider
+	wrappers   map[string]DBWrapper
+	operations map[string]func(*ScenarioMetrics) []DBOperationDef
+}{
+	providers:  make(map[string]registeredProvider),
+	wrappers:   make(map[string]DBWrapper),
+	operations: make(map[string]func(*ScenarioMetrics) []DBOperationDef),
+}
+
+// ProviderOpts configures a provider chosen by name. Each provider rejects
+// the options it has no use for.
+type ProviderOpts struct {
+	// Dir is the directory file backed databases are created in.
+	Dir string
+	// SyncDelay is added to every durable write of file backed databases.
+	SyncDelay time.Duration
+	// Nodes is the number of nodes of a cluster.
+	Nodes int
+	// Latency, and a random extra of up to Jitter, is added to the traffic
+	// between the nodes of a cluster.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Cleanup deletes the file backed databases the provider created when
+	// the run ends.
+	Cleanup bool
+}
+
+type registeredProvider struct {
+	description string
+	newProvider func(ProviderOpts) (DBProvider, error)
+}
+
+// DefaultOperationsName is the name the default operations are registered
+// under.
+const DefaultOperationsName = "default"
+
+// DefaultProviderName is the name of the provider scenarios use unless
+// another is chosen.
+const DefaultProviderName = "sqlite"
+
+func init() {
+	RegisterProvider(DefaultProviderName, "in-memory SQLite databases",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if err := opts.check(DefaultProviderName, false, false); err != nil {
+				return nil, err
+			}
+			return NewSQLiteDBProvider(), nil
+		})
+	RegisterProvider("sqlite-file", "SQLite databases in WAL mode in files under -provider-dir, or a temporary directory removed when the run ends, optionally with -sync-delay and -provider-cleanup",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if err := opts.check("sqlite-file", true, false); err != nil {
+				return nil, err
+			}
+			if opts.Dir == "" {
+				dbp, err := NewTempSQLiteFileDBProvider()
+				if err != nil {
+					return nil, err
+				}
+				return dbp.WithSyncDelay(opts.SyncDelay), nil
+			}
+			dbp, err := NewSQLiteFileDBProvider(opts.Dir)
+			if err != nil {
+				return nil, err
+			}
+			dbp = dbp.WithSyncDelay(opts.SyncDelay)
+			if opts.Cleanup {
+				dbp = dbp.WithCleanup()
+			}
+			return dbp, nil
+		})
+	RegisterProvider("dqlite1", "a single dqlite node",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if err := opts.check("dqlite1", false, false); err != nil {
+				return nil, err
+			}
+			return NewDQLite1NodeDBProvider(), nil
+		})
+	RegisterProvider("dqlite3", "a three node dqlite cluster, optionally with -network-latency and -network-jitter between the nodes",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if opts.Nodes != 0 {
+				return nil, errors.New("provider dqlite3 has three nodes, use dqlite-cluster for another number")
+			}
+			opts.Nodes = 3
+			return newClusterProvider("dqlite3", opts)
+		})
+	RegisterProvider("dqlite-cluster", "a dqlite cluster of -provider-nodes nodes, 3 if not given, optionally with -network-latency and -network-jitter between the nodes",
+		func(opts ProviderOpts) (DBProvider, error) {
+			if opts.Nodes == 0 {
+				opts.Nodes = 3
+			}
+			return newClusterProvider("dqlite-cluster", opts)
+		})
+	RegisterWrapper(SQLWrapper{})
+	RegisterWrapper(PreparedSQLWrapper{})
+	RegisterWrapper(SQLairWrapper{})
+	RegisterWrapper(PreparedSQLairWrapper{})
+	RegisterWrapper(SQLXWrapper{})
+	RegisterWrapper(GormWrapper{})
+	RegisterOperations(DefaultOperationsName, DefaultOperations)
+}
+
+// newClusterProvider starts the dqlite cluster the options describe.
+func newClusterProvider(name string, opts ProviderOpts) (DBProvider, error) {
+	if err := opts.check(name, false, true); err != nil {
+		return nil, err
+	}
+	var clusterOpts []ClusterOption
+	if opts.Latency > 0 || opts.Jitter > 0 {
+		clusterOpts = append(clusterOpts, WithClusterNetwork(NewNetwork(opts.Latency, opts.Jitter)))
+	}
+	return NewDQLiteClusterProvider(opts.Nodes, clusterOpts...)
+}
+
+// check returns an error if the options set any the provider has no use
+// for, files being the directory and sync delay, and cluster the number of
+// nodes and the latency and jitter between them.
+func (opts ProviderOpts) check(name string, files, cluster bool) error {
+	if !files && (opts.Dir != "" || opts.SyncDelay != 0 || opts.Cleanup) {
+		return fmt.Errorf("provider %s has no files to place, delay or clean up", name)
+	}
+	if !cluster && opts.Nodes != 0 {
+		return fmt.Errorf("provider %s has no nodes to count", name)
+	}
+	if !cluster && (opts.Latency != 0 || opts.Jitter != 0) {
+		return fmt.Errorf("provider %s has no network between nodes", name)
+	}
+	return nil
+}
+
+// RegisterProvider makes a provider available by name, described by
+// description in usage. It panics if a provider of the same name is
+// already registered.
+func RegisterProvider(name, description string, newProvider func(ProviderOpts) (DBProvider, error)) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.providers[name]; ok {
+		panic(fmt.Sprintf("provider %q already registered", name))
+	}
+	registry.providers[name] = registeredProvider{description: description, newProvider: newProvider}
+}
+
+// RegisterWrapper makes the wrapper available by its name. It panics if a
+// wrapper of the same name is already registered.
+func RegisterWrapper(w DBWrapper) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.wrappers[w.Name()]; ok {
+		panic(fmt.Sprintf("wrapper %q already registered", w.Name()))
+	}
+	registry.wrappers[w.Name()] = w
+}
+
+// RegisterOperations makes a set of operations available by name. It
+// panics if a set of the same name is already registered.
+func RegisterOperations(name string, ops func(*ScenarioMetrics) []DBOperationDef) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.operations[name]; ok {
+		panic(fmt.Sprintf("operations %q already registered", name))
+	}
+	registry.operations[name] = ops
+}
+
+// NewRegisteredProvider returns a new provider of the kind registered under
+// name, configured by opts.
+func NewRegisteredProvider(name string, opts ProviderOpts) (DBProvider, error) {
+	registry.mu.Lock()
+	p, ok := registry.providers[name]
+	names := registeredNames(registry.providers)
+	registry.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no provider %q registered, have %v", name, names)
+	}
+	return p.newProvider(opts)
+}
+
+// RegisteredWrapper returns the wrapper registered under name.
+func RegisteredWrapper(name string) (DBWrapper, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	w, ok := registry.wrappers[name]
+	if !ok {
+		return nil, fmt.Errorf("no wrapper %q registered, have %v", name, registeredNames(registry.wrappers))
+	}
+	return w, nil
+}
+
+// RegisteredOperations returns the set of operations registered under name.
+func RegisteredOperations(name string) (func(*ScenarioMetrics) []DBOperationDef, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	ops, ok := registry.operations[name]
+	if !ok {
+		return nil, fmt.Errorf("no operations %q registered, have %v", name, registeredNames(registry.operations))
+	}
+	return ops, nil
+}
+
+// WriteRegistryUsage writes the providers, wrappers and operations that
+// can be chosen by name.
+func WriteRegistryUsage(w io.Writer) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Providers:")
+	for _, name := range registeredNames(registry.providers) {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, registry.providers[name].description)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Wrappers: %s\nOperations: %s\n",
+		strings.Join(registeredNames(registry.wrappers), ", "),
+		strings.Join(registeredNames(registry.operations), ", "))
+	return err
+}
+
+func registeredNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPlugin opens a Go plugin, which registers its wrappers and operations
+// from its init functions. Plugins are main packages built with
+// -buildmode=plugin against the same version of this module as the
+// harness, for example:
+//
+//	package main
+//
+//	import "sqlair-bench/bench"
+//
+//	func init() {
+//		bench.RegisterOperations("my-queries", myOperations)
+//	}
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("loading plugin %s: %w", path, err)
+	}
+	return nil
+}
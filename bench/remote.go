@@ -0,0 +1,114 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/canonical/go-dqlite/driver"
+)
+
+// remoteDrivers counts the drivers registered by remote providers, to name
+// each uniquely.
+var remoteDrivers atomic.Int64
+
+// RemoteDQLiteOpts configures the connections of a RemoteDQLiteDBProvider.
+type RemoteDQLiteOpts struct {
+	// TLS, if set, is used to connect to nodes serving TLS, as Juju's
+	// controllers do.
+	TLS *tls.Config
+	// Network, if set, carries the connections to the nodes, adding its
+	// latency to every request.
+	Network *Network
+}
+
+// RemoteDQLiteDBProvider creates databases on dqlite nodes running in other
+// processes, connecting to them over the network with the dqlite driver, as
+// Juju's controllers do, rather than through an in-process node.
+type RemoteDQLiteDBProvider struct {
+	driverName string
+}
+
+// NewRemoteDQLiteDBProvider connects to the cluster of the nodes at addrs.
+// The driver finds the leader amongst them for each connection.
+func NewRemoteDQLiteDBProvider(addrs []string, opts RemoteDQLiteOpts) (*RemoteDQLiteDBProvider, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no dqlite nodes to connect to")
+	}
+	store := client.NewInmemNodeStore()
+	nodes := make([]client.NodeInfo, len(addrs))
+	for i, addr := range addrs {
+		if addr == "" {
+			return nil, fmt.Errorf("dqlite node %d has no address", i)
+		}
+		nodes[i] = client.NodeInfo{Address: addr}
+	}
+	if err := store.Set(context.Background(), nodes); err != nil {
+		return nil, fmt.Errorf("storing dqlite nodes: %w", err)
+	}
+
+	dial := client.DefaultDialFunc
+	if opts.Network != nil {
+		dial = opts.Network.dialer("load-generator")
+	}
+	if opts.TLS != nil {
+		dial = client.DialFuncWithTLS(dial, opts.TLS)
+	}
+	drv, err := driver.New(store, driver.WithDialFunc(dial))
+	if err != nil {
+		return nil, fmt.Errorf("creating dqlite driver: %w", err)
+	}
+	name := fmt.Sprintf("dqlite-remote-%d", remoteDrivers.Add(1))
+	sql.Register(name, drv)
+	return &RemoteDQLiteDBProvider{driverName: name}, nil
+}
+
+func (dbp *RemoteDQLiteDBProvider) NewDB(name string) (*sql.DB, error) {
+	db, err := dbp.OpenDB(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(Schema); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return db, tx.Commit()
+}
+
+func (dbp *RemoteDQLiteDBProvider) OpenDB(name string) (*sql.DB, error) {
+	return sql.Open(dbp.driverName, name)
+}
+
+// RemoteTLSConfig loads the client certificate and key and the CA
+// certificate of the nodes from PEM files, for RemoteDQLiteOpts.TLS.
+func RemoteTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no CA certificates in " + caFile)
+	}
+	return app.SimpleDialTLSConfig(cert, pool), nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The databases of a running benchmark can be queried while it runs, to
+// inspect their data, row counts and plans without stopping it or attaching
+// other tools. Queries run on a connection of the database's own pool made
+// read-only for the query, so they are subject to the same locks as the
+// operations.
+
+const (
+	// QueryRowLimit is the most rows a query returns.
+	QueryRowLimit = 1000
+	// QueryTimeout bounds how long a query can run.
+	QueryTimeout = 10 * time.Second
+)
+
+// dbNamed returns the database of the scenario with the given name.
+func (s *Scenario) dbNamed(name string) (DB, bool) {
+	for _, db := range s.DBs() {
+		if db.Name() == name {
+			return db, true
+		}
+	}
+	return nil, false
+}
+
+// queryResult is the rows a query returned, formatted as text.
+type queryResult struct {
+	columns []string
+	rows    [][]string
+	// truncated is set if the query returned more than QueryRowLimit rows.
+	truncated bool
+}
+
+// queryReadOnly runs query against sqldb with the connection it runs on
+// made read-only, returning at most QueryRowLimit rows.
+func queryReadOnly(ctx context.Context, sqldb *sql.DB, query string) (queryResult, error) {
+	var r queryResult
+	conn, err := sqldb.Conn(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return r, fmt.Errorf("making the connection read-only: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); err != nil {
+			// The connection must not go back to the pool read-only.
+			_ = conn.Raw(func(any) error {
+				return driver.ErrBadConn
+			})
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	if r.columns, err = rows.Columns(); err != nil {
+		return r, err
+	}
+	values := make([]any, len(r.columns))
+	dest := make([]any, len(r.columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if len(r.rows) == QueryRowLimit {
+			r.truncated = true
+			break
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return r, err
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+				row[i] = "NULL"
+			case []byte:
+				row[i] = string(v)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		r.rows = append(r.rows, row)
+	}
+	return r, rows.Err()
+}
+
+// write writes the result as a table.
+func (r queryResult) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(r.columns, "\t"))
+	for _, row := range r.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if r.truncated {
+		_, err := fmt.Fprintf(w, "(first %d rows)\n", QueryRowLimit)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "(%d rows)\n", len(r.rows))
+	return err
+}
+
+// handleQueries serves /control/dbs, which lists the databases of the
+// scenario parameter, or of every scenario, and /control/query, which runs
+// the read-only query POSTed to it against the database picked by the
+// scenario and db parameters, responding with the rows as a table.
+func handleQueries(mux *http.ServeMux, scenarios []*Scenario) {
+	mux.HandleFunc("/control/dbs", func(w http.ResponseWriter, r *http.Request) {
+		scenario := r.URL.Query().Get("scenario")
+		for _, s := range scenarios {
+			if scenario != "" && s.name != scenario {
+				continue
+			}
+			for _, db := range s.DBs() {
+				fmt.Fprintf(w, "%s %s\n", s.name, db.Name())
+			}
+		}
+	})
+	mux.HandleFunc("/control/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "queries are POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		scenario, name := r.URL.Query().Get("scenario"), r.URL.Query().Get("db")
+		var db DB
+		for _, s := range scenarios {
+			if s.name == scenario {
+				db, _ = s.dbNamed(name)
+			}
+		}
+		if db == nil {
+			http.Error(w, fmt.Sprintf("no db %s in scenario %s", name, scenario), http.StatusNotFound)
+			return
+		}
+		plain, ok := db.(PlainDB)
+		if !ok || plain.PlainDB() == nil {
+			http.Error(w, fmt.Sprintf("cannot query %T databases", db), http.StatusBadRequest)
+			return
+		}
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), QueryTimeout)
+		defer cancel()
+		result, err := queryReadOnly(ctx, plain.PlainDB(), string(query))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = result.write(w)
+	})
+}
+
+// replHelp describes the commands of the REPL.
+const replHelp = `Statements end with a semicolon and run against the current db.
+.dbs [scenario]      list the dbs of every scenario, or of one
+.use scenario db     query db of scenario from now on
+.help                show this help
+.quit                leave`
+
+// ReplCommand implements `repl [-addr addr] [scenario db]`, reading queries
+// from standard input and running them against the databases of the
+// benchmark serving on addr.
+func ReplCommand(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:3333", "address the benchmark serves metrics and its control API on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var scenario, db string
+	switch fs.NArg() {
+	case 0:
+	case 2:
+		scenario, db = fs.Arg(0), fs.Arg(1)
+	default:
+		return errors.New("usage: repl [-addr addr] [scenario db]")
+	}
+	base := "http://" + *addr + "/control/"
+
+	fmt.Println(replHelp)
+	in := bufio.NewScanner(os.Stdin)
+	var statement strings.Builder
+	for {
+		if statement.Len() == 0 {
+			fmt.Printf("%s/%s> ", scenario, db)
+		} else {
+			fmt.Print("... ")
+		}
+		if !in.Scan() {
+			return in.Err()
+		}
+		line := strings.TrimSpace(in.Text())
+		if statement.Len() == 0 && strings.HasPrefix(line, ".") {
+			fields := strings.Fields(line)
+			switch {
+			case fields[0] == ".quit":
+				return nil
+			case fields[0] == ".dbs" && len(fields) <= 2:
+				query := ""
+				if len(fields) == 2 {
+					query = "?scenario=" + url.QueryEscape(fields[1])
+				}
+				replRequest(http.MethodGet, base+"dbs"+query, "")
+			case fields[0] == ".use" && len(fields) == 3:
+				scenario, db = fields[1], fields[2]
+			default:
+				fmt.Println(replHelp)
+			}
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if !strings.HasSuffix(line, ";") {
+			continue
+		}
+		query := url.Values{"scenario": {scenario}, "db": {db}}
+		replRequest(http.MethodPost, base+"query?"+query.Encode(), statement.String())
+		statement.Reset()
+	}
+}
+
+// replRequest makes a request of the control API and prints the response.
+func replRequest(method, target, body string) {
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+}
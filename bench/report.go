@@ -0,0 +1,443 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reportCommand implements
+// `report [-format html|markdown] [-baseline base.json] results.json [output]`,
+// rendering the results of a run as a standalone HTML page or as Markdown.
+// The results can also be the CSV written with RunOpts.OpCSV, ending in
+// .csv. The report is written next to the results if no output is given.
+func ReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	format := fs.String("format", "html", "report format, html or markdown")
+	baselinePath := fs.String("baseline", "", "results of an earlier run to compare against, markdown only")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: report [-format html|markdown] [-baseline base.json] results.json|ops.csv [output]")
+	}
+	var ext string
+	switch *format {
+	case "html":
+		ext = ".html"
+	case "markdown":
+		ext = ".md"
+	default:
+		return fmt.Errorf("unknown report format %q", *format)
+	}
+
+	r, err := readResults(args[0])
+	if err != nil {
+		return err
+	}
+	var baseline *RunResults
+	if *baselinePath != "" {
+		b, err := readResults(*baselinePath)
+		if err != nil {
+			return err
+		}
+		baseline = &b
+	}
+	out := strings.TrimSuffix(args[0], filepath.Ext(args[0])) + ext
+	if len(args) == 2 {
+		out = args[1]
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if *format == "markdown" {
+		err = writeMarkdownReport(f, r, baseline)
+	} else {
+		err = writeHTMLReport(f, r)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("report written to %s\n", out)
+	return nil
+}
+
+// htmlReport is what the report template is rendered from.
+type htmlReport struct {
+	RunResults
+	Throughput template.HTML
+	DBCount    template.HTML
+	Latencies  []htmlLatencyChart
+	// Comparison charts the p95 of every operation in each scenario side
+	// by side, and Relative is each scenario's p95 relative to the first.
+	Comparison template.HTML
+	Relative   []htmlRelativeP95
+}
+
+// htmlRelativeP95 is the p95 of an operation in a scenario, as a multiple
+// of its p95 in the first scenario.
+type htmlRelativeP95 struct {
+	Scenario  string
+	Operation string
+	P95       time.Duration
+	Ratio     string
+}
+
+type htmlLatencyChart struct {
+	Operation string
+	Chart     template.HTML
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>sqlair-bench report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg { display: block; margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h1>sqlair-bench report</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Scenarios</h2>
+{{range .Scenarios}}
+<h3>{{.Name}}</h3>
+<table>
+<tr><th>dbs</th><td>{{.DBs}}</td></tr>
+{{range $k, $v := .Metadata}}<tr><th>{{$k}}</th><td>{{$v}}</td></tr>
+{{end}}
+</table>
+{{if .Events}}
+<table>
+<tr><th>time</th><th>kind</th><th>detail</th></tr>
+{{range .Events}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Kind}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+
+<h2>Operations</h2>
+<table>
+<tr><th>scenario</th><th>operation</th><th>count</th><th>errors</th><th>mean</th><th>p50</th><th>p95</th><th>p99</th></tr>
+{{range .Ops}}<tr><td>{{.Scenario}}</td><td>{{.Operation}}</td><td>{{.Count}}</td><td>{{.Errors}}</td><td>{{.Mean}}</td><td>{{.P50}}</td><td>{{.P95}}</td><td>{{.P99}}</td></tr>
+{{end}}
+</table>
+
+{{if .Plans}}
+<h2>Query plans</h2>
+<p>The query plans SQLite chose for each operation's statements under plain SQL and under sqlair.</p>
+<table>
+<tr><th>operation</th><th>plans</th></tr>
+{{range .Plans}}<tr><td>{{.Operation}}</td><td>{{if .Diff}}differ{{else}}same{{end}}</td></tr>
+{{end}}
+</table>
+{{range .Plans}}{{if .Diff}}
+<h3>{{.Operation}} (- plain SQL, + sqlair)</h3>
+<pre>{{range .Diff}}{{.}}
+{{end}}</pre>
+{{end}}{{end}}
+{{end}}
+
+{{if .Relative}}
+<h2>Scenarios compared</h2>
+{{.Comparison}}
+<table>
+<tr><th>scenario</th><th>operation</th><th>p95</th><th>vs {{(index .Relative 0).Scenario}}</th></tr>
+{{range .Relative}}<tr><td>{{.Scenario}}</td><td>{{.Operation}}</td><td>{{.P95}}</td><td>{{.Ratio}}</td></tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Throughput over time</h2>
+{{.Throughput}}
+
+<h2>Databases over time</h2>
+{{.DBCount}}
+
+<h2>Latency distributions</h2>
+{{range .Latencies}}
+<h3>{{.Operation}}</h3>
+{{.Chart}}
+{{end}}
+</body>
+</html>
+`))
+
+// writeHTMLReport renders the results as a standalone HTML page, with the
+// charts drawn as inline SVG so the page needs nothing else to display.
+func writeHTMLReport(w io.Writer, r RunResults) error {
+	report := htmlReport{RunResults: r}
+
+	var start time.Time
+	for _, s := range r.Scenarios {
+		if len(s.Timeline) > 0 && (start.IsZero() || s.Timeline[0].Time.Before(start)) {
+			start = s.Timeline[0].Time
+		}
+	}
+	var throughput, dbs []chartSeries
+	for _, s := range r.Scenarios {
+		ops := chartSeries{Name: s.Name}
+		count := chartSeries{Name: s.Name}
+		for i, p := range s.Timeline {
+			x := p.Time.Sub(start).Seconds()
+			count.Points = append(count.Points, chartPoint{x, float64(p.DBs)})
+			if i == 0 {
+				continue
+			}
+			prev := s.Timeline[i-1]
+			if dt := p.Time.Sub(prev.Time).Seconds(); dt > 0 {
+				ops.Points = append(ops.Points, chartPoint{x, float64(p.Ops-prev.Ops) / dt})
+			}
+		}
+		throughput = append(throughput, ops)
+		dbs = append(dbs, count)
+	}
+	report.Throughput = lineChart("ops/s", throughput)
+	report.DBCount = lineChart("dbs", dbs)
+
+	// One chart per operation, comparing the scenarios.
+	var operations []string
+	byOp := make(map[string][]LatencyDistribution)
+	for _, d := range r.Latencies {
+		if _, ok := byOp[d.Operation]; !ok {
+			operations = append(operations, d.Operation)
+		}
+		byOp[d.Operation] = append(byOp[d.Operation], d)
+	}
+	for _, op := range operations {
+		report.Latencies = append(report.Latencies, htmlLatencyChart{
+			Operation: op,
+			Chart:     latencyChart(byOp[op]),
+		})
+	}
+
+	// The scenarios are only compared if there is more than one.
+	scenarios := make(map[string]bool)
+	for _, op := range r.Ops {
+		scenarios[op.Scenario] = true
+	}
+	if len(scenarios) > 1 {
+		report.Comparison = comparisonChart(r.Ops)
+		report.Relative = relativeP95s(r.Ops)
+	}
+	return reportTemplate.Execute(w, report)
+}
+
+// relativeP95s returns the p95 of each operation in each scenario relative
+// to its p95 in the first scenario, which the ops are sorted by.
+func relativeP95s(ops []OpStats) []htmlRelativeP95 {
+	first := ops[0].Scenario
+	base := make(map[string]time.Duration)
+	for _, op := range ops {
+		if op.Scenario == first {
+			base[op.Operation] = op.P95
+		}
+	}
+	var rows []htmlRelativeP95
+	for _, op := range ops {
+		row := htmlRelativeP95{Scenario: op.Scenario, Operation: op.Operation, P95: op.P95, Ratio: "-"}
+		if b, ok := base[op.Operation]; ok && b > 0 {
+			row.Ratio = fmt.Sprintf("%.2fx", float64(op.P95)/float64(b))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type chartPoint struct{ X, Y float64 }
+
+type chartSeries struct {
+	Name   string
+	Points []chartPoint
+}
+
+const (
+	chartWidth  = 720
+	chartHeight = 240
+	chartLeft   = 70
+	chartRight  = 130
+	chartTop    = 15
+	chartBottom = 35
+)
+
+var chartColours = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"}
+
+func chartColour(i int) string {
+	return chartColours[i%len(chartColours)]
+}
+
+// chartFrame starts an SVG chart with its axes, labelled with the maximum
+// values, and a legend for the series names.
+func chartFrame(b *strings.Builder, xLabel, yLabel, maxX, maxY string, names []string) {
+	plotRight := chartWidth - chartRight
+	plotBottom := chartHeight - chartBottom
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="11">`, chartWidth, chartHeight)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`, chartLeft, plotBottom, plotRight, plotBottom)
+	fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`, chartLeft, chartTop, chartLeft, plotBottom)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartLeft-4, chartTop+4, template.HTMLEscapeString(maxY))
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">0</text>`, chartLeft-4, plotBottom)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, plotRight, plotBottom+14, template.HTMLEscapeString(maxX))
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`, (chartLeft+plotRight)/2, chartHeight-4, template.HTMLEscapeString(xLabel))
+	fmt.Fprintf(b, `<text x="12" y="%d" transform="rotate(-90 12 %d)" text-anchor="middle">%s</text>`,
+		(chartTop+plotBottom)/2, (chartTop+plotBottom)/2, template.HTMLEscapeString(yLabel))
+	for i, name := range names {
+		y := chartTop + 10 + i*16
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, plotRight+10, y-9, chartColour(i))
+		fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`, plotRight+24, y, template.HTMLEscapeString(name))
+	}
+}
+
+// lineChart draws each series as a line against time in seconds.
+func lineChart(yLabel string, series []chartSeries) template.HTML {
+	maxX, maxY := 0.0, 0.0
+	names := make([]string, len(series))
+	for i, s := range series {
+		names[i] = s.Name
+		for _, p := range s.Points {
+			maxX = max(maxX, p.X)
+			maxY = max(maxY, p.Y)
+		}
+	}
+	if maxX == 0 {
+		maxX = 1
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+
+	var b strings.Builder
+	chartFrame(&b, "seconds", yLabel, fmt.Sprintf("%.0f", maxX), fmt.Sprintf("%.4g", maxY), names)
+	width := float64(chartWidth - chartRight - chartLeft)
+	height := float64(chartHeight - chartBottom - chartTop)
+	for i, s := range series {
+		points := make([]string, len(s.Points))
+		for j, p := range s.Points {
+			x := float64(chartLeft) + p.X/maxX*width
+			y := float64(chartTop) + height - p.Y/maxY*height
+			points[j] = fmt.Sprintf("%.1f,%.1f", x, y)
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`,
+			chartColour(i), strings.Join(points, " "))
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// latencyChart draws the share of samples in each latency bucket as bars,
+// grouped by bucket with a bar for each scenario. Shares rather than counts
+// are drawn so that scenarios that ran different amounts of work can be
+// compared.
+func latencyChart(dists []LatencyDistribution) template.HTML {
+	var bounds []LatencyBucket
+	names := make([]string, len(dists))
+	shares := make([][]float64, len(dists))
+	maxShare := 0.0
+	for i, d := range dists {
+		names[i] = d.Scenario
+		if len(d.Buckets) > len(bounds) {
+			bounds = d.Buckets
+		}
+		var total uint64
+		for _, b := range d.Buckets {
+			total += b.Count
+		}
+		shares[i] = make([]float64, len(d.Buckets))
+		if total == 0 {
+			continue
+		}
+		for j, b := range d.Buckets {
+			shares[i][j] = float64(b.Count) / float64(total) * 100
+			maxShare = max(maxShare, shares[i][j])
+		}
+	}
+	if maxShare == 0 {
+		maxShare = 1
+	}
+	groups := make([]string, len(bounds))
+	for j, bound := range bounds {
+		groups[j] = "more"
+		if bound.UpperBound > 0 {
+			groups[j] = bound.UpperBound.String()
+		}
+	}
+	return barChart("latency up to", "% of samples", fmt.Sprintf("%.0f%%", maxShare), maxShare, groups, names, shares)
+}
+
+// comparisonChart draws the p95 latency of each operation as bars, grouped
+// by operation with a bar for each scenario, so the wrappers can be compared
+// operation by operation.
+func comparisonChart(ops []OpStats) template.HTML {
+	var operations, names []string
+	opIndex := make(map[string]int)
+	nameIndex := make(map[string]int)
+	for _, op := range ops {
+		if _, ok := opIndex[op.Operation]; !ok {
+			opIndex[op.Operation] = len(operations)
+			operations = append(operations, op.Operation)
+		}
+		if _, ok := nameIndex[op.Scenario]; !ok {
+			nameIndex[op.Scenario] = len(names)
+			names = append(names, op.Scenario)
+		}
+	}
+	p95s := make([][]float64, len(names))
+	for i := range p95s {
+		p95s[i] = make([]float64, len(operations))
+	}
+	var maxP95 time.Duration
+	for _, op := range ops {
+		p95s[nameIndex[op.Scenario]][opIndex[op.Operation]] = op.P95.Seconds()
+		maxP95 = max(maxP95, op.P95)
+	}
+	if maxP95 == 0 {
+		maxP95 = time.Second
+	}
+	return barChart("operation", "p95", maxP95.String(), maxP95.Seconds(), operations, names, p95s)
+}
+
+// barChart draws values[i][j] as the bar of series i in group j, scaled so
+// that maxValue reaches the top of the chart, where it is labelled maxLabel.
+func barChart(xLabel, yLabel, maxLabel string, maxValue float64, groups, names []string, values [][]float64) template.HTML {
+	var b strings.Builder
+	chartFrame(&b, xLabel, yLabel, "", maxLabel, names)
+	width := float64(chartWidth - chartRight - chartLeft)
+	height := float64(chartHeight - chartBottom - chartTop)
+	group := width / float64(max(len(groups), 1))
+	bar := group * 0.8 / float64(max(len(names), 1))
+	for j, label := range groups {
+		x := float64(chartLeft) + float64(j)*group
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle" font-size="9">%s</text>`,
+			x+group/2, chartHeight-chartBottom+12, template.HTMLEscapeString(label))
+		for i := range values {
+			if j >= len(values[i]) {
+				continue
+			}
+			h := values[i][j] / maxValue * height
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`,
+				x+group*0.1+float64(i)*bar, float64(chartTop)+height-h, bar, h, chartColour(i))
+		}
+	}
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
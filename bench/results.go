@@ -0,0 +1,109 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunResults are the results of a whole run, written at the end of it so
+// that runs can be compared afterwards.
+type RunResults struct {
+	Generated   time.Time             `json:"generated"`
+	Scenarios   []ScenarioResults     `json:"scenarios"`
+	Ops         []OpStats             `json:"ops"`
+	Latencies   []LatencyDistribution `json:"latencies"`
+	Memory      []MemorySample        `json:"memory,omitempty"`
+	MemoryPerDB []MemoryEstimate      `json:"memory_per_db,omitempty"`
+	Plans       []PlanComparison      `json:"plans,omitempty"`
+	Validation  []ValidationResult    `json:"validation,omitempty"`
+	LostUpdates []LostUpdateResult    `json:"lost_updates,omitempty"`
+	ExactlyOnce []ExactlyOnceResult   `json:"exactly_once,omitempty"`
+}
+
+// ScenarioResults describe how a scenario was run.
+type ScenarioResults struct {
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+	DBs      int               `json:"dbs"`
+	Events   []Event           `json:"events,omitempty"`
+	Timeline []TimelinePoint   `json:"timeline,omitempty"`
+	Curve    []CurvePoint      `json:"curve,omitempty"`
+	Knee     int               `json:"knee,omitempty"`
+}
+
+// collectRunResults gathers the results of the scenarios so far.
+func collectRunResults(scenarios []*Scenario, memory *MemorySampler) (RunResults, error) {
+	aggs, err := gatherHistograms(measuredPhases...)
+	if err != nil {
+		return RunResults{}, err
+	}
+	r := RunResults{
+		Generated: time.Now(),
+		Ops:       opStats(aggs),
+		Latencies: latencyDistributions(aggs),
+	}
+	if memory != nil {
+		r.Memory = memory.Samples()
+		r.MemoryPerDB = estimateMemoryPerDB(scenarios, r.Memory)
+	}
+	r.Scenarios = scenarioResults(scenarios)
+	return r, nil
+}
+
+// scenarioResults describes how each of the scenarios has been run so far.
+func scenarioResults(scenarios []*Scenario) []ScenarioResults {
+	var results []ScenarioResults
+	for _, s := range scenarios {
+		results = append(results, ScenarioResults{
+			Name:     s.Name(),
+			Metadata: s.Metadata(),
+			DBs:      len(s.DBs()),
+			Events:   s.Events(),
+			Timeline: s.Timeline(),
+			Curve:    s.Curve(),
+			Knee:     s.Knee(),
+		})
+	}
+	return results
+}
+
+// writeRunResults writes the results of the scenarios, along with the
+// comparison of their query plans, the validation of their data, the
+// updates they lost and whether their operations were applied exactly
+// once, to path.
+func writeRunResults(path string, scenarios []*Scenario, memory *MemorySampler, plans []PlanComparison, validation []ValidationResult, lostUpdates []LostUpdateResult, exactlyOnce []ExactlyOnceResult) error {
+	r, err := collectRunResults(scenarios, memory)
+	if err != nil {
+		return err
+	}
+	r.Plans = plans
+	r.Validation = validation
+	r.LostUpdates = lostUpdates
+	r.ExactlyOnce = exactlyOnce
+	return writeFileAtomic(path, r)
+}
+
+// readResults reads results written by writeRunResults, or summarises the
+// rows written to an operation CSV if path ends in .csv.
+func readResults(path string) (RunResults, error) {
+	if filepath.Ext(path) == ".csv" {
+		return readOpCSV(path)
+	}
+	return readRunResults(path)
+}
+
+// readRunResults reads results written by writeRunResults.
+func readRunResults(path string) (RunResults, error) {
+	var r RunResults
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
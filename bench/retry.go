@@ -0,0 +1,307 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/canonical/go-dqlite/driver"
+	"github.com/canonical/sqlair"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxTxAttempts bounds how many times a Retrier attempts a
+	// transaction.
+	MaxTxAttempts = 5
+	// RetryBackoff is how long a Retrier waits before its first retry,
+	// doubling for each retry after.
+	RetryBackoff = 10 * time.Millisecond
+)
+
+const (
+	// Kinds of commit failure forced by a CommitFailureInjector, as
+	// counted by the tx_injected_commit_failures metric.
+	CommitFailureBusy         = "busy"
+	CommitFailureLeaderChange = "leader-change"
+)
+
+var (
+	errInjectedBusy = errors.New("injected commit failure: database is locked")
+	// A dqlite client sees a leader change as a bad connection.
+	errInjectedLeaderChange = fmt.Errorf("injected commit failure: %w", sqldriver.ErrBadConn)
+	// errDuplicateRetry is returned by a Retrier when a constraint rejects
+	// the retry of a transaction whose commit had taken effect, the retry
+	// having tried to apply it again.
+	errDuplicateRetry = errors.New("retried a commit that had taken effect")
+)
+
+const (
+	// Reasons a transaction is retried for, as counted by the tx_retries
+	// metric.
+	RetryBusy      = "busy"
+	RetryLocked    = "locked"
+	RetryNotLeader = "not-leader"
+	RetryBadConn   = "bad-conn"
+)
+
+// Extended error codes dqlite fails a statement with when the node it was
+// sent to is not, or has stopped being, the leader. go-dqlite does not
+// export them. The legacy ones are those of nodes before
+// 3.32.1+replication4.
+const (
+	dqliteErrNotLeader            = 10 | 40<<8
+	dqliteErrLeadershipLost       = 10 | 41<<8
+	dqliteErrNotLeaderLegacy      = 10 | 32<<8
+	dqliteErrLeadershipLostLegacy = 10 | 33<<8
+)
+
+// IsTransient reports whether err is a failure that retrying the
+// transaction may succeed after: the database being busy or locked, or the
+// connection to the dqlite leader being lost.
+func IsTransient(err error) bool {
+	return transientReason(err) != ""
+}
+
+// transientReason returns which of the retry reasons err is, or "" if it
+// is not transient.
+func transientReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errInjectedBusy):
+		return RetryBusy
+	case errors.Is(err, errInjectedLeaderChange), errors.Is(err, driver.ErrNoAvailableLeader):
+		return RetryNotLeader
+	case errors.Is(err, sqldriver.ErrBadConn):
+		// go-dqlite reports a lost leader as a bad connection.
+		return RetryBadConn
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy:
+			return RetryBusy
+		case sqlite3.ErrLocked:
+			return RetryLocked
+		}
+		return ""
+	}
+	var dqliteErr driver.Error
+	if errors.As(err, &dqliteErr) {
+		switch dqliteErr.Code {
+		case dqliteErrNotLeader, dqliteErrLeadershipLost, dqliteErrNotLeaderLegacy, dqliteErrLeadershipLostLegacy:
+			return RetryNotLeader
+		}
+		switch dqliteErr.Code & 0xff {
+		case driver.ErrBusy:
+			return RetryBusy
+		case int(sqlite3.ErrLocked):
+			return RetryLocked
+		}
+	}
+	return ""
+}
+
+// CommitFailureInjector makes a fraction of commits fail transiently. Half
+// fail as if the database were busy, and are rolled back. The other half
+// fail as if the leader changed once the commit had been replicated, so
+// they take effect although the caller is told they failed.
+type CommitFailureInjector struct {
+	fraction float64
+	failures *prometheus.CounterVec
+}
+
+func NewCommitFailureInjector(fraction float64, failures *prometheus.CounterVec) *CommitFailureInjector {
+	return &CommitFailureInjector{
+		fraction: fraction,
+		failures: failures,
+	}
+}
+
+// commit commits or rolls back the transaction, failing the commit if
+// the next one is to fail.
+func (c *CommitFailureInjector) commit(commit, rollback func() error) error {
+	if rand.Float64() >= c.fraction {
+		return commit()
+	}
+	if rand.Intn(2) == 0 {
+		c.failures.WithLabelValues(CommitFailureBusy).Inc()
+		_ = rollback()
+		return errInjectedBusy
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	c.failures.WithLabelValues(CommitFailureLeaderChange).Inc()
+	return errInjectedLeaderChange
+}
+
+// Retrier retries transactions that fail transiently, with exponential
+// backoff, as sqlair users are recommended to.
+type Retrier struct {
+	retries *prometheus.CounterVec
+}
+
+// NewRetrier returns a Retrier that counts its retries in retries, by
+// reason.
+func NewRetrier(retries *prometheus.CounterVec) *Retrier {
+	return &Retrier{retries: retries}
+}
+
+// retry runs attempt until it succeeds, fails other than transiently or
+// has been attempted MaxTxAttempts times. A retry of a commit that was
+// failed by the injector once it had taken effect, and that a constraint
+// then rejects, fails with errDuplicateRetry and the first failure rather
+// than the constraint.
+func (r *Retrier) retry(ctx context.Context, attempt func() error) error {
+	backoff := RetryBackoff
+	var applied error
+	for i := 1; ; i++ {
+		err := attempt()
+		if applied != nil && err != nil && errorClass(ctx, err) == ErrorClassConstraint {
+			return fmt.Errorf("%w: %w", errDuplicateRetry, applied)
+		}
+		if errors.Is(err, errInjectedLeaderChange) {
+			applied = err
+		}
+		reason := transientReason(err)
+		if reason == "" || i == MaxTxAttempts {
+			return err
+		}
+		r.retries.WithLabelValues(reason).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// CommitFailureInjectable is a DBWrapper whose commits can be failed by a
+// CommitFailureInjector and whose transactions can be retried by a
+// Retrier.
+type CommitFailureInjectable interface {
+	DBWrapper
+	// WithCommitFailures returns the wrapper with either or both of
+	// injector and retrier set.
+	WithCommitFailures(injector *CommitFailureInjector, retrier *Retrier) DBWrapper
+}
+
+// SQLTxRunnerWithCommitFailures returns a transaction runner that has some
+// of its commits fail.
+func SQLTxRunnerWithCommitFailures(injector *CommitFailureInjector) SQLRunner {
+	return func(ctx context.Context, db *sql.DB, fn func(SQLQuerySubstrate) error) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return injector.commit(tx.Commit, tx.Rollback)
+	}
+}
+
+// SQLairTxRunnerWithCommitFailures returns a transaction runner that has
+// some of its commits fail.
+func SQLairTxRunnerWithCommitFailures(injector *CommitFailureInjector) SQLairRunner {
+	return func(ctx context.Context, db *sqlair.DB, fn func(SQLairQuerySubstrate) error) error {
+		tx, err := db.Begin(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return injector.commit(tx.Commit, tx.Rollback)
+	}
+}
+
+// SQLXTxRunnerWithCommitFailures returns a transaction runner that has some
+// of its commits fail.
+func SQLXTxRunnerWithCommitFailures(injector *CommitFailureInjector) SQLXRunner {
+	return func(ctx context.Context, db *sqlx.DB, fn func(SQLXQuerySubstrate) error) error {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return injector.commit(tx.Commit, tx.Rollback)
+	}
+}
+
+// GormTxRunnerWithCommitFailures returns a transaction runner that has some
+// of its commits fail.
+func GormTxRunnerWithCommitFailures(injector *CommitFailureInjector) GormRunner {
+	return func(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error) error {
+		tx := db.WithContext(ctx).Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if err := fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return injector.commit(
+			func() error { return tx.Commit().Error },
+			func() error { return tx.Rollback().Error },
+		)
+	}
+}
+
+// SQLRetryRunner returns a runner that retries the transactions of runner
+// that fail transiently.
+func SQLRetryRunner(runner SQLRunner, retrier *Retrier) SQLRunner {
+	return func(ctx context.Context, db *sql.DB, fn func(SQLQuerySubstrate) error) error {
+		return retrier.retry(ctx, func() error {
+			return runner(ctx, db, fn)
+		})
+	}
+}
+
+// SQLairRetryRunner returns a runner that retries the transactions of
+// runner that fail transiently.
+func SQLairRetryRunner(runner SQLairRunner, retrier *Retrier) SQLairRunner {
+	return func(ctx context.Context, db *sqlair.DB, fn func(SQLairQuerySubstrate) error) error {
+		return retrier.retry(ctx, func() error {
+			return runner(ctx, db, fn)
+		})
+	}
+}
+
+// SQLXRetryRunner returns a runner that retries the transactions of runner
+// that fail transiently.
+func SQLXRetryRunner(runner SQLXRunner, retrier *Retrier) SQLXRunner {
+	return func(ctx context.Context, db *sqlx.DB, fn func(SQLXQuerySubstrate) error) error {
+		return retrier.retry(ctx, func() error {
+			return runner(ctx, db, fn)
+		})
+	}
+}
+
+// GormRetryRunner returns a runner that retries the transactions of runner
+// that fail transiently.
+func GormRetryRunner(runner GormRunner, retrier *Retrier) GormRunner {
+	return func(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error) error {
+		return retrier.retry(ctx, func() error {
+			return runner(ctx, db, fn)
+		})
+	}
+}
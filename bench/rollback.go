@@ -0,0 +1,166 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/canonical/sqlair"
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// MaxRollbackRetries bounds how many times in a row a transaction is rolled
+// back, after which it is always committed.
+const MaxRollbackRetries = 10
+
+// RollbackInjector rolls back a fraction of transactions instead of
+// committing them. The transaction is then retried, so that operations still
+// take effect exactly once and the cost of the retry can be measured. A
+// retry writes the same values as the attempt that was rolled back, so any
+// effect the rollback failed to undo, such as a seeded agent, fails the
+// retry and is counted as an operation error.
+type RollbackInjector struct {
+	fraction float64
+
+	rollbacks prometheus.Counter
+	// retryCost is the time spent on attempts that were rolled back.
+	retryCost prometheus.Histogram
+}
+
+func NewRollbackInjector(fraction float64, rollbacks prometheus.Counter, retryCost prometheus.Histogram) *RollbackInjector {
+	return &RollbackInjector{
+		fraction:  fraction,
+		rollbacks: rollbacks,
+		retryCost: retryCost,
+	}
+}
+
+// rollback reports whether the next transaction should be rolled back.
+func (r *RollbackInjector) rollback() bool {
+	return rand.Float64() < r.fraction
+}
+
+// retry runs attempt until it commits. attempt runs the transaction and
+// rolls it back instead of committing if told to.
+func (r *RollbackInjector) retry(attempt func(rollback bool) error) error {
+	for i := 0; ; i++ {
+		rollback := i < MaxRollbackRetries && r.rollback()
+		start := time.Now()
+		err := attempt(rollback)
+		if err != nil || !rollback {
+			return err
+		}
+		r.rollbacks.Inc()
+		r.retryCost.Observe(time.Since(start).Seconds())
+	}
+}
+
+// RollbackInjectable is a DBWrapper whose transactions can be rolled back by
+// a RollbackInjector.
+type RollbackInjectable interface {
+	DBWrapper
+	WithRollbacks(injector *RollbackInjector) DBWrapper
+}
+
+// SQLTxRunnerWithRollbacks returns a transaction runner that has some of
+// its transactions rolled back and retried.
+func SQLTxRunnerWithRollbacks(injector *RollbackInjector) SQLRunner {
+	return func(ctx context.Context, db *sql.DB, fn func(SQLQuerySubstrate) error) error {
+		return injector.retry(func(rollback bool) error {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(tx); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if rollback {
+				if err := tx.Rollback(); err != nil {
+					return fmt.Errorf("injected rollback: %w", err)
+				}
+				return nil
+			}
+			return tx.Commit()
+		})
+	}
+}
+
+// SQLairTxRunnerWithRollbacks returns a transaction runner that has some of
+// its transactions rolled back and retried.
+func SQLairTxRunnerWithRollbacks(injector *RollbackInjector) SQLairRunner {
+	return func(ctx context.Context, db *sqlair.DB, fn func(SQLairQuerySubstrate) error) error {
+		return injector.retry(func(rollback bool) error {
+			tx, err := db.Begin(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(tx); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if rollback {
+				if err := tx.Rollback(); err != nil {
+					return fmt.Errorf("injected rollback: %w", err)
+				}
+				return nil
+			}
+			return tx.Commit()
+		})
+	}
+}
+
+// SQLXTxRunnerWithRollbacks returns a transaction runner that has some of
+// its transactions rolled back and retried.
+func SQLXTxRunnerWithRollbacks(injector *RollbackInjector) SQLXRunner {
+	return func(ctx context.Context, db *sqlx.DB, fn func(SQLXQuerySubstrate) error) error {
+		return injector.retry(func(rollback bool) error {
+			tx, err := db.BeginTxx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(tx); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if rollback {
+				if err := tx.Rollback(); err != nil {
+					return fmt.Errorf("injected rollback: %w", err)
+				}
+				return nil
+			}
+			return tx.Commit()
+		})
+	}
+}
+
+// GormTxRunnerWithRollbacks returns a transaction runner that has some of
+// its transactions rolled back and retried.
+func GormTxRunnerWithRollbacks(injector *RollbackInjector) GormRunner {
+	return func(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error) error {
+		return injector.retry(func(rollback bool) error {
+			tx := db.WithContext(ctx).Begin()
+			if tx.Error != nil {
+				return tx.Error
+			}
+			if err := fn(tx); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if rollback {
+				if err := tx.Rollback().Error; err != nil {
+					return fmt.Errorf("injected rollback: %w", err)
+				}
+				return nil
+			}
+			return tx.Commit().Error
+		})
+	}
+}
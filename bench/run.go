@@ -0,0 +1,410 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/tomb.v2"
+)
+
+// RunOpts configures a run of one or more scenarios side by side.
+type RunOpts struct {
+	// Addr is the address metrics and profiles are served on. It
+	// defaults to :3333.
+	Addr string
+	// Soak writes a report of the last window of the run every interval.
+	Soak SoakOpts
+	// TimeSeries snapshots every metric to a file every interval.
+	TimeSeries TimeSeriesOpts
+	// CI, if set, runs a short fixed workload instead and checks it
+	// against the thresholds.
+	CI *CIOpts
+	// Results is the path the results of the run are written to, for the
+	// compare and report commands. Empty writes no results.
+	Results string
+	// CPUProfile is the path a CPU profile of the run is written to,
+	// comparing the time each wrapper spends in sqlair, database/sql and
+	// the driver. Empty does not profile the run.
+	CPUProfile string
+	// Collector is the URL of a collector the stats of the run are sent
+	// to, as an agent of a distributed run. Empty sends them nowhere.
+	Collector string
+	// Agent names this process to the collector. It defaults to the
+	// hostname.
+	Agent string
+	// ResultsUpload is a URL the results are put to once written, such as
+	// a presigned object store URL. It needs Results to be set.
+	ResultsUpload string
+	// ShutdownTimeout bounds how long the scenarios are given to stop once
+	// the run is interrupted, so that it is reported on within a pod's
+	// termination grace period. Zero waits for them to stop.
+	ShutdownTimeout time.Duration
+	// GC tunes the garbage collector for the duration of the run.
+	GC GCOpts
+	// OpCSV is the path of a CSV file a row is appended to for every
+	// operation run in the measure phase, with its time, duration and
+	// error. Empty writes no rows.
+	OpCSV string
+	// Duration stops the run once it has gone on this long, letting the
+	// operations in flight finish, then reports on it as if interrupted.
+	// Zero runs until interrupted.
+	Duration time.Duration
+}
+
+// nameScenarios names the options left unnamed after their wrapper,
+// numbering those that share a wrapper from the second on, so that every
+// scenario of the run has time series of its own.
+func nameScenarios(scenarioOpts []*BenchmarkOpts) {
+	taken := make(map[string]bool)
+	for _, o := range scenarioOpts {
+		if o.Name != "" {
+			taken[o.Name] = true
+		}
+	}
+	for _, o := range scenarioOpts {
+		if o.Name != "" {
+			continue
+		}
+		name := o.Wrapper.Name()
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s-%d", o.Wrapper.Name(), i)
+		}
+		if name != o.Wrapper.Name() {
+			o.Name = name
+		}
+		taken[name] = true
+	}
+}
+
+// ErrCIFailed is returned by Run when a CI run does not meet its
+// thresholds.
+var ErrCIFailed = errors.New("ci thresholds not met")
+
+// Run runs a scenario for each of the options until they have all finished
+// or the process is interrupted, then reports on them.
+func Run(opts RunOpts, scenarioOpts ...*BenchmarkOpts) error {
+	if opts.CI != nil {
+		for _, o := range scenarioOpts {
+			opts.CI.apply(o)
+		}
+	}
+	if opts.Addr == "" {
+		opts.Addr = ":3333"
+	}
+	if opts.ResultsUpload != "" && opts.Results == "" {
+		return errors.New("uploading results needs a results path")
+	}
+	if opts.Agent == "" {
+		opts.Agent, _ = os.Hostname()
+	}
+
+	var err error
+	if _, err = os.Stat("/tmp"); errors.Is(err, fs.ErrNotExist) {
+		err = os.Mkdir("/tmp", 0750)
+	}
+	if err != nil {
+		return fmt.Errorf("establishing tmp dir: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	server := http.Server{
+		Addr:         opts.Addr,
+		Handler:      mux,
+		WriteTimeout: 50 * time.Second,
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	var ready atomic.Bool
+	handleHealth(mux, &ready, healthCheckers(scenarioOpts))
+	mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+
+	t := tomb.Tomb{}
+
+	t.Go(func() error {
+		return server.ListenAndServe()
+	})
+
+	var profile *CPUProfile
+	var opCSV *OpCSV
+	var started []*Scenario
+	// abort undoes what the run started before it failed to start, so
+	// that Run can be called again in the same process.
+	abort := func(err error) error {
+		for _, s := range started {
+			s.Kill()
+		}
+		for _, s := range started {
+			_ = s.Wait()
+			s.closeDBs()
+		}
+		if opCSV != nil {
+			_ = opCSV.Close()
+		}
+		if profile != nil {
+			_ = profile.Stop()
+		}
+		server.Close()
+		t.Kill(nil)
+		_ = t.Wait()
+		return err
+	}
+
+	if opts.CPUProfile != "" {
+		if profile, err = startCPUProfile(opts.CPUProfile); err != nil {
+			return abort(fmt.Errorf("starting cpu profile: %w", err))
+		}
+	}
+
+	gcSettings, restoreGC := applyGC(opts.GC)
+	defer restoreGC()
+	gcStart := takeGCSnapshot()
+
+	if opts.OpCSV != "" {
+		if opCSV, err = OpenOpCSV(opts.OpCSV); err != nil {
+			return abort(fmt.Errorf("opening operation csv: %w", err))
+		}
+	}
+
+	nameScenarios(scenarioOpts)
+	var scenarios []*Scenario
+	for _, o := range scenarioOpts {
+		s := NewScenario(o)
+		s.opCSV = opCSV
+		setGCMetadata(s, gcSettings)
+		scenarios = append(scenarios, s)
+	}
+	handleSnapshots(mux, scenarios)
+	handleQueries(mux, scenarios)
+	for _, s := range scenarios {
+		if err := s.Start(); err != nil {
+			// Start fails before the scenario runs anything, but its
+			// agent samplers stop with it.
+			s.Kill()
+			return abort(fmt.Errorf("starting scenario %s: %w", s.Name(), err))
+		}
+		started = append(started, s)
+	}
+	ready.Store(true)
+
+	// Scenarios are independent, a scenario that dies is reported but
+	// the others carry on running.
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	failed := make(map[string]error)
+	for _, s := range scenarios {
+		wg.Add(1)
+		go func(s *Scenario) {
+			defer wg.Done()
+			if err := s.Wait(); err != nil {
+				runLog.Error("scenario failed", "scenario", s.Name(), "err", err)
+				failedMu.Lock()
+				failed[s.Name()] = err
+				failedMu.Unlock()
+			}
+		}(s)
+	}
+	allDead := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDead)
+	}()
+
+	runSoakReports(&t, opts.Soak, scenarios)
+	runTimeSeriesExport(&t, opts.TimeSeries)
+	memory := runMemorySampler(&t, scenarios)
+	if opts.Collector != "" {
+		runCollectorReports(&t, opts.Collector, opts.Agent, scenarios)
+	}
+
+	// SIGUSR1 dumps the current stats without stopping the run.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	defer signal.Stop(usr1)
+	go func() {
+		for range usr1 {
+			if err := dumpStats(os.Stdout, scenarios); err != nil {
+				runLog.Error("dumping stats", "err", err)
+			}
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	var finished <-chan time.Time
+	if opts.Duration > 0 {
+		timer := time.NewTimer(opts.Duration)
+		defer timer.Stop()
+		finished = timer.C
+	}
+
+	select {
+	case <-t.Dead():
+	case <-allDead:
+	case <-sig:
+	case <-finished:
+		runLog.Info("run reached its duration, stopping", "duration", opts.Duration)
+	}
+	end := time.Now()
+	ready.Store(false)
+	for _, s := range scenarios {
+		s.Kill()
+	}
+	waitStopped(allDead, opts.ShutdownTimeout)
+	server.Close()
+	// Write out what the workers logged before the reports.
+	DefaultWorkerLog().Flush()
+	if opCSV != nil {
+		if err := opCSV.Close(); err != nil {
+			runLog.Error("writing operation csv", "err", err)
+		}
+	}
+	// The reports collect garbage of their own, so the run's is taken
+	// before them.
+	gcEnd := takeGCSnapshot()
+
+	// The server was closed above, which is how it normally stops.
+	if err := t.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		runLog.Error("run failed", "err", err)
+	}
+
+	if profile != nil {
+		if err := profile.Stop(); err != nil {
+			runLog.Error("writing cpu profile", "err", err)
+		} else if breakdowns, err := breakdownProfile(opts.CPUProfile, scenarios); err != nil {
+			runLog.Error("comparing cpu profiles", "err", err)
+		} else if err := printProfileComparison(os.Stdout, opts.CPUProfile, breakdowns); err != nil {
+			runLog.Error("comparing cpu profiles", "err", err)
+		}
+	}
+
+	if err := printRunSummary(os.Stdout, scenarios, end); err != nil {
+		runLog.Error("reporting run summary", "err", err)
+	}
+	if err := printHDRReport(os.Stdout, scenarios); err != nil {
+		runLog.Error("reporting latency percentiles", "err", err)
+	}
+	if err := printOverheadReport(os.Stdout, scenarios); err != nil {
+		runLog.Error("reporting sqlair overhead", "err", err)
+	}
+	if err := printSignificanceReport(os.Stdout, scenarios); err != nil {
+		runLog.Error("reporting significance", "err", err)
+	}
+	if err := printReadTimingReport(os.Stdout); err != nil {
+		runLog.Error("reporting read timings", "err", err)
+	}
+	if err := printGCReport(os.Stdout, gcSettings, gcStart, gcEnd, scenarios); err != nil {
+		runLog.Error("reporting gc", "err", err)
+	}
+	var misses int64
+	for _, s := range scenarios {
+		misses += s.samplers.misses()
+	}
+	if misses > 0 {
+		runLog.Warn("agent sampler fell behind, sampling agents inline while timed", "misses", misses)
+	}
+	if dropped := DefaultWorkerLog().Dropped(); dropped > 0 {
+		runLog.Warn("worker log was full, dropping lines", "dropped", dropped)
+	}
+	if opCSV != nil && opCSV.Dropped() > 0 {
+		runLog.Warn("operation csv was full, dropping rows", "dropped", opCSV.Dropped())
+	}
+	if misses := DefaultUUIDPool().Misses(); misses > 0 {
+		runLog.Warn("uuid pool fell behind, generating uuids inline while timed", "misses", misses)
+	}
+	if err := printForeignKeyReport(os.Stdout, scenarios); err != nil {
+		runLog.Error("reporting foreign key enforcement", "err", err)
+	}
+	if err := printMemoryReport(os.Stdout, estimateMemoryPerDB(scenarios, memory.Samples())); err != nil {
+		runLog.Error("reporting memory per database", "err", err)
+	}
+	plans, err := compareQueryPlans(scenarios)
+	if err != nil {
+		runLog.Error("comparing query plans", "err", err)
+	}
+	printQueryPlans(os.Stdout, plans)
+	validation := validateScenarios(scenarios)
+	if err := printValidationReport(os.Stdout, validation); err != nil {
+		runLog.Error("reporting data validation", "err", err)
+	}
+	lostUpdates := checkScenariosLostUpdates(scenarios)
+	if err := printLostUpdateReport(os.Stdout, lostUpdates); err != nil {
+		runLog.Error("reporting lost updates", "err", err)
+	}
+	exactlyOnce := checkScenariosExactlyOnce(scenarios)
+	if err := printExactlyOnceReport(os.Stdout, exactlyOnce); err != nil {
+		runLog.Error("reporting exactly once verification", "err", err)
+	}
+	if opts.Collector != "" {
+		r, err := newAgentReport(opts.Agent, scenarios)
+		if err == nil {
+			r.Final = true
+			r.Plans = plans
+			err = sendAgentReport(opts.Collector, r)
+		}
+		if err != nil {
+			runLog.Error("reporting to collector", "err", err)
+		}
+	}
+	if opts.Results != "" {
+		if err := writeRunResults(opts.Results, scenarios, memory, plans, validation, lostUpdates, exactlyOnce); err != nil {
+			runLog.Error("writing results", "err", err)
+		} else if opts.ResultsUpload != "" {
+			if err := uploadResults(opts.Results, opts.ResultsUpload); err != nil {
+				runLog.Error("uploading results", "err", err)
+			}
+		}
+	}
+
+	// The databases are only closed once reported on, as the reports
+	// read them.
+	for _, s := range scenarios {
+		s.closeDBs()
+	}
+	closeProviders(scenarios)
+
+	if opts.CI != nil {
+		passed, err := reportCI(*opts.CI, scenarios, failed)
+		if err != nil {
+			return fmt.Errorf("reporting ci results: %w", err)
+		}
+		if !passed {
+			return ErrCIFailed
+		}
+	}
+	return nil
+}
+
+// closeProviders closes the providers of the scenarios that hold resources
+// of their own, such as the nodes of a dqlite cluster or the files of the
+// databases, once the databases are closed.
+func closeProviders(scenarios []*Scenario) {
+	closed := make(map[io.Closer]bool)
+	for _, s := range scenarios {
+		c, ok := s.opts.Provider.(io.Closer)
+		if !ok || closed[c] {
+			continue
+		}
+		closed[c] = true
+		if err := c.Close(); err != nil {
+			runLog.Error("closing provider", "provider", fmt.Sprintf("%T", c), "err", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package bench
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/canonical/sqlair"
+	"github.com/jmoiron/sqlx"
+	"gorm.io/gorm"
+)
+
+// The runner can be global. The context bounds the transaction the runner
+// opens, and fn passes it on to the queries it runs.
+type SQLRunner func(context.Context, *sql.DB, func(SQLQuerySubstrate) error) error
+
+var SQLTxRunner = func(ctx context.Context, db *sql.DB, fn func(SQLQuerySubstrate) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var SQLPlainRunner = func(ctx context.Context, db *sql.DB, fn func(qs SQLQuerySubstrate) error) error {
+	err := fn(db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type SQLairRunner func(context.Context, *sqlair.DB, func(SQLairQuerySubstrate) error) error
+
+var SQLairTxRunner = func(ctx context.Context, db *sqlair.DB, fn func(SQLairQuerySubstrate) error) error {
+	tx, err := db.Begin(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var SQLairPlainRunner = func(ctx context.Context, db *sqlair.DB, fn func(SQLairQuerySubstrate) error) error {
+	err := fn(db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type SQLXRunner func(context.Context, *sqlx.DB, func(SQLXQuerySubstrate) error) error
+
+var SQLXTxRunner = func(ctx context.Context, db *sqlx.DB, fn func(SQLXQuerySubstrate) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+var SQLXPlainRunner = func(ctx context.Context, db *sqlx.DB, fn func(SQLXQuerySubstrate) error) error {
+	err := fn(db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GormRunner runs fn against the database, or a transaction of it, bound to
+// the context.
+type GormRunner func(context.Context, *gorm.DB, func(*gorm.DB) error) error
+
+var GormTxRunner = func(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error) error {
+	tx := db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	err := fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+var GormPlainRunner = func(ctx context.Context, db *gorm.DB, fn func(*gorm.DB) error) error {
+	return fn(db.WithContext(ctx))
+}
@@ -0,0 +1,348 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// Scenario is a single benchmark configuration. Each scenario has its own
+// tomb and metrics so that a failure in one does not affect any others
+// running alongside it.
+type Scenario struct {
+	name      string
+	opts      *BenchmarkOpts
+	metrics   *ScenarioMetrics
+	scheduler *Scheduler
+	tomb      tomb.Tomb
+	// model is the model of the databases' contents when validating.
+	model *dataModel
+	// versions counts the increments of the databases' versions when
+	// operations run concurrently.
+	versions *versionCounts
+	// ledger holds the logical operations applied to each database when
+	// commits are made to fail.
+	ledger *operationLedger
+	// recentErrors holds the most recent operation errors, for snapshots.
+	recentErrors *errorRing
+	// latencies are the HDR histograms of the operations.
+	latencies *hdrLatencies
+	// opCSV, if set, has a row appended for every operation run.
+	opCSV *OpCSV
+	// live are the databases whose operations are running.
+	live liveDBs
+	// workloads seeds the workload, if it is seeded.
+	workloads *workloadSeeds
+	// samplers pick the agents the operations touch, ahead of time, until
+	// the scenario stops.
+	samplers *agentSamplers
+
+	started time.Time
+	// phases is the phase clock of the run, once it has started.
+	phases *PhaseClock
+
+	mu       sync.Mutex
+	metadata map[string]string
+	dbs      []DB
+	events   []Event
+	timeline []TimelinePoint
+	curve    []CurvePoint
+}
+
+// NewScenario returns a scenario for the given options. If the options do
+// not name the scenario, the wrapper name is used.
+func NewScenario(opts *BenchmarkOpts) *Scenario {
+	name := opts.Name
+	if name == "" {
+		name = opts.Wrapper.Name()
+	}
+	if len(opts.Curve.Counts) > 0 {
+		opts.Ramp = newCurveRamp(opts.Curve)
+	}
+	if opts.AgentDistribution == nil {
+		opts.AgentDistribution = UniformAgents{}
+	}
+	if opts.Ramp == nil {
+		opts.Ramp = StepRamp{
+			Step:   AddDBRate,
+			Every:  DatabaseAddFrequency,
+			MaxDBs: MaxNumberOfDatabases,
+		}
+	}
+	s := &Scenario{
+		name:      name,
+		opts:      opts,
+		metrics:   newScenarioMetrics(name),
+		scheduler: NewScheduler(opts.Scheduler, opts.SchedulerWorkers),
+		metadata:  make(map[string]string),
+
+		recentErrors: newErrorRing(RecentErrorsSize),
+		latencies:    newHDRLatencies(),
+		workloads:    newWorkloadSeeds(opts.Seed),
+	}
+	s.samplers = newAgentSamplers(s.tomb.Context(nil), opts.AgentDistribution)
+	s.SetMetadata("wrapper", opts.Wrapper.Name())
+	s.SetMetadata("provider", fmt.Sprintf("%T", opts.Provider))
+	s.SetMetadata("sqlair_version", SQLairVersion())
+	if p, ok := opts.Provider.(*SQLiteFileDBProvider); ok && p.syncDelay > 0 {
+		s.SetMetadata("sync_delay", p.syncDelay.String())
+	}
+	if p, ok := opts.Provider.(SQLiteDSNConfigurer); ok {
+		if params := p.DSNOpts().Params(); params != "" {
+			s.SetMetadata("sqlite_dsn", params)
+		}
+		if mmap := p.DSNOpts().MmapSize; mmap != 0 {
+			s.SetMetadata("sqlite_mmap_size", strconv.FormatInt(mmap, 10))
+		}
+	}
+	s.SetMetadata("run_in_tx", strconv.FormatBool(opts.RunInTx))
+	s.metrics.poolStats.watch(s.DBs)
+	s.metrics.diskUsage.watch(s.DBs, opts.Provider)
+	if !opts.Pool.isZero() {
+		s.SetMetadata("pool", fmt.Sprintf("max_open=%d max_idle=%d max_lifetime=%s",
+			opts.Pool.MaxOpen, opts.Pool.MaxIdle, opts.Pool.MaxLifetime))
+	}
+	if fk, ok := opts.Provider.(ForeignKeyEnforcer); ok && fk.EnforcesForeignKeys() {
+		s.SetMetadata("foreign_keys", "true")
+	}
+	s.SetMetadata("agent_distribution", opts.AgentDistribution.Name())
+	if opts.Seed != 0 {
+		s.SetMetadata("seed", strconv.FormatInt(opts.Seed, 10))
+	}
+	s.SetMetadata("db_creation_parallelism", strconv.Itoa(opts.CreateParallelism))
+	s.SetMetadata("ramp", fmt.Sprintf("%+v", opts.Ramp))
+	if opts.Churn.Every > 0 {
+		if opts.Churn.Count < 1 {
+			opts.Churn.Count = 1
+		}
+		s.SetMetadata("churn", fmt.Sprintf("%d every %s", opts.Churn.Count, opts.Churn.Every))
+	}
+	s.SetMetadata("scheduler", s.scheduler.kind)
+	if s.scheduler.kind == SchedulerPool {
+		s.SetMetadata("scheduler_workers", strconv.Itoa(s.scheduler.workers))
+	}
+	s.scheduler.SetLagObserver(func(lag time.Duration) {
+		s.metrics.schedulerLag.Observe(lag.Seconds())
+	})
+	if opts.OpenLoop && !opts.fixedWork() {
+		s.scheduler.SetOpenLoop(func(delta int) {
+			s.metrics.schedulerBacklog.Add(float64(delta))
+		})
+		s.SetMetadata("load", "open-loop")
+	} else {
+		s.SetMetadata("load", "closed-loop")
+	}
+	if opts.Deterministic.Steps > 0 {
+		s.SetMetadata("deterministic_steps", strconv.Itoa(opts.Deterministic.Steps))
+		s.SetMetadata("deterministic_seed", strconv.FormatInt(opts.Deterministic.Seed, 10))
+	} else if opts.Iterations > 0 {
+		s.SetMetadata("iterations", strconv.Itoa(opts.Iterations))
+	}
+	if opts.Paired != nil {
+		s.SetMetadata("paired", "true")
+	}
+	if opts.Invariants.Interval > 0 {
+		s.SetMetadata("invariant_interval", opts.Invariants.Interval.String())
+	}
+	if opts.Differential.Interval > 0 {
+		s.SetMetadata("differential_interval", opts.Differential.Interval.String())
+	}
+	if opts.OpConcurrency > 1 {
+		s.versions = newVersionCounts()
+		s.SetMetadata("op_concurrency", strconv.Itoa(opts.OpConcurrency))
+	}
+	if opts.OpTimeout > 0 {
+		s.SetMetadata("op_timeout", opts.OpTimeout.String())
+	}
+	if opts.Validate {
+		s.model = newDataModel()
+		s.SetMetadata("validate", "true")
+	}
+	if opts.RollbackFraction > 0 {
+		if w, ok := opts.Wrapper.(RollbackInjectable); ok && opts.RunInTx {
+			opts.Wrapper = w.WithRollbacks(NewRollbackInjector(
+				opts.RollbackFraction, s.metrics.injectedRollbacks, s.metrics.rollbackRetryCost))
+			s.SetMetadata("rollback_fraction", strconv.FormatFloat(opts.RollbackFraction, 'f', -1, 64))
+		} else {
+			scenarioLog(s, "rollbacks").Warn("cannot inject rollbacks, transactions are not in use or the wrapper does not support it",
+				"type", fmt.Sprintf("%T", opts.Wrapper))
+		}
+	}
+	if opts.CommitFailureFraction > 0 || opts.Retry {
+		if w, ok := opts.Wrapper.(CommitFailureInjectable); ok && opts.RunInTx {
+			var injector *CommitFailureInjector
+			if opts.CommitFailureFraction > 0 {
+				injector = NewCommitFailureInjector(opts.CommitFailureFraction, s.metrics.commitFailures)
+				s.metrics.commitFailures.WithLabelValues(CommitFailureBusy)
+				s.metrics.commitFailures.WithLabelValues(CommitFailureLeaderChange)
+				s.ledger = newOperationLedger()
+				s.SetMetadata("commit_failure_fraction", strconv.FormatFloat(opts.CommitFailureFraction, 'f', -1, 64))
+			}
+			var retrier *Retrier
+			if opts.Retry {
+				retrier = NewRetrier(s.metrics.txRetries)
+				for _, reason := range []string{RetryBusy, RetryLocked, RetryNotLeader, RetryBadConn} {
+					s.metrics.txRetries.WithLabelValues(reason)
+				}
+				s.SetMetadata("retry", "true")
+			}
+			opts.Wrapper = w.WithCommitFailures(injector, retrier)
+		} else {
+			scenarioLog(s, "commits").Warn("cannot fail commits or retry, transactions are not in use or the wrapper does not support it",
+				"type", fmt.Sprintf("%T", opts.Wrapper))
+		}
+	}
+	if opts.RateLimit != nil {
+		s.scheduler.SetRateLimit(
+			opts.RateLimit,
+			func(wait time.Duration) {
+				s.metrics.rateLimitWait.Add(wait.Seconds())
+			},
+		)
+		s.SetMetadata("max_ops_per_second", strconv.FormatFloat(opts.RateLimit.Rate(), 'f', -1, 64))
+	}
+	return s
+}
+
+// SetMetadata records a setting that describes how the scenario was run.
+func (s *Scenario) SetMetadata(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.metadata[key]; ok {
+		s.metrics.metadata.DeleteLabelValues(key, old)
+	}
+	s.metadata[key] = value
+	s.metrics.metadata.WithLabelValues(key, value).Set(1)
+}
+
+// Metadata returns a copy of the settings recorded for the scenario.
+func (s *Scenario) Metadata() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := make(map[string]string, len(s.metadata))
+	for k, v := range s.metadata {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+func (s *Scenario) Name() string {
+	return s.name
+}
+
+// addDBs records databases that are part of the scenario.
+func (s *Scenario) addDBs(dbs []DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbs = append(s.dbs, dbs...)
+}
+
+// removeDB removes a database from the scenario.
+func (s *Scenario) removeDB(db DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.dbs {
+		if other == db {
+			s.dbs = append(s.dbs[:i], s.dbs[i+1:]...)
+			return
+		}
+	}
+}
+
+// DBs returns the databases that are part of the scenario.
+func (s *Scenario) DBs() []DB {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]DB(nil), s.dbs...)
+}
+
+// closeDBs closes the databases of the scenario, once it has stopped.
+func (s *Scenario) closeDBs() {
+	for _, db := range s.DBs() {
+		if err := db.Close(); err != nil {
+			scenarioLog(s, "scenario").Error("closing db", "db", db.Name(), "err", err)
+		}
+	}
+}
+
+// Start begins creating databases and running operations against them. If
+// the scenario is configured to resume from a checkpoint, the run carries on
+// from where the checkpoint left off.
+func (s *Scenario) Start() error {
+	start := time.Now()
+	s.started = start
+	var resumed []DB
+	checkpoint, err := s.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		start = start.Add(-checkpoint.Elapsed)
+		resumed = resumeDBs(s, checkpoint)
+		scenarioLog(s, "checkpoint").Info("resuming from checkpoint",
+			"saved", checkpoint.Saved.Format(time.RFC3339), "elapsed", checkpoint.Elapsed)
+	}
+
+	ops := s.opts.operations(s.metrics)
+	phases := NewPhaseClock(s.opts.Phases, start)
+	s.phases = phases
+	runPhases(s, phases)
+	stages := NewStageClock(s.opts.Stages, start)
+	runStages(s, stages)
+	env := newOperationEnv(s, phases, stages, ops)
+	if checkpoint != nil {
+		checkpoint.restoreCounts(env)
+	}
+	runCheckpoints(s, start, phases, stages, env)
+	runChaos(s, env, start)
+	runTimeline(s, env)
+	runInvariantChecks(s)
+	runDifferentialChecks(s)
+	if ramp, ok := s.opts.Ramp.(*curveRamp); ok {
+		runCurve(s, ramp)
+	}
+
+	s.scheduler.Run(&s.tomb)
+	queue := dbRamper(s, RampCheckFrequency, s.opts.Ramp, start, len(resumed))
+	dbSpawner(s, env, queue, resumed, ops)
+	return nil
+}
+
+// Kill stops the scenario.
+func (s *Scenario) Kill() {
+	s.tomb.Kill(nil)
+}
+
+// Dead is closed once every goroutine of the scenario has finished.
+func (s *Scenario) Dead() <-chan struct{} {
+	return s.tomb.Dead()
+}
+
+// Wait blocks until the scenario has finished and returns the reason it died.
+func (s *Scenario) Wait() error {
+	err := s.tomb.Wait()
+	if err != nil {
+		return fmt.Errorf("scenario %s: %w", s.name, err)
+	}
+	return nil
+}
+
+// safeGo runs fn in the tomb, converting a panic into an error that kills
+// the tomb rather than the whole process.
+func safeGo(t *tomb.Tomb, fn func() error) {
+	t.Go(func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+			}
+		}()
+		return fn()
+	})
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// The kinds of scheduler a scenario can run its operations on.
+const (
+	// SchedulerPool runs operations on a bounded pool of workers, which
+	// take whichever operation is due first from a queue.
+	SchedulerPool = "pool"
+	// SchedulerGoroutine runs every operation of every database on a
+	// goroutine and timer of its own, so the cost of scheduling grows with
+	// the number of databases. It is kept to measure that cost against.
+	SchedulerGoroutine = "goroutine"
+)
+
+// SchedulerKinds returns the kinds of scheduler a scenario can use.
+func SchedulerKinds() []string {
+	return []string{SchedulerPool, SchedulerGoroutine}
+}
+
+// CheckSchedulerKind returns an error if kind is not one of SchedulerKinds.
+// Empty is the pool.
+func CheckSchedulerKind(kind string) error {
+	if kind != "" && !slices.Contains(SchedulerKinds(), kind) {
+		return fmt.Errorf("unknown scheduler %q, have %v", kind, SchedulerKinds())
+	}
+	return nil
+}
+
+// Scheduler runs tasks when they fall due, by default on a bounded pool of
+// workers. The pool replaces a goroutine and ticker per operation per
+// database, so the cost of scheduling does not grow with the number of
+// databases.
+type Scheduler struct {
+	kind    string
+	workers int
+	limiter *RateLimiter
+	// throttled is called with the time a worker spent waiting for the
+	// rate limiter.
+	throttled func(time.Duration)
+	// lag is called with how long after it was due each task started.
+	lag func(time.Duration)
+	// openLoop keeps tasks due at fixed intervals however long they
+	// take, calling backlog with the change in the number of runs that
+	// are due but have not started.
+	openLoop bool
+	backlog  func(int)
+
+	mu    sync.Mutex
+	tasks taskQueue
+	wake  chan struct{}
+	// t is the tomb the goroutine scheduler runs tasks in, once it has
+	// been started. Tasks scheduled before then wait in tasks.
+	t *tomb.Tomb
+}
+
+// scheduledTask is a task and the time it is next due. run is passed the
+// time the run is measured from and returns how long after it was due the
+// task is next due, or zero if it should not be scheduled again.
+type scheduledTask struct {
+	due   time.Time
+	run   func(start time.Time) time.Duration
+	index int
+	// backlog is the number of runs of the task that were due but had
+	// not started when it last ran, in open loop.
+	backlog int
+}
+
+// NewScheduler returns a scheduler of the kind, one of SchedulerKinds, with
+// workers workers if it is a pool. An empty kind is a pool.
+func NewScheduler(kind string, workers int) *Scheduler {
+	if kind == "" {
+		kind = SchedulerPool
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scheduler{
+		kind:    kind,
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetRateLimit limits the number of tasks the scheduler starts per second
+// across all workers. It must be called before Run.
+func (s *Scheduler) SetRateLimit(limiter *RateLimiter, throttled func(time.Duration)) {
+	s.limiter = limiter
+	s.throttled = throttled
+}
+
+// SetLagObserver calls lag with how long after it was due each task
+// started, including any wait for the rate limit. It must be called before
+// Run.
+func (s *Scheduler) SetLagObserver(lag func(time.Duration)) {
+	s.lag = lag
+}
+
+// SetOpenLoop runs tasks open loop: a task falls due at fixed intervals
+// however long its runs take, instead of a slow run dropping the ticks it
+// overran, and each run is measured from when it was due rather than when
+// it started, so that waiting behind slow runs counts towards latency.
+// backlog is called with the change in the number of runs that are due but
+// have not started. It must be called before Run.
+func (s *Scheduler) SetOpenLoop(backlog func(int)) {
+	s.openLoop = true
+	s.backlog = backlog
+}
+
+// Schedule adds a task that is first due after delay. After each run, the
+// task is scheduled again after the interval it returns.
+func (s *Scheduler) Schedule(delay time.Duration, run func(start time.Time) time.Duration) {
+	s.push(&scheduledTask{
+		due: time.Now().Add(delay),
+		run: run,
+	})
+}
+
+func (s *Scheduler) push(task *scheduledTask) {
+	s.mu.Lock()
+	t := s.t
+	if t == nil {
+		heap.Push(&s.tasks, task)
+	}
+	s.mu.Unlock()
+
+	if t != nil {
+		s.goTask(t, task)
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start waits for the rate limiter, then runs the task and works out when
+// it is next due. It returns false if the tomb died while waiting.
+func (s *Scheduler) start(t *tomb.Tomb, task *scheduledTask) (next time.Duration, ok bool) {
+	if s.limiter != nil {
+		wait, ok := s.limiter.Wait(t.Dying())
+		if wait > 0 && s.throttled != nil {
+			s.throttled(wait)
+		}
+		if !ok {
+			return 0, false
+		}
+	}
+	if s.lag != nil {
+		s.lag(time.Since(task.due))
+	}
+	if !s.openLoop {
+		next = task.run(time.Now())
+		if next <= 0 {
+			return 0, true
+		}
+		// Like a time.Ticker, ticks missed while the task was running
+		// are dropped.
+		if behind := time.Since(task.due); behind >= 0 {
+			task.due = task.due.Add((behind/next + 1) * next)
+		}
+		return next, true
+	}
+
+	next = task.run(task.due)
+	backlog := 0
+	if next > 0 {
+		// Ticks missed while the task was running are kept, and run
+		// back to back until it has caught up.
+		task.due = task.due.Add(next)
+		if behind := time.Since(task.due); behind >= 0 {
+			backlog = int(behind/next) + 1
+		}
+	}
+	if backlog != task.backlog && s.backlog != nil {
+		s.backlog(backlog - task.backlog)
+	}
+	task.backlog = backlog
+	return next, true
+}
+
+// goTask runs the task on a goroutine of its own for as long as it is
+// scheduled again.
+func (s *Scheduler) goTask(t *tomb.Tomb, task *scheduledTask) {
+	safeGo(t, func() error {
+		timer := time.NewTimer(time.Until(task.due))
+		defer timer.Stop()
+		for {
+			select {
+			case <-t.Dying():
+				return nil
+			case <-timer.C:
+			}
+			next, ok := s.start(t, task)
+			if !ok || next <= 0 {
+				return nil
+			}
+			timer.Reset(time.Until(task.due))
+		}
+	})
+}
+
+// Run starts the dispatcher and workers in the tomb, or for the goroutine
+// scheduler a goroutine for every task.
+func (s *Scheduler) Run(t *tomb.Tomb) {
+	if s.kind == SchedulerGoroutine {
+		s.mu.Lock()
+		s.t = t
+		tasks := s.tasks
+		s.tasks = nil
+		s.mu.Unlock()
+		for _, task := range tasks {
+			s.goTask(t, task)
+		}
+		return
+	}
+
+	work := make(chan *scheduledTask)
+
+	for i := 0; i < s.workers; i++ {
+		safeGo(t, func() error {
+			for {
+				select {
+				case <-t.Dying():
+					return nil
+				case task := <-work:
+					next, ok := s.start(t, task)
+					if !ok {
+						return nil
+					}
+					if next > 0 {
+						s.push(task)
+					}
+				}
+			}
+		})
+	}
+
+	safeGo(t, func() error {
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		for {
+			s.mu.Lock()
+			var due *scheduledTask
+			var wait <-chan time.Time
+			if len(s.tasks) > 0 {
+				if d := time.Until(s.tasks[0].due); d <= 0 {
+					due = heap.Pop(&s.tasks).(*scheduledTask)
+				} else {
+					timer.Reset(d)
+					wait = timer.C
+				}
+			}
+			s.mu.Unlock()
+
+			if due != nil {
+				select {
+				case work <- due:
+				case <-t.Dying():
+					return nil
+				}
+				continue
+			}
+
+			select {
+			case <-wait:
+			case <-s.wake:
+				if !timer.Stop() && wait != nil {
+					<-timer.C
+				}
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
+
+// taskQueue is a heap of tasks ordered by when they are due.
+type taskQueue []*scheduledTask
+
+func (q taskQueue) Len() int { return len(q) }
+
+func (q taskQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x any) {
+	task := x.(*scheduledTask)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *taskQueue) Pop() any {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return task
+}
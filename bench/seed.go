@@ -0,0 +1,92 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// workloadSeeds hands out the random streams of a seeded workload. Each
+// database gets the index it was created at, and each operation against it
+// a stream seeded from the seed, the index and the name of the operation.
+// Two runs with the same seed, or two scenarios of the same run, so put the
+// same agents in their databases and pick the same ones, whatever order
+// their databases and operations happen to run in.
+type workloadSeeds struct {
+	seed int64
+
+	mu   sync.Mutex
+	next int
+	dbs  map[string]int
+}
+
+// newWorkloadSeeds returns the streams of the workload with the seed, or nil
+// if it is zero and the workload is not seeded.
+func newWorkloadSeeds(seed int64) *workloadSeeds {
+	if seed == 0 {
+		return nil
+	}
+	return &workloadSeeds{seed: seed, dbs: make(map[string]int)}
+}
+
+// add gives a newly created database the next index.
+func (w *workloadSeeds) add(name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dbs[name] = w.next
+	w.next++
+}
+
+// rand returns the stream of the operation against the database, or nil if
+// the workload is not seeded or the database was not created by the
+// scenario, such as one resumed from a checkpoint.
+func (w *workloadSeeds) rand(db, op string) *rand.Rand {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	index, ok := w.dbs[db]
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%d/%s", w.seed, index, op)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+type workloadKey struct{}
+
+// withWorkloadRand returns a context carrying the stream an operation draws
+// its agents from.
+func withWorkloadRand(ctx context.Context, r *rand.Rand) context.Context {
+	return context.WithValue(ctx, workloadKey{}, r)
+}
+
+// workloadRand returns the stream of a seeded workload carried by ctx, if
+// there is one.
+func workloadRand(ctx context.Context) (*rand.Rand, bool) {
+	r, ok := ctx.Value(workloadKey{}).(*rand.Rand)
+	return r, ok
+}
+
+// seededUUIDs returns n random UUIDs read from r.
+func seededUUIDs(r *rand.Rand, n int) []string {
+	uuids := make([]string, n)
+	for i := range uuids {
+		// Reading from a rand.Rand never fails.
+		id, _ := uuid.NewRandomFromReader(r)
+		uuids[i] = id.String()
+	}
+	return uuids
+}
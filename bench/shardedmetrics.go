@@ -0,0 +1,136 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricShards is how many shards the latency of each operation is
+// accumulated in. Every operation run observes its latency, so with
+// thousands of databases the workers would otherwise all be updating the
+// same counters, and contention on them would become part of what is
+// measured.
+var MetricShards = runtime.GOMAXPROCS(0)
+
+// shardedHistogramVec is a histogram vector whose observations are spread
+// across shards that each sit on their own cache lines. The shards are
+// merged whenever the metrics are gathered, so readers of the Prometheus
+// registry see an ordinary histogram.
+type shardedHistogramVec struct {
+	desc    *prometheus.Desc
+	buckets []float64
+
+	mu       sync.Mutex
+	children map[string]*shardedHistogram
+}
+
+// newShardedHistogramVec returns a vector of histograms with the given
+// variable labels. It must be registered to be gathered.
+func newShardedHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *shardedHistogramVec {
+	return &shardedHistogramVec{
+		desc:     prometheus.NewDesc(opts.Name, opts.Help, labelNames, opts.ConstLabels),
+		buckets:  opts.Buckets,
+		children: make(map[string]*shardedHistogram),
+	}
+}
+
+// WithLabelValues returns the histogram for the label values, creating it
+// the first time.
+func (v *shardedHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	key := ""
+	for _, lv := range lvs {
+		key += lv + "\xff"
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.children[key]
+	if !ok {
+		h = &shardedHistogram{
+			buckets:     v.buckets,
+			labelValues: append([]string(nil), lvs...),
+			shards:      make([]histogramShard, max(MetricShards, 1)),
+		}
+		for i := range h.shards {
+			// One count per bucket, and one for +Inf.
+			h.shards[i].counts = make([]atomic.Uint64, len(v.buckets)+1)
+		}
+		v.children[key] = h
+	}
+	return h
+}
+
+func (v *shardedHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *shardedHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	children := make([]*shardedHistogram, 0, len(v.children))
+	for _, h := range v.children {
+		children = append(children, h)
+	}
+	v.mu.Unlock()
+	for _, h := range children {
+		count, sum, buckets := h.merge()
+		ch <- prometheus.MustNewConstHistogram(v.desc, count, sum, buckets, h.labelValues...)
+	}
+}
+
+// shardedHistogram is one histogram of a shardedHistogramVec.
+type shardedHistogram struct {
+	buckets     []float64
+	labelValues []string
+	shards      []histogramShard
+}
+
+// histogramShard holds the observations made in one shard. Its counts are
+// per bucket rather than cumulative, so an observation updates one.
+type histogramShard struct {
+	counts  []atomic.Uint64
+	sumBits atomic.Uint64
+	// Keep neighbouring shards off each other's cache lines.
+	_ [40]byte
+}
+
+// Observe adds v to a shard picked at random, which is cheap and spreads
+// concurrent observers out without knowing which worker they are.
+func (h *shardedHistogram) Observe(v float64) {
+	shard := &h.shards[rand.Intn(len(h.shards))]
+	shard.counts[sort.SearchFloat64s(h.buckets, v)].Add(1)
+	for {
+		old := shard.sumBits.Load()
+		if shard.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// merge returns the total count, sum and cumulative bucket counts across
+// the shards. The count is that of the buckets, so that it is consistent
+// with them while observations are being made.
+func (h *shardedHistogram) merge() (uint64, float64, map[float64]uint64) {
+	counts := make([]uint64, len(h.buckets)+1)
+	var sum float64
+	for i := range h.shards {
+		for j := range counts {
+			counts[j] += h.shards[i].counts[j].Load()
+		}
+		sum += math.Float64frombits(h.shards[i].sumBits.Load())
+	}
+	buckets := make(map[float64]uint64, len(h.buckets))
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += counts[i]
+		buckets[upper] = cumulative
+	}
+	return cumulative + counts[len(h.buckets)], sum, buckets
+}
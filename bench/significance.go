@@ -0,0 +1,165 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+)
+
+// SignificanceLevel is the p-value below which a difference in latency
+// between plain SQL and sqlair is reported as significant.
+const SignificanceLevel = 0.05
+
+// Since the wrappers run side by side, the latencies of each operation under
+// plain SQL and under sqlair are two samples taken under the same load. A
+// Mann-Whitney U test tells whether one tends to be slower than the other
+// without assuming how latencies are distributed. Only the histograms of the
+// latencies are kept, so samples in the same bucket are ranked as ties,
+// which makes the test conservative rather than wrong.
+
+// Significance is the result of a Mann-Whitney U test of the latencies of an
+// operation under plain SQL and under sqlair.
+type Significance struct {
+	Operation   string
+	SQLCount    uint64
+	SQLairCount uint64
+	// SQLairSlower is the probability that a run of the operation through
+	// sqlair is slower than one through plain SQL, counting ties as half,
+	// with 0.5 meaning neither tends to be slower.
+	SQLairSlower float64
+	Z            float64
+	P            float64
+}
+
+// Significant returns whether the difference is significant at
+// SignificanceLevel.
+func (s Significance) Significant() bool {
+	return s.P < SignificanceLevel
+}
+
+// mannWhitney tests whether the samples of a tend to be larger than those
+// of b, given the cumulative histograms of both keyed by upper bound as in
+// histogramAgg. It returns the probability that a sample of a is larger
+// than one of b, the z score of the U statistic and its two sided p-value.
+func mannWhitney(a, b map[float64]uint64) (slower, z, p float64) {
+	bounds := make([]float64, 0, len(a))
+	seen := make(map[float64]bool)
+	for _, h := range []map[float64]uint64{a, b} {
+		for bound := range h {
+			if !seen[bound] {
+				seen[bound] = true
+				bounds = append(bounds, bound)
+			}
+		}
+	}
+	sort.Float64s(bounds)
+
+	var na, nb, rankA, ties float64
+	var prevA, prevB uint64
+	for _, bound := range bounds {
+		cumA, ok := a[bound]
+		if !ok {
+			cumA = prevA
+		}
+		cumB, ok := b[bound]
+		if !ok {
+			cumB = prevB
+		}
+		countA, countB := float64(cumA-prevA), float64(cumB-prevB)
+		prevA, prevB = cumA, cumB
+		t := countA + countB
+		if t == 0 {
+			continue
+		}
+		// Every sample in the bucket takes the mean of the ranks the
+		// bucket spans.
+		midRank := na + nb + (t+1)/2
+		rankA += countA * midRank
+		ties += t*t*t - t
+		na += countA
+		nb += countB
+	}
+	if na == 0 || nb == 0 {
+		return 0.5, 0, 1
+	}
+	n := na + nb
+	u := rankA - na*(na+1)/2
+	mean := na * nb / 2
+	variance := na * nb / 12 * ((n + 1) - ties/(n*(n-1)))
+	slower = u / (na * nb)
+	if variance <= 0 {
+		// Every sample fell in the same bucket.
+		return slower, 0, 1
+	}
+	z = (u - mean) / math.Sqrt(variance)
+	p = math.Erfc(math.Abs(z) / math.Sqrt2)
+	return slower, z, p
+}
+
+// printSignificanceReport writes whether the latencies of each operation
+// differ significantly between plain SQL and sqlair, for each of the
+// overheadPairs with a scenario of both wrappers in the run.
+func printSignificanceReport(w io.Writer, scenarios []*Scenario) error {
+	var aggs map[opKey]*histogramAgg
+	for _, pair := range overheadPairs {
+		sqlScenario, sqlairScenario := overheadScenarios(scenarios, pair[0], pair[1])
+		if sqlScenario == nil {
+			continue
+		}
+		if aggs == nil {
+			var err error
+			if aggs, err = gatherHistograms(measuredPhases...); err != nil {
+				return err
+			}
+		}
+		var results []Significance
+		for k, sqlair := range aggs {
+			if k.scenario != sqlairScenario.Name() {
+				continue
+			}
+			sql, ok := aggs[opKey{sqlScenario.Name(), k.operation}]
+			if !ok || sql.count == 0 || sqlair.count == 0 {
+				continue
+			}
+			s := Significance{Operation: k.operation, SQLCount: sql.count, SQLairCount: sqlair.count}
+			s.SQLairSlower, s.Z, s.P = mannWhitney(sqlair.buckets, sql.buckets)
+			results = append(results, s)
+		}
+		if len(results) == 0 {
+			continue
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].Operation < results[j].Operation })
+		if err := printSignificance(w, sqlScenario.Name(), sqlairScenario.Name(), results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printSignificance writes the results of the tests between two scenarios.
+func printSignificance(w io.Writer, sqlName, sqlairName string, results []Significance) error {
+	fmt.Fprintf(w, "significance of the latency difference, Mann-Whitney U (%s vs %s):\n", sqlairName, sqlName)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tSQL RUNS\tSQLAIR RUNS\tP(SQLAIR SLOWER)\tZ\tP-VALUE\tSIGNIFICANT")
+	for _, s := range results {
+		verdict := "no"
+		if s.Significant() {
+			verdict = "sqlair faster"
+			if s.SQLairSlower > 0.5 {
+				verdict = "sqlair slower"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.3f\t%+.2f\t%.3g\t%s\n",
+			s.Operation, s.SQLCount, s.SQLairCount, s.SQLairSlower, s.Z, s.P, verdict)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "latencies in the same histogram bucket count as ties, differences are significant below p=%v\n", SignificanceLevel)
+	return nil
+}
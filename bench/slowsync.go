@@ -0,0 +1,148 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// slowSyncConnector opens SQLite connections whose durable writes take an
+// extra delay, as if the disk were slow to sync. SQLite syncs when a
+// transaction that wrote commits, so the delay is added to those commits
+// and to every write made outside a transaction. This stands in for a VFS
+// that delays fsync, which the SQLite driver does not let us install.
+type slowSyncConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+	delay  time.Duration
+}
+
+func (c *slowSyncConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &slowSyncConn{conn: conn.(*sqlite3.SQLiteConn), delay: c.delay}, nil
+}
+
+func (c *slowSyncConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type slowSyncConn struct {
+	conn  *sqlite3.SQLiteConn
+	delay time.Duration
+	inTx  bool
+	// wrote is set once the current transaction has written.
+	wrote bool
+}
+
+// sync waits as long as a slow disk would take to sync a write.
+func (c *slowSyncConn) sync() {
+	time.Sleep(c.delay)
+}
+
+// wroteOK notes a successful write, syncing if it was not in a
+// transaction.
+func (c *slowSyncConn) wroteOK() {
+	if c.inTx {
+		c.wrote = true
+		return
+	}
+	c.sync()
+}
+
+func (c *slowSyncConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *slowSyncConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &slowSyncStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *slowSyncConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *slowSyncConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *slowSyncConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.inTx, c.wrote = true, false
+	return &slowSyncTx{tx: tx, conn: c}, nil
+}
+
+func (c *slowSyncConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.conn.ExecContext(ctx, query, args)
+	if err == nil {
+		c.wroteOK()
+	}
+	return res, err
+}
+
+func (c *slowSyncConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.conn.QueryContext(ctx, query, args)
+}
+
+func (c *slowSyncConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+type slowSyncTx struct {
+	tx   driver.Tx
+	conn *slowSyncConn
+}
+
+func (t *slowSyncTx) Commit() error {
+	t.conn.inTx = false
+	err := t.tx.Commit()
+	if err == nil && t.conn.wrote {
+		t.conn.sync()
+	}
+	return err
+}
+
+func (t *slowSyncTx) Rollback() error {
+	t.conn.inTx = false
+	return t.tx.Rollback()
+}
+
+type slowSyncStmt struct {
+	driver.Stmt
+	conn *slowSyncConn
+}
+
+func (s *slowSyncStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, errors.New("statement does not support ExecContext")
+	}
+	res, err := execer.ExecContext(ctx, args)
+	if err == nil {
+		s.conn.wroteOK()
+	}
+	return res, err
+}
+
+func (s *slowSyncStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, errors.New("statement does not support QueryContext")
+	}
+	return queryer.QueryContext(ctx, args)
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotOpts configures snapshots of databases, which copy their contents
+// to disk along with the recent errors of the scenario, so that anomalies
+// seen during a run can be investigated afterwards with the actual data.
+// Snapshots are taken with VACUUM INTO, so only SQLite databases can be
+// snapshotted.
+type SnapshotOpts struct {
+	// Dir is the directory snapshots are written to. Empty disables
+	// snapshots.
+	Dir string
+	// OnAnomaly snapshots a database as soon as a differential check or
+	// invariant check finds something wrong with it.
+	OnAnomaly bool
+}
+
+// RecentErrorsSize is how many of the most recent operation errors each
+// scenario keeps for its snapshots.
+const RecentErrorsSize = 1000
+
+// recentError is an error returned by an operation.
+type recentError struct {
+	time time.Time
+	op   string
+	db   string
+	err  error
+}
+
+// errorRing keeps the most recent operation errors of a scenario. Errors
+// are only formatted when read.
+type errorRing struct {
+	mu     sync.Mutex
+	errors []recentError
+	next   int
+	full   bool
+}
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{errors: make([]recentError, size)}
+}
+
+func (r *errorRing) add(e recentError) {
+	r.mu.Lock()
+	r.errors[r.next] = e
+	r.next++
+	if r.next == len(r.errors) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+}
+
+// recent returns the errors kept, oldest first.
+func (r *errorRing) recent() []recentError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]recentError(nil), r.errors[:r.next]...)
+	}
+	return append(append([]recentError(nil), r.errors[r.next:]...), r.errors[:r.next]...)
+}
+
+// unsafeFileChars are replaced in the names of snapshot files.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// snapshotDBs writes the given databases of the scenario, or all of them if
+// none are named, to a new directory under the snapshot directory, along
+// with the recent errors of the scenario. It returns the directory.
+func (s *Scenario) snapshotDBs(reason string, names ...string) (string, error) {
+	if s.opts.Snapshots.Dir == "" {
+		return "", errors.New("snapshots are not enabled")
+	}
+	dbs := s.DBs()
+	if len(names) > 0 {
+		byName := make(map[string]DB, len(dbs))
+		for _, db := range dbs {
+			byName[db.Name()] = db
+		}
+		dbs = dbs[:0]
+		for _, name := range names {
+			db, ok := byName[name]
+			if !ok {
+				return "", fmt.Errorf("scenario %s has no db %s", s.name, name)
+			}
+			dbs = append(dbs, db)
+		}
+	}
+
+	dir := filepath.Join(s.opts.Snapshots.Dir, s.name,
+		time.Now().Format("20060102T150405.000")+"-"+unsafeFileChars.ReplaceAllString(reason, "_"))
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	var errs []error
+	for _, db := range dbs {
+		if err := snapshotDB(db, filepath.Join(dir, unsafeFileChars.ReplaceAllString(db.Name(), "_")+".db")); err != nil {
+			errs = append(errs, fmt.Errorf("db %s: %w", db.Name(), err))
+		}
+	}
+	if err := s.writeRecentErrors(filepath.Join(dir, "errors.log"), reason); err != nil {
+		errs = append(errs, fmt.Errorf("writing recent errors: %w", err))
+	}
+	return dir, errors.Join(errs...)
+}
+
+// snapshotDB copies the contents of db to a database file at path.
+func snapshotDB(db DB, path string) error {
+	plain, ok := db.(PlainDB)
+	if !ok || plain.PlainDB() == nil {
+		return fmt.Errorf("cannot snapshot %T databases", db)
+	}
+	_, err := plain.PlainDB().Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// writeRecentErrors writes the recent errors of the scenario to path, oldest
+// first.
+func (s *Scenario) writeRecentErrors(path, reason string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "snapshot of scenario %s at %s: %s\n", s.name, time.Now().Format(time.RFC3339Nano), reason)
+	for _, e := range s.recentErrors.recent() {
+		fmt.Fprintf(&b, "%s operation %s died for db %s: %v\n", e.time.Format(time.RFC3339Nano), e.op, e.db, e.err)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0640)
+}
+
+// snapshotOnAnomaly snapshots db if the scenario snapshots anomalies.
+func (s *Scenario) snapshotOnAnomaly(db DB, reason string) {
+	if s.opts.Snapshots.Dir == "" || !s.opts.Snapshots.OnAnomaly {
+		return
+	}
+	dir, err := s.snapshotDBs(reason, db.Name())
+	if err != nil {
+		scenarioLog(s, "snapshot").Error("snapshotting db", "db", db.Name(), "err", err)
+		return
+	}
+	s.recordEvent("snapshot", "db %s after %s to %s", db.Name(), reason, dir)
+}
+
+// handleSnapshots serves /control/snapshot, which snapshots databases when
+// POSTed to. The scenario parameter picks a scenario, every scenario
+// otherwise, and db parameters, which may be repeated, pick databases of
+// it, every database otherwise. Picking databases needs a scenario. The reason parameter is kept with the
+// snapshot. It responds with the directories written.
+func handleSnapshots(mux *http.ServeMux, scenarios []*Scenario) {
+	mux.HandleFunc("/control/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "snapshots are taken with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		scenario, names := query.Get("scenario"), query["db"]
+		if len(names) > 0 && scenario == "" {
+			http.Error(w, "picking dbs needs a scenario", http.StatusBadRequest)
+			return
+		}
+		reason := query.Get("reason")
+		if reason == "" {
+			reason = "requested"
+		}
+		dirs := make(map[string]string)
+		for _, s := range scenarios {
+			if (scenario != "" && s.name != scenario) || s.opts.Snapshots.Dir == "" {
+				continue
+			}
+			dir, err := s.snapshotDBs(reason, names...)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("snapshotting scenario %s: %v", s.name, err), http.StatusInternalServerError)
+				return
+			}
+			which := "every db"
+			if len(names) > 0 {
+				which = "dbs " + strings.Join(names, ", ")
+			}
+			s.recordEvent("snapshot", "%s, %s, to %s", which, reason, dir)
+			dirs[s.name] = dir
+		}
+		if len(dirs) == 0 {
+			http.Error(w, "no scenario to snapshot", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(dirs)
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// SoakOpts configures the interval reports of long stability runs.
+type SoakOpts struct {
+	// Dir is where reports are written. An empty Dir disables them.
+	Dir string
+	// Interval is how often a report is written. It defaults to ten
+	// minutes.
+	Interval time.Duration
+	// Window is how far back the operation statistics of each report
+	// go. It defaults to an hour.
+	Window time.Duration
+	// Keep is the number of reports kept, older ones are removed. Zero
+	// keeps them all.
+	Keep int
+}
+
+// SoakReport is a self contained summary of the last window of a run.
+type SoakReport struct {
+	Generated time.Time     `json:"generated"`
+	Uptime    time.Duration `json:"uptime"`
+	Window    time.Duration `json:"window"`
+
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"num_gc"`
+	// HeapGrowth is the change in heap size over the window, and
+	// TotalHeapGrowth since the first report.
+	HeapGrowth      int64 `json:"heap_growth"`
+	TotalHeapGrowth int64 `json:"total_heap_growth"`
+
+	DBs map[string]int `json:"dbs"`
+	Ops []OpStats      `json:"ops"`
+	// Events are the events of each scenario in the window, such as
+	// injected faults.
+	Events map[string][]Event `json:"events,omitempty"`
+}
+
+// soakSample is the state of the run when a report was written, kept to
+// work out what changed over the window.
+type soakSample struct {
+	at    time.Time
+	heap  uint64
+	hists map[opKey]*histogramAgg
+}
+
+// runSoakReports writes a report every interval until the tomb is dying.
+func runSoakReports(t *tomb.Tomb, opts SoakOpts, scenarios []*Scenario) {
+	if opts.Dir == "" {
+		return
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Minute
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Hour
+	}
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		runLog.Error("cannot create soak report dir", "err", err)
+		return
+	}
+
+	start := time.Now()
+	var first *soakSample
+	var samples []*soakSample
+
+	report := func() error {
+		hists, err := gatherHistograms()
+		if err != nil {
+			return err
+		}
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		now := time.Now()
+		sample := &soakSample{at: now, heap: mem.HeapAlloc, hists: hists}
+		if first == nil {
+			first = sample
+		}
+
+		// Compare against the newest sample at least a window old, or
+		// the start of the run if there is none yet.
+		for len(samples) > 1 && now.Sub(samples[1].at) >= opts.Window {
+			samples = samples[1:]
+		}
+		var base *soakSample
+		if len(samples) > 0 && now.Sub(samples[0].at) >= opts.Window {
+			base = samples[0]
+		}
+		samples = append(samples, sample)
+
+		window := now.Sub(start)
+		windowed := hists
+		heapGrowth := int64(mem.HeapAlloc) - int64(first.heap)
+		if base != nil {
+			window = now.Sub(base.at)
+			windowed = make(map[opKey]*histogramAgg, len(hists))
+			for k, h := range hists {
+				windowed[k] = h.since(base.hists[k])
+			}
+			heapGrowth = int64(mem.HeapAlloc) - int64(base.heap)
+		}
+
+		r := SoakReport{
+			Generated:       now,
+			Uptime:          now.Sub(start),
+			Window:          window,
+			Goroutines:      runtime.NumGoroutine(),
+			HeapAlloc:       mem.HeapAlloc,
+			Sys:             mem.Sys,
+			NumGC:           mem.NumGC,
+			HeapGrowth:      heapGrowth,
+			TotalHeapGrowth: int64(mem.HeapAlloc) - int64(first.heap),
+			DBs:             make(map[string]int, len(scenarios)),
+			Ops:             opStats(windowed),
+			Events:          make(map[string][]Event),
+		}
+		for _, s := range scenarios {
+			r.DBs[s.Name()] = len(s.DBs())
+			for _, e := range s.Events() {
+				if now.Sub(e.Time) <= window {
+					r.Events[s.Name()] = append(r.Events[s.Name()], e)
+				}
+			}
+		}
+
+		name := fmt.Sprintf("soak-%s.json", now.UTC().Format("20060102T150405Z"))
+		if err := writeFileAtomic(filepath.Join(opts.Dir, name), r); err != nil {
+			return err
+		}
+		return rotateSoakReports(opts)
+	}
+
+	t.Go(func() error {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := report(); err != nil {
+					runLog.Error("writing soak report", "err", err)
+				}
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
+
+// rotateSoakReports removes the oldest reports beyond the number kept.
+func rotateSoakReports(opts SoakOpts) error {
+	if opts.Keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return err
+	}
+	var reports []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "soak-") && strings.HasSuffix(e.Name(), ".json") {
+			reports = append(reports, e.Name())
+		}
+	}
+	// The timestamped names sort oldest first.
+	sort.Strings(reports)
+	for len(reports) > opts.Keep {
+		if err := os.Remove(filepath.Join(opts.Dir, reports[0])); err != nil {
+			return err
+		}
+		reports = reports[1:]
+	}
+	return nil
+}
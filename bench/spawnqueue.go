@@ -0,0 +1,92 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// DefaultSpawnQueueSize is how many databases can be created ahead of
+// their operations starting when a scenario does not set it, enough for a
+// step of the default ramp.
+const DefaultSpawnQueueSize = AddDBRate
+
+// spawnQueue hands new databases from the ramper to the spawner. The ramper
+// reserves room for databases before creating them, and the room is only
+// given back once the spawner has started their operations. Creation
+// therefore never runs further ahead of the spawner than the size of the
+// queue, and a batch, once created, is always delivered whole. The time the
+// ramper spends waiting for room is measured, so a lagging spawner shows up
+// in the metrics rather than as an unexplained stall.
+type spawnQueue struct {
+	s  *Scenario
+	ch chan DB
+	// room holds a token for every database that can be created before
+	// the spawner catches up.
+	room chan struct{}
+}
+
+func newSpawnQueue(s *Scenario, size int) *spawnQueue {
+	if size < 1 {
+		size = DefaultSpawnQueueSize
+	}
+	q := &spawnQueue{
+		s:    s,
+		ch:   make(chan DB, size),
+		room: make(chan struct{}, size),
+	}
+	for i := 0; i < size; i++ {
+		q.room <- struct{}{}
+	}
+	return q
+}
+
+// reserve waits until there is room for at least one database, then
+// reserves room for up to n. It returns false if the tomb dies first.
+func (q *spawnQueue) reserve(t *tomb.Tomb, n int) (int, bool) {
+	select {
+	case <-q.room:
+	default:
+		start := time.Now()
+		select {
+		case <-q.room:
+		case <-t.Dying():
+			return 0, false
+		}
+		q.s.metrics.spawnStalls.Inc()
+		q.s.metrics.spawnStallTime.Add(time.Since(start).Seconds())
+	}
+	reserved := 1
+	for reserved < n {
+		select {
+		case <-q.room:
+			reserved++
+			continue
+		default:
+		}
+		break
+	}
+	return reserved, true
+}
+
+// release gives back room that was reserved but not used.
+func (q *spawnQueue) release(n int) {
+	for i := 0; i < n; i++ {
+		q.room <- struct{}{}
+	}
+}
+
+// send queues a database that room was reserved for. It never blocks.
+func (q *spawnQueue) send(db DB) {
+	q.s.metrics.spawnQueueDepth.Inc()
+	q.ch <- db
+}
+
+// started gives back the room of databases whose operations have started.
+func (q *spawnQueue) started(n int) {
+	q.s.metrics.spawnQueueDepth.Sub(float64(n))
+	q.release(n)
+}
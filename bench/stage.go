@@ -0,0 +1,124 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"time"
+)
+
+// DefaultStage is the name of the stage used when a scenario has no workload
+// schedule.
+const DefaultStage = "default"
+
+// WorkloadStage is a period of the run with its own mix of operations.
+type WorkloadStage struct {
+	Name     string
+	Duration time.Duration
+	// Ops maps the name of each operation that runs during the stage to
+	// its frequency. A zero frequency keeps the operation's default.
+	// Operations not listed are paused for the stage. Operations that
+	// only run once, such as db-init, always run.
+	Ops map[string]time.Duration
+}
+
+// WorkloadSchedule is a sequence of stages. The last stage lasts until the
+// end of the run.
+type WorkloadSchedule []WorkloadStage
+
+// StageClock reports the workload stage of a run based on the time since it
+// started.
+type StageClock struct {
+	start    time.Time
+	schedule WorkloadSchedule
+}
+
+func NewStageClock(schedule WorkloadSchedule, start time.Time) *StageClock {
+	return &StageClock{
+		start:    start,
+		schedule: schedule,
+	}
+}
+
+// Current returns the stage the run is in now, or nil if there is no
+// schedule.
+func (c *StageClock) Current() *WorkloadStage {
+	stage, _ := c.current()
+	return stage
+}
+
+// current returns the current stage and the time until it ends. The time is
+// zero for the last stage.
+func (c *StageClock) current() (*WorkloadStage, time.Duration) {
+	if len(c.schedule) == 0 {
+		return nil, 0
+	}
+	elapsed := time.Since(c.start)
+	for i := range c.schedule {
+		stage := &c.schedule[i]
+		if i == len(c.schedule)-1 {
+			return stage, 0
+		}
+		if elapsed < stage.Duration {
+			return stage, stage.Duration - elapsed
+		}
+		elapsed -= stage.Duration
+	}
+	return nil, 0
+}
+
+// Name returns the name of the current stage.
+func (c *StageClock) Name() string {
+	stage := c.Current()
+	if stage == nil {
+		return DefaultStage
+	}
+	return stage.Name
+}
+
+// Freq returns how often the named operation runs in the current stage, and
+// false if the operation is paused.
+func (c *StageClock) Freq(opName string, defaultFreq time.Duration) (time.Duration, bool) {
+	stage := c.Current()
+	if stage == nil {
+		return defaultFreq, true
+	}
+	freq, ok := stage.Ops[opName]
+	if !ok {
+		return defaultFreq, false
+	}
+	if freq == 0 {
+		freq = defaultFreq
+	}
+	return freq, true
+}
+
+// runStages publishes the current workload stage of the run.
+func runStages(s *Scenario, clock *StageClock) {
+	if len(clock.schedule) == 0 {
+		return
+	}
+	t := &s.tomb
+	safeGo(t, func() error {
+		for {
+			stage, left := clock.current()
+			for _, st := range clock.schedule {
+				v := 0.0
+				if st.Name == stage.Name {
+					v = 1
+				}
+				s.metrics.stage.WithLabelValues(st.Name).Set(v)
+			}
+			scenarioLog(s, "stages").Info("entering workload stage", "stage", stage.Name)
+			if left == 0 {
+				return nil
+			}
+
+			select {
+			case <-time.After(left):
+			case <-t.Dying():
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,353 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OpStats are the aggregated statistics of one operation in one scenario.
+type OpStats struct {
+	Scenario  string        `json:"scenario"`
+	Operation string        `json:"operation"`
+	Count     uint64        `json:"count"`
+	Errors    uint64        `json:"errors"`
+	Mean      time.Duration `json:"mean"`
+	P50       time.Duration `json:"p50"`
+	P95       time.Duration `json:"p95"`
+	P99       time.Duration `json:"p99"`
+}
+
+// histogramAgg accumulates histogram samples across label values.
+type histogramAgg struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+	errors  uint64
+}
+
+// opKey identifies the samples of one operation in one scenario.
+type opKey struct{ scenario, operation string }
+
+// gatherOpStats reads the operation metrics of every scenario from the
+// default registry. Only samples from the given phases are included, or all
+// samples if no phases are given.
+func gatherOpStats(phases ...Phase) ([]OpStats, error) {
+	aggs, err := gatherHistograms(phases...)
+	if err != nil {
+		return nil, err
+	}
+	return opStats(aggs), nil
+}
+
+// gatherHistograms reads the operation histograms and error counts of every
+// scenario from the default registry, summed across the phases given.
+func gatherHistograms(phases ...Phase) (map[opKey]*histogramAgg, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	return histograms(families, phases...), nil
+}
+
+// histograms sums the operation histograms and error counts of every
+// scenario in the metric families across the phases given.
+func histograms(families []*dto.MetricFamily, phases ...Phase) map[opKey]*histogramAgg {
+	include := func(m *dto.Metric) bool {
+		if len(phases) == 0 {
+			return true
+		}
+		phase := labelValue(m, "phase")
+		for _, p := range phases {
+			if string(p) == phase {
+				return true
+			}
+		}
+		return false
+	}
+
+	aggs := make(map[opKey]*histogramAgg)
+	get := func(m *dto.Metric) *histogramAgg {
+		k := opKey{labelValue(m, "scenario"), labelValue(m, "operation")}
+		agg, ok := aggs[k]
+		if !ok {
+			agg = &histogramAgg{buckets: make(map[float64]uint64)}
+			aggs[k] = agg
+		}
+		return agg
+	}
+
+	for _, family := range families {
+		switch family.GetName() {
+		case "db_operation_time":
+			for _, m := range family.GetMetric() {
+				if !include(m) {
+					continue
+				}
+				agg := get(m)
+				h := m.GetHistogram()
+				agg.count += h.GetSampleCount()
+				agg.sum += h.GetSampleSum()
+				for _, b := range h.GetBucket() {
+					agg.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+				}
+			}
+		case "db_operation_errors":
+			for _, m := range family.GetMetric() {
+				if !include(m) {
+					continue
+				}
+				get(m).errors += uint64(m.GetCounter().GetValue())
+			}
+		}
+	}
+	return aggs
+}
+
+// opStats summarises the histograms, sorted by scenario and operation.
+func opStats(aggs map[opKey]*histogramAgg) []OpStats {
+	stats := make([]OpStats, 0, len(aggs))
+	for k, agg := range aggs {
+		s := OpStats{
+			Scenario:  k.scenario,
+			Operation: k.operation,
+			Count:     agg.count,
+			Errors:    agg.errors,
+			P50:       agg.quantile(0.5),
+			P95:       agg.quantile(0.95),
+			P99:       agg.quantile(0.99),
+		}
+		if agg.count > 0 {
+			s.Mean = seconds(agg.sum / float64(agg.count))
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Scenario != stats[j].Scenario {
+			return stats[i].Scenario < stats[j].Scenario
+		}
+		return stats[i].Operation < stats[j].Operation
+	})
+	return stats
+}
+
+// LatencyDistribution is the histogram of the latency of one operation in
+// one scenario.
+type LatencyDistribution struct {
+	Scenario  string          `json:"scenario"`
+	Operation string          `json:"operation"`
+	Buckets   []LatencyBucket `json:"buckets"`
+}
+
+// LatencyBucket counts the samples that took longer than the previous
+// bucket's bound and no longer than this one's. The last bucket has no
+// bound.
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      uint64        `json:"count"`
+}
+
+// latencyDistributions returns the histograms of the operations, sorted by
+// scenario and operation.
+func latencyDistributions(aggs map[opKey]*histogramAgg) []LatencyDistribution {
+	dists := make([]LatencyDistribution, 0, len(aggs))
+	for k, agg := range aggs {
+		bounds := make([]float64, 0, len(agg.buckets))
+		for b := range agg.buckets {
+			bounds = append(bounds, b)
+		}
+		sort.Float64s(bounds)
+		d := LatencyDistribution{Scenario: k.scenario, Operation: k.operation}
+		var below uint64
+		for _, b := range bounds {
+			if math.IsInf(b, 1) {
+				continue
+			}
+			d.Buckets = append(d.Buckets, LatencyBucket{
+				UpperBound: seconds(b),
+				Count:      agg.buckets[b] - below,
+			})
+			below = agg.buckets[b]
+		}
+		d.Buckets = append(d.Buckets, LatencyBucket{Count: agg.count - below})
+		dists = append(dists, d)
+	}
+	sort.Slice(dists, func(i, j int) bool {
+		if dists[i].Scenario != dists[j].Scenario {
+			return dists[i].Scenario < dists[j].Scenario
+		}
+		return dists[i].Operation < dists[j].Operation
+	})
+	return dists
+}
+
+// add adds the samples of other to h.
+func (h *histogramAgg) add(other *histogramAgg) {
+	h.count += other.count
+	h.sum += other.sum
+	h.errors += other.errors
+	for b, c := range other.buckets {
+		h.buckets[b] += c
+	}
+}
+
+// since returns the samples taken after prev was gathered.
+func (h *histogramAgg) since(prev *histogramAgg) *histogramAgg {
+	if prev == nil {
+		return h
+	}
+	d := &histogramAgg{
+		count:   h.count - prev.count,
+		sum:     h.sum - prev.sum,
+		errors:  h.errors - prev.errors,
+		buckets: make(map[float64]uint64, len(h.buckets)),
+	}
+	for b, c := range h.buckets {
+		d.buckets[b] = c - prev.buckets[b]
+	}
+	return d
+}
+
+// quantile estimates a quantile by interpolating within the histogram bucket
+// that contains it. Samples above the largest bucket are reported as the
+// largest bucket bound.
+func (h *histogramAgg) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	bounds := make([]float64, 0, len(h.buckets))
+	for b := range h.buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	rank := q * float64(h.count)
+	lower, lowerCount := 0.0, uint64(0)
+	for _, upper := range bounds {
+		count := h.buckets[upper]
+		if float64(count) >= rank {
+			if math.IsInf(upper, 1) {
+				return seconds(lower)
+			}
+			inBucket := float64(count - lowerCount)
+			if inBucket == 0 {
+				return seconds(upper)
+			}
+			return seconds(lower + (upper-lower)*(rank-float64(lowerCount))/inBucket)
+		}
+		lower, lowerCount = upper, count
+	}
+	return seconds(lower)
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// dumpStats writes a snapshot of the current state of the run without
+// interrupting it.
+func dumpStats(w io.Writer, scenarios []*Scenario) error {
+	stats, err := gatherOpStats()
+	if err != nil {
+		return err
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintf(w, "=== stats at %s ===\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "heap alloc: %d MiB, sys: %d MiB, gc cycles: %d\n",
+		mem.HeapAlloc>>20, mem.Sys>>20, mem.NumGC)
+	for _, s := range scenarios {
+		fmt.Fprintf(w, "scenario %s: %d dbs\n", s.Name(), len(s.DBs()))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tOPERATION\tCOUNT\tERRORS\tMEAN\tP50\tP95\tP99")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			s.Scenario, s.Operation, s.Count, s.Errors, s.Mean, s.P50, s.P95, s.P99)
+	}
+	return tw.Flush()
+}
+
+// printRunSummary writes the throughput, latencies and error rate of every
+// operation of each scenario over the measure phase of the run, which ended
+// at end. The latencies are those of the HDR histograms, like the report of
+// their percentiles.
+func printRunSummary(w io.Writer, scenarios []*Scenario, end time.Time) error {
+	stats, err := gatherOpStats(measuredPhases...)
+	if err != nil {
+		return err
+	}
+	withHDRPercentiles(stats, scenarios)
+	measured := make(map[string]time.Duration)
+	for _, s := range scenarios {
+		if s.phases == nil {
+			continue
+		}
+		measured[s.Name()] = s.phases.measuredUntil(end)
+		if measured[s.Name()] <= 0 {
+			fmt.Fprintf(w, "%s stopped during its warmup of %s, nothing was measured\n", s.Name(), s.opts.Phases.Warmup)
+		}
+	}
+
+	fmt.Fprintln(w, "run summary:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tOPERATION\tMEASURED\tOPS/S\tP50\tP95\tP99\tERRORS")
+	for _, op := range stats {
+		d, ok := measured[op.Scenario]
+		if !ok || d <= 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%s\t%s\t%s\t%.2f%%\n",
+			op.Scenario, op.Operation, d.Round(time.Second), float64(op.Count)/d.Seconds(),
+			op.P50, op.P95, op.P99, errorRate(&op)*100)
+	}
+	return tw.Flush()
+}
+
+// printFixedWorkResults reports the total time taken by a fixed work or
+// deterministic run, in the style of go test -bench.
+func printFixedWorkResults(w io.Writer, s *Scenario) error {
+	elapsed := time.Since(s.started)
+	stats, err := gatherOpStats()
+	if err != nil {
+		return err
+	}
+	work := fmt.Sprintf("%d iterations per operation", s.opts.Iterations)
+	if opts := s.opts.Deterministic; opts.Steps > 0 {
+		work = fmt.Sprintf("%d steps with seed %d (sequence %s)",
+			opts.Steps, opts.Seed, s.Metadata()["sequence_digest"])
+	}
+	fmt.Fprintf(w, "scenario %s: %d dbs, %s, finished in %s\n",
+		s.Name(), len(s.DBs()), work, elapsed)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, op := range stats {
+		if op.Scenario != s.Name() {
+			continue
+		}
+		fmt.Fprintf(tw, "%s/%s\t%d\t%d ns/op\t%d errors\n",
+			op.Scenario, op.Operation, op.Count, op.Mean.Nanoseconds(), op.Errors)
+	}
+	return tw.Flush()
+}
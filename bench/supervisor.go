@@ -0,0 +1,386 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// ErrDBDropped is returned by operations on a database that has been dropped
+// from the run by its supervisor.
+var ErrDBDropped = errors.New("database dropped from run")
+
+// SupervisorAction is what a supervisor does with a database that keeps
+// failing.
+type SupervisorAction string
+
+const (
+	// SupervisorRecreate replaces the database with a freshly created and
+	// initialised one.
+	SupervisorRecreate SupervisorAction = "recreate"
+	// SupervisorDrop removes the database from the run.
+	SupervisorDrop SupervisorAction = "drop"
+)
+
+// SupervisorOpts configures per database supervision.
+type SupervisorOpts struct {
+	// MaxConsecutiveFailures is the number of operations in a row that
+	// can fail on a database before the supervisor acts. Zero disables
+	// supervision.
+	MaxConsecutiveFailures int
+	Action                 SupervisorAction
+
+	// RestartBackoff is how long to wait before restarting the operations
+	// of a database after one of them died. It doubles after every
+	// restart up to MaxRestartBackoff.
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	// MaxRestarts is the number of times the operations of a database
+	// are restarted before it is quarantined and removed from the run.
+	MaxRestarts int
+}
+
+// SupervisedDB is a DB that tracks consecutive operation failures and
+// recreates or drops the underlying database once there have been too many.
+// A database that is replaced or dropped is closed once the operations
+// running against it have finished, rather than under them.
+type SupervisedDB struct {
+	mu         sync.RWMutex
+	db         DB
+	generation int
+	failures   int
+	dropped    bool
+	// inflight counts the operations running against db.
+	inflight *sync.WaitGroup
+
+	scenario *Scenario
+	initOps  []DBOperation
+}
+
+// NewSupervisedDB wraps db so that it is supervised. initOps are run against
+// any database created to replace it.
+func NewSupervisedDB(scenario *Scenario, db DB, initOps []DBOperation) DB {
+	if scenario.opts.Supervisor.MaxConsecutiveFailures <= 0 {
+		return db
+	}
+	return &SupervisedDB{
+		db:       db,
+		inflight: &sync.WaitGroup{},
+		scenario: scenario,
+		initOps:  initOps,
+	}
+}
+
+// current returns the current database and its generation, which is kept
+// open until done is called.
+func (s *SupervisedDB) current() (db DB, generation int, done func(), err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.dropped {
+		return nil, 0, nil, ErrDBDropped
+	}
+	s.inflight.Add(1)
+	return s.db, s.generation, s.inflight.Done, nil
+}
+
+func (s *SupervisedDB) do(fn func(DB) error) error {
+	db, generation, done, err := s.current()
+	if err != nil {
+		return err
+	}
+	err = fn(db)
+	done()
+	s.record(generation, err)
+	return err
+}
+
+// pin returns the name and plain database of the current database, which
+// is kept open until unpin is called. plain is nil if it has none or has
+// been dropped.
+func (s *SupervisedDB) pin() (name string, plain *sql.DB, unpin func()) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.dropped {
+		return s.db.Name(), nil, func() {}
+	}
+	if p, ok := s.db.(PlainDB); ok {
+		plain = p.PlainDB()
+	}
+	s.inflight.Add(1)
+	return s.db.Name(), plain, s.inflight.Done
+}
+
+// retire closes db once the operations running against it have finished.
+// It must be called with the lock held, once db has been replaced or
+// dropped.
+func (s *SupervisedDB) retire(db DB, inflight *sync.WaitGroup) {
+	go func() {
+		inflight.Wait()
+		_ = db.Close()
+	}()
+}
+
+// record notes the outcome of an operation run against the given generation
+// of the database. Outcomes for databases that have since been replaced are
+// ignored.
+func (s *SupervisedDB) record(generation int, opErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped || generation != s.generation {
+		return
+	}
+	if opErr == nil {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures < s.scenario.opts.Supervisor.MaxConsecutiveFailures {
+		return
+	}
+
+	action := s.scenario.opts.Supervisor.Action
+	name := s.db.Name()
+	if action == SupervisorRecreate {
+		if err := s.recreate(); err != nil {
+			scenarioLog(s.scenario, "supervisor").Error("recreating db", "db", name, "err", err)
+			action = SupervisorDrop
+		}
+	}
+	if action == SupervisorDrop {
+		s.dropped = true
+		s.retire(s.db, s.inflight)
+	}
+	s.scenario.metrics.supervisorIncidents.WithLabelValues(string(action)).Inc()
+	scenarioLog(s.scenario, "supervisor").Warn("db failing",
+		"action", string(action), "db", name, "failures", s.failures, "err", opErr)
+}
+
+// recreate replaces the database with a new one. It must be called with the
+// lock held.
+func (s *SupervisedDB) recreate() error {
+	db, err := newDB(s.scenario)
+	if err != nil {
+		return err
+	}
+	for _, op := range s.initOps {
+		if _, err := op(context.Background(), db); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	s.retire(s.db, s.inflight)
+	s.db = db
+	s.inflight = &sync.WaitGroup{}
+	s.generation++
+	s.failures = 0
+	return nil
+}
+
+func (s *SupervisedDB) Name() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Name()
+}
+
+// PlainDB returns the database underneath the current database, or nil if
+// it has none or has been dropped. It can be closed once replaced, which
+// pinPlainDB guards against.
+func (s *SupervisedDB) PlainDB() *sql.DB {
+	_, plain, unpin := s.pin()
+	unpin()
+	return plain
+}
+
+func (s *SupervisedDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.SeedModelAgents(ctx, agentUUIDs)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.UpdateModelAgentStatus(ctx, agentUUIDs, status)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.GenerateAgentEvents(ctx, agentUUIDs)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.CullAgentEvents(ctx, maxEvents)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		agentUUIDs, result, err = db.AgentUUIDs(ctx)
+		return err
+	})
+	return agentUUIDs, result, err
+}
+
+func (s *SupervisedDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		count, result, err = db.AgentModelCount(ctx)
+		return err
+	})
+	return count, result, err
+}
+
+func (s *SupervisedDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		count, result, err = db.AgentEventModelCount(ctx)
+		return err
+	})
+	return count, result, err
+}
+
+func (s *SupervisedDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		count, result, err = db.OrphanedAgentEventCount(ctx)
+		return err
+	})
+	return count, result, err
+}
+
+func (s *SupervisedDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.IncrementVersion(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := s.do(func(db DB) error {
+		var err error
+		result, err = db.LogOperation(ctx, id)
+		return err
+	})
+	return result, err
+}
+
+func (s *SupervisedDB) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped {
+		return nil
+	}
+	s.dropped = true
+	return s.db.Close()
+}
+
+// pinPlainDB returns the name and plain database underneath db, which a
+// supervisor does not close until unpin is called, so that they can be read
+// together at the end of the run even if the database is being replaced.
+// plain is nil if db has none.
+func pinPlainDB(db DB) (name string, plain *sql.DB, unpin func()) {
+	if supervised, ok := db.(*SupervisedDB); ok {
+		return supervised.pin()
+	}
+	if p, ok := db.(PlainDB); ok {
+		plain = p.PlainDB()
+	}
+	return db.Name(), plain, func() {}
+}
+
+// superviseDB runs the operations of a single database in a tomb of its own.
+// If one of the operations dies, they are all restarted after an exponential
+// backoff. A database that keeps dying is quarantined. Neither affects the
+// parent tomb or the operations of any other database. If the database is
+// already initialised, the operations are started as if restarted. The
+// operations stop for good once the database is removed from the run.
+func superviseDB(parent *tomb.Tomb, s *Scenario, db DB, initialised bool, startOps func(dbTomb *tomb.Tomb, restart bool)) {
+	opts := s.opts.Supervisor
+	live := s.live.add(db)
+	safeGo(parent, func() error {
+		defer close(live.done)
+		defer s.live.remove(live)
+		backoff := opts.RestartBackoff
+		for restarts := 0; ; restarts++ {
+			dbTomb := &tomb.Tomb{}
+			startOps(dbTomb, initialised || restarts > 0)
+
+			select {
+			case <-parent.Dying():
+				dbTomb.Kill(nil)
+				_ = dbTomb.Wait()
+				return nil
+			case <-live.stop:
+				dbTomb.Kill(nil)
+				_ = dbTomb.Wait()
+				return nil
+			case <-dbTomb.Dead():
+			}
+
+			err := dbTomb.Wait()
+			if err == nil {
+				// The operations have finished of their own accord.
+				return nil
+			}
+
+			if restarts >= opts.MaxRestarts {
+				s.metrics.supervisorIncidents.WithLabelValues("quarantine").Inc()
+				scenarioLog(s, "supervisor").Warn("quarantining db", "db", db.Name(), "restarts", restarts, "err", err)
+				_ = db.Close()
+				return nil
+			}
+
+			s.metrics.supervisorIncidents.WithLabelValues("restart").Inc()
+			scenarioLog(s, "supervisor").Warn("restarting db operations", "db", db.Name(), "backoff", backoff, "err", err)
+			select {
+			case <-parent.Dying():
+				return nil
+			case <-live.stop:
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > opts.MaxRestartBackoff {
+				backoff = opts.MaxRestartBackoff
+			}
+		}
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"time"
+)
+
+// TimelineInterval is how often the timeline of a scenario is sampled.
+const TimelineInterval = 5 * time.Second
+
+// TimelinePoint is the state of a scenario at a point in the run.
+type TimelinePoint struct {
+	Time time.Time `json:"time"`
+	DBs  int       `json:"dbs"`
+	// Ops and Errors are the operations run, and those that failed, since
+	// the start of the run.
+	Ops    int64 `json:"ops"`
+	Errors int64 `json:"errors"`
+}
+
+// runTimeline samples the number of databases and operations of the
+// scenario every TimelineInterval, and once more when it stops, so that the
+// course of the run can be charted afterwards.
+func runTimeline(s *Scenario, env *OperationEnv) {
+	sample := func() {
+		p := TimelinePoint{
+			Time:   time.Now(),
+			DBs:    len(s.DBs()),
+			Ops:    env.runCount(),
+			Errors: env.errorCount(),
+		}
+		s.mu.Lock()
+		s.timeline = append(s.timeline, p)
+		s.mu.Unlock()
+	}
+
+	t := &s.tomb
+	safeGo(t, func() error {
+		sample()
+		ticker := time.NewTicker(TimelineInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sample()
+			case <-t.Dying():
+				sample()
+				return nil
+			}
+		}
+	})
+}
+
+// Timeline returns the samples taken of the scenario so far.
+func (s *Scenario) Timeline() []TimelinePoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TimelinePoint(nil), s.timeline...)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/tomb.v2"
+)
+
+// TimeSeriesOpts configures the export of every metric as a time series, so
+// that a run can be analysed afterwards without Prometheus having scraped
+// it.
+type TimeSeriesOpts struct {
+	// Dir is where the time series file is written. An empty Dir
+	// disables the export.
+	Dir string
+	// Interval is how often the metrics are snapshotted. It defaults to
+	// ten seconds.
+	Interval time.Duration
+}
+
+// TimeSeriesSnapshot is one line of the time series file. Series are named
+// as in the Prometheus exposition format, with histograms split into their
+// _bucket, _sum and _count series. Only series that changed since the
+// previous snapshot are included, so a series keeps its last value until
+// it appears again.
+type TimeSeriesSnapshot struct {
+	// Time is in milliseconds since the Unix epoch.
+	Time   int64              `json:"t"`
+	Series map[string]float64 `json:"s"`
+}
+
+// runTimeSeriesExport appends a snapshot of every metric to a file in the
+// configured directory every interval, and a final one once the tomb is
+// dying.
+func runTimeSeriesExport(t *tomb.Tomb, opts TimeSeriesOpts) {
+	if opts.Dir == "" {
+		return
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		runLog.Error("cannot create time series dir", "err", err)
+		return
+	}
+	name := fmt.Sprintf("timeseries-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"))
+	f, err := os.OpenFile(filepath.Join(opts.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		runLog.Error("cannot create time series file", "err", err)
+		return
+	}
+
+	last := make(map[string]float64)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	snapshot := func() error {
+		series, err := gatherSeries()
+		if err != nil {
+			return err
+		}
+		s := TimeSeriesSnapshot{
+			Time:   time.Now().UnixMilli(),
+			Series: make(map[string]float64),
+		}
+		for k, v := range series {
+			if old, ok := last[k]; ok && (old == v || math.IsNaN(old) && math.IsNaN(v)) {
+				continue
+			}
+			s.Series[k] = v
+			last[k] = v
+		}
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	t.Go(func() error {
+		defer f.Close()
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := snapshot(); err != nil {
+					runLog.Error("writing time series", "err", err)
+				}
+			case <-t.Dying():
+				if err := snapshot(); err != nil {
+					runLog.Error("writing time series", "err", err)
+				}
+				return nil
+			}
+		}
+	})
+}
+
+// gatherSeries returns the current value of every series in the default
+// registry.
+func gatherSeries() (map[string]float64, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[string]float64)
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				series[seriesName(name, m)] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				series[seriesName(name, m)] = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				series[seriesName(name, m)] = m.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					le := strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)
+					series[seriesName(name+"_bucket", m, "le", le)] = float64(b.GetCumulativeCount())
+				}
+				series[seriesName(name+"_bucket", m, "le", "+Inf")] = float64(h.GetSampleCount())
+				series[seriesName(name+"_sum", m)] = h.GetSampleSum()
+				series[seriesName(name+"_count", m)] = float64(h.GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					quantile := strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)
+					series[seriesName(name, m, "quantile", quantile)] = q.GetValue()
+				}
+				series[seriesName(name+"_sum", m)] = s.GetSampleSum()
+				series[seriesName(name+"_count", m)] = float64(s.GetSampleCount())
+			}
+		}
+	}
+	return series, nil
+}
+
+// seriesName formats a series as in the Prometheus exposition format, with
+// the labels sorted by name. extra is a label name and value to add.
+func seriesName(name string, m *dto.Metric, extra ...string) string {
+	labels := make([]string, 0, len(m.GetLabel())+1)
+	for _, l := range m.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+	}
+	if len(extra) == 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", extra[0], extra[1]))
+	}
+	if len(labels) == 0 {
+		return name
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
@@ -0,0 +1,364 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// Validation keeps a lightweight model of what the operations run against
+// each database should have left in it, and checks the contents of the
+// databases against it once the run is over. The operations pick agents at
+// random, so the model tracks bounds rather than exact contents:
+//   - the agents are exactly those seeded,
+//   - every agent has a status that was seeded or applied,
+//   - every event belongs to a seeded agent,
+//   - there are no more events than were inserted, no fewer than were
+//     inserted since culling last ran, and no more than culling leaves
+//     plus those inserted since.
+//
+// Operations that fail may still have had an effect, so they only widen the
+// bounds.
+
+// maxDivergencesShown bounds the divergences printed per scenario.
+const maxDivergencesShown = 10
+
+// Divergence is a way the contents of a database differ from the model.
+type Divergence struct {
+	Scenario string `json:"scenario"`
+	Wrapper  string `json:"wrapper"`
+	DB       string `json:"db"`
+	Detail   string `json:"detail"`
+}
+
+// dataModel holds the model of each database of a scenario by name.
+type dataModel struct {
+	mu  sync.Mutex
+	dbs map[string]*modelState
+}
+
+func newDataModel() *dataModel {
+	return &dataModel{dbs: make(map[string]*modelState)}
+}
+
+// track returns db with the operations run against it updating its model.
+func (m *dataModel) track(db DB) DB {
+	state := &modelState{statuses: make(map[string]bool)}
+	m.mu.Lock()
+	m.dbs[db.Name()] = state
+	m.mu.Unlock()
+	return &modelledDB{DB: db, state: state}
+}
+
+// state returns the model of the database of the given name, or nil if its
+// operations were not tracked.
+func (m *dataModel) state(name string) *modelState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dbs[name]
+}
+
+// modelState is the model of one database.
+type modelState struct {
+	mu sync.Mutex
+	// seeded is set once the agents have been seeded. Databases whose
+	// seeding was not seen cannot be validated.
+	seeded   bool
+	agents   map[string]bool
+	statuses map[string]bool
+
+	// insertedMax is the most events that can have been inserted.
+	insertedMax int
+	// cullStarts counts the culls started and cullsRunning those still
+	// running.
+	cullStarts   int
+	cullsRunning int
+	// sinceCullMin is the fewest events inserted since the last cull
+	// started, which no cull can have removed.
+	sinceCullMin int
+	// endedMax is the most events inserted by inserts that have
+	// finished. culled is set once a cull has succeeded, and capBase is
+	// then the least over the successful culls of the events that cull
+	// leaves, less endedMax at the time it started. Adding insertedMax
+	// gives the most events there can be.
+	endedMax int
+	culled   bool
+	capBase  int
+}
+
+func (s *modelState) seed(agentUUIDs []any, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || s.seeded {
+		return
+	}
+	s.seeded = true
+	s.agents = make(map[string]bool)
+	for i := 0; i+2 < len(agentUUIDs); i += 3 {
+		s.agents[fmt.Sprint(agentUUIDs[i])] = true
+		s.statuses[fmt.Sprint(agentUUIDs[i+2])] = true
+	}
+}
+
+func (s *modelState) updateStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status] = true
+}
+
+// startInsert notes the start of an insert of up to n events, returning
+// what finishInsert needs to know.
+func (s *modelState) startInsert(n int) (events, cullStarts int, certain bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seeded && n > len(s.agents) {
+		n = len(s.agents)
+	}
+	s.insertedMax += n
+	return n, s.cullStarts, s.cullsRunning == 0
+}
+
+// finishInsert notes the end of an insert. Its events certainly remain if
+// it succeeded and no cull has run since it started.
+func (s *modelState) finishInsert(events, cullStarts int, certain bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endedMax += events
+	if err == nil && certain && cullStarts == s.cullStarts {
+		s.sinceCullMin += events
+	}
+}
+
+func (s *modelState) startCull() (endedMax int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cullStarts++
+	s.cullsRunning++
+	s.sinceCullMin = 0
+	return s.endedMax
+}
+
+// finishCull notes the end of a cull. A successful cull leaves at most
+// maxEvents for each agent, plus whatever inserts were still running when it
+// started.
+func (s *modelState) finishCull(maxEvents, endedMax int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cullsRunning--
+	if err != nil || !s.seeded {
+		return
+	}
+	capBase := len(s.agents)*maxEvents - endedMax
+	if !s.culled || capBase < s.capBase {
+		s.capBase = capBase
+	}
+	s.culled = true
+}
+
+// modelledDB updates the model of a database as operations run against it.
+type modelledDB struct {
+	DB
+	state *modelState
+}
+
+func (db *modelledDB) PlainDB() *sql.DB {
+	if plain, ok := db.DB.(PlainDB); ok {
+		return plain.PlainDB()
+	}
+	return nil
+}
+
+func (db *modelledDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	result, err := db.DB.SeedModelAgents(ctx, agentUUIDs)
+	db.state.seed(agentUUIDs, err)
+	return result, err
+}
+
+func (db *modelledDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	db.state.updateStatus(status)
+	return db.DB.UpdateModelAgentStatus(ctx, agentUUIDs, status)
+}
+
+func (db *modelledDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	events, cullStarts, certain := db.state.startInsert(len(agentUUIDs))
+	result, err := db.DB.GenerateAgentEvents(ctx, agentUUIDs)
+	db.state.finishInsert(events, cullStarts, certain, err)
+	return result, err
+}
+
+func (db *modelledDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	endedMax := db.state.startCull()
+	result, err := db.DB.CullAgentEvents(ctx, maxEvents)
+	db.state.finishCull(maxEvents, endedMax, err)
+	return result, err
+}
+
+// validate checks the contents of the database against the model.
+func (s *modelState) validate(db *sql.DB) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var divergences []string
+
+	rows, err := db.Query("SELECT uuid, status FROM agent")
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for rows.Next() {
+		var uuid, status string
+		if err := rows.Scan(&uuid, &status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found[uuid] = true
+		if !s.agents[uuid] {
+			divergences = append(divergences, fmt.Sprintf("agent %s was never seeded", uuid))
+		} else if !s.statuses[status] {
+			divergences = append(divergences, fmt.Sprintf("agent %s has status %q, which was never applied", uuid, status))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	missing := 0
+	for uuid := range s.agents {
+		if !found[uuid] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		divergences = append(divergences, fmt.Sprintf("%d of %d seeded agents are missing", missing, len(s.agents)))
+	}
+
+	rows, err = db.Query("SELECT agent_uuid, count(*) FROM agent_events GROUP BY agent_uuid")
+	if err != nil {
+		return nil, err
+	}
+	events := 0
+	for rows.Next() {
+		var uuid string
+		var count int
+		if err := rows.Scan(&uuid, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events += count
+		if !s.agents[uuid] {
+			divergences = append(divergences, fmt.Sprintf("%d events belong to agent %s, which was never seeded", count, uuid))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if events > s.insertedMax {
+		divergences = append(divergences, fmt.Sprintf("%d events, but at most %d were inserted", events, s.insertedMax))
+	}
+	if events < s.sinceCullMin {
+		divergences = append(divergences, fmt.Sprintf("%d events, but %d were inserted since the last cull", events, s.sinceCullMin))
+	}
+	if most := s.capBase + s.insertedMax; s.culled && events > most {
+		divergences = append(divergences, fmt.Sprintf("%d events, but culling should have left at most %d", events, most))
+	}
+	return divergences, nil
+}
+
+// ValidationResult is the outcome of validating the databases of a scenario.
+type ValidationResult struct {
+	Scenario string `json:"scenario"`
+	Wrapper  string `json:"wrapper"`
+	// Validated counts the databases checked, and Skipped those whose
+	// seeding was not seen, such as resumed or paired databases, or that
+	// could not be read.
+	Validated   int          `json:"validated"`
+	Skipped     int          `json:"skipped"`
+	Divergences []Divergence `json:"divergences,omitempty"`
+}
+
+// validateScenario checks every database of the scenario against its model.
+func validateScenario(s *Scenario) ValidationResult {
+	wrapper := s.opts.Wrapper.Name()
+	result := ValidationResult{Scenario: s.name, Wrapper: wrapper}
+	for _, db := range s.DBs() {
+		name, plain, unpin := pinPlainDB(db)
+		state := s.model.state(name)
+		if state == nil || plain == nil || !state.isSeeded() {
+			unpin()
+			result.Skipped++
+			continue
+		}
+		divergences, err := state.validate(plain)
+		unpin()
+		if err != nil {
+			scenarioLog(s, "validate").Warn("cannot validate db", "db", name, "err", err)
+			result.Skipped++
+			continue
+		}
+		result.Validated++
+		for _, d := range divergences {
+			result.Divergences = append(result.Divergences, Divergence{
+				Scenario: s.name,
+				Wrapper:  wrapper,
+				DB:       name,
+				Detail:   d,
+			})
+		}
+	}
+	sort.SliceStable(result.Divergences, func(i, j int) bool {
+		return result.Divergences[i].DB < result.Divergences[j].DB
+	})
+	return result
+}
+
+func (s *modelState) isSeeded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seeded
+}
+
+// validateScenarios validates the databases of every scenario that keeps a
+// model of them.
+func validateScenarios(scenarios []*Scenario) []ValidationResult {
+	var results []ValidationResult
+	for _, s := range scenarios {
+		if s.model != nil {
+			results = append(results, validateScenario(s))
+		}
+	}
+	return results
+}
+
+// printValidationReport writes the outcome of validating each scenario,
+// with the first few divergences of each.
+func printValidationReport(w io.Writer, results []ValidationResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "data validation:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tWRAPPER\tVALIDATED\tSKIPPED\tDIVERGENCES")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", r.Scenario, r.Wrapper, r.Validated, r.Skipped, len(r.Divergences))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		for i, d := range r.Divergences {
+			if i == maxDivergencesShown {
+				fmt.Fprintf(w, "%s: and %d more\n", r.Scenario, len(r.Divergences)-i)
+				break
+			}
+			fmt.Fprintf(w, "%s: db %s: %s\n", r.Scenario, d.DB, d.Detail)
+		}
+	}
+	return nil
+}
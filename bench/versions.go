@@ -0,0 +1,298 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Two versions of sqlair cannot be linked into one binary, so they are
+// compared by building the benchmark once against each and running both
+// builds side by side on the same machine, where they are subject to the
+// same conditions. The plain SQL scenario of each build does not depend on
+// sqlair, so how much it differs between the builds is the noise the
+// sqlair scenarios are judged against.
+
+const sqlairModule = "github.com/canonical/sqlair"
+
+// SQLairVersion returns the version of sqlair the binary was built with,
+// including where it was replaced from, or unknown if it cannot be told.
+func SQLairVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != sqlairModule {
+			continue
+		}
+		if r := dep.Replace; r != nil {
+			if r.Version == "" {
+				return dep.Version + " => " + r.Path
+			}
+			return dep.Version + " => " + r.Path + " " + r.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
+
+// VersionsOpts configures a side by side run of two builds of the
+// benchmark, each built against a different version of sqlair.
+type VersionsOpts struct {
+	// Binaries are the two builds, the first being the baseline.
+	Binaries [2]string
+	// Args are passed to both builds.
+	Args []string
+	// Duration is how long both builds run for once they are both
+	// running. Zero runs until interrupted.
+	Duration time.Duration
+	// Dir is where the results and output of each build are written.
+	Dir string
+	// Addrs are the addresses the builds serve their metrics and control
+	// API on.
+	Addrs [2]string
+}
+
+// RunVersions runs both builds at once until the duration is up or it is
+// interrupted, then compares their results.
+func RunVersions(w io.Writer, opts VersionsOpts) error {
+	if err := os.MkdirAll(opts.Dir, 0750); err != nil {
+		return err
+	}
+	var cmds [2]*exec.Cmd
+	var results [2]string
+	for i, binary := range opts.Binaries {
+		results[i] = filepath.Join(opts.Dir, fmt.Sprintf("run%d.json", i+1))
+		out, err := os.Create(filepath.Join(opts.Dir, fmt.Sprintf("run%d.log", i+1)))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		args := append([]string{"-addr", opts.Addrs[i], "-results", results[i]}, opts.Args...)
+		cmds[i] = exec.Command(binary, args...)
+		cmds[i].Stdout, cmds[i].Stderr = out, out
+	}
+	for i, cmd := range cmds {
+		if err := cmd.Start(); err != nil {
+			for _, started := range cmds[:i] {
+				_ = started.Process.Kill()
+				_ = started.Wait()
+			}
+			return fmt.Errorf("starting %s: %w", cmd.Path, err)
+		}
+	}
+	// exited is told of each build exiting, and stopped once all have.
+	exited := make(chan error, len(cmds))
+	var stopped sync.WaitGroup
+	for _, cmd := range cmds {
+		cmd := cmd
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			exited <- cmd.Wait()
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	// The duration starts once both builds are running, so that neither
+	// runs for longer than the other.
+	if err := waitReady(opts.Addrs[:], exited, sig); err != nil {
+		fmt.Fprintf(w, "builds did not both start: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "both builds running, output in %s\n", opts.Dir)
+		var timeout <-chan time.Time
+		if opts.Duration > 0 {
+			timeout = time.After(opts.Duration)
+		}
+		select {
+		case <-timeout:
+		case <-sig:
+		case err := <-exited:
+			fmt.Fprintf(w, "a build stopped early: %v\n", err)
+		}
+	}
+	for _, cmd := range cmds {
+		_ = cmd.Process.Signal(os.Interrupt)
+	}
+	stopped.Wait()
+
+	var runs [2]RunResults
+	for i, path := range results {
+		r, err := readRunResults(path)
+		if err != nil {
+			return fmt.Errorf("reading results of %s: %w", opts.Binaries[i], err)
+		}
+		runs[i] = r
+	}
+	return printVersionComparison(w, runs[0], runs[1])
+}
+
+// waitReady waits until the builds serving on addrs are all ready, or one
+// of them exits or the wait is interrupted.
+func waitReady(addrs []string, exited <-chan error, sig <-chan os.Signal) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ready := 0
+		for _, addr := range addrs {
+			host := addr
+			if host != "" && host[0] == ':' {
+				host = "localhost" + host
+			}
+			resp, err := http.Get("http://" + host + "/readyz")
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				ready++
+			}
+		}
+		if ready == len(addrs) {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("a build exited: %v", err)
+		case <-sig:
+			return errors.New("interrupted")
+		case <-ticker.C:
+		}
+	}
+}
+
+// runVersion returns the sqlair version the scenarios of a run were built
+// with.
+func runVersion(r RunResults) string {
+	for _, s := range r.Scenarios {
+		if v := s.Metadata["sqlair_version"]; v != "" {
+			return v
+		}
+	}
+	return "unknown"
+}
+
+// printVersionComparison writes how the operations of every scenario using
+// sqlair changed between the builds. The largest change in the mean, and in
+// the p99, of an operation of the plain SQL scenarios is taken as the noise
+// of the runs in each, and only changes beyond the threshold and the noise
+// are marked as regressions or improvements.
+func printVersionComparison(w io.Writer, before, after RunResults) error {
+	wrappers := make(map[string]string)
+	for _, r := range []RunResults{before, after} {
+		for _, s := range r.Scenarios {
+			wrappers[s.Name] = s.Metadata["wrapper"]
+		}
+	}
+	afterOps := make(map[opKey]OpStats)
+	for _, op := range after.Ops {
+		afterOps[opKey{op.Scenario, op.Operation}] = op
+	}
+
+	type delta struct {
+		before, after OpStats
+		mean, p99     float64
+	}
+	var meanNoise, p99Noise float64
+	var deltas []delta
+	for _, a := range before.Ops {
+		b, ok := afterOps[opKey{a.Scenario, a.Operation}]
+		if !ok || a.Count == 0 || b.Count == 0 {
+			continue
+		}
+		d := delta{
+			before: a,
+			after:  b,
+			mean:   percentChange(float64(a.Mean), float64(b.Mean)),
+			p99:    percentChange(float64(a.P99), float64(b.P99)),
+		}
+		if wrappers[a.Scenario] == (SQLWrapper{}).Name() {
+			meanNoise = math.Max(meanNoise, math.Abs(d.mean))
+			p99Noise = math.Max(p99Noise, math.Abs(d.p99))
+			continue
+		}
+		deltas = append(deltas, d)
+	}
+	if len(deltas) == 0 {
+		return errors.New("the runs have no sqlair operations in common")
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].before.Scenario != deltas[j].before.Scenario {
+			return deltas[i].before.Scenario < deltas[j].before.Scenario
+		}
+		return deltas[i].before.Operation < deltas[j].before.Operation
+	})
+
+	mark := func(change, noise float64) string {
+		threshold := CompareThreshold + noise
+		switch {
+		case change > threshold:
+			return fmt.Sprintf("%+.1f%% !", change)
+		case change < -threshold:
+			return fmt.Sprintf("%+.1f%% *", change)
+		}
+		return fmt.Sprintf("%+.1f%%", change)
+	}
+	fmt.Fprintf(w, "sqlair %s vs %s:\n", runVersion(before), runVersion(after))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tOPERATION\tMEAN 1\tMEAN 2\tDELTA\tP99 1\tP99 2\tDELTA\tERRORS 1\tERRORS 2")
+	for _, d := range deltas {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%d/%d\n",
+			d.before.Scenario, d.before.Operation,
+			d.before.Mean, d.after.Mean, mark(d.mean, meanNoise),
+			d.before.P99, d.after.P99, mark(d.p99, p99Noise),
+			d.before.Errors, d.before.Count, d.after.Errors, d.after.Count)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "plain SQL moved by up to %.1f%% in mean and %.1f%% in p99 between the builds, so changes within %.1f%% and %.1f%% are not marked\n",
+		meanNoise, p99Noise, CompareThreshold+meanNoise, CompareThreshold+p99Noise)
+	return nil
+}
+
+// VersionsCommand implements
+// `versions [-duration d] [-dir dir] baseline candidate [-- flags]`,
+// running two builds of the benchmark built against different versions of
+// sqlair side by side and comparing them. The flags after -- are passed to
+// both builds.
+func VersionsCommand(args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ContinueOnError)
+	opts := VersionsOpts{Addrs: [2]string{":3341", ":3342"}}
+	fs.DurationVar(&opts.Duration, "duration", 10*time.Minute, "how long to run both builds for once running, or zero to run until interrupted")
+	fs.StringVar(&opts.Dir, "dir", "versions", "directory to write the results and output of each build to")
+	fs.StringVar(&opts.Addrs[0], "addr1", opts.Addrs[0], "address the baseline serves metrics on")
+	fs.StringVar(&opts.Addrs[1], "addr2", opts.Addrs[1], "address the candidate serves metrics on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rest := fs.Args()
+	if len(rest) < 2 || (len(rest) > 2 && rest[2] != "--") {
+		return errors.New("usage: versions [-duration d] [-dir dir] baseline candidate [-- flags]")
+	}
+	opts.Binaries = [2]string{rest[0], rest[1]}
+	if len(rest) > 2 {
+		opts.Args = rest[3:]
+	}
+	return RunVersions(os.Stdout, opts)
+}
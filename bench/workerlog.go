@@ -0,0 +1,113 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package bench
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WorkerLogSize is how many lines the default worker log holds before it
+// starts dropping them.
+const WorkerLogSize = 4096
+
+// WorkerLog writes the lines logged by operation workers from a goroutine
+// of its own. Workers log from inside timed operations, and writing to
+// stdout directly serialises all of them on it, so logging only queues the
+// line. If the queue is full the line is dropped and counted rather than
+// waited for.
+type WorkerLog struct {
+	lines   chan workerLogEntry
+	dropped atomic.Int64
+}
+
+// workerLogEntry is a line to write, or a request to be told once every
+// line queued before it has been written.
+type workerLogEntry struct {
+	line    string
+	flushed chan struct{}
+}
+
+// NewWorkerLog starts writing the lines logged to w, queueing up to size of
+// them.
+func NewWorkerLog(w io.Writer, size int) *WorkerLog {
+	l := &WorkerLog{lines: make(chan workerLogEntry, size)}
+	go func() {
+		bw := bufio.NewWriter(w)
+		for entry := range l.lines {
+			if entry.flushed == nil {
+				_, _ = bw.WriteString(entry.line)
+				_ = bw.WriteByte('\n')
+			}
+			// Write out whenever the queue runs dry, so that lines are
+			// not held back while the workers are quiet.
+			if len(l.lines) == 0 {
+				_ = bw.Flush()
+			}
+			if entry.flushed != nil {
+				close(entry.flushed)
+			}
+		}
+	}()
+	return l
+}
+
+var (
+	defaultWorkerLogOnce sync.Once
+	defaultWorkerLog     *WorkerLog
+)
+
+// DefaultWorkerLog returns the log the default operations write to stdout
+// through, starting it the first time.
+func DefaultWorkerLog() *WorkerLog {
+	defaultWorkerLogOnce.Do(func() {
+		defaultWorkerLog = NewWorkerLog(stdout{}, WorkerLogSize)
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "worker_log_dropped_lines",
+			Help: "The number of lines logged by operation workers that were dropped because the log was full",
+		}, func() float64 {
+			return float64(defaultWorkerLog.Dropped())
+		}))
+	})
+	return defaultWorkerLog
+}
+
+// Println queues the line, without waiting for room.
+func (l *WorkerLog) Println(line string) {
+	select {
+	case l.lines <- workerLogEntry{line: line}:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Printf formats and queues a line, without waiting for room.
+func (l *WorkerLog) Printf(format string, args ...any) {
+	l.Println(fmt.Sprintf(format, args...))
+}
+
+// Flush waits for the lines queued so far to be written.
+func (l *WorkerLog) Flush() {
+	flushed := make(chan struct{})
+	l.lines <- workerLogEntry{flushed: flushed}
+	<-flushed
+}
+
+// Dropped returns the number of lines dropped because the log was full.
+func (l *WorkerLog) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// stdout writes to whatever os.Stdout is at the time.
+type stdout struct{}
+
+func (stdout) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+//go:build zombiezen
+
+package bench
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	moderncsqlite "modernc.org/sqlite"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// zombiezen.com/go/sqlite calls SQLite directly rather than through
+// database/sql, so running the operations through it shows what the
+// database/sql layer costs. It is built on the same pure Go SQLite as
+// modernc.org/sqlite, so its connections share the in-memory databases of
+// the sqlite-zombiezen provider, or of sqlite-modernc, and it is only built
+// in with the zombiezen build tag.
+
+// ZombiezenPoolSize is the number of connections each database opens
+// through zombiezen.
+const ZombiezenPoolSize = 10
+
+func init() {
+	RegisterWrapper(ZombiezenWrapper{})
+}
+
+// ZombiezenWrapper runs the operations through zombiezen.com/go/sqlite.
+// It needs the databases of the sqlite-zombiezen or sqlite-modernc
+// provider.
+type ZombiezenWrapper struct{}
+
+func (ZombiezenWrapper) Name() string {
+	return "zombiezen"
+}
+
+func (ZombiezenWrapper) Wrap(db *sql.DB, name string, runInTx bool) DB {
+	runner := ZombiezenPlainRunner
+	if runInTx {
+		runner = ZombiezenTxRunner
+	}
+	zdb := &ZombiezenDB{
+		sqldb:  db,
+		name:   name,
+		runner: runner,
+	}
+	if _, ok := db.Driver().(*moderncsqlite.Driver); !ok {
+		zdb.err = fmt.Errorf("zombiezen needs the sqlite-zombiezen or sqlite-modernc provider, not a %T database", db.Driver())
+		return zdb
+	}
+	zdb.pool, zdb.err = sqlitex.NewPool(zombiezenURI(name), sqlitex.PoolOptions{
+		Flags:    sqlite.OpenReadWrite | sqlite.OpenURI,
+		PoolSize: ZombiezenPoolSize,
+	})
+	return zdb
+}
+
+// ZombiezenRunner runs fn against a connection of the pool, or a
+// transaction of it, interrupted once the context is done.
+type ZombiezenRunner func(context.Context, *sqlitex.Pool, func(*sqlite.Conn) error) error
+
+var ZombiezenTxRunner = func(ctx context.Context, pool *sqlitex.Pool, fn func(*sqlite.Conn) error) error {
+	return withZombiezenConn(ctx, pool, func(conn *sqlite.Conn) (err error) {
+		defer sqlitex.Transaction(conn)(&err)
+		return fn(conn)
+	})
+}
+
+var ZombiezenPlainRunner = func(ctx context.Context, pool *sqlitex.Pool, fn func(*sqlite.Conn) error) error {
+	return withZombiezenConn(ctx, pool, fn)
+}
+
+// withZombiezenConn runs fn with a connection taken from the pool.
+func withZombiezenConn(ctx context.Context, pool *sqlitex.Pool, fn func(*sqlite.Conn) error) error {
+	conn, err := pool.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.Put(conn)
+	conn.SetInterrupt(ctx.Done())
+	defer conn.SetInterrupt(nil)
+	return fn(conn)
+}
+
+// ZombiezenDB runs the operations through zombiezen.com/go/sqlite, whose
+// connections cache the statements they prepare.
+type ZombiezenDB struct {
+	pool   *sqlitex.Pool
+	sqldb  *sql.DB
+	name   string
+	runner ZombiezenRunner
+	// err is why the database could not be opened with zombiezen,
+	// returned by every operation.
+	err error
+}
+
+func (db *ZombiezenDB) Name() string {
+	return db.name
+}
+
+func (db *ZombiezenDB) Close() error {
+	if db.pool != nil {
+		_ = db.pool.Close()
+	}
+	return db.sqldb.Close()
+}
+
+func (db *ZombiezenDB) PlainDB() *sql.DB {
+	return db.sqldb
+}
+
+// run runs fn with the runner, once the database has been opened.
+func (db *ZombiezenDB) run(ctx context.Context, fn func(*sqlite.Conn) error) error {
+	if db.err != nil {
+		return db.err
+	}
+	return db.runner(ctx, db.pool, fn)
+}
+
+// zombiezenExec runs a statement returning no rows, and returns the rows it
+// changed.
+func zombiezenExec(conn *sqlite.Conn, query string, args ...any) (OpResult, error) {
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+		return OpResult{}, err
+	}
+	return OpResult{RowsAffected: int64(conn.Changes())}, nil
+}
+
+func (db *ZombiezenDB) SeedModelAgents(ctx context.Context, agentUUIDs []any) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		var insertStrings []string
+		for i := 0; i < len(agentUUIDs)/3; i++ {
+			insertStrings = append(insertStrings, "(?, ?, ?)")
+		}
+		var err error
+		result, err = zombiezenExec(conn, "INSERT INTO agent VALUES "+strings.Join(insertStrings, ","), agentUUIDs...)
+		return err
+	})
+	return result, err
+}
+
+func (db *ZombiezenDB) UpdateModelAgentStatus(ctx context.Context, agentUUIDs []string, status string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		args := make([]any, 0, len(agentUUIDs)+1)
+		args = append(args, status)
+		for _, agentUUID := range agentUUIDs {
+			args = append(args, agentUUID)
+		}
+		var err error
+		result, err = zombiezenExec(conn, "UPDATE agent SET status = ? WHERE uuid IN ("+SliceToPlaceholder(agentUUIDs)+")", args...)
+		return err
+	})
+	return result, err
+}
+
+func (db *ZombiezenDB) GenerateAgentEvents(ctx context.Context, agentUUIDs []string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		args := make([]any, 0, len(agentUUIDs)*2)
+		insertStrings := make([]string, 0, len(agentUUIDs))
+		for _, agentUUID := range agentUUIDs {
+			args = append(args, agentUUID, "event")
+			insertStrings = append(insertStrings, "(?, ?)")
+		}
+		var err error
+		result, err = zombiezenExec(conn, "INSERT INTO agent_events VALUES "+strings.Join(insertStrings, ","), args...)
+		return err
+	})
+	return result, err
+}
+
+func (db *ZombiezenDB) CullAgentEvents(ctx context.Context, maxEvents int) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		result, err = zombiezenExec(conn, "DELETE FROM agent_events WHERE agent_uuid IN (SELECT agent_uuid from agent_events INNER JOIN agent ON agent.uuid = agent_events.agent_uuid WHERE agent.model_name = ? GROUP BY agent_uuid HAVING COUNT(*) > ?)",
+			db.Name(), maxEvents)
+		return err
+	})
+	return result, err
+}
+
+func (db *ZombiezenDB) AgentModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent
+		WHERE model_name = ?
+		`, db.Name())
+}
+
+func (db *ZombiezenDB) AgentEventModelCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		INNER JOIN agent ON agent.uuid = agent_events.agent_uuid
+		WHERE agent.model_name = ?
+		`, db.Name())
+}
+
+func (db *ZombiezenDB) AgentUUIDs(ctx context.Context) ([]string, OpResult, error) {
+	var agentUUIDs []string
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		agentUUIDs = nil
+		timing := startScan()
+		err := sqlitex.Execute(conn, "SELECT uuid FROM agent WHERE model_name = ? ORDER BY rowid", &sqlitex.ExecOptions{
+			Args: []any{db.Name()},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				timing.row()
+				agentUUIDs = append(agentUUIDs, stmt.ColumnText(0))
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return agentUUIDs, result, err
+}
+
+func (db *ZombiezenDB) OrphanedAgentEventCount(ctx context.Context) (int, OpResult, error) {
+	return db.count(ctx, `
+		SELECT count(*)
+		FROM agent_events
+		WHERE agent_uuid NOT IN (SELECT uuid FROM agent)
+		`)
+}
+
+// count runs a query returning a single count.
+func (db *ZombiezenDB) count(ctx context.Context, query string, args ...any) (int, OpResult, error) {
+	var count int
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		count = 0
+		timing := startScan()
+		err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				timing.row()
+				count = int(stmt.ColumnInt64(0))
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		result = timing.done()
+		return nil
+	})
+	return count, result, err
+}
+
+func (db *ZombiezenDB) IncrementVersion(ctx context.Context) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		var version int64
+		var scanned int64
+		err := sqlitex.Execute(conn, "SELECT version FROM version WHERE id = 1", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt64(0)
+				scanned++
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		res, err := zombiezenExec(conn, "UPDATE version SET version = ? WHERE id = 1", version+1)
+		if err != nil {
+			return err
+		}
+		result = res.Add(OpResult{RowsScanned: scanned})
+		return nil
+	})
+	return result, err
+}
+
+func (db *ZombiezenDB) LogOperation(ctx context.Context, id string) (OpResult, error) {
+	var result OpResult
+	err := db.run(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		result, err = zombiezenExec(conn, "INSERT INTO operation_log VALUES (?)", id)
+		return err
+	})
+	return result, err
+}
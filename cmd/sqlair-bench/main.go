@@ -0,0 +1,644 @@
+// Copyright 2023 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// sqlair-bench runs the benchmark scenarios configured below. The harness
+// itself is in the bench package, so that other projects can embed it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sqlair-bench/bench"
+)
+
+// combinations describes which flags can be given together, beyond every
+// wrapper running against every provider.
+const combinations = `
+Every wrapper runs against every provider, in transactions or not. Beyond that:
+  -provider-dir, -sync-delay and -provider-cleanup need -provider sqlite-file
+  -provider-nodes needs -provider dqlite-cluster
+  -network-latency and -network-jitter need -provider dqlite3 or dqlite-cluster
+  -sqlite-busy-timeout, -sqlite-txlock, -sqlite-journal, -sqlite-synchronous,
+  -sqlite-cache-size, -sqlite-mmap-size and -sqlite-foreign-keys need a SQLite provider
+  -foreign-keys needs a SQLite provider, and cannot be given with -sqlite-foreign-keys
+  -retry and -commit-failure-fraction need -tx
+  -validate cannot be given with -commit-failure-fraction
+  -chaos-node-restart-every, -chaos-node-downtime, -chaos-node-kill and
+  -chaos-leadership-transfer-every need -provider dqlite3 or dqlite-cluster
+  -db-host and -dqlite-nodes replace the provider, so cannot be given with -provider
+`
+
+// isSet returns whether the flag was given, on the command line or from
+// the environment.
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// exit logs err and exits with a non-zero status.
+func exit(err error) {
+	bench.Logger().Error(err.Error())
+	os.Exit(1)
+}
+
+func main() {
+	ci := flag.Bool("ci", false, "run a short fixed workload, check it against thresholds and exit non-zero if any fail")
+	ciOutput := flag.String("ci-output", bench.DefaultCIOpts.Output, "path of the JUnit file written in CI mode")
+	results := flag.String("results", "", "path to write the results of the run to, for the compare and report commands")
+	opCSV := flag.String("op-csv", "", "path of a CSV file to append a row to for every operation run after the warmup, with its time, wrapper, db, duration and error")
+	cpuProfile := flag.String("cpu-profile", "", "path to write a CPU profile of the run to, comparing the time each wrapper spends in sqlair, database/sql and the driver")
+	var plugins, wrappers []string
+	flag.Func("plugin", "path of a Go plugin that registers wrappers or operations, may be repeated", func(path string) error {
+		plugins = append(plugins, path)
+		return nil
+	})
+	operations := flag.String("operations", bench.DefaultOperationsName, "name of the registered operations every scenario runs")
+	flag.Func("wrapper", "name of a registered wrapper to run a scenario with, may be repeated, sql and sqlair if not given", func(name string) error {
+		wrappers = append(wrappers, name)
+		return nil
+	})
+	providerName := flag.String("provider", bench.DefaultProviderName, "name of the registered provider every scenario creates its databases with")
+	providerDir := flag.String("provider-dir", "", "directory the sqlite-file provider creates databases in, or empty for a temporary directory removed when the run ends")
+	providerCleanup := flag.Bool("provider-cleanup", false, "delete the databases the sqlite-file provider created in -provider-dir when the run ends")
+	syncDelay := flag.Duration("sync-delay", 0, "delay the sqlite-file provider adds to every durable write, to study a slow disk")
+	providerNodes := flag.Int("provider-nodes", 0, "number of nodes the dqlite-cluster provider runs, 3 if not given")
+	networkLatency := flag.Duration("network-latency", 0, "latency the dqlite cluster providers add to the traffic between their nodes")
+	networkJitter := flag.Duration("network-jitter", 0, "random extra latency of up to this the dqlite cluster providers add to the traffic between their nodes")
+	tx := flag.Bool("tx", true, "run the queries of each operation in a transaction")
+	config := flag.String("config", "", "path of a YAML definition of the provider, wrappers, transactions, ramp, stages, chaos timeline and operations to run, which the flags given with it override")
+	addr := flag.String("addr", ":3333", "address metrics and profiles are served on")
+	coordinator := flag.String("coordinator", "", "URL of a coordinator to join as an agent of a distributed run, for example http://host:3334")
+	hostname, _ := os.Hostname()
+	agent := flag.String("agent", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "name this process registers with the coordinator as")
+	collector := flag.String("collector", "", "URL of a collector to send the stats of the run to, for example http://host:3335")
+	resultsUpload := flag.String("results-upload", "", "URL to put the results to once written, such as a presigned object store URL")
+	seed := flag.Int64("seed", 0, "seed of the agents each database is seeded with, the agents operations pick and when they first run, so that runs with the same seed and the scenarios of a run put the same workload on their databases, or zero to pick them at random")
+	warmup := flag.Duration("warmup", time.Minute, "how long operations run before they are measured, their runs until then being left out of the reports and labelled phase=warmup in the metrics")
+	duration := flag.Duration("duration", 0, "how long to run for before stopping, letting the operations in flight finish, closing the databases and reporting, or zero to run until interrupted")
+	churnEvery := flag.Duration("churn-every", 0, "how often to remove the oldest databases for the ramp to replace with new ones, measuring teardown and the effect of churn, or zero not to")
+	churnCount := flag.Int("churn-count", 1, "how many databases -churn-every removes each time")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 0, "how long the scenarios are given to stop once interrupted, to report within a pod's termination grace period, or zero to wait for them")
+	dbHost := flag.String("db-host", "", "URL of a database host to run the scenarios against, instead of their providers, for example http://host:3336")
+	dqliteNodes := flag.String("dqlite-nodes", "", "comma separated addresses of dqlite nodes in other processes to run the scenarios against, instead of their providers")
+	dqliteCert := flag.String("dqlite-cert", "", "path of the client certificate to connect to -dqlite-nodes or -db-host over TLS with")
+	dqliteKey := flag.String("dqlite-key", "", "path of the key of -dqlite-cert")
+	dqliteCA := flag.String("dqlite-ca", "", "path of the CA certificate of the dqlite nodes")
+	validate := flag.Bool("validate", false, "check the contents of every database against a model of the operations run once the run is over")
+	invariantInterval := flag.Duration("invariant-interval", 0, "how often to check the row counts of every database against invariants while running, or zero not to")
+	differentialInterval := flag.Duration("differential-interval", 0, "how often to read a database through both sql and sqlair and compare the results while running, or zero not to")
+	snapshotDir := flag.String("snapshot-dir", "", "directory to write snapshots of databases to, taken by POSTing to /control/snapshot, or empty not to take any")
+	snapshotOnAnomaly := flag.Bool("snapshot-on-anomaly", false, "snapshot a database as soon as a differential or invariant check finds something wrong with it, needs -snapshot-dir")
+	opConcurrency := flag.Int("op-concurrency", 1, "how many copies of each periodic operation to run against each database at once, above one counting the updates lost to concurrent writers")
+	commitFailureFraction := flag.Float64("commit-failure-fraction", 0, "fraction of commits to fail as if the database were busy or its leader changed, checking every operation is applied exactly once")
+	scheduler := flag.String("scheduler", bench.SchedulerPool, fmt.Sprintf("scheduler operations run on, one of %s, where goroutine runs every operation of every database on a goroutine of its own", strings.Join(bench.SchedulerKinds(), ", ")))
+	schedulerWorkers := flag.Int("scheduler-workers", 64, "how many operations the pool scheduler runs at once")
+	openLoop := flag.Bool("open-loop", false, "keep operations due at their frequency however long they take and measure them from when they were due, so that latency under saturation is not hidden by slow runs delaying the next")
+	maxOpsPerSec := flag.Float64("max-ops-per-sec", 0, "how many operations the run may start per second in total, across every scenario and database, evenly spaced without bursts, to measure latency at a fixed throughput, or zero not to limit them")
+	opTimeout := flag.Duration("op-timeout", 0, "how long each run of an operation may take before it is cancelled and counted as an error, or zero not to bound it")
+	retry := flag.Bool("retry", false, "retry transactions that fail transiently, busy, locked or without a dqlite leader, with exponential backoff")
+	chaosNodeRestartEvery := flag.Duration("chaos-node-restart-every", 0, "how often a dqlite node is stopped and started again, or zero not to")
+	chaosNodeDowntime := flag.Duration("chaos-node-downtime", 30*time.Second, "how long a node stopped by -chaos-node-restart-every stays down")
+	chaosNodeKill := flag.Bool("chaos-node-kill", false, "kill nodes stopped by -chaos-node-restart-every without handing over their roles, as a crash would")
+	chaosLeadershipTransferEvery := flag.Duration("chaos-leadership-transfer-every", 0, "how often dqlite cluster leadership is handed to another node, or zero not to")
+	var agentDistribution bench.AgentDistribution = bench.UniformAgents{}
+	flag.Func("agent-distribution", "distribution operations pick the agents they touch from: uniform, zipf[:s] or hotset[:fraction[:probability]]", func(spec string) error {
+		dist, err := bench.ParseAgentDistribution(spec)
+		if err != nil {
+			return err
+		}
+		agentDistribution = dist
+		return nil
+	})
+	sqliteBusyTimeout := flag.Duration("sqlite-busy-timeout", 0, "how long SQLite connections wait for a lock before failing as busy, as _busy_timeout, or zero for the provider's default")
+	sqliteTxLock := flag.String("sqlite-txlock", "", "lock SQLite transactions take when they begin, deferred, immediate or exclusive, as _txlock, or empty for the provider's default")
+	sqliteJournal := flag.String("sqlite-journal", "", "SQLite journal mode, such as WAL, as _journal, or empty for the provider's default")
+	sqliteSynchronous := flag.String("sqlite-synchronous", "", "how often SQLite syncs to disk, OFF, NORMAL, FULL or EXTRA, as _sync, or empty for SQLite's default")
+	sqliteCacheSize := flag.Int("sqlite-cache-size", 0, "SQLite page cache size of each connection, in pages if positive or KiB if negative, as _cache_size, or zero for SQLite's default")
+	sqliteMmapSize := flag.Int64("sqlite-mmap-size", 0, "how many bytes of each SQLite database to read through memory mapped I/O, as PRAGMA mmap_size, or zero not to")
+	sqliteForeignKeys := flag.Bool("sqlite-foreign-keys", false, "enforce foreign keys in every scenario, as _fk")
+	maxOpenConns := flag.Int("max-open-conns", 0, "how many connections each database may have open, or zero not to limit them")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "how many idle connections each database keeps open, or zero for database/sql's default of 2")
+	connMaxLifetime := flag.Duration("conn-max-lifetime", 0, "how long a connection is reused before it is closed, or zero to reuse connections forever")
+	var gc bench.GCOpts
+	flag.Func("gogc", "GOGC to run with, a percentage or off, instead of the environment's", func(s string) error {
+		percent, err := bench.ParseGCPercent(s)
+		gc.Percent = &percent
+		return err
+	})
+	flag.Func("gomemlimit", "GOMEMLIMIT to run with, for example 4GiB, instead of the environment's", func(s string) error {
+		var err error
+		gc.MemoryLimit, err = bench.ParseBytes(s)
+		return err
+	})
+	flag.Func("gc-ballast", "size of a heap ballast to hold for the run, for example 1GiB, raising the heap size the collector aims for", func(s string) error {
+		var err error
+		gc.Ballast, err = bench.ParseBytes(s)
+		return err
+	})
+	logLevel := flag.String("log-level", "info", "level to log at, debug, info, warn or error, with debug logging every operation run")
+	logFormat := flag.String("log-format", "text", "format to log in, text or json")
+	foreignKeys := flag.Bool("foreign-keys", false, "also run every scenario with foreign keys enforced, reporting the cost of enforcement")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command args]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(out)
+		_ = bench.WriteRegistryUsage(out)
+		fmt.Fprintf(out, "Operation kinds of -config: %s\n", strings.Join(bench.OperationKinds(), ", "))
+		fmt.Fprint(out, combinations)
+	}
+	flag.Parse()
+	// Flags can also be set from the environment, for example
+	// SQLAIR_BENCH_RESULTS for -results, to configure runs in Kubernetes
+	// from a ConfigMap.
+	if err := bench.FlagsFromEnv(flag.CommandLine, "SQLAIR_BENCH_"); err != nil {
+		exit(err)
+	}
+	if err := bench.ConfigureLogging(*logLevel, *logFormat); err != nil {
+		exit(err)
+	}
+
+	// Subcommands work on the results of earlier runs:
+	// compare run1.json run2.json compares the results of two runs, failing
+	// with -max-p95-regression if an operation's p95 grew by more than it,
+	// and
+	// report results.json [output] renders them as a HTML page, or with
+	// -format markdown as Markdown for pasting into issues, as it does the
+	// rows written with -op-csv.
+	// coordinator -agents n coordinates a distributed run between n agents,
+	// each started with -coordinator, and collector merges the stats of
+	// agents started with -collector into one results file. host runs
+	// dqlite nodes for runs started with -db-host to load. versions
+	// baseline candidate runs two builds against different versions of
+	// sqlair side by side and compares them, see make versions. repl
+	// queries the databases of a running benchmark.
+	commands := map[string]func([]string) error{
+		"compare":     bench.CompareCommand,
+		"report":      bench.ReportCommand,
+		"coordinator": bench.CoordinatorCommand,
+		"collector":   bench.CollectorCommand,
+		"host":        bench.HostCommand,
+		"versions":    bench.VersionsCommand,
+		"repl":        bench.ReplCommand,
+	}
+	if command, ok := commands[flag.Arg(0)]; ok {
+		if err := command(flag.Args()[1:]); err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	// A config file fills in the flags that were not given.
+	var cfg *bench.Config
+	if *config != "" {
+		var err error
+		if cfg, err = bench.LoadConfig(*config); err != nil {
+			exit(err)
+		}
+		setDefault := func(name, value string) {
+			if value != "" && !isSet(name) {
+				if err := flag.Set(name, value); err != nil {
+					exit(fmt.Errorf("config %s: %v", *config, err))
+				}
+			}
+		}
+		if *dbHost == "" && *dqliteNodes == "" {
+			setDefault("provider", cfg.Provider)
+		}
+		setDefault("provider-dir", cfg.ProviderDir)
+		if cfg.ProviderCleanup {
+			setDefault("provider-cleanup", "true")
+		}
+		setDefault("scheduler", cfg.Scheduler)
+		if cfg.SchedulerWorkers != 0 {
+			setDefault("scheduler-workers", strconv.Itoa(cfg.SchedulerWorkers))
+		}
+		if cfg.MaxOpsPerSec != 0 {
+			setDefault("max-ops-per-sec", strconv.FormatFloat(cfg.MaxOpsPerSec, 'f', -1, 64))
+		}
+		if cfg.ProviderNodes != 0 {
+			setDefault("provider-nodes", strconv.Itoa(cfg.ProviderNodes))
+		}
+		setDefault("sqlite-txlock", cfg.SQLiteTxLock)
+		setDefault("sqlite-journal", cfg.SQLiteJournal)
+		setDefault("sqlite-synchronous", cfg.SQLiteSynchronous)
+		if cfg.SQLiteCacheSize != 0 {
+			setDefault("sqlite-cache-size", strconv.Itoa(cfg.SQLiteCacheSize))
+		}
+		if cfg.SQLiteMmapSize != 0 {
+			setDefault("sqlite-mmap-size", strconv.FormatInt(cfg.SQLiteMmapSize, 10))
+		}
+		if cfg.SQLiteForeignKeys {
+			setDefault("sqlite-foreign-keys", "true")
+		}
+		if cfg.MaxOpenConns != 0 {
+			setDefault("max-open-conns", strconv.Itoa(cfg.MaxOpenConns))
+		}
+		if cfg.MaxIdleConns != 0 {
+			setDefault("max-idle-conns", strconv.Itoa(cfg.MaxIdleConns))
+		}
+		for name, d := range map[string]time.Duration{
+			"sync-delay":          cfg.SyncDelay,
+			"network-latency":     cfg.NetworkLatency,
+			"network-jitter":      cfg.NetworkJitter,
+			"duration":            cfg.Duration,
+			"churn-every":         cfg.ChurnEvery,
+			"conn-max-lifetime":   cfg.ConnMaxLifetime,
+			"sqlite-busy-timeout": cfg.SQLiteBusyTimeout,
+		} {
+			if d != 0 {
+				setDefault(name, d.String())
+			}
+		}
+		if cfg.OpenLoop {
+			setDefault("open-loop", "true")
+		}
+		if cfg.Seed != 0 {
+			setDefault("seed", strconv.FormatInt(cfg.Seed, 10))
+		}
+		if cfg.Warmup != nil {
+			setDefault("warmup", cfg.Warmup.String())
+		}
+		if cfg.ChurnCount != 0 {
+			setDefault("churn-count", strconv.Itoa(cfg.ChurnCount))
+		}
+		if cfg.Tx != nil {
+			setDefault("tx", strconv.FormatBool(*cfg.Tx))
+		}
+		if len(wrappers) == 0 {
+			wrappers = cfg.Wrappers
+		}
+	}
+
+	for _, path := range plugins {
+		if err := bench.LoadPlugin(path); err != nil {
+			exit(err)
+		}
+	}
+	ops, err := bench.RegisteredOperations(*operations)
+	if err != nil {
+		exit(err)
+	}
+	if cfg != nil && cfg.OperationsFunc() != nil && !isSet("operations") {
+		ops = cfg.OperationsFunc()
+	}
+	if !*tx && (*retry || *commitFailureFraction > 0) {
+		exit(errors.New("-retry and -commit-failure-fraction need -tx"))
+	}
+	// A commit failed once it had taken effect, or applied again by its
+	// retry, is not what the model was told happened.
+	if *validate && *commitFailureFraction > 0 {
+		exit(errors.New("-validate cannot be given with -commit-failure-fraction"))
+	}
+	if err := bench.CheckSchedulerKind(*scheduler); err != nil {
+		exit(err)
+	}
+	if *warmup < 0 {
+		exit(errors.New("-warmup cannot be negative"))
+	}
+	if *churnEvery < 0 || *churnCount < 1 {
+		exit(errors.New("-churn-every cannot be negative and -churn-count must be at least one"))
+	}
+	if *maxOpsPerSec < 0 {
+		exit(errors.New("-max-ops-per-sec cannot be negative"))
+	}
+	pool := bench.PoolOpts{
+		MaxOpen:     *maxOpenConns,
+		MaxIdle:     *maxIdleConns,
+		MaxLifetime: *connMaxLifetime,
+	}
+	if err := pool.Validate(); err != nil {
+		exit(err)
+	}
+
+	// Scenarios can instead run against dqlite nodes in other processes,
+	// connecting to them over the network.
+	var provider bench.DBProvider
+	if *dbHost != "" || *dqliteNodes != "" {
+		if isSet("provider") {
+			exit(errors.New("-provider cannot be given with -db-host or -dqlite-nodes, which replace it"))
+		}
+		var remoteOpts bench.RemoteDQLiteOpts
+		if *dqliteCert != "" {
+			remoteOpts.TLS, err = bench.RemoteTLSConfig(*dqliteCert, *dqliteKey, *dqliteCA)
+			if err != nil {
+				exit(err)
+			}
+		}
+		switch {
+		case *dbHost != "" && *dqliteNodes != "":
+			exit(errors.New("only one of -db-host and -dqlite-nodes can be given"))
+		case *dbHost != "":
+			if provider, err = bench.NewHostedDBProvider(*dbHost, remoteOpts); err != nil {
+				exit(err)
+			}
+		default:
+			if provider, err = bench.NewRemoteDQLiteDBProvider(strings.Split(*dqliteNodes, ","), remoteOpts); err != nil {
+				exit(err)
+			}
+		}
+	} else {
+		provider, err = bench.NewRegisteredProvider(*providerName, bench.ProviderOpts{
+			Dir:       *providerDir,
+			SyncDelay: *syncDelay,
+			Cleanup:   *providerCleanup,
+			Nodes:     *providerNodes,
+			Latency:   *networkLatency,
+			Jitter:    *networkJitter,
+		})
+		if err != nil {
+			exit(err)
+		}
+	}
+	if p, ok := provider.(bench.SQLiteDSNConfigurer); ok {
+		dsnOpts := p.DSNOpts()
+		if *sqliteBusyTimeout != 0 {
+			dsnOpts.BusyTimeout = *sqliteBusyTimeout
+		}
+		if *sqliteTxLock != "" {
+			dsnOpts.TxLock = *sqliteTxLock
+		}
+		if *sqliteJournal != "" {
+			dsnOpts.Journal = *sqliteJournal
+		}
+		if *sqliteSynchronous != "" {
+			dsnOpts.Synchronous = *sqliteSynchronous
+		}
+		if *sqliteCacheSize != 0 {
+			dsnOpts.CacheSize = *sqliteCacheSize
+		}
+		if *sqliteMmapSize != 0 {
+			dsnOpts.MmapSize = *sqliteMmapSize
+		}
+		if *sqliteForeignKeys {
+			dsnOpts.ForeignKeys = true
+		}
+		if err := dsnOpts.Validate(); err != nil {
+			exit(err)
+		}
+		provider = p.WithDSNOpts(dsnOpts)
+	} else {
+		for _, name := range []string{"sqlite-busy-timeout", "sqlite-txlock", "sqlite-journal", "sqlite-synchronous", "sqlite-cache-size", "sqlite-mmap-size", "sqlite-foreign-keys"} {
+			if isSet(name) {
+				exit(fmt.Errorf("the -sqlite- flags need a SQLite provider, not %T", provider))
+			}
+		}
+	}
+	if *foreignKeys && *sqliteForeignKeys {
+		exit(errors.New("-foreign-keys compares against scenarios without foreign keys, so cannot be given with -sqlite-foreign-keys"))
+	}
+	chaosNodes := isSet("chaos-node-restart-every") || isSet("chaos-node-downtime") || isSet("chaos-node-kill") || isSet("chaos-leadership-transfer-every")
+	if _, ok := provider.(bench.ClusterProvider); chaosNodes && !ok {
+		exit(fmt.Errorf("the -chaos- flags need a dqlite cluster provider, not %T", provider))
+	}
+	if _, ok := provider.(bench.ForeignKeyEnforcer); *foreignKeys && !ok {
+		exit(fmt.Errorf("-foreign-keys needs a provider that can enforce them, not %T", provider))
+	}
+
+	// base configures every scenario, each of which runs it with one of
+	// the wrappers.
+	base := bench.BenchmarkOpts{
+		// Provider is chosen with -provider, or replaced with -db-host or
+		// -dqlite-nodes, and shared by every scenario. Any DBProvider can
+		// be set here instead, such as
+		// bench.NewSQLiteDBProvider().WithDSNOpts(bench.SQLiteDSNOpts{BusyTimeout: 5 * time.Second}).
+		Provider: provider,
+		// RunInTx indicates if queries will be applied in transactions or
+		// not, set with -tx.
+		RunInTx: *tx,
+		// Phases sets the length of the warmup, measure and cooldown
+		// Phases. Only the measure phase is reported on at the end of the
+		// run. The warmup is set with -warmup.
+		Phases: bench.PhaseSchedule{
+			Warmup: *warmup,
+		},
+		// Supervisor recreates or drops databases whose operations keep
+		// failing.
+		Supervisor: bench.SupervisorOpts{
+			MaxConsecutiveFailures: 10,
+			Action:                 bench.SupervisorRecreate,
+			RestartBackoff:         time.Second,
+			MaxRestartBackoff:      time.Minute,
+			MaxRestarts:            5,
+		},
+		// CreateParallelism is how many databases are created at once.
+		CreateParallelism: 8,
+		// SpawnQueueSize is how many databases can be created ahead of
+		// their operations starting.
+		SpawnQueueSize: bench.DefaultSpawnQueueSize,
+		// Scheduler is what runs the operations, set with -scheduler:
+		// a pool of SchedulerWorkers workers, set with
+		// -scheduler-workers, or a goroutine per operation per database.
+		Scheduler:        *scheduler,
+		SchedulerWorkers: *schedulerWorkers,
+		// Pool sets the connection pool of every database, with
+		// -max-open-conns, -max-idle-conns and -conn-max-lifetime.
+		Pool: pool,
+		// Seed makes the workload the same across scenarios and runs,
+		// set with -seed.
+		Seed: *seed,
+		// AgentDistribution is what operations pick agents from, set
+		// with -agent-distribution.
+		AgentDistribution: agentDistribution,
+		// OpenLoop measures operations from when they were due rather
+		// than when they started, set with -open-loop.
+		OpenLoop: *openLoop,
+		// Valid values for Ramp are:
+		// - bench.LinearRamp{}
+		// - bench.StepRamp{}
+		// - bench.ExponentialRamp{}
+		// - bench.SineRamp{}
+		// - bench.ScheduleRamp{}
+		Ramp: bench.StepRamp{
+			Step:   bench.AddDBRate,
+			Every:  bench.DatabaseAddFrequency,
+			MaxDBs: bench.MaxNumberOfDatabases,
+		},
+		// Churn removes the oldest databases every Every for the ramp to
+		// replace, set with -churn-every and -churn-count.
+		Churn: bench.ChurnOpts{
+			Every: *churnEvery,
+			Count: *churnCount,
+		},
+		// Iterations runs each operation a fixed number of times per
+		// database and exits once done, for directly comparable total
+		// times. Zero runs until interrupted.
+		Iterations: 0,
+		// Deterministic runs the same seeded sequence of operations
+		// against every database instead of using timers, for example:
+		// bench.DeterministicOpts{Steps: 1000, Seed: 1}
+		// Chaos injects faults into the run. Node restarts and
+		// leadership transfers need a provider with a cluster, and
+		// filling the disk needs file backed databases on a small
+		// filesystem, for example:
+		// bench.ChaosOpts{NodeRestartEvery: 5 * time.Minute, NodeDowntime: 30 * time.Second,
+		// 	LeadershipTransferEvery: time.Minute,
+		// 	PartitionEvery: 10 * time.Minute, PartitionFor: 20 * time.Second,
+		// 	DiskFullEvery: 15 * time.Minute, DiskFullFor: time.Minute,
+		// 	NoisyNeighbourEvery: 10 * time.Second, NoisyNeighbourHold: 100 * time.Millisecond,
+		// 	ConnKillEvery: 5 * time.Second, MembershipChurnEvery: 10 * time.Minute}
+		// or, to repeat an experiment exactly, a timeline of faults:
+		// bench.ChaosOpts{Schedule: []bench.ChaosEvent{
+		// 	{At: 5 * time.Minute, Fault: bench.FaultPartition, For: 30 * time.Second},
+		// 	{At: 10 * time.Minute, Fault: bench.FaultLeadershipTransfer}}}
+		// Node restarts and leadership transfers are also set with the
+		// -chaos- flags.
+		Chaos: bench.ChaosOpts{
+			NodeRestartEvery:        *chaosNodeRestartEvery,
+			NodeDowntime:            *chaosNodeDowntime,
+			NodeKill:                *chaosNodeKill,
+			LeadershipTransferEvery: *chaosLeadershipTransferEvery,
+		},
+		// RollbackFraction rolls back and retries this fraction of
+		// transactions, to measure the cost of retries.
+		RollbackFraction: 0,
+		// Checkpoint saves the run state so that an interrupted run on
+		// persistent databases can be resumed, for example:
+		// bench.CheckpointOpts{Dir: "/tmp/checkpoints", Interval: time.Minute, Resume: true}
+		// Curve measures throughput and latency at each number of
+		// databases in turn, then stops, for example:
+		// bench.CurveOpts{Counts: []int{50, 100, 200, 400}, Settle: 30 * time.Second, Hold: 2 * time.Minute}
+		// Setting MaxP99 or MaxErrorRate keeps doubling the databases
+		// until they are broken, to find the breaking point.
+		// Paired runs this scenario against clones of the databases of
+		// any other scenario given the same pairing, for example
+		// Paired: pairing, with pairing := bench.NewPairing() shared by both.
+		// Stages optionally changes the mix of operations over time, for
+		// example a write heavy stage followed by a read heavy one:
+		// bench.WorkloadSchedule{
+		// 	{Name: "write-heavy", Duration: 15 * time.Minute, Ops: map[string]time.Duration{
+		// 		"agent-status-active": time.Second, "agent-events": 2 * time.Second}},
+		// 	{Name: "read-heavy", Ops: map[string]time.Duration{
+		// 		"agents-count": time.Second, "agent-events-count": time.Second}},
+		// }
+	}
+	// soak writes a report of the last window of the run every interval,
+	// for long stability runs, for example:
+	// bench.SoakOpts{Dir: "/tmp/soak", Interval: 10 * time.Minute, Window: time.Hour, Keep: 144}
+	soak := bench.SoakOpts{}
+	// timeSeries snapshots every metric to a file every interval, so the
+	// run can be analysed afterwards without Prometheus, for example:
+	// bench.TimeSeriesOpts{Dir: "/tmp/timeseries", Interval: 10 * time.Second}
+	timeSeries := bench.TimeSeriesOpts{}
+
+	if cfg != nil && cfg.RampProfile() != nil {
+		base.Ramp = cfg.RampProfile()
+	}
+	if cfg != nil && cfg.WorkloadSchedule() != nil {
+		base.Stages = cfg.WorkloadSchedule()
+	}
+	if cfg != nil && cfg.ChaosSchedule() != nil {
+		base.Chaos.Schedule = cfg.ChaosSchedule()
+	}
+	if len(wrappers) == 0 {
+		wrappers = []string{bench.SQLWrapper{}.Name(), bench.SQLairWrapper{}.Name()}
+	}
+	// RateLimit holds the throughput of the run to one token bucket
+	// shared by every scenario, set with -max-ops-per-sec. It holds a
+	// single token, so that the operations start evenly spaced rather
+	// than in a burst. Without it the load is left to the operation
+	// frequencies.
+	if *maxOpsPerSec > 0 {
+		base.RateLimit = bench.NewRateLimiter(*maxOpsPerSec, 1)
+	}
+	var scenarios []*bench.BenchmarkOpts
+	seen := make(map[string]bool)
+	for _, name := range wrappers {
+		if seen[name] {
+			exit(fmt.Errorf("wrapper %s given more than once", name))
+		}
+		seen[name] = true
+		w, err := bench.RegisteredWrapper(name)
+		if err != nil {
+			exit(err)
+		}
+		opts := base
+		opts.Wrapper = w
+		scenarios = append(scenarios, &opts)
+	}
+	for _, opts := range scenarios {
+		opts.Operations = ops
+		opts.Validate = *validate
+		opts.Invariants.Interval = *invariantInterval
+		opts.Differential.Interval = *differentialInterval
+		opts.Snapshots = bench.SnapshotOpts{Dir: *snapshotDir, OnAnomaly: *snapshotOnAnomaly}
+		opts.OpConcurrency = *opConcurrency
+		opts.OpTimeout = *opTimeout
+		opts.CommitFailureFraction = *commitFailureFraction
+		opts.Retry = *retry
+	}
+
+	// Each scenario can be paired with one enforcing foreign keys, to
+	// measure the cost of enforcement.
+	if *foreignKeys {
+		for _, opts := range scenarios {
+			fk, ok := opts.Provider.(bench.ForeignKeyEnforcer)
+			if !ok {
+				continue
+			}
+			enforced := *opts
+			enforced.Provider = fk.WithForeignKeys()
+			enforced.Name = opts.Name + "-fk"
+			if opts.Name == "" {
+				enforced.Name = opts.Wrapper.Name() + "-fk"
+			}
+			scenarios = append(scenarios, &enforced)
+		}
+	}
+
+	// As an agent, the scenarios run the share of the distributed run the
+	// coordinator assigns, starting when every other agent does.
+	if *coordinator != "" {
+		a, err := bench.JoinCoordinator(*coordinator, *agent)
+		if err != nil {
+			exit(err)
+		}
+		for _, opts := range scenarios {
+			if err := a.Apply(opts); err != nil {
+				exit(err)
+			}
+		}
+		bench.Logger().Info("joined distributed run", "agent", a.Agent, "agents", a.Agents,
+			"first_db", a.FirstDB, "last_db", a.FirstDB+a.DBs-1, "start", a.Start.Format(time.RFC3339))
+		time.Sleep(time.Until(a.Start))
+	}
+
+	var ciOpts *bench.CIOpts
+	if *ci {
+		o := bench.DefaultCIOpts
+		o.Output = *ciOutput
+		ciOpts = &o
+	}
+
+	err = bench.Run(bench.RunOpts{
+		Addr:            *addr,
+		Soak:            soak,
+		TimeSeries:      timeSeries,
+		CI:              ciOpts,
+		Results:         *results,
+		CPUProfile:      *cpuProfile,
+		Collector:       *collector,
+		Agent:           *agent,
+		ResultsUpload:   *resultsUpload,
+		ShutdownTimeout: *shutdownTimeout,
+		GC:              gc,
+		OpCSV:           *opCSV,
+		Duration:        *duration,
+	}, scenarios...)
+	if errors.Is(err, bench.ErrCIFailed) {
+		os.Exit(1)
+	} else if err != nil {
+		exit(err)
+	}
+}